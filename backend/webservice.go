@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"io/ioutil"
 	"encoding/json"
+	"errors"
 
 	"github.com/gorilla/mux"
 	"github.com/frikky/schemaless"
@@ -42,7 +43,7 @@ func TranslateWrapper(resp http.ResponseWriter, request *http.Request) {
 	log.Printf("[DEBUG] Translating to format '%s'\n\n", format)
 
 	ctx := shuffle.GetContext(request)
-	parsedOutput, err := schemaless.Translate(ctx, format, body)
+	parsedOutput, _, err := schemaless.Translate(ctx, format, body)
 	if err != nil {
 		log.Printf("[ERROR] Failed getting output: %s", err)
 		resp.WriteHeader(400)
@@ -123,13 +124,598 @@ func GetStandards(resp http.ResponseWriter, request *http.Request) {
 	resp.Write([]byte(jsonOutput))
 }
 
-func init() {
+func writeJson(resp http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling response"}`))
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
+
+func writeError(resp http.ResponseWriter, status int, reason string) {
+	writeJson(resp, status, map[string]interface{}{
+		"success": false,
+		"reason":  reason,
+	})
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, schemaless.ErrNotFound) {
+		return 404
+	}
+
+	if errors.Is(err, schemaless.ErrInvalidStandard) {
+		return 400
+	}
+
+	if errors.Is(err, schemaless.ErrNoMapping) {
+		return 404
+	}
+
+	if errors.Is(err, schemaless.ErrNotStored) {
+		return 501
+	}
+
+	return 500
+}
+
+// Who made a change, for the version history
+func getUser(request *http.Request) string {
+	user := request.Header.Get("X-Schemaless-User")
+	if len(user) == 0 {
+		user = "api"
+	}
+
+	return user
+}
+
+// Standards are returned as JSON when they are, and as a string otherwise
+func standardValue(data []byte) interface{} {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+
+	return string(data)
+}
+
+func GetRegistryStandard(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	name := mux.Vars(request)["name"]
+	data, _, err := schemaless.GetRawStandard(ctx, name, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed getting standard %s: %s", name, err))
+		return
+	}
+
+	versions, err := schemaless.ListStandardVersions(ctx, name, schemaless.ShuffleConfig{})
+	if err != nil {
+		log.Printf("[WARNING] Failed getting versions of standard %s: %s", name, err)
+	}
+
+	response := map[string]interface{}{
+		"success":  true,
+		"name":     name,
+		"standard": standardValue(data),
+	}
+
+	if len(versions) > 0 {
+		response["version"] = versions[len(versions)-1]
+	}
+
+	writeJson(resp, 200, response)
+}
+
+func SaveRegistryStandard(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeError(resp, 400, fmt.Sprintf("Failed reading body: %s", err))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	name := mux.Vars(request)["name"]
+
+	// Validated first, to return each problem on its own
+	problems := schemaless.ValidateStandard(ctx, name, body, schemaless.ShuffleConfig{})
+	if len(problems) > 0 {
+		writeJson(resp, 400, map[string]interface{}{
+			"success": false,
+			"reason":  fmt.Sprintf("Standard %s is not valid", name),
+			"errors":  problems,
+		})
+		return
+	}
+
+	invalidate := request.URL.Query().Get("invalidate") == "true"
+	version, err := schemaless.SaveStandard(ctx, name, body, getUser(request), invalidate, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed saving standard %s: %s", name, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"name":    name,
+		"version": version,
+	})
+}
+
+func DeleteRegistryStandard(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	name := mux.Vars(request)["name"]
+	invalidate := request.URL.Query().Get("invalidate") == "true"
+	err := schemaless.DeleteStandard(ctx, name, getUser(request), invalidate, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed deleting standard %s: %s", name, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func ValidateRegistryStandard(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeError(resp, 400, fmt.Sprintf("Failed reading body: %s", err))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	problems := schemaless.ValidateStandard(ctx, mux.Vars(request)["name"], body, schemaless.ShuffleConfig{})
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"valid":   len(problems) == 0,
+		"errors":  problems,
+	})
+}
+
+func GetRegistryStandardVersions(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	name := mux.Vars(request)["name"]
+	versions, err := schemaless.ListStandardVersions(ctx, name, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed getting versions of standard %s: %s", name, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success":  true,
+		"versions": versions,
+	})
+}
+
+func GetRegistryStandardVersion(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	vars := mux.Vars(request)
+	data, err := schemaless.GetStandardVersion(ctx, vars["name"], vars["version"], schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed getting version %s of standard %s: %s", vars["version"], vars["name"], err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success":  true,
+		"version":  vars["version"],
+		"standard": standardValue(data),
+	})
+}
+
+func GetRegistryStandardFields(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	name := mux.Vars(request)["name"]
+	fields, err := schemaless.GetStandardFields(ctx, name, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed getting fields of standard %s: %s", name, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"fields":  fields,
+	})
+}
+
+func GetRegistryStandardDependents(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	name := mux.Vars(request)["name"]
+	dependents, err := schemaless.GetStandardDependents(ctx, name, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed finding what depends on standard %s: %s", name, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success":   true,
+		"standards": dependents.Standards,
+		"mappings":  dependents.Mappings,
+	})
+}
+
+func ListRegistryStandards(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	standards, err := schemaless.ListStandards(ctx, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, 500, fmt.Sprintf("Failed listing standards: %s", err))
+		return
+	}
+
+	packs, err := schemaless.ListStandardPacks()
+	if err != nil {
+		log.Printf("[WARNING] Failed listing standard packs: %s", err)
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success":   true,
+		"standards": standards,
+		"packs":     packs,
+	})
+}
+
+func ListMappings(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	standard := request.URL.Query().Get("standard")
+	mappings, err := schemaless.ListMappings(ctx, standard, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed listing mappings: %s", err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success":  true,
+		"mappings": mappings,
+	})
+}
+
+func GetMapping(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	key := mux.Vars(request)["key"]
+	details, err := schemaless.GetMapping(ctx, key, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed getting mapping %s: %s", key, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"mapping": details,
+	})
+}
+
+// The body is the new value of the field. ?lock=true also locks it against regeneration.
+// Fields with dots or slashes in their keys are given as a JSON Pointer in ?path= instead, e.g. ?path=/user/first.name
+func EditMappingField(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeError(resp, 400, fmt.Sprintf("Failed reading body: %s", err))
+		return
+	}
+
+	var value interface{}
+	err = json.Unmarshal(body, &value)
+	if err != nil {
+		writeError(resp, 400, fmt.Sprintf("The body must be the JSON value of the field: %s", err))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	vars := mux.Vars(request)
+	lock := request.URL.Query().Get("lock") == "true"
+	field := vars["field"]
+	if len(field) == 0 {
+		field = request.URL.Query().Get("path")
+	}
+
+	err = schemaless.EditMappingField(ctx, vars["key"], field, value, getUser(request), lock, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed editing field %s of mapping %s: %s", field, vars["key"], err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func DeleteMapping(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	key := mux.Vars(request)["key"]
+	err := schemaless.DeleteMapping(ctx, key, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed deleting mapping %s: %s", key, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// ?model= picks another model than the default
+func RegenerateMapping(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	key := mux.Vars(request)["key"]
+	version, err := schemaless.RegenerateMapping(ctx, key, request.URL.Query().Get("model"), schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed regenerating mapping %s: %s", key, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"version": version,
+	})
+}
+
+func GetMappingVersions(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	key := mux.Vars(request)["key"]
+	versions, err := schemaless.ListMappingVersions(ctx, key, schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed getting versions of mapping %s: %s", key, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success":  true,
+		"versions": versions,
+	})
+}
+
+func RollbackMapping(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	vars := mux.Vars(request)
+	version, err := schemaless.RollbackMapping(ctx, vars["key"], vars["version"], getUser(request), schemaless.ShuffleConfig{})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed rolling mapping %s back to %s: %s", vars["key"], vars["version"], err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"version": version,
+	})
+}
+
+type PreviewRequest struct {
+	// The input to translate. A JSON string is translated as-is, e.g. for YAML.
+	Input json.RawMessage `json:"input"`
+
+	// Candidate mapping to use instead of the stored one
+	Mapping map[string]interface{} `json:"mapping,omitempty"`
+
+	AllowLLM bool `json:"allow_llm,omitempty"`
+}
+
+// Translates without saving or caching anything, and only asks the LLM for missing mappings with allow_llm
+func PreviewTranslation(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeError(resp, 400, fmt.Sprintf("Failed reading body: %s", err))
+		return
+	}
+
+	previewRequest := PreviewRequest{}
+	err = json.Unmarshal(body, &previewRequest)
+	if err != nil || len(previewRequest.Input) == 0 {
+		writeError(resp, 400, "The body must be a JSON object with the input, and optionally a mapping and allow_llm")
+		return
+	}
+
+	input := []byte(previewRequest.Input)
+	var inputString string
+	if json.Unmarshal(input, &inputString) == nil {
+		input = []byte(inputString)
+	}
+
+	ctx := shuffle.GetContext(request)
+	format := mux.Vars(request)["format"]
+	result, err := schemaless.PreviewTranslate(ctx, format, input, schemaless.PreviewOptions{
+		Mapping:  previewRequest.Mapping,
+		AllowLLM: previewRequest.AllowLLM,
+	})
+	if err != nil {
+		writeError(resp, errorStatus(err), fmt.Sprintf("Failed previewing translation to %s: %s", format, err))
+		return
+	}
+
+	writeJson(resp, 200, map[string]interface{}{
+		"success": true,
+		"preview": result,
+	})
+}
+
+// Translates NDJSON, one event per line, and streams back a result per line in the same order
+func TranslateBatch(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	format := mux.Vars(request)["format"]
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	resp.WriteHeader(200)
+
+	stats, err := schemaless.TranslateBatch(ctx, format, request.Body, resp)
+	if err != nil {
+		// The status is already sent, so the error goes on the last line
+		log.Printf("[ERROR] Batch translation to %s stopped after %d events: %s", format, stats.Events, err)
+		json.NewEncoder(resp).Encode(map[string]interface{}{
+			"success": false,
+			"reason":  fmt.Sprintf("Batch translation stopped after %d events: %s", stats.Events, err),
+		})
+		return
+	}
+
+	log.Printf("[INFO] Batch translated %d events to %s. %d failed.", stats.Events, format, stats.Failed)
+}
+
+// Translates the list in a large JSON document, e.g. {"Records": [...]}, and streams back the translated items as a JSON list.
+// The list can be chosen with ?list_path=, e.g. $data.items.#. Errors after the list has started can't change the status,
+// so they are sent in the X-Translation-Error trailer.
+func TranslateStream(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	format := mux.Vars(request)["format"]
+
+	inputConfig := []string{""}
+	if listPath := request.URL.Query().Get("list_path"); len(listPath) > 0 {
+		inputConfig = append(inputConfig, fmt.Sprintf("list_path:%s", listPath))
+	}
+
+	// The status is sent with the first item, so a missing list can still get its own
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Trailer", "X-Translation-Error")
+
+	stats, err := schemaless.TranslateStream(ctx, format, request.Body, resp, inputConfig...)
+	if errors.Is(err, schemaless.ErrListNotFound) {
+		writeError(resp, 400, fmt.Sprintf("Failed streaming translation to %s: %s", format, err))
+		return
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Streaming translation to %s stopped after %d items: %s", format, stats.Events, err)
+		resp.Header().Set("X-Translation-Error", fmt.Sprintf("Streaming translation stopped after %d items: %s", stats.Events, err))
+		return
+	}
+
+	log.Printf("[INFO] Stream translated %d items to %s. %d failed.", stats.Events, format, stats.Failed)
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/v1/translate/to/{format}", TranslateWrapper).Methods("OPTIONS", "POST")
+	r.HandleFunc("/api/v1/translate/preview/{format:.+}", PreviewTranslation).Methods("OPTIONS", "POST")
+	r.HandleFunc("/api/v1/translate/batch/{format:.+}", TranslateBatch).Methods("OPTIONS", "POST")
+	r.HandleFunc("/api/v1/translate/stream/{format:.+}", TranslateStream).Methods("OPTIONS", "POST")
 	r.HandleFunc("/api/v1/standards", GetStandards).Methods("OPTIONS", "GET")
 
-	http.Handle("/", r)
+	// Standards registry. Names can contain slashes for pack standards, e.g. ecs/8.11/event, so the longer routes go first and
+	// ecs/8.11/event/fields is the fields of ecs/8.11/event. Saved standards can't have slashes, so e.g. PUT ticket/fields is
+	// rejected as a change to a pack standard.
+	r.HandleFunc("/api/v1/registry/standards", ListRegistryStandards).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}/validate", ValidateRegistryStandard).Methods("OPTIONS", "POST")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}/versions/{version}", GetRegistryStandardVersion).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}/versions", GetRegistryStandardVersions).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}/fields", GetRegistryStandardFields).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}/dependents", GetRegistryStandardDependents).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}", GetRegistryStandard).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}", SaveRegistryStandard).Methods("PUT")
+	r.HandleFunc("/api/v1/registry/standards/{name:.+}", DeleteRegistryStandard).Methods("DELETE")
+
+	// Generated mappings, named <standard>-<md5 of the input structure>
+	r.HandleFunc("/api/v1/mappings", ListMappings).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/mappings/{key}/fields/{field}", EditMappingField).Methods("OPTIONS", "PUT")
+	r.HandleFunc("/api/v1/mappings/{key}/fields", EditMappingField).Methods("OPTIONS", "PUT")
+	r.HandleFunc("/api/v1/mappings/{key}/regenerate", RegenerateMapping).Methods("OPTIONS", "POST")
+	r.HandleFunc("/api/v1/mappings/{key}/versions", GetMappingVersions).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/mappings/{key}/versions/{version}/rollback", RollbackMapping).Methods("OPTIONS", "POST")
+	r.HandleFunc("/api/v1/mappings/{key}", GetMapping).Methods("OPTIONS", "GET")
+	r.HandleFunc("/api/v1/mappings/{key}", DeleteMapping).Methods("DELETE")
+
+	return r
+}
+
+func init() {
+	http.Handle("/", newRouter())
 }
 
 func main() {
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/frikky/schemaless"
+)
+
+func TestMain(m *testing.M) {
+	// Standards come from the store and the bundled packs only
+	schemaless.SetOffline(true)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Sends a request through the router and parses the JSON response, if it is one
+func serveTest(t *testing.T, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+	parsed := map[string]interface{}{}
+	if strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/json") {
+		err := json.Unmarshal(recorder.Body.Bytes(), &parsed)
+		if err != nil {
+			t.Fatalf("%s %s: invalid response %s: %s", method, path, recorder.Body.String(), err)
+		}
+	}
+
+	return recorder.Code, parsed
+}
+
+// Sends a request and fails unless it gets the status
+func expectStatus(t *testing.T, method, path, body string, status int) map[string]interface{} {
+	t.Helper()
+
+	code, parsed := serveTest(t, method, path, body)
+	if code != status {
+		t.Fatalf("%s %s: got status %d, expected %d (%v)", method, path, code, status, parsed)
+	}
+
+	return parsed
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: standard 'ticket'", schemaless.ErrNotFound), 404},
+		{fmt.Errorf("%w: bad name", schemaless.ErrInvalidStandard), 400},
+		{fmt.Errorf("%w: ticket-abc", schemaless.ErrNoMapping), 404},
+		{fmt.Errorf("%w: sample inputs", schemaless.ErrNotStored), 501},
+		{errors.New("Store unavailable"), 500},
+	}
+
+	for _, test := range tests {
+		if status := errorStatus(test.err); status != test.status {
+			t.Errorf("%s: got %d, expected %d", test.err, status, test.status)
+		}
+	}
+}
+
+func TestRegistryRoutes(t *testing.T) {
+	schemaless.SetStore(schemaless.NewMemoryStore())
+
+	standard := `{"title": "The title", "severity": "The severity"}`
+	saved := expectStatus(t, "PUT", "/api/v1/registry/standards/ticket", standard, 200)
+	version, _ := saved["version"].(map[string]interface{})
+	versionID, _ := version["id"].(string)
+	if saved["name"] != "ticket" || len(versionID) == 0 {
+		t.Fatalf("expected ticket to be saved with a version, got %v", saved)
+	}
+
+	got := expectStatus(t, "GET", "/api/v1/registry/standards/ticket", "", 200)
+	if fmt.Sprint(got["standard"]) != fmt.Sprint(map[string]interface{}{"title": "The title", "severity": "The severity"}) {
+		t.Errorf("got standard %v", got["standard"])
+	}
+
+	listed := expectStatus(t, "GET", "/api/v1/registry/standards", "", 200)
+	if fmt.Sprint(listed["standards"]) != "[ticket]" {
+		t.Errorf("expected only ticket to be listed, got %v", listed["standards"])
+	}
+
+	fields := expectStatus(t, "GET", "/api/v1/registry/standards/ticket/fields", "", 200)
+	if found, _ := fields["fields"].([]interface{}); len(found) != 2 {
+		t.Errorf("expected the two fields of ticket, got %v", fields)
+	}
+
+	versions := expectStatus(t, "GET", "/api/v1/registry/standards/ticket/versions", "", 200)
+	if found, _ := versions["versions"].([]interface{}); len(found) != 1 {
+		t.Errorf("expected one version, got %v", versions)
+	}
+
+	expectStatus(t, "GET", "/api/v1/registry/standards/ticket/versions/"+versionID, "", 200)
+	expectStatus(t, "GET", "/api/v1/registry/standards/ticket/versions/missing", "", 404)
+	expectStatus(t, "GET", "/api/v1/registry/standards/ticket/dependents", "", 200)
+
+	validated := expectStatus(t, "POST", "/api/v1/registry/standards/ticket/validate", `{"title": `, 200)
+	if validated["valid"] != false {
+		t.Errorf("expected the broken standard not to be valid, got %v", validated)
+	}
+
+	invalid := expectStatus(t, "PUT", "/api/v1/registry/standards/ticket", `{"title": `, 400)
+	if problems, _ := invalid["errors"].([]interface{}); len(problems) == 0 {
+		t.Errorf("expected the problems with the standard, got %v", invalid)
+	}
+
+	// Pack standards can be read, but not changed
+	packFields := expectStatus(t, "GET", "/api/v1/registry/standards/ecs/8.11/event/fields", "", 200)
+	if found, _ := packFields["fields"].([]interface{}); len(found) == 0 {
+		t.Errorf("expected the fields of ecs/8.11/event, got %v", packFields)
+	}
+
+	expectStatus(t, "DELETE", "/api/v1/registry/standards/ecs/8.11/event", "", 400)
+	expectStatus(t, "GET", "/api/v1/registry/standards/missing", "", 404)
+	expectStatus(t, "GET", "/api/v1/registry/standards/missing/fields", "", 404)
+
+	expectStatus(t, "DELETE", "/api/v1/registry/standards/ticket", "", 200)
+	expectStatus(t, "GET", "/api/v1/registry/standards/ticket", "", 404)
+}
+
+// Pack standard names have slashes, so the routes under a standard are matched before the standard itself
+func TestRegistryRoutesWithSlashNames(t *testing.T) {
+	schemaless.SetStore(schemaless.NewMemoryStore())
+
+	standard := expectStatus(t, "GET", "/api/v1/registry/standards/ecs/8.11/event", "", 200)
+	if standard["name"] != "ecs/8.11/event" {
+		t.Errorf("expected ecs/8.11/event, got %v", standard["name"])
+	}
+
+	fields := expectStatus(t, "GET", "/api/v1/registry/standards/ecs/8.11/event/fields", "", 200)
+	if _, ok := fields["fields"]; !ok {
+		t.Errorf("expected the fields of ecs/8.11/event, got %v", fields)
+	}
+
+	expectStatus(t, "GET", "/api/v1/registry/standards/ecs/8.11/event/versions", "", 200)
+	expectStatus(t, "GET", "/api/v1/registry/standards/ecs/8.11/event/dependents", "", 200)
+	expectStatus(t, "POST", "/api/v1/registry/standards/ecs/8.11/event/validate", `{"title": "The title"}`, 200)
+
+	// Saved standards can't have slashes, so changes to names ending like a route are rejected as changes to a pack standard
+	expectStatus(t, "PUT", "/api/v1/registry/standards/ticket", `{"title": "The title"}`, 200)
+	for _, path := range []string{"ticket/fields", "ticket/versions", "ticket/dependents", "ticket/validate", "ticket/versions/1"} {
+		expectStatus(t, "PUT", "/api/v1/registry/standards/"+path, `{"title": "The title"}`, 400)
+		expectStatus(t, "DELETE", "/api/v1/registry/standards/"+path, "", 400)
+	}
+
+	listed := expectStatus(t, "GET", "/api/v1/registry/standards", "", 200)
+	if fmt.Sprint(listed["standards"]) != "[ticket]" {
+		t.Errorf("expected only ticket to be saved, got %v", listed["standards"])
+	}
+
+	ticketFields := expectStatus(t, "GET", "/api/v1/registry/standards/ticket/fields", "", 200)
+	if found, _ := ticketFields["fields"].([]interface{}); len(found) != 1 {
+		t.Errorf("expected the fields of ticket, got %v", ticketFields)
+	}
+
+	// Single names are standards, even when they are named like a route
+	expectStatus(t, "PUT", "/api/v1/registry/standards/fields", `{"title": "The title"}`, 200)
+	expectStatus(t, "GET", "/api/v1/registry/standards/fields", "", 200)
+	expectStatus(t, "GET", "/api/v1/registry/standards/fields/fields", "", 200)
+
+	expectStatus(t, "POST", "/api/v1/registry/standards/ticket", "", 405)
+}
+
+// Saves a standard and a mapping for an input of it, and returns the key of the mapping
+func saveTestMapping(t *testing.T, standard, input, mapping string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	_, err := schemaless.SaveStandard(ctx, standard, []byte(`{"title": "The title", "severity": "The severity"}`), "test", false, schemaless.ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := schemaless.MappingFile(standard, []byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = schemaless.SaveTranslationContext(ctx, key, mapping, schemaless.ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestMappingRoutes(t *testing.T) {
+	schemaless.SetStore(schemaless.NewMemoryStore())
+	key := saveTestMapping(t, "ticket", `{"subject": "Disk full", "level": "high"}`, `{"title": "$subject"}`)
+
+	listed := expectStatus(t, "GET", "/api/v1/mappings?standard=ticket", "", 200)
+	if found, _ := listed["mappings"].([]interface{}); len(found) != 1 {
+		t.Errorf("expected the mapping of ticket, got %v", listed)
+	}
+
+	listed = expectStatus(t, "GET", "/api/v1/mappings?standard=alert", "", 200)
+	if found, _ := listed["mappings"].([]interface{}); len(found) != 0 {
+		t.Errorf("expected no mappings of alert, got %v", listed)
+	}
+
+	got := expectStatus(t, "GET", "/api/v1/mappings/"+key, "", 200)
+	details, _ := got["mapping"].(map[string]interface{})
+	if fmt.Sprint(details["mapping"]) != "map[title:$subject]" {
+		t.Errorf("expected the stored mapping, got %v", got)
+	}
+
+	expectStatus(t, "PUT", "/api/v1/mappings/"+key+"/fields/severity", `"$level"`, 200)
+	expectStatus(t, "PUT", "/api/v1/mappings/"+key+"/fields?path=/title&lock=true", `"Subject: $subject"`, 200)
+	expectStatus(t, "PUT", "/api/v1/mappings/"+key+"/fields/title", `not json`, 400)
+
+	got = expectStatus(t, "GET", "/api/v1/mappings/"+key, "", 200)
+	details, _ = got["mapping"].(map[string]interface{})
+	if fmt.Sprint(details["mapping"]) != "map[severity:$level title:Subject: $subject]" {
+		t.Errorf("expected the edited mapping, got %v", details["mapping"])
+	}
+
+	versions := expectStatus(t, "GET", "/api/v1/mappings/"+key+"/versions", "", 200)
+	found, _ := versions["versions"].([]interface{})
+	if len(found) != 3 {
+		t.Fatalf("expected the saved and two edited versions, got %v", versions)
+	}
+
+	first, _ := found[0].(map[string]interface{})
+	rolledBack := expectStatus(t, "POST", fmt.Sprintf("/api/v1/mappings/%s/versions/%s/rollback", key, first["id"]), "", 200)
+	if version, _ := rolledBack["version"].(map[string]interface{}); version["id"] != "v4" {
+		t.Errorf("expected the rollback to be v4, got %v", rolledBack)
+	}
+
+	got = expectStatus(t, "GET", "/api/v1/mappings/"+key, "", 200)
+	details, _ = got["mapping"].(map[string]interface{})
+	if fmt.Sprint(details["mapping"]) != "map[title:$subject]" {
+		t.Errorf("expected the rolled back mapping, got %v", details["mapping"])
+	}
+
+	expectStatus(t, "POST", "/api/v1/mappings/"+key+"/versions/v9/rollback", "", 404)
+	expectStatus(t, "DELETE", "/api/v1/mappings/"+key, "", 200)
+
+	// Gone
+	expectStatus(t, "GET", "/api/v1/mappings/"+key, "", 404)
+	expectStatus(t, "DELETE", "/api/v1/mappings/"+key, "", 404)
+	expectStatus(t, "PUT", "/api/v1/mappings/"+key+"/fields/title", `"$subject"`, 404)
+	expectStatus(t, "POST", "/api/v1/mappings/"+key+"/regenerate", "", 404)
+	expectStatus(t, "GET", "/api/v1/mappings/"+key+"/versions", "", 200)
+
+	// Mapping keys have no slashes
+	expectStatus(t, "GET", "/api/v1/mappings/"+key+"/other", "", 404)
+}
+
+func TestPreviewRoute(t *testing.T) {
+	schemaless.SetStore(schemaless.NewMemoryStore())
+	input := `{"subject": "Disk full", "level": "high"}`
+	key := saveTestMapping(t, "ticket", input, `{"title": "$subject"}`)
+
+	stored := expectStatus(t, "POST", "/api/v1/translate/preview/ticket", fmt.Sprintf(`{"input": %s}`, input), 200)
+	preview, _ := stored["preview"].(map[string]interface{})
+	if preview["mapping_source"] != "stored" || !strings.HasSuffix(fmt.Sprint(preview["mapping_file"]), key) {
+		t.Errorf("expected the stored mapping to be used, got %v", stored)
+	}
+
+	candidate := expectStatus(t, "POST", "/api/v1/translate/preview/ticket", fmt.Sprintf(`{"input": %s, "mapping": {"title": "$level"}}`, input), 200)
+	preview, _ = candidate["preview"].(map[string]interface{})
+	if preview["mapping_source"] != "candidate" {
+		t.Errorf("expected the candidate mapping to be used, got %v", candidate)
+	}
+
+	// Inputs as a JSON string are translated as-is
+	expectStatus(t, "POST", "/api/v1/translate/preview/ticket", fmt.Sprintf(`{"input": %q}`, input), 200)
+
+	expectStatus(t, "POST", "/api/v1/translate/preview/ticket", `not json`, 400)
+	expectStatus(t, "POST", "/api/v1/translate/preview/ticket", `{"mapping": {"title": "$level"}}`, 400)
+
+	// No mapping for the structure, and the LLM isn't allowed
+	expectStatus(t, "POST", "/api/v1/translate/preview/ticket", `{"input": {"host": "web"}}`, 404)
+
+	// Like translations, inputs for a missing standard are given back as-is, with a warning
+	missing := expectStatus(t, "POST", "/api/v1/translate/preview/missing", fmt.Sprintf(`{"input": %s}`, input), 200)
+	preview, _ = missing["preview"].(map[string]interface{})
+	if warnings, _ := preview["warnings"].([]interface{}); len(warnings) == 0 {
+		t.Errorf("expected a warning about the missing standard, got %v", missing)
+	}
+
+	// The preview saved nothing
+	listed := expectStatus(t, "GET", "/api/v1/mappings?standard=ticket", "", 200)
+	if found, _ := listed["mappings"].([]interface{}); len(found) != 1 {
+		t.Errorf("expected only the saved mapping of ticket, got %v", listed)
+	}
+
+	expectStatus(t, "GET", "/api/v1/translate/preview/ticket", "", 405)
+}
@@ -0,0 +1,294 @@
+package schemaless
+
+/*
+Translates streams of newline delimited JSON (NDJSON), one event per line. Events are translated by a pool of workers, and the
+results are written back as NDJSON in the order of the input, with an error on the line of each event that failed.
+Only a window of events is held in memory at a time, so the size of the stream doesn't matter.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// How many events of a batch are translated at the same time, and the longest line accepted
+var batchWorkers = 10
+var maxBatchLineSize = 1024 * 1024
+
+func init() {
+	if tok := os.Getenv("BATCH_WORKERS"); tok != "" {
+		if t, err := strconv.Atoi(tok); err == nil && t > 0 {
+			batchWorkers = t
+		}
+	}
+
+	if tok := os.Getenv("MAX_BATCH_LINE_SIZE"); tok != "" {
+		if t, err := strconv.Atoi(tok); err == nil && t > 0 {
+			maxBatchLineSize = t
+		}
+	}
+}
+
+// The result of a single event. Line is the line number in the input, starting at 1.
+type BatchResult struct {
+	Line        int             `json:"line"`
+	Output      json.RawMessage `json:"output,omitempty"`
+	MappingFile string          `json:"mapping_file,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+type BatchStats struct {
+	Events     int `json:"events"`
+	Translated int `json:"translated"`
+	Failed     int `json:"failed"`
+}
+
+type batchJob struct {
+	line   int
+	data   []byte
+	err    error
+	result chan BatchResult
+}
+
+// Translates each line of input to the standard and writes a BatchResult per line to output as soon as it and the lines before it are done.
+// Events with the same structure share a mapping, so only the first event of each structure may ask the LLM. Empty lines are skipped.
+// Returns early if reading, writing or ctx fails, after writing the results of the events before it.
+func TranslateBatch(ctx context.Context, inputStandard string, input io.Reader, output io.Writer, inputConfig ...string) (BatchStats, error) {
+	reader := bufio.NewReader(input)
+	line := 0
+	next := func() (*batchJob, error) {
+		line += 1
+		data, err := readBatchLine(reader, maxBatchLineSize)
+		if err != nil && !errors.Is(err, errLineTooLong) {
+			return nil, err
+		}
+
+		if err == nil && len(bytes.TrimSpace(data)) == 0 {
+			return nil, nil
+		}
+
+		return &batchJob{
+			line: line,
+			data: data,
+			err:  err,
+		}, nil
+	}
+
+	writer := bufio.NewWriter(output)
+	encoder := json.NewEncoder(writer)
+	write := func(result BatchResult, flush bool) error {
+		err := encoder.Encode(result)
+		if err == nil && flush {
+			err = flushBatchOutput(writer, output)
+		}
+
+		return err
+	}
+
+	translate := func(ctx context.Context, data []byte) ([]byte, string, error) {
+		return Translate(ctx, inputStandard, data, inputConfig...)
+	}
+
+	// The results before a failure are sent as well
+	stats, err := runBatchJobs(ctx, translate, next, write)
+	flushErr := flushBatchOutput(writer, output)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, flushErr
+}
+
+// Translates a single event, returning the output and the mapping file used
+type batchTranslateFunc func(ctx context.Context, data []byte) ([]byte, string, error)
+
+// Gets events with next until it returns io.EOF, translates them with batchWorkers workers, and passes the results to write in
+// the order they were read. flush is set when no other result is done yet. next returns a nil job for events to skip.
+func runBatchJobs(ctx context.Context, translate batchTranslateFunc, next func() (*batchJob, error), write func(result BatchResult, flush bool) error) (BatchStats, error) {
+	stats := BatchStats{}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan *batchJob)
+
+	// Results are written in the order the events were read. This also limits how many events are in memory.
+	ordered := make(chan *batchJob, batchWorkers*2)
+
+	for worker := 0; worker < batchWorkers; worker++ {
+		go func() {
+			for job := range jobs {
+				job.result <- translateBatchEvent(ctx, translate, job)
+			}
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+
+		for {
+			job, err := next()
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			if job == nil {
+				continue
+			}
+
+			job.result = make(chan BatchResult, 1)
+			select {
+			case ordered <- job:
+			case <-ctx.Done():
+				readErr <- ctx.Err()
+				return
+			}
+
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				readErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for job := range ordered {
+		var result BatchResult
+		select {
+		case result = <-job.result:
+		case <-ctx.Done():
+			return stats, contextError(ctx, ctx.Err())
+		}
+
+		stats.Events += 1
+		if len(result.Error) > 0 {
+			stats.Failed += 1
+		} else {
+			stats.Translated += 1
+		}
+
+		// Nothing else is done yet, so the results so far are sent on instead of waiting for a full buffer
+		err := write(result, len(ordered) == 0)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Failed writing result of event %d in batch translation: %s", result.Line, err)
+			return stats, err
+		}
+	}
+
+	err := <-readErr
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Failed reading batch input after %d events: %s", stats.Events, err)
+		return stats, contextError(ctx, err)
+	}
+
+	return stats, nil
+}
+
+func translateBatchEvent(ctx context.Context, translate batchTranslateFunc, job *batchJob) BatchResult {
+	result := BatchResult{
+		Line: job.line,
+	}
+
+	if job.err != nil {
+		result.Error = job.err.Error()
+		return result
+	}
+
+	if !json.Valid(job.data) {
+		result.Error = "Invalid JSON"
+		return result
+	}
+
+	output, mappingFile, err := translate(ctx, job.data)
+	result.MappingFile = mappingFile
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if !json.Valid(output) {
+		result.Error = "The translation is not valid JSON"
+		return result
+	}
+
+	// Kept on a single line, as the output is NDJSON
+	compacted := bytes.Buffer{}
+	err = json.Compact(&compacted, output)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Output = compacted.Bytes()
+	return result
+}
+
+var errLineTooLong = errors.New("Line too long")
+
+// Reads a line without the newline. Lines longer than maxSize are skipped and return errLineTooLong.
+func readBatchLine(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		part, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(part) > maxSize+1 {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, part...)
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err == io.EOF && (len(line) > 0 || tooLong) {
+			err = nil
+		}
+
+		if err != nil {
+			return []byte{}, err
+		}
+
+		break
+	}
+
+	if tooLong {
+		return []byte{}, fmt.Errorf("%w. Max is %d bytes (MAX_BATCH_LINE_SIZE)", errLineTooLong, maxSize)
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// Flushes the buffered results, and the output itself if it buffers, e.g. an http.ResponseWriter
+func flushBatchOutput(writer *bufio.Writer, output io.Writer) error {
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if flusher, ok := output.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
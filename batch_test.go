@@ -0,0 +1,236 @@
+package schemaless
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Uses a set amount of batch workers for the test
+func useBatchWorkers(t *testing.T, workers int) {
+	t.Helper()
+
+	previous := batchWorkers
+	batchWorkers = workers
+	t.Cleanup(func() {
+		batchWorkers = previous
+	})
+}
+
+func parseBatchResults(t *testing.T, output []byte) []BatchResult {
+	t.Helper()
+
+	results := []BatchResult{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		result := BatchResult{}
+		err := json.Unmarshal([]byte(line), &result)
+		if err != nil {
+			t.Fatalf("invalid result line %q: %s", line, err)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func TestTranslateBatchKeepsOrder(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+
+	useBatchWorkers(t, 4)
+
+	// Every event has its own structure, and the earlier ones take the longest
+	events := 8
+	// Keys ending with a number aren't part of the structure, so they end with a letter
+	fieldPattern := regexp.MustCompile(`field_([a-z])`)
+	useFakeLLM(t, func(system, user string) string {
+		match := fieldPattern.FindStringSubmatch(user)
+		if match == nil {
+			return `{}`
+		}
+
+		index := int(match[1][0] - 'a')
+		time.Sleep(time.Duration(events-index) * 5 * time.Millisecond)
+		return fmt.Sprintf(`{"title": "$field_%s"}`, match[1])
+	})
+
+	input := bytes.Buffer{}
+	for cnt := 0; cnt < events; cnt++ {
+		fmt.Fprintf(&input, `{"field_%c": "event %d"}`+"\n", 'a'+cnt, cnt)
+
+		// Skipped, but still counted as lines
+		if cnt == 2 {
+			input.WriteString("\n  \n")
+		}
+	}
+
+	output := bytes.Buffer{}
+	stats, err := TranslateBatch(context.Background(), "ticket", &input, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Events != events || stats.Translated != events || stats.Failed != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	results := parseBatchResults(t, output.Bytes())
+	if len(results) != events {
+		t.Fatalf("expected %d results, got %d", events, len(results))
+	}
+
+	for cnt, result := range results {
+		line := cnt + 1
+		if cnt > 2 {
+			line += 2
+		}
+
+		expected := fmt.Sprintf(`{"title":"event %d"}`, cnt)
+		if result.Line != line || string(result.Output) != expected || len(result.Error) > 0 {
+			t.Errorf("result %d: expected line %d with %s, got %+v", cnt, line, expected, result)
+		}
+	}
+}
+
+func TestTranslateBatchFailedLines(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+
+	useBatchWorkers(t, 3)
+	previous := maxBatchLineSize
+	maxBatchLineSize = 64
+	t.Cleanup(func() {
+		maxBatchLineSize = previous
+	})
+
+	// Events with the same structure share the mapping
+	requests := useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject"}`
+	})
+
+	lines := []string{
+		`{"subject": "first"}`,
+		`not json`,
+		fmt.Sprintf(`{"subject": "%s"}`, strings.Repeat("x", 100)),
+		`{"subject": "second"}`,
+		`{"subject": "third"}`,
+	}
+
+	output := bytes.Buffer{}
+	stats, err := TranslateBatch(context.Background(), "ticket", strings.NewReader(strings.Join(lines, "\r\n")), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Events != 5 || stats.Translated != 3 || stats.Failed != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if requests.Load() != 1 {
+		t.Errorf("expected a single LLM request for the shared structure, got %d", requests.Load())
+	}
+
+	results := parseBatchResults(t, output.Bytes())
+	expected := []string{`{"title":"first"}`, "Invalid JSON", "Line too long", `{"title":"second"}`, `{"title":"third"}`}
+	for cnt, result := range results {
+		if result.Line != cnt+1 || (string(result.Output) != expected[cnt] && !strings.HasPrefix(result.Error, expected[cnt])) {
+			t.Errorf("line %d: expected %s, got %+v", cnt+1, expected[cnt], result)
+		}
+	}
+}
+
+// Fails after writing a set amount of bytes
+type failingWriter struct {
+	written int
+	limit   int
+}
+
+func (writer *failingWriter) Write(data []byte) (int, error) {
+	if writer.written+len(data) > writer.limit {
+		return 0, errors.New("Disk full")
+	}
+
+	writer.written += len(data)
+	return len(data), nil
+}
+
+func TestTranslateBatchStopsOnErrors(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+
+	useBatchWorkers(t, 2)
+	useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject"}`
+	})
+
+	input := strings.Repeat(`{"subject": "event"}`+"\n", 50)
+	_, err := TranslateBatch(context.Background(), "ticket", strings.NewReader(input), &failingWriter{limit: 10})
+	if err == nil || !strings.Contains(err.Error(), "Disk full") {
+		t.Errorf("expected the write error, got %v", err)
+	}
+
+	// Results read before the reader failed are written first
+	output := bytes.Buffer{}
+	reader := io.MultiReader(strings.NewReader(`{"subject": "first"}`+"\n"), &failingReader{})
+	stats, err := TranslateBatch(context.Background(), "ticket", reader, &output)
+	if err == nil || !strings.Contains(err.Error(), "Connection reset") {
+		t.Errorf("expected the read error, got %v", err)
+	}
+
+	if stats.Translated != 1 || !strings.Contains(output.String(), `"first"`) {
+		t.Errorf("expected the result before the error, got %+v: %s", stats, output.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = TranslateBatch(ctx, "ticket", strings.NewReader(input), io.Discard)
+	if !errors.Is(err, ErrTranslationCanceled) {
+		t.Errorf("expected ErrTranslationCanceled, got %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (reader *failingReader) Read(data []byte) (int, error) {
+	return 0, errors.New("Connection reset")
+}
+
+func TestReadBatchLine(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader("first\r\n0123456789\n"+strings.Repeat("x", 40)+"\nlast"), 16)
+
+	expected := []string{"first", "0123456789", "", "last"}
+	for cnt, line := range expected {
+		data, err := readBatchLine(reader, 10)
+		if cnt == 2 {
+			if !errors.Is(err, errLineTooLong) {
+				t.Errorf("expected errLineTooLong, got %s (%v)", data, err)
+			}
+
+			continue
+		}
+
+		if err != nil || string(data) != line {
+			t.Errorf("line %d: got %q (%v), expected %q", cnt+1, data, err, line)
+		}
+	}
+
+	_, err := readBatchLine(reader, 10)
+	if err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package schemaless
+
+/*
+Generated events and a fixed mapping to measure translations with, used by the benchmarks and the bench command. The mapping
+is for the bundled common/alert standard, so no LLM is needed.
+*/
+
+import (
+	"fmt"
+)
+
+// The standard BenchMapping translates to
+const BenchStandard = "common/alert"
+
+// A mapping reading top level and nested fields of BenchEvent, with a template
+func BenchMapping() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          "event_id",
+		"title":       "message",
+		"severity":    "severity",
+		"source":      "user.name",
+		"description": "$message by $user.name",
+		"rule": map[string]interface{}{
+			"id":   "group_0_values.field_0_value",
+			"name": "group_0_values.field_1_value",
+		},
+	}
+}
+
+// Makes an event with the fields of BenchMapping, padded with groups of 10 fields up to the amount of fields
+func BenchEvent(fields int) map[string]interface{} {
+	event := map[string]interface{}{
+		"event_id": "4c1d8b2e",
+		"message":  "Suspicious login",
+		"severity": "high",
+		"user": map[string]interface{}{
+			"name": "alice",
+			"id":   1001,
+		},
+		"group_0_values": map[string]interface{}{
+			"field_0_value": "R-1",
+			"field_1_value": "Brute force",
+		},
+	}
+
+	// Keys ending with a number aren't part of the structure, so the padding doesn't end with one
+	for cnt := len(event); cnt < fields; cnt++ {
+		groupName := fmt.Sprintf("group_%d_values", cnt/10)
+		group, ok := event[groupName].(map[string]interface{})
+		if !ok {
+			group = map[string]interface{}{}
+			event[groupName] = group
+		}
+
+		group[fmt.Sprintf("field_%d_value", cnt%10)] = fmt.Sprintf("value %d", cnt)
+	}
+
+	return event
+}
@@ -0,0 +1,656 @@
+package schemaless
+
+/*
+Caching of LLM results, mappings and remote files. Memory is used by default, memcached with SHUFFLE_MEMCACHED and Redis (or anything speaking its protocol) with SCHEMALESS_REDIS.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gomemcache "github.com/bradfitz/gomemcache/memcache"
+	"github.com/patrickmn/go-cache"
+)
+
+// Returned by caches when a key isn't set or has expired
+var ErrCacheMiss = errors.New("Cache miss")
+
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Implemented by caches that can set a value only if the key isn't set, used as a lease between replicas.
+// Renew and Release only change the key while it still holds value, so a replica can't touch a lease another one took over.
+type LeaseCache interface {
+	Cache
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	Renew(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, key string, value []byte) (bool, error)
+}
+
+// The kinds of entries that are cached, each with their own TTL
+type CacheKind string
+
+const (
+	// Held by the replica running an LLM query, so the same query isn't sent multiple times
+	CacheKindLease CacheKind = "lease"
+
+	CacheKindLLMResult      CacheKind = "llm_result"
+	CacheKindStructure      CacheKind = "structure"
+	CacheKindGithub         CacheKind = "github"
+	CacheKindShuffleFile    CacheKind = "shuffle_file"
+	CacheKindShuffleUpload  CacheKind = "shuffle_upload"
+	CacheKindShuffleListing CacheKind = "shuffle_listing"
+
+	// Compiled mappings, kept in memory. Bounds how long changes made by other replicas take to show up.
+	CacheKindPlan CacheKind = "plan"
+)
+
+var cacheTTLMutex sync.RWMutex
+var cacheTTLs = map[CacheKind]time.Duration{
+	CacheKindLease:          3 * time.Minute,
+	CacheKindLLMResult:      30 * time.Minute,
+	CacheKindStructure:      24 * time.Hour,
+	CacheKindGithub:         30 * time.Minute,
+	CacheKindShuffleFile:    10 * time.Minute,
+	CacheKindShuffleUpload:  10 * time.Minute,
+	CacheKindShuffleListing: 3 * time.Minute,
+	CacheKindPlan:           1 * time.Minute,
+}
+
+func CacheTTL(kind CacheKind) time.Duration {
+	cacheTTLMutex.RLock()
+	defer cacheTTLMutex.RUnlock()
+
+	return cacheTTLs[kind]
+}
+
+// Overrides the TTL for a kind of entry. Can also be set with SCHEMALESS_CACHE_TTL_<KIND>, e.g. SCHEMALESS_CACHE_TTL_STRUCTURE=48h
+func SetCacheTTL(kind CacheKind, ttl time.Duration) {
+	cacheTTLMutex.Lock()
+	defer cacheTTLMutex.Unlock()
+
+	cacheTTLs[kind] = ttl
+}
+
+var cacheBackend Cache = NewMemoryCache()
+
+// Sets the cache used for everything. Defaults to memory.
+func SetCacheBackend(backend Cache) {
+	cacheBackend = backend
+}
+
+func GetCacheBackend() Cache {
+	return cacheBackend
+}
+
+// Keys can't contain spaces in memcached
+func cacheKey(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
+
+func DeleteCache(ctx context.Context, name string) error {
+	return cacheBackend.Delete(ctx, cacheKey(name))
+}
+
+func GetCache(ctx context.Context, name string) ([]byte, error) {
+	if len(name) == 0 {
+		log.Printf("[ERROR] No name provided for cache")
+		return []byte{}, ErrCacheMiss
+	}
+
+	return cacheBackend.Get(ctx, cacheKey(name))
+}
+
+// Sets a key in cache with an expiration in minutes
+//
+// Deprecated: Use SetCacheWithTTL, which takes a time.Duration
+func SetCache(ctx context.Context, name string, data []byte, expiration int32) error {
+	return SetCacheWithTTL(ctx, name, data, time.Duration(expiration)*time.Minute)
+}
+
+// Sets a key in cache. Use CacheTTL() to get the TTL for a kind of entry.
+func SetCacheWithTTL(ctx context.Context, name string, data []byte, ttl time.Duration) error {
+	if len(name) == 0 {
+		log.Printf("[WARNING] Key '%s' is empty with value length %d and TTL %s. Skipping cache.", name, len(data), ttl)
+		return nil
+	}
+
+	// Previews don't leave anything behind
+	if isPreview(ctx) {
+		return nil
+	}
+
+	return cacheBackend.Set(ctx, cacheKey(name), data, ttl)
+}
+
+// In-process cache. Not shared between replicas.
+type MemoryCache struct {
+	cache *cache.Cache
+
+	// Makes the lease operations atomic
+	leaseMu sync.Mutex
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		cache: cache.New(60*time.Minute, 10*time.Minute),
+	}
+}
+
+func (memoryCache *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, found := memoryCache.cache.Get(key)
+	if !found {
+		return []byte{}, fmt.Errorf("%w: %s", ErrCacheMiss, key)
+	}
+
+	return value.([]byte), nil
+}
+
+func (memoryCache *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	memoryCache.cache.Set(key, append([]byte{}, value...), ttl)
+	return nil
+}
+
+func (memoryCache *MemoryCache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	memoryCache.leaseMu.Lock()
+	defer memoryCache.leaseMu.Unlock()
+
+	err := memoryCache.cache.Add(key, append([]byte{}, value...), ttl)
+	return err == nil, nil
+}
+
+func (memoryCache *MemoryCache) Renew(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	memoryCache.leaseMu.Lock()
+	defer memoryCache.leaseMu.Unlock()
+
+	current, found := memoryCache.cache.Get(key)
+	if !found || !bytes.Equal(current.([]byte), value) {
+		return false, nil
+	}
+
+	memoryCache.cache.Set(key, current, ttl)
+	return true, nil
+}
+
+func (memoryCache *MemoryCache) Release(ctx context.Context, key string, value []byte) (bool, error) {
+	memoryCache.leaseMu.Lock()
+	defer memoryCache.leaseMu.Unlock()
+
+	current, found := memoryCache.cache.Get(key)
+	if !found || !bytes.Equal(current.([]byte), value) {
+		return false, nil
+	}
+
+	memoryCache.cache.Delete(key)
+	return true, nil
+}
+
+func (memoryCache *MemoryCache) Delete(ctx context.Context, key string) error {
+	memoryCache.cache.Delete(key)
+	return nil
+}
+
+// Memcached has a max item size of 1MB, so larger values are split into <key>, <key>_1, <key>_2...
+// A value ends at the first chunk smaller than maxCacheSize.
+var maxCacheSize = 1020000
+var maxCacheChunks = 50
+
+type MemcachedCache struct {
+	client *gomemcache.Client
+}
+
+// Servers are comma separated host:port pairs
+func NewMemcachedCache(servers string) *MemcachedCache {
+	return &MemcachedCache{
+		client: gomemcache.New(strings.Split(servers, ",")...),
+	}
+}
+
+func memcachedChunkKey(key string, chunk int) string {
+	if chunk == 0 {
+		return key
+	}
+
+	return fmt.Sprintf("%s_%d", key, chunk)
+}
+
+func (memcachedCache *MemcachedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data := []byte{}
+	for chunk := 0; chunk <= maxCacheChunks; chunk++ {
+		item, err := memcachedCache.client.Get(memcachedChunkKey(key, chunk))
+		if err != nil {
+			if chunk > 0 {
+				// A missing chunk means the value is incomplete
+				log.Printf("[WARNING] Schemaless: Chunk %d of cache key %s is missing: %s", chunk, key, err)
+			}
+
+			if err == gomemcache.ErrCacheMiss || chunk > 0 {
+				return []byte{}, fmt.Errorf("%w: %s", ErrCacheMiss, key)
+			}
+
+			return []byte{}, err
+		}
+
+		data = append(data, item.Value...)
+		if len(item.Value) != maxCacheSize {
+			return data, nil
+		}
+	}
+
+	return []byte{}, fmt.Errorf("%w: %s has too many chunks", ErrCacheMiss, key)
+}
+
+func (memcachedCache *MemcachedCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if len(value) >= maxCacheSize*maxCacheChunks {
+		return errors.New(fmt.Sprintf("Couldn't set cache for %s - too large: %d > %d", key, len(value), maxCacheSize*maxCacheChunks))
+	}
+
+	expiration := memcachedExpiration(ttl)
+
+	// Always ends with a chunk smaller than maxCacheSize, which may be empty
+	for chunk := 0; ; chunk++ {
+		start := chunk * maxCacheSize
+		end := start + maxCacheSize
+		if end > len(value) {
+			end = len(value)
+		}
+
+		err := memcachedCache.client.Set(&gomemcache.Item{
+			Key:        memcachedChunkKey(key, chunk),
+			Value:      value[start:end],
+			Expiration: expiration,
+		})
+
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for key '%s' with data size %d: %s", key, len(value), err)
+			return err
+		}
+
+		if end-start < maxCacheSize {
+			return nil
+		}
+	}
+}
+
+// Memcached reads 0 as never expiring and expirations above 30 days as a unix timestamp, so TTLs are rounded up to a second
+// and long ones are made absolute
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	if ttl > 30*24*time.Hour {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+// Only for small values, as they aren't chunked
+func (memcachedCache *MemcachedCache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	err := memcachedCache.client.Add(&gomemcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: memcachedExpiration(ttl),
+	})
+
+	if err == gomemcache.ErrNotStored {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (memcachedCache *MemcachedCache) Renew(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return memcachedCache.compareAndSwap(key, value, memcachedExpiration(ttl))
+}
+
+// Memcached can only delete unconditionally, so the lease is expired right away instead
+func (memcachedCache *MemcachedCache) Release(ctx context.Context, key string, value []byte) (bool, error) {
+	return memcachedCache.compareAndSwap(key, value, -1)
+}
+
+// Sets a new expiration on a small value if it still holds value, using the cas token of the read
+func (memcachedCache *MemcachedCache) compareAndSwap(key string, value []byte, expiration int32) (bool, error) {
+	item, err := memcachedCache.client.Get(key)
+	if err == gomemcache.ErrCacheMiss {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if !bytes.Equal(item.Value, value) {
+		return false, nil
+	}
+
+	item.Expiration = expiration
+	err = memcachedCache.client.CompareAndSwap(item)
+	if err == gomemcache.ErrCASConflict || err == gomemcache.ErrNotStored || err == gomemcache.ErrCacheMiss {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (memcachedCache *MemcachedCache) Delete(ctx context.Context, key string) error {
+	err := memcachedCache.client.Delete(key)
+	if err == gomemcache.ErrCacheMiss {
+		return nil
+	}
+
+	return err
+}
+
+// Talks the Redis protocol (RESP) directly, so it works with Redis, Valkey, KeyDB and similar
+type RedisCache struct {
+	Address  string
+	Password string
+	DB       int
+
+	// How long to wait for a connection or a reply when the context has no deadline
+	Timeout time.Duration
+
+	conns chan net.Conn
+}
+
+// Accepts host:port or redis://[:password@]host:port[/db]
+func NewRedisCache(address string) (*RedisCache, error) {
+	redisCache := &RedisCache{
+		Address: address,
+		Timeout: 5 * time.Second,
+		conns:   make(chan net.Conn, 10),
+	}
+
+	if strings.Contains(address, "://") {
+		parsedUrl, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+
+		redisCache.Address = parsedUrl.Host
+		if parsedUrl.User != nil {
+			redisCache.Password, _ = parsedUrl.User.Password()
+		}
+
+		db := strings.Trim(parsedUrl.Path, "/")
+		if len(db) > 0 {
+			redisCache.DB, err = strconv.Atoi(db)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid Redis database '%s'", db))
+			}
+		}
+	}
+
+	if !strings.Contains(redisCache.Address, ":") {
+		redisCache.Address += ":6379"
+	}
+
+	return redisCache, nil
+}
+
+func (redisCache *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := redisCache.do(ctx, "GET", key)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if reply == nil {
+		return []byte{}, fmt.Errorf("%w: %s", ErrCacheMiss, key)
+	}
+
+	value, ok := reply.([]byte)
+	if !ok {
+		return []byte{}, errors.New(fmt.Sprintf("Unexpected Redis reply for %s: %#v", key, reply))
+	}
+
+	return value, nil
+}
+
+// Redis rejects a PX of 0, so TTLs below a millisecond are rounded up
+func redisTTL(ttl time.Duration) string {
+	milliseconds := ttl.Milliseconds()
+	if milliseconds < 1 {
+		milliseconds = 1
+	}
+
+	return strconv.FormatInt(milliseconds, 10)
+}
+
+func (redisCache *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		_, err := redisCache.do(ctx, "SET", key, string(value))
+		return err
+	}
+
+	_, err := redisCache.do(ctx, "SET", key, string(value), "PX", redisTTL(ttl))
+	return err
+}
+
+func (redisCache *RedisCache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := redisCache.do(ctx, "SET", key, string(value), "NX", "PX", redisTTL(ttl))
+	if err != nil {
+		return false, err
+	}
+
+	// Nil when the key is already set
+	return reply != nil, nil
+}
+
+// Only change the lease if it still holds the value, in a single step on the server
+var redisRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+var redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+func (redisCache *RedisCache) Renew(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := redisCache.do(ctx, "EVAL", redisRenewScript, "1", key, string(value), redisTTL(ttl))
+	return reply == int64(1), err
+}
+
+func (redisCache *RedisCache) Release(ctx context.Context, key string, value []byte) (bool, error) {
+	reply, err := redisCache.do(ctx, "EVAL", redisReleaseScript, "1", key, string(value))
+	return reply == int64(1), err
+}
+
+func (redisCache *RedisCache) Delete(ctx context.Context, key string) error {
+	_, err := redisCache.do(ctx, "DEL", key)
+	return err
+}
+
+func (redisCache *RedisCache) getConn(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-redisCache.conns:
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: redisCache.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", redisCache.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(redisCache.Password) > 0 {
+		_, err = redisCache.command(ctx, conn, "AUTH", redisCache.Password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if redisCache.DB > 0 {
+		_, err = redisCache.command(ctx, conn, "SELECT", strconv.Itoa(redisCache.DB))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (redisCache *RedisCache) putConn(conn net.Conn) {
+	select {
+	case redisCache.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (redisCache *RedisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := redisCache.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := redisCache.command(ctx, conn, args...)
+	if err != nil {
+		// Error replies leave the connection usable, anything else may not
+		var redisErr redisError
+		if errors.As(err, &redisErr) {
+			redisCache.putConn(conn)
+		} else {
+			conn.Close()
+		}
+
+		return nil, err
+	}
+
+	redisCache.putConn(conn)
+	return reply, nil
+}
+
+type redisError string
+
+func (err redisError) Error() string {
+	return fmt.Sprintf("Redis error: %s", string(err))
+}
+
+func (redisCache *RedisCache) command(ctx context.Context, conn net.Conn, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisCache.Timeout)
+	}
+
+	conn.SetDeadline(deadline)
+
+	request := strings.Builder{}
+	request.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		request.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+
+	_, err := conn.Write([]byte(request.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(bufio.NewReader(conn))
+}
+
+// Reads a single RESP reply. Bulk strings are returned as []byte, and nil bulk strings as nil.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("Empty reply from Redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if length < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if length < 0 {
+			return nil, nil
+		}
+
+		items := []interface{}{}
+		for i := 0; i < length; i++ {
+			item, err := readRedisReply(reader)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown reply from Redis: %s", line))
+}
+
+func init() {
+	for kind := range cacheTTLs {
+		envName := fmt.Sprintf("SCHEMALESS_CACHE_TTL_%s", strings.ToUpper(string(kind)))
+		if value := os.Getenv(envName); len(value) > 0 {
+			ttl, err := time.ParseDuration(value)
+			if err != nil {
+				log.Printf("[WARNING] Schemaless: Invalid duration '%s' in %s: %s", value, envName, err)
+				continue
+			}
+
+			cacheTTLs[kind] = ttl
+		}
+	}
+
+	if memcached := os.Getenv("SHUFFLE_MEMCACHED"); len(memcached) > 0 {
+		cacheBackend = NewMemcachedCache(memcached)
+		return
+	}
+
+	if redisAddress := os.Getenv("SCHEMALESS_REDIS"); len(redisAddress) > 0 {
+		redisCache, err := NewRedisCache(redisAddress)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Invalid SCHEMALESS_REDIS '%s': %s", redisAddress, err)
+			return
+		}
+
+		cacheBackend = redisCache
+	}
+}
@@ -0,0 +1,501 @@
+package schemaless
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves every connection to a local listener with handle until the test ends
+func serveFake(t *testing.T, handle func(reader *bufio.Reader, writer io.Writer) error) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen locally: %s", err)
+	}
+
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for handle(reader, conn) == nil {
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// A Redis server keeping strings in memory. Records every command it gets.
+type fakeRedis struct {
+	mu       sync.Mutex
+	values   map[string]string
+	commands [][]string
+}
+
+func (fake *fakeRedis) handle(reader *bufio.Reader, writer io.Writer) error {
+	request, err := readRedisReply(reader)
+	if err != nil {
+		return err
+	}
+
+	args := []string{}
+	for _, arg := range request.([]interface{}) {
+		args = append(args, string(arg.([]byte)))
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.commands = append(fake.commands, args)
+
+	reply := "+OK\r\n"
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := fake.values[args[1]]
+		if !ok {
+			reply = "$-1\r\n"
+		} else {
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+	case "SET":
+		options := strings.ToUpper(strings.Join(args[3:], " "))
+		if strings.Contains(options, "PX 0") || strings.HasSuffix(options, "PX -1") {
+			reply = "-ERR invalid expire time in 'set' command\r\n"
+			break
+		}
+
+		if _, ok := fake.values[args[1]]; ok && strings.Contains(options, "NX") {
+			reply = "$-1\r\n"
+			break
+		}
+
+		fake.values[args[1]] = args[2]
+	case "EVAL":
+		// Only the lease scripts, which change the key if it holds the value
+		reply = ":0\r\n"
+		if value, ok := fake.values[args[3]]; ok && value == args[4] {
+			if strings.Contains(args[1], "DEL") {
+				delete(fake.values, args[3])
+			}
+
+			reply = ":1\r\n"
+		}
+	case "DEL":
+		_, ok := fake.values[args[1]]
+		delete(fake.values, args[1])
+		reply = ":0\r\n"
+		if ok {
+			reply = ":1\r\n"
+		}
+	case "AUTH":
+		if args[1] != "secret" {
+			reply = "-WRONGPASS invalid password\r\n"
+		}
+	case "SELECT":
+	default:
+		reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+
+	_, err = io.WriteString(writer, reply)
+	return err
+}
+
+func TestRedisCache(t *testing.T) {
+	fake := &fakeRedis{values: map[string]string{}}
+	address := serveFake(t, fake.handle)
+
+	redisCache, err := NewRedisCache(fmt.Sprintf("redis://:secret@%s/2", address))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	_, err = redisCache.Get(ctx, "missing")
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected ErrCacheMiss, got %v", err)
+	}
+
+	// Binary values and line breaks survive as bulk strings
+	value := []byte("line1\r\nline2\x00end")
+	err = redisCache.Set(ctx, "key", value, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := redisCache.Get(ctx, "key")
+	if err != nil || !bytes.Equal(stored, value) {
+		t.Errorf("got %q (%v), expected %q", stored, err, value)
+	}
+
+	// Below a millisecond is rounded up instead of sending PX 0
+	err = redisCache.Set(ctx, "short", []byte("a"), 100*time.Microsecond)
+	if err != nil {
+		t.Errorf("expected a TTL below a millisecond to be accepted, got %v", err)
+	}
+
+	added, err := redisCache.Add(ctx, "lease", []byte("1"), 0)
+	if err != nil || !added {
+		t.Errorf("expected the lease to be added, got %t (%v)", added, err)
+	}
+
+	added, err = redisCache.Add(ctx, "lease", []byte("2"), time.Minute)
+	if err != nil || added {
+		t.Errorf("expected the taken lease to be refused, got %t (%v)", added, err)
+	}
+
+	err = redisCache.Delete(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = redisCache.Get(ctx, "key")
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected ErrCacheMiss after deleting, got %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	// The connection is authenticated and selects the database once, then reused
+	commands := []string{}
+	for _, command := range fake.commands {
+		commands = append(commands, command[0])
+	}
+
+	if strings.Join(commands, ",") != "AUTH,SELECT,GET,SET,GET,SET,SET,SET,DEL,GET" {
+		t.Errorf("unexpected commands %v", commands)
+	}
+
+	for _, command := range fake.commands {
+		if command[0] == "SET" && command[1] == "short" && command[len(command)-1] != "1" {
+			t.Errorf("expected PX 1, got %v", command)
+		}
+	}
+}
+
+func TestRedisCacheErrors(t *testing.T) {
+	fake := &fakeRedis{values: map[string]string{}}
+	address := serveFake(t, fake.handle)
+
+	redisCache, err := NewRedisCache(fmt.Sprintf("redis://:wrong@%s", address))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = redisCache.Get(context.Background(), "key")
+	var redisErr redisError
+	if !errors.As(err, &redisErr) || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected the error reply, got %v", err)
+	}
+
+	_, err = NewRedisCache("redis://localhost/abc")
+	if err == nil {
+		t.Error("expected an invalid database to be refused")
+	}
+
+	redisCache, err = NewRedisCache("localhost")
+	if err != nil || redisCache.Address != "localhost:6379" {
+		t.Errorf("expected the default port, got %s (%v)", redisCache.Address, err)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	reply, err := readRedisReply(bufio.NewReader(strings.NewReader("*3\r\n:5\r\n$3\r\nabc\r\n$-1\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := reply.([]interface{})
+	if len(items) != 3 || items[0] != int64(5) || string(items[1].([]byte)) != "abc" || items[2] != nil {
+		t.Errorf("unexpected reply %#v", reply)
+	}
+
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("?what\r\n")))
+	if err == nil {
+		t.Error("expected an unknown reply to fail")
+	}
+}
+
+// A memcached server speaking the text protocol, keeping items in memory
+type fakeMemcached struct {
+	mu          sync.Mutex
+	items       map[string][]byte
+	expirations map[string]int64
+
+	// The cas token of each item, changed by every write
+	casIDs  map[string]int
+	lastCas int
+}
+
+func (fake *fakeMemcached) handle(reader *bufio.Reader, writer io.Writer) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	switch fields[0] {
+	case "get", "gets":
+		response := strings.Builder{}
+		for _, key := range fields[1:] {
+			if value, ok := fake.items[key]; ok {
+				response.WriteString(fmt.Sprintf("VALUE %s 0 %d %d\r\n%s\r\n", key, len(value), fake.casIDs[key], value))
+			}
+		}
+
+		response.WriteString("END\r\n")
+		_, err = io.WriteString(writer, response.String())
+	case "set", "add", "cas":
+		length, _ := strconv.Atoi(fields[4])
+		value := make([]byte, length+2)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := fake.items[fields[1]]; ok && fields[0] == "add" {
+			_, err = io.WriteString(writer, "NOT_STORED\r\n")
+			break
+		}
+
+		if fields[0] == "cas" {
+			if _, ok := fake.items[fields[1]]; !ok {
+				_, err = io.WriteString(writer, "NOT_FOUND\r\n")
+				break
+			}
+
+			if casID, _ := strconv.Atoi(fields[5]); casID != fake.casIDs[fields[1]] {
+				_, err = io.WriteString(writer, "EXISTS\r\n")
+				break
+			}
+		}
+
+		if fake.casIDs == nil {
+			fake.casIDs = map[string]int{}
+		}
+
+		fake.lastCas += 1
+		fake.casIDs[fields[1]] = fake.lastCas
+
+		// Negative expirations expire the item right away
+		if strings.HasPrefix(fields[3], "-") {
+			delete(fake.items, fields[1])
+			_, err = io.WriteString(writer, "STORED\r\n")
+			break
+		}
+
+		fake.items[fields[1]] = value[:length]
+		if fake.expirations != nil {
+			fake.expirations[fields[1]], _ = strconv.ParseInt(fields[3], 10, 64)
+		}
+
+		_, err = io.WriteString(writer, "STORED\r\n")
+	case "delete":
+		if _, ok := fake.items[fields[1]]; !ok {
+			_, err = io.WriteString(writer, "NOT_FOUND\r\n")
+			break
+		}
+
+		delete(fake.items, fields[1])
+		_, err = io.WriteString(writer, "DELETED\r\n")
+	default:
+		_, err = io.WriteString(writer, "ERROR\r\n")
+	}
+
+	return err
+}
+
+func TestMemcachedCacheChunks(t *testing.T) {
+	fake := &fakeMemcached{items: map[string][]byte{}}
+	memcachedCache := NewMemcachedCache(serveFake(t, fake.handle))
+
+	oldSize, oldChunks := maxCacheSize, maxCacheChunks
+	maxCacheSize, maxCacheChunks = 10, 5
+	t.Cleanup(func() {
+		maxCacheSize, maxCacheChunks = oldSize, oldChunks
+	})
+
+	ctx := context.Background()
+	tests := map[string]int{
+		"empty":      0,
+		"small":      4,
+		"exact":      10,
+		"two_chunks": 15,
+		"even":       20,
+	}
+
+	for key, size := range tests {
+		value := bytes.Repeat([]byte("x"), size)
+		for i := range value {
+			value[i] = byte('a' + i%26)
+		}
+
+		err := memcachedCache.Set(ctx, key, value, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := memcachedCache.Get(ctx, key)
+		if err != nil || !bytes.Equal(stored, value) {
+			t.Errorf("%s: got %q (%v), expected %q", key, stored, err, value)
+		}
+	}
+
+	// A value of exactly a chunk ends with an empty chunk, so it isn't read as incomplete
+	fake.mu.Lock()
+	last, ok := fake.items["exact_1"]
+	fake.mu.Unlock()
+	if !ok || len(last) != 0 {
+		t.Errorf("expected an empty chunk after a full one, got %q (%t)", last, ok)
+	}
+
+	// Missing chunks are a miss instead of a partial value
+	fake.mu.Lock()
+	delete(fake.items, "two_chunks_1")
+	fake.mu.Unlock()
+
+	_, err := memcachedCache.Get(ctx, "two_chunks")
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected ErrCacheMiss for a missing chunk, got %v", err)
+	}
+
+	err = memcachedCache.Set(ctx, "too_large", make([]byte, 50), time.Minute)
+	if err == nil {
+		t.Error("expected a value over the chunk limit to be refused")
+	}
+
+	added, err := memcachedCache.Add(ctx, "lease", []byte("1"), time.Minute)
+	if err != nil || !added {
+		t.Errorf("expected the lease to be added, got %t (%v)", added, err)
+	}
+
+	added, err = memcachedCache.Add(ctx, "lease", []byte("2"), time.Minute)
+	if err != nil || added {
+		t.Errorf("expected the taken lease to be refused, got %t (%v)", added, err)
+	}
+
+	err = memcachedCache.Delete(ctx, "missing")
+	if err != nil {
+		t.Errorf("deleting a missing key should succeed, got %v", err)
+	}
+}
+
+func TestMemcachedCacheExpiration(t *testing.T) {
+	fake := &fakeMemcached{items: map[string][]byte{}, expirations: map[string]int64{}}
+	memcachedCache := NewMemcachedCache(serveFake(t, fake.handle))
+
+	ctx := context.Background()
+	longTTL := 40 * 24 * time.Hour
+	for key, ttl := range map[string]time.Duration{"short": 200 * time.Millisecond, "minute": time.Minute + time.Millisecond, "long": longTTL} {
+		err := memcachedCache.Set(ctx, key, []byte("value"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = memcachedCache.Add(ctx, "add_"+key, []byte("value"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	// Set stores chunks, Add a single item. Sub-second TTLs would never expire as 0.
+	expected := time.Now().Add(longTTL).Unix()
+	keys := map[string]func(key string) string{
+		"set": func(key string) string { return memcachedChunkKey(key, 0) },
+		"add": func(key string) string { return "add_" + key },
+	}
+
+	for name, itemKey := range keys {
+		short, minute, long := fake.expirations[itemKey("short")], fake.expirations[itemKey("minute")], fake.expirations[itemKey("long")]
+		if short != 1 || minute != 61 || long < expected-5 || long > expected+5 {
+			t.Errorf("%s: unexpected expirations %d, %d and %d", name, short, minute, long)
+		}
+	}
+}
+
+// Renewing and releasing a lease only works for the holder
+func testLeaseCache(t *testing.T, leaseCache LeaseCache) {
+	t.Helper()
+
+	ctx := context.Background()
+	added, err := leaseCache.Add(ctx, "lease", []byte("ours"), time.Minute)
+	if err != nil || !added {
+		t.Fatalf("expected the lease to be added, got %t (%v)", added, err)
+	}
+
+	for _, token := range []string{"theirs", "ours"} {
+		renewed, err := leaseCache.Renew(ctx, "lease", []byte(token), time.Minute)
+		if err != nil || renewed != (token == "ours") {
+			t.Errorf("renewing with %s: got %t (%v)", token, renewed, err)
+		}
+	}
+
+	released, err := leaseCache.Release(ctx, "lease", []byte("theirs"))
+	if err != nil || released {
+		t.Errorf("expected the lease of another replica to be kept, got %t (%v)", released, err)
+	}
+
+	if value, err := leaseCache.Get(ctx, "lease"); err != nil || string(value) != "ours" {
+		t.Errorf("expected the lease to be kept, got %s (%v)", value, err)
+	}
+
+	released, err = leaseCache.Release(ctx, "lease", []byte("ours"))
+	if err != nil || !released {
+		t.Errorf("expected the lease to be released, got %t (%v)", released, err)
+	}
+
+	if _, err := leaseCache.Get(ctx, "lease"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected the lease to be gone, got %v", err)
+	}
+
+	renewed, err := leaseCache.Renew(ctx, "lease", []byte("ours"), time.Minute)
+	if err != nil || renewed {
+		t.Errorf("expected a released lease not to be renewed, got %t (%v)", renewed, err)
+	}
+}
+
+func TestLeaseCaches(t *testing.T) {
+	testLeaseCache(t, NewMemoryCache())
+
+	fakeMemcache := &fakeMemcached{items: map[string][]byte{}}
+	testLeaseCache(t, NewMemcachedCache(serveFake(t, fakeMemcache.handle)))
+
+	fake := &fakeRedis{values: map[string]string{}}
+	redisCache, err := NewRedisCache(serveFake(t, fake.handle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testLeaseCache(t, redisCache)
+}
@@ -0,0 +1,525 @@
+package schemaless
+
+/*
+Splits inputs that are too large for a single LLM request into smaller parts, and merges the partial translations back into a single standard mapping.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The max amount of LLM requests a single oversized input can be split into
+var maxInputChunks = 10
+
+func init() {
+	if tok := os.Getenv("MAX_AI_INPUT_CHUNKS"); tok != "" {
+		if t, err := strconv.Atoi(tok); err == nil && t > 0 {
+			maxInputChunks = t
+		}
+	}
+}
+
+// Translates inputs larger than maxInputSize by sending sub-trees of it to the LLM one at a time
+func chunkedLLMTranslate(ctx context.Context, keyTokenFile, standardFormat, inputDataFormat string, shuffleConfig ShuffleConfig) (string, error) {
+	chunks, err := splitInputForLLM(inputDataFormat, maxInputSize)
+	if err != nil {
+		return standardFormat, errors.New(fmt.Sprintf("Input data too long and could not be split. Max is %d. Current is %d: %s", maxInputSize, len(inputDataFormat), err))
+	}
+
+	if len(chunks) > maxInputChunks {
+		return standardFormat, errors.New(fmt.Sprintf("Input data too long. Would need %d requests, but max is %d (MAX_AI_INPUT_CHUNKS)", len(chunks), maxInputChunks))
+	}
+
+	log.Printf("[INFO] Schemaless: Input of length %d is larger than %d. Translating it in %d parts", len(inputDataFormat), maxInputSize, len(chunks))
+
+	additionalCondition := "The User Input is only a part of a larger JSON structure. If no key in it fits a field in the standard, set that field to an empty string. "
+
+	partials := []string{}
+	for cnt, chunk := range chunks {
+		chunkFile := fmt.Sprintf("%s-part%d", keyTokenFile, cnt)
+		partial, err := llmTranslate(ctx, chunkFile, standardFormat, chunk, additionalCondition, shuffleConfig)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Failed translating part %d/%d of large input: %s", cnt+1, len(chunks), err)
+			return standardFormat, err
+		}
+
+		partials = append(partials, partial)
+	}
+
+	return mergeTranslationParts(standardFormat, partials)
+}
+
+// Splits a value-stripped JSON object or list into parts that are each at most maxSize long.
+// Sub-trees are kept intact where possible. Sub-trees that are too large on their own
+// are summarised into a condensed key listing with their types.
+func splitInputForLLM(input string, maxSize int) ([]string, error) {
+	var parsed interface{}
+	err := json.Unmarshal([]byte(input), &parsed)
+	if err != nil {
+		return []string{}, err
+	}
+
+	path := inputPath{}
+	root, ok := parsed.(map[string]interface{})
+	if list, isList := parsed.([]interface{}); isList {
+		// Items are value-stripped, so their keys are merged into a single item that is split like an object
+		path.listRoot = true
+		root, ok = mergeInputItems(list)
+		if !ok {
+			root = map[string]interface{}{}
+			for key, valueType := range condenseInput(list, "") {
+				root[key] = valueType
+			}
+
+			path.listRoot = false
+		}
+	} else if !ok {
+		return []string{}, errors.New("The input has to be a JSON object or list")
+	}
+
+	parts, err := splitInputTree(root, measureInput(root), path, maxSize)
+	if err != nil {
+		return []string{}, err
+	}
+
+	chunks := []string{}
+	for _, part := range parts {
+		marshalled, err := json.MarshalIndent(part, "", "\t")
+		if err != nil {
+			return []string{}, err
+		}
+
+		chunks = append(chunks, string(marshalled))
+	}
+
+	return chunks, nil
+}
+
+// Where a part is in the original input: the keys above it, and whether the input is a list
+type inputPath struct {
+	keys     []string
+	listRoot bool
+}
+
+func (path inputPath) child(key string) inputPath {
+	return inputPath{
+		keys:     append(append([]string{}, path.keys...), key),
+		listRoot: path.listRoot,
+	}
+}
+
+// The indentation depth of the part
+func (path inputPath) depth() int {
+	if path.listRoot {
+		return len(path.keys) + 1
+	}
+
+	return len(path.keys)
+}
+
+// The size the parents of the part add to it when indented
+func (path inputPath) overhead() int {
+	size := 0
+	depth := 0
+	if path.listRoot {
+		// [\n\t<part>\n]
+		size += 5
+		depth = 1
+	}
+
+	for _, key := range path.keys {
+		// {\n<tabs>"key": <part>\n<tabs>}
+		size += quotedSize(key) + 2*depth + 7
+		depth += 1
+	}
+
+	return size
+}
+
+// Nests a part inside its parents, e.g. [{"a": {"b": part}}], so the paths stay the same
+func (path inputPath) wrap(part map[string]interface{}) interface{} {
+	wrapped := part
+	for i := len(path.keys) - 1; i >= 0; i-- {
+		wrapped = map[string]interface{}{
+			path.keys[i]: wrapped,
+		}
+	}
+
+	if path.listRoot {
+		return []interface{}{wrapped}
+	}
+
+	return wrapped
+}
+
+// The indented size of a value at depth 0 is base, and each level of depth adds a tab to each of its lines
+type sizedInput struct {
+	base   int
+	lines  int
+	fields map[string]*sizedInput
+}
+
+func (sized *sizedInput) at(depth int) int {
+	return sized.base + sized.lines*depth
+}
+
+// Measures the size json.MarshalIndent gives a value and its fields, in a single pass from the bottom up
+func measureInput(value interface{}) *sizedInput {
+	sized := &sizedInput{}
+	switch val := value.(type) {
+	case map[string]interface{}:
+		sized.fields = make(map[string]*sizedInput, len(val))
+		entriesSize := 0
+		for key, field := range val {
+			child := measureInput(field)
+			sized.fields[key] = child
+			entriesSize += entrySize(key, child, 0)
+			sized.lines += child.lines + 1
+		}
+
+		sized.base = objectSize(len(val), entriesSize, 0)
+		if len(val) > 0 {
+			sized.lines += 1
+		}
+	case []interface{}:
+		entriesSize := 0
+		for _, item := range val {
+			child := measureInput(item)
+			entriesSize += 2 + child.at(1)
+			sized.lines += child.lines + 1
+		}
+
+		sized.base = objectSize(len(val), entriesSize, 0)
+		if len(val) > 0 {
+			sized.lines += 1
+		}
+	default:
+		sized.base = jsonSize(val)
+	}
+
+	return sized
+}
+
+// The size of a field of an indented object at depth
+func entrySize(key string, value *sizedInput, depth int) int {
+	// \n<tabs>"key": <value>
+	return 1 + (depth + 1) + quotedSize(key) + 2 + value.at(depth+1)
+}
+
+// The size of an indented object or list at depth, from the sizes of its fields and the commas between them
+func objectSize(entries, entriesSize, depth int) int {
+	if entries == 0 {
+		return 2
+	}
+
+	return 2 + (entries - 1) + entriesSize + 1 + depth
+}
+
+func quotedSize(key string) int {
+	return jsonSize(key)
+}
+
+// Greedily packs the keys of a map into parts below maxSize. The path of the map in the original input
+// is used to wrap the parts, so that the paths stay the same.
+func splitInputTree(input map[string]interface{}, sized *sizedInput, path inputPath, maxSize int) ([]interface{}, error) {
+	keys := make([]string, 0, len(input))
+	for k := range input {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	overhead := path.overhead()
+	depth := path.depth()
+
+	parts := []interface{}{}
+	current := map[string]interface{}{}
+	currentSize := 0
+	for _, key := range keys {
+		keySize := entrySize(key, sized.fields[key], depth)
+		if overhead+objectSize(len(current)+1, currentSize+keySize, depth) <= maxSize {
+			current[key] = input[key]
+			currentSize += keySize
+			continue
+		}
+
+		if len(current) > 0 {
+			parts = append(parts, path.wrap(current))
+			current = map[string]interface{}{}
+			currentSize = 0
+		}
+
+		if overhead+objectSize(1, keySize, depth) <= maxSize {
+			current[key] = input[key]
+			currentSize = keySize
+			continue
+		}
+
+		// The key alone is too large. Go deeper if possible, otherwise summarise it.
+		subPath := path.child(key)
+		if subMap, ok := input[key].(map[string]interface{}); ok && len(subMap) > 1 {
+			subParts, err := splitInputTree(subMap, sized.fields[key], subPath, maxSize)
+			if err != nil {
+				return parts, err
+			}
+
+			parts = append(parts, subParts...)
+			continue
+		}
+
+		listingPath := strings.Join(subPath.keys, ".")
+		if path.listRoot {
+			listingPath = "#." + listingPath
+		}
+
+		condensedParts, err := splitCondensedListing(condenseInput(input[key], listingPath), maxSize)
+		if err != nil {
+			return parts, err
+		}
+
+		parts = append(parts, condensedParts...)
+	}
+
+	if len(current) > 0 {
+		parts = append(parts, path.wrap(current))
+	}
+
+	return parts, nil
+}
+
+// Merges the objects of a list into one with the keys of all of them. Returns false if the list has no objects.
+func mergeInputItems(list []interface{}) (map[string]interface{}, bool) {
+	merged := map[string]interface{}{}
+	found := false
+	for _, item := range list {
+		if itemMap, ok := item.(map[string]interface{}); ok {
+			merged = mergeInputStructure(merged, itemMap)
+			found = true
+		}
+	}
+
+	return merged, found
+}
+
+func mergeInputStructure(dst, src map[string]interface{}) map[string]interface{} {
+	for key, value := range src {
+		dstMap, dstOk := dst[key].(map[string]interface{})
+		srcMap, srcOk := value.(map[string]interface{})
+		if dstOk && srcOk {
+			dst[key] = mergeInputStructure(dstMap, srcMap)
+			continue
+		}
+
+		if _, ok := dst[key]; !ok {
+			dst[key] = value
+		}
+	}
+
+	return dst
+}
+
+// Splits a flat key listing into parts below maxSize
+func splitCondensedListing(listing map[string]interface{}, maxSize int) ([]interface{}, error) {
+	keys := make([]string, 0, len(listing))
+	for k := range listing {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	parts := []interface{}{}
+	current := map[string]interface{}{}
+	currentSize := 0
+	for _, key := range keys {
+		keySize := entrySize(key, measureInput(listing[key]), 0)
+		if objectSize(len(current)+1, currentSize+keySize, 0) <= maxSize {
+			current[key] = listing[key]
+			currentSize += keySize
+			continue
+		}
+
+		if len(current) == 0 {
+			return parts, errors.New(fmt.Sprintf("Key '%s' is larger than %d on its own", key, maxSize))
+		}
+
+		parts = append(parts, current)
+		current = map[string]interface{}{
+			key: listing[key],
+		}
+		currentSize = keySize
+	}
+
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+
+	return parts, nil
+}
+
+// Summarises a value into a flat listing of its paths and types:
+// {"fields.id": "string", "fields.labels.#.name": "string"}
+func condenseInput(value interface{}, path string) map[string]interface{} {
+	listing := map[string]interface{}{}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for k, v := range val {
+			subPath := k
+			if len(path) > 0 {
+				subPath = fmt.Sprintf("%s.%s", path, k)
+			}
+
+			for subKey, subType := range condenseInput(v, subPath) {
+				listing[subKey] = subType
+			}
+		}
+
+		if len(val) == 0 && len(path) > 0 {
+			listing[path] = "object"
+		}
+	case []interface{}:
+		listPath := "#"
+		if len(path) > 0 {
+			listPath = fmt.Sprintf("%s.#", path)
+		}
+
+		// Items are value-stripped, meaning they mostly share the same keys
+		for _, item := range val {
+			for subKey, subType := range condenseInput(item, listPath) {
+				listing[subKey] = subType
+			}
+		}
+
+		if len(val) == 0 && len(path) > 0 {
+			listing[path] = "array"
+		}
+	case string:
+		listing[path] = "string"
+	case float64:
+		listing[path] = "number"
+	case bool:
+		listing[path] = "boolean"
+	case nil:
+		listing[path] = "null"
+	default:
+		listing[path] = fmt.Sprintf("%T", val)
+	}
+
+	return listing
+}
+
+func jsonSize(value interface{}) int {
+	marshalled, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return 0
+	}
+
+	return len(marshalled)
+}
+
+// Merges the translations of each input part into a single standard mapping.
+// For each field, the first part that actually mapped it ($path) wins.
+func mergeTranslationParts(standardFormat string, partials []string) (string, error) {
+	parsedParts := []map[string]interface{}{}
+	for cnt, partial := range partials {
+		parsed := map[string]interface{}{}
+		err := json.Unmarshal([]byte(FixTranslationStructure(partial)), &parsed)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed unmarshalling translation part %d. Skipping it: %s", cnt, err)
+			continue
+		}
+
+		parsedParts = append(parsedParts, parsed)
+	}
+
+	if len(parsedParts) == 0 {
+		return standardFormat, errors.New("No valid translation parts to merge")
+	}
+
+	standard := map[string]interface{}{}
+	err := json.Unmarshal([]byte(standardFormat), &standard)
+	if err != nil {
+		// Not a map standard. Use the first valid part as-is.
+		marshalled, err := json.MarshalIndent(parsedParts[0], "", "\t")
+		return string(marshalled), err
+	}
+
+	merged := mergeTranslationMaps(standard, parsedParts)
+	marshalled, err := json.MarshalIndent(merged, "", "\t")
+	if err != nil {
+		return standardFormat, err
+	}
+
+	return string(marshalled), nil
+}
+
+func mergeTranslationMaps(standard map[string]interface{}, parts []map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, standardValue := range standard {
+		if subStandard, ok := standardValue.(map[string]interface{}); ok {
+			subParts := []map[string]interface{}{}
+			for _, part := range parts {
+				if subPart, ok := part[key].(map[string]interface{}); ok {
+					subParts = append(subParts, subPart)
+				}
+			}
+
+			if len(subParts) > 0 {
+				merged[key] = mergeTranslationMaps(subStandard, subParts)
+				continue
+			}
+		}
+
+		var found interface{}
+		hasValue := false
+		for _, part := range parts {
+			partValue, ok := part[key]
+			if !ok {
+				continue
+			}
+
+			if !hasValue {
+				found = partValue
+				hasValue = true
+			}
+
+			if isMappedValue(partValue) {
+				found = partValue
+				break
+			}
+		}
+
+		if hasValue {
+			merged[key] = found
+		} else {
+			merged[key] = ""
+		}
+	}
+
+	return merged
+}
+
+// Checks whether a translated field points to a location in the input
+func isMappedValue(value interface{}) bool {
+	switch val := value.(type) {
+	case string:
+		return strings.Contains(val, "$")
+	case []interface{}, map[string]interface{}:
+		marshalled, err := json.Marshal(val)
+		if err != nil {
+			return false
+		}
+
+		return strings.Contains(string(marshalled), "$")
+	}
+
+	return false
+}
@@ -0,0 +1,193 @@
+package schemaless
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func chunkTestInput(fields int) map[string]interface{} {
+	input := map[string]interface{}{
+		"id":      "",
+		"enabled": false,
+		"score":   0,
+		"tags":    []interface{}{"", ""},
+		"empty":   map[string]interface{}{},
+		"html":    "<a & b>",
+	}
+
+	for group := 0; group < fields/10; group++ {
+		items := []interface{}{}
+		for item := 0; item < 3; item++ {
+			items = append(items, map[string]interface{}{
+				"name":  "",
+				"value": 0,
+			})
+		}
+
+		fieldMap := map[string]interface{}{
+			"items": items,
+		}
+
+		for field := 0; field < 10; field++ {
+			fieldMap[fmt.Sprintf("field_%d_name", field)] = ""
+		}
+
+		input[fmt.Sprintf("group_%d_values", group)] = map[string]interface{}{
+			"fields": fieldMap,
+		}
+	}
+
+	return input
+}
+
+func TestMeasureInput(t *testing.T) {
+	values := []interface{}{
+		"",
+		0,
+		nil,
+		[]interface{}{},
+		map[string]interface{}{},
+		[]interface{}{"", false, []interface{}{0}},
+		map[string]interface{}{"a \"quoted\" key": map[string]interface{}{"b": []interface{}{map[string]interface{}{}}}},
+		chunkTestInput(50),
+	}
+
+	for cnt, value := range values {
+		marshalled, err := json.MarshalIndent(value, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size := measureInput(value).at(0); size != len(marshalled) {
+			t.Errorf("value %d: measured %d, MarshalIndent gives %d", cnt, size, len(marshalled))
+		}
+	}
+}
+
+func TestInputPathOverhead(t *testing.T) {
+	part := map[string]interface{}{
+		"name":  "",
+		"items": []interface{}{map[string]interface{}{"id": 0}},
+	}
+
+	sized := measureInput(part)
+	paths := []inputPath{
+		{},
+		{listRoot: true},
+		{keys: []string{"data"}},
+		{keys: []string{"data", "nested \"key\""}, listRoot: true},
+	}
+
+	for _, path := range paths {
+		marshalled, err := json.MarshalIndent(path.wrap(part), "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entriesSize := 0
+		for key := range part {
+			entriesSize += entrySize(key, sized.fields[key], path.depth())
+		}
+
+		if size := path.overhead() + objectSize(len(part), entriesSize, path.depth()); size != len(marshalled) {
+			t.Errorf("path %+v: computed %d, MarshalIndent gives %d", path, size, len(marshalled))
+		}
+	}
+}
+
+// The paths of every value in the parts, so splitting can be checked for dropped fields
+func chunkPaths(t *testing.T, chunks []string) []string {
+	found := map[string]bool{}
+	for _, chunk := range chunks {
+		var parsed interface{}
+		err := json.Unmarshal([]byte(chunk), &parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for path := range condenseInput(parsed, "") {
+			found[path] = true
+		}
+	}
+
+	paths := []string{}
+	for path := range found {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func TestSplitInputForLLM(t *testing.T) {
+	object := chunkTestInput(200)
+	list := []interface{}{chunkTestInput(100), map[string]interface{}{"only_in_second": ""}}
+
+	tests := []struct {
+		name    string
+		input   interface{}
+		maxSize int
+	}{
+		{"object", object, 2000},
+		{"object in small parts", object, 400},
+		{"list of objects", list, 2000},
+		{"list of strings", []interface{}{"", ""}, 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input, err := json.MarshalIndent(test.input, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chunks, err := splitInputForLLM(string(input), test.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for cnt, chunk := range chunks {
+				if len(chunk) > test.maxSize {
+					t.Errorf("chunk %d is %d long, max is %d", cnt, len(chunk), test.maxSize)
+				}
+			}
+
+			// Items of lists are merged, so the paths are the ones of the merged item
+			expected := test.input
+			if listInput, ok := test.input.([]interface{}); ok {
+				if merged, ok := mergeInputItems(listInput); ok {
+					expected = []interface{}{merged}
+				}
+			}
+
+			expectedPaths := chunkPaths(t, []string{mustMarshal(t, expected)})
+			if got := chunkPaths(t, chunks); strings.Join(got, ",") != strings.Join(expectedPaths, ",") {
+				t.Errorf("paths differ after splitting.\nGot:      %v\nExpected: %v", got, expectedPaths)
+			}
+		})
+	}
+}
+
+func TestSplitInputForLLMTooLarge(t *testing.T) {
+	_, err := splitInputForLLM(`{"a_very_long_key_that_does_not_fit": ""}`, 10)
+	if err == nil {
+		t.Error("expected an error for a key larger than the max size")
+	}
+
+	_, err = splitInputForLLM(`"text"`, 100)
+	if err == nil {
+		t.Error("expected an error for an input that isn't an object or list")
+	}
+}
+
+func mustMarshal(t *testing.T, value interface{}) string {
+	marshalled, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(marshalled)
+}
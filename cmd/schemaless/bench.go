@@ -0,0 +1,257 @@
+package main
+
+/*
+Measures translation throughput for generated events of different sizes, with and without compiled mapping plans.
+Runs offline against the bundled common/alert standard with a fixed mapping, so no LLM is needed.
+
+	schemaless bench -n 2000 -sizes 10,100,1000
+
+The fingerprint mode compares RemoveJsonValues with StructureFingerprint on the same events, nested to different depths.
+
+	schemaless bench -mode fingerprint -sizes 10,1000 -depths 1,4,8
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/frikky/schemaless"
+)
+
+type benchResult struct {
+	events   int
+	duration time.Duration
+	allocs   uint64
+}
+
+func (result benchResult) perEvent() time.Duration {
+	return result.duration / time.Duration(result.events)
+}
+
+func (result benchResult) perSecond() float64 {
+	return float64(result.events) / result.duration.Seconds()
+}
+
+func (result benchResult) allocsPerEvent() uint64 {
+	return result.allocs / uint64(result.events)
+}
+
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	mode := flags.String("mode", "translate", "What to measure: 'translate' or 'fingerprint'")
+	events := flags.Int("n", 1000, "Events to translate per size and mode")
+	sizes := flags.String("sizes", "10,100,1000", "Comma separated amount of fields per event")
+	depths := flags.String("depths", "1,4,8", "Comma separated nesting depths of the fields, for the fingerprint mode")
+	storeType := flags.String("store", "filesystem", "Store mappings in 'filesystem' (a temporary folder) or 'memory'")
+	verbose := flags.Bool("v", false, "Show the logs of the translations")
+	flags.Parse(args)
+
+	if *events <= 0 {
+		return fmt.Errorf("-n must be above 0")
+	}
+
+	if *mode == "fingerprint" {
+		return benchFingerprints(*events, *sizes, *depths)
+	}
+
+	if *mode != "translate" {
+		return fmt.Errorf("Invalid mode '%s'. Use 'translate' or 'fingerprint'.", *mode)
+	}
+
+	switch *storeType {
+	case "memory":
+		schemaless.SetStore(schemaless.NewMemoryStore())
+	case "filesystem":
+		folder, err := os.MkdirTemp("", "schemaless-bench-")
+		if err != nil {
+			return err
+		}
+
+		defer os.RemoveAll(folder)
+		schemaless.SetStore(schemaless.NewFilesystemStore(folder + "/"))
+	default:
+		return fmt.Errorf("Invalid store '%s'. Use 'filesystem' or 'memory'.", *storeType)
+	}
+
+	schemaless.SetOffline(true)
+	if !*verbose {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	mapping, err := json.Marshal(schemaless.BenchMapping())
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "FIELDS\tBYTES\tINTERPRETED\tCOMPILED\tEVENTS/S\tSPEEDUP\n")
+	for _, size := range splitList(*sizes) {
+		fields, err := strconv.Atoi(size)
+		if err != nil || fields <= 0 {
+			return fmt.Errorf("Invalid size '%s'", size)
+		}
+
+		event, err := json.Marshal(schemaless.BenchEvent(fields))
+		if err != nil {
+			return err
+		}
+
+		mappingFile, err := schemaless.MappingFile(schemaless.BenchStandard, event)
+		if err != nil {
+			return err
+		}
+
+		err = schemaless.SaveTranslationContext(ctx, mappingFile, string(mapping), schemaless.ShuffleConfig{})
+		if err != nil {
+			return err
+		}
+
+		interpreted, err := benchTranslations(ctx, event, *events, false)
+		if err != nil {
+			return err
+		}
+
+		compiled, err := benchTranslations(ctx, event, *events, true)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(writer, "%d\t%d\t%s\t%s\t%.0f\t%.1fx\n", fields, len(event), interpreted.perEvent(), compiled.perEvent(), compiled.perSecond(), float64(interpreted.perEvent())/float64(compiled.perEvent()))
+	}
+
+	return writer.Flush()
+}
+
+func benchTranslations(ctx context.Context, event []byte, events int, plans bool) (benchResult, error) {
+	schemaless.SetMappingPlans(plans)
+
+	// The first translation loads the standard and compiles the plan
+	_, _, err := schemaless.Translate(ctx, schemaless.BenchStandard, event)
+	if err != nil {
+		return benchResult{}, err
+	}
+
+	started := time.Now()
+	for cnt := 0; cnt < events; cnt++ {
+		_, _, err := schemaless.Translate(ctx, schemaless.BenchStandard, event)
+		if err != nil {
+			return benchResult{}, err
+		}
+	}
+
+	return benchResult{
+		events:   events,
+		duration: time.Since(started),
+	}, nil
+}
+
+// Moves the padding groups of an event down to depth, e.g. group_0_values.nested.nested for depth 3
+func nestBenchEvent(event map[string]interface{}, depth int) map[string]interface{} {
+	for key, value := range event {
+		if !strings.HasPrefix(key, "group_") {
+			continue
+		}
+
+		for level := 1; level < depth; level++ {
+			value = map[string]interface{}{
+				"nested": value,
+			}
+		}
+
+		event[key] = value
+	}
+
+	return event
+}
+
+func benchFingerprints(events int, sizes, depths string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "FIELDS\tDEPTH\tBYTES\tREMOVEJSONVALUES\tALLOCS\tSINGLE-PASS\tALLOCS\tSPEEDUP\n")
+	for _, size := range splitList(sizes) {
+		fields, err := strconv.Atoi(size)
+		if err != nil || fields <= 0 {
+			return fmt.Errorf("Invalid size '%s'", size)
+		}
+
+		for _, depthValue := range splitList(depths) {
+			depth, err := strconv.Atoi(depthValue)
+			if err != nil || depth <= 0 {
+				return fmt.Errorf("Invalid depth '%s'", depthValue)
+			}
+
+			event, err := json.Marshal(nestBenchEvent(schemaless.BenchEvent(fields), depth))
+			if err != nil {
+				return err
+			}
+
+			// Both have to give the same mapping file and sample, or the comparison is pointless
+			previousSample, previousToken, err := schemaless.RemoveJsonValues(event, 1)
+			if err != nil {
+				return err
+			}
+
+			sample, keyToken, err := schemaless.StructureFingerprint(event)
+			if err != nil {
+				return err
+			}
+
+			if keyToken != previousToken || string(sample) != string(previousSample) {
+				return fmt.Errorf("StructureFingerprint differs from RemoveJsonValues for %d fields at depth %d", fields, depth)
+			}
+
+			previous, err := benchFingerprint(event, events, func(input []byte) error {
+				_, _, err := schemaless.RemoveJsonValues(input, 1)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			current, err := benchFingerprint(event, events, func(input []byte) error {
+				_, _, err := schemaless.StructureFingerprint(input)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(writer, "%d\t%d\t%d\t%s\t%d\t%s\t%d\t%.1fx\n", fields, depth, len(event), previous.perEvent(), previous.allocsPerEvent(), current.perEvent(), current.allocsPerEvent(), float64(previous.perEvent())/float64(current.perEvent()))
+		}
+	}
+
+	return writer.Flush()
+}
+
+func benchFingerprint(event []byte, events int, fingerprint func([]byte) error) (benchResult, error) {
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	mallocs := memStats.Mallocs
+
+	started := time.Now()
+	for cnt := 0; cnt < events; cnt++ {
+		err := fingerprint(event)
+		if err != nil {
+			return benchResult{}, err
+		}
+	}
+
+	duration := time.Since(started)
+	runtime.ReadMemStats(&memStats)
+	return benchResult{
+		events:   events,
+		duration: duration,
+		allocs:   memStats.Mallocs - mallocs,
+	}, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+/*
+Command line tools for schemaless.
+
+	schemaless import-ocsf -schema ocsf_export.json -class file_activity -profiles host,cloud -out standards/
+	schemaless bench -n 2000 -sizes 10,100,1000
+*/
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/frikky/schemaless"
+)
+
+var commands = map[string]func(args []string) error{
+	"import-ocsf": importOCSF,
+	"bench":       bench,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: schemaless <command> [flags]\n\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "  import-ocsf\tGenerate standards from an offline OCSF schema export\n")
+	fmt.Fprintf(os.Stderr, "  bench\t\tMeasure translation and fingerprint throughput per event size\n")
+	fmt.Fprintf(os.Stderr, "\nRun 'schemaless <command> -h' for the flags of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	err := command(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func importOCSF(args []string) error {
+	flags := flag.NewFlagSet("import-ocsf", flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "Path to the OCSF schema export (https://schema.ocsf.io/export/schema)")
+	classNames := flags.String("class", "", "Comma separated classes to import, by name or uid, or 'all'")
+	profiles := flags.String("profiles", "", "Comma separated profiles to include attributes from, or 'all'")
+	depth := flags.Int("depth", 0, "Levels of nested objects to include attributes for (default 3)")
+	format := flags.String("format", "schema", "Output as 'schema' (JSON Schema) or 'standard' (descriptions as values)")
+	outputDir := flags.String("out", "", "Folder to write <class>.json files to. Prints a single class if empty.")
+	flags.Parse(args)
+
+	if len(*schemaPath) == 0 || len(*classNames) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-schema and -class are required")
+	}
+
+	if *format != "schema" && *format != "standard" {
+		return fmt.Errorf("Invalid format '%s'. Use 'schema' or 'standard'.", *format)
+	}
+
+	schemaExport, err := os.ReadFile(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	classes := splitList(*classNames)
+	if len(classes) == 1 && classes[0] == "all" {
+		classes, err = schemaless.ListOCSFClasses(schemaExport)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(classes) > 1 && len(*outputDir) == 0 {
+		return fmt.Errorf("-out is required when importing more than one class")
+	}
+
+	options := schemaless.OCSFImportOptions{
+		Profiles: splitList(*profiles),
+		MaxDepth: *depth,
+	}
+
+	for _, class := range classes {
+		standard, err := schemaless.ImportOCSF(schemaExport, class, options)
+		if err != nil {
+			return err
+		}
+
+		if *format == "standard" {
+			standard, err = schemaless.ConvertStandardFormat(standard)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(*outputDir) == 0 {
+			fmt.Println(string(standard))
+			continue
+		}
+
+		err = os.MkdirAll(*outputDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		outputPath := filepath.Join(*outputDir, fmt.Sprintf("%s.json", class))
+		err = os.WriteFile(outputPath, standard, 0644)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", outputPath)
+	}
+
+	return nil
+}
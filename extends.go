@@ -0,0 +1,320 @@
+package schemaless
+
+/*
+Handles standards built on other standards, such as an OCSF class extending base_event:
+{"extends": "base_event", "file": "The file the event is about", "severity": "Overrides the base description"}
+
+The base fields are merged in by GetStandard. When mapping a new input, fields inherited from a base are reused from the
+mapping of the base standard for the same input structure, so only the added or overridden fields are asked for.
+Mappings made for an extending standard are only saved for the base as partial mappings, <base mapping>~partial-<md5>,
+which leave out the overridden fields and are only reused by standards overriding the same fields.
+*/
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Key used in a standard to extend one or more other standards
+const standardExtendsKey = "extends"
+
+// Separates the key of a base mapping from the hash of the fields a partial mapping leaves out
+const partialMappingSeparator = "~partial-"
+
+// The key of the base mapping made from a standard extending it, without the fields in ownFields
+func partialMappingFile(baseMappingFile string, ownFields map[string]interface{}) string {
+	keys := []string{}
+	for key := range ownFields {
+		if key != standardExtendsKey {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return fmt.Sprintf("%s%s%x", baseMappingFile, partialMappingSeparator, md5.Sum([]byte(strings.Join(keys, ","))))
+}
+
+// Gets the standards a standard extends. The value can be a name or a list of names, where later ones override earlier ones.
+func getStandardBases(parsedStandard map[string]interface{}) ([]string, error) {
+	value, ok := parsedStandard[standardExtendsKey]
+	if !ok {
+		return []string{}, nil
+	}
+
+	bases := []string{}
+	switch val := value.(type) {
+	case string:
+		bases = append(bases, val)
+	case []interface{}:
+		for _, item := range val {
+			name, ok := item.(string)
+			if !ok {
+				return bases, errors.New(fmt.Sprintf("Invalid '%s' value %#v. Should be a standard name.", standardExtendsKey, item))
+			}
+
+			bases = append(bases, name)
+		}
+	default:
+		return bases, errors.New(fmt.Sprintf("Invalid '%s' value %#v. Should be a standard name or a list of them.", standardExtendsKey, value))
+	}
+
+	for cnt, base := range bases {
+		bases[cnt] = standardKey(strings.TrimSpace(base))
+		if len(bases[cnt]) == 0 {
+			return bases, errors.New(fmt.Sprintf("Empty standard name in '%s'", standardExtendsKey))
+		}
+	}
+
+	return bases, nil
+}
+
+// Merges the standards a standard extends into it, recursively. Fields of the standard override the base fields,
+// nested objects are merged, and null removes a base field.
+func composeStandard(ctx context.Context, inputStandard string, standardFormat []byte, chain []string, shuffleConfig ShuffleConfig) ([]byte, error) {
+	if !strings.Contains(string(standardFormat), standardExtendsKey) {
+		return standardFormat, nil
+	}
+
+	parsedStandard := map[string]interface{}{}
+	err := json.Unmarshal(standardFormat, &parsedStandard)
+	if err != nil {
+		return standardFormat, nil
+	}
+
+	bases, err := getStandardBases(parsedStandard)
+	if err != nil || len(bases) == 0 {
+		return standardFormat, err
+	}
+
+	if err := checkStandardChain(inputStandard, chain); err != nil {
+		return standardFormat, err
+	}
+
+	chain = append(chain, inputStandard)
+	composed := map[string]interface{}{}
+	for _, base := range bases {
+		if err := checkStandardChain(base, chain); err != nil {
+			return standardFormat, err
+		}
+
+		baseFormat, _, err := getRawStandard(ctx, base, shuffleConfig)
+		if err != nil {
+			return standardFormat, errors.New(fmt.Sprintf("Failed loading standard %s extended by %s: %s", base, inputStandard, err))
+		}
+
+		baseFormat, err = ConvertStandardFormat(baseFormat)
+		if err != nil {
+			return standardFormat, err
+		}
+
+		baseFormat, err = composeStandard(ctx, base, baseFormat, chain, shuffleConfig)
+		if err != nil {
+			return standardFormat, err
+		}
+
+		parsedBase := map[string]interface{}{}
+		err = json.Unmarshal(baseFormat, &parsedBase)
+		if err != nil {
+			return standardFormat, errors.New(fmt.Sprintf("Standard %s extended by %s is not a JSON object: %s", base, inputStandard, err))
+		}
+
+		composed = overlayStandard(composed, parsedBase)
+	}
+
+	delete(parsedStandard, standardExtendsKey)
+	composed = overlayStandard(composed, parsedStandard)
+
+	return json.MarshalIndent(composed, "", "\t")
+}
+
+// Puts the fields of src on top of dst
+func overlayStandard(dst, src map[string]interface{}) map[string]interface{} {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+
+		if srcMap, ok := value.(map[string]interface{}); ok {
+			if dstMap, ok := dst[key].(map[string]interface{}); ok {
+				dst[key] = overlayStandard(copyMap(dstMap), srcMap)
+				continue
+			}
+		}
+
+		dst[key] = value
+	}
+
+	return dst
+}
+
+// Maps an input to a standard, reusing the fields inherited from base standards that already have a mapping
+// for the same input structure. Bases without a mapping get one made from the result, for the next standard sharing them.
+func llmTranslateWithBases(ctx context.Context, keyTokenFile, inputStandard, standardFormat string, returnJson []byte, baseMappingFile func(string) string, shuffleConfig ShuffleConfig) (string, error) {
+	rawStandard, _, err := getRawStandard(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return LLMTranslateContext(ctx, keyTokenFile, describeStandardRefs(standardFormat), string(returnJson), shuffleConfig)
+	}
+
+	parsedRaw := map[string]interface{}{}
+	parsedStandard := map[string]interface{}{}
+	if json.Unmarshal(rawStandard, &parsedRaw) != nil || json.Unmarshal([]byte(standardFormat), &parsedStandard) != nil {
+		return LLMTranslateContext(ctx, keyTokenFile, describeStandardRefs(standardFormat), string(returnJson), shuffleConfig)
+	}
+
+	bases, err := getStandardBases(parsedRaw)
+	if err != nil || len(bases) == 0 {
+		return LLMTranslateContext(ctx, keyTokenFile, describeStandardRefs(standardFormat), string(returnJson), shuffleConfig)
+	}
+
+	mapping := map[string]interface{}{}
+	missingBases := []string{}
+	for _, base := range bases {
+		baseMapping, found := getBaseMapping(ctx, base, baseMappingFile(base), parsedRaw, shuffleConfig)
+		if !found {
+			missingBases = append(missingBases, base)
+			continue
+		}
+
+		for key, value := range baseMapping {
+			// Added or overridden fields are always mapped for the standard itself
+			if _, own := parsedRaw[key]; own {
+				continue
+			}
+
+			if _, inStandard := parsedStandard[key]; inStandard {
+				mapping[key] = value
+			}
+		}
+	}
+
+	remaining := []string{}
+	for key := range parsedStandard {
+		if _, found := mapping[key]; !found {
+			remaining = append(remaining, key)
+		}
+	}
+
+	sort.Strings(remaining)
+
+	translated := ""
+	if len(mapping) == 0 {
+		translated, err = LLMTranslateContext(ctx, keyTokenFile, describeStandardRefs(standardFormat), string(returnJson), shuffleConfig)
+	} else {
+		log.Printf("[INFO] Schemaless: Reusing %d field(s) from base mappings for %s. Mapping %d field(s).", len(mapping), keyTokenFile, len(remaining))
+
+		var marshalledMapping []byte
+		marshalledMapping, err = json.MarshalIndent(mapping, "", "\t")
+		if err != nil {
+			return "", err
+		}
+
+		translated = string(marshalledMapping)
+		if len(remaining) > 0 {
+			translated, err = RemapFields(ctx, keyTokenFile, describeStandardRefs(standardFormat), marshalledMapping, returnJson, remaining, []string{}, shuffleConfig)
+		}
+	}
+
+	if err != nil {
+		return translated, err
+	}
+
+	for _, base := range missingBases {
+		saveBaseMapping(ctx, base, partialMappingFile(baseMappingFile(base), parsedRaw), translated, parsedRaw, returnJson, shuffleConfig)
+	}
+
+	return translated, nil
+}
+
+// Gets the mapping of a base standard, without metadata. The mapping stored for the base is only used if it was made
+// for the base itself, with every field of it. Otherwise the partial mapping left out the same fields is used.
+func getBaseMapping(ctx context.Context, base, baseMappingFile string, ownFields map[string]interface{}, shuffleConfig ShuffleConfig) (map[string]interface{}, bool) {
+	parsedMapping, found := getStoredMapping(ctx, baseMappingFile, shuffleConfig)
+	if found {
+		baseFormat, _, err := GetStandardContext(ctx, base, shuffleConfig)
+		parsedBase := map[string]interface{}{}
+		if err == nil && json.Unmarshal(baseFormat, &parsedBase) == nil {
+			complete := true
+			for key := range parsedBase {
+				if _, ok := parsedMapping[key]; !ok {
+					complete = false
+					break
+				}
+			}
+
+			if complete {
+				return parsedMapping, true
+			}
+
+			// e.g. saved from a standard extending it before partial mappings were kept apart
+			log.Printf("[WARNING] Schemaless: Not reusing mapping %s for base standard %s, as it is missing fields of the standard", baseMappingFile, base)
+		}
+	}
+
+	return getStoredMapping(ctx, partialMappingFile(baseMappingFile, ownFields), shuffleConfig)
+}
+
+func getStoredMapping(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) (map[string]interface{}, bool) {
+	existing, _, err := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return nil, false
+	}
+
+	parsedMapping, _, err := ParseStoredMapping([]byte(FixTranslationStructure(string(existing))))
+	if err != nil || len(parsedMapping) == 0 {
+		return nil, false
+	}
+
+	return parsedMapping, true
+}
+
+// Saves the fields a mapping inherited from a base standard as a partial mapping of the base standard.
+// Fields the extending standard overrides are left out, as they were mapped to its own description of them.
+func saveBaseMapping(ctx context.Context, base, partialMappingFile, translated string, ownFields map[string]interface{}, returnJson []byte, shuffleConfig ShuffleConfig) {
+	baseFormat, _, err := GetStandardContext(ctx, base, shuffleConfig)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Not saving mapping for base standard %s: %s", base, err)
+		return
+	}
+
+	parsedBase := map[string]interface{}{}
+	parsedMapping := map[string]interface{}{}
+	if json.Unmarshal(baseFormat, &parsedBase) != nil || json.Unmarshal([]byte(FixTranslationStructure(translated)), &parsedMapping) != nil {
+		return
+	}
+
+	baseMapping := map[string]interface{}{}
+	for key := range parsedBase {
+		if _, own := ownFields[key]; own {
+			continue
+		}
+
+		if value, ok := parsedMapping[key]; ok {
+			baseMapping[key] = value
+		}
+	}
+
+	if len(baseMapping) == 0 {
+		return
+	}
+
+	marshalled, err := json.MarshalIndent(baseMapping, "", "\t")
+	if err != nil {
+		return
+	}
+
+	err = SaveParsedInputContext(ctx, partialMappingFile, returnJson, shuffleConfig)
+	if err == nil {
+		_, err = saveMapping(ctx, partialMappingFile, base, string(marshalled), fmt.Sprintf("llm:%s", llmModel(ctx)), shuffleConfig)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed saving partial mapping %s for base standard %s: %s", partialMappingFile, base, err)
+	}
+}
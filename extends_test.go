@@ -0,0 +1,187 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestComposeStandardOverlay(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"base_event": `{"time": "When it happened", "severity": "The severity", "device": {"name": "The device name", "ip": "The device IP"}, "message": "The message"}`,
+		"detection":  `{"extends": "base_event", "severity": "The severity of the detection", "rule": "The rule"}`,
+		"file_event": `{"extends": ["detection", "base_event_v2"], "message": null, "device": {"ip": null, "os": "The OS"}, "file": "The file"}`,
+
+		"base_event_v2": `{"rule": "The rule that matched", "time": "The event time"}`,
+		"loop_a":        `{"extends": "loop_b", "a": ""}`,
+		"loop_b":        `{"extends": "loop_a", "b": ""}`,
+	})
+
+	composed, _, err := GetStandardContext(context.Background(), "file_event", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := map[string]interface{}{}
+	err = json.Unmarshal(composed, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Later bases override earlier ones, nested objects are merged and null removes a field
+	expected := map[string]interface{}{
+		"time":     "The event time",
+		"severity": "The severity of the detection",
+		"rule":     "The rule that matched",
+		"device": map[string]interface{}{
+			"name": "The device name",
+			"os":   "The OS",
+		},
+		"file": "The file",
+	}
+
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("got %s", composed)
+	}
+
+	// The bases aren't changed by the overlay
+	base, _, err := GetStandardContext(context.Background(), "base_event", ShuffleConfig{})
+	if err != nil || !strings.Contains(string(base), "The device IP") || !strings.Contains(string(base), "The message") {
+		t.Errorf("the base standard was changed: %s (%v)", base, err)
+	}
+
+	_, _, err = GetStandardContext(context.Background(), "loop_a", ShuffleConfig{})
+	if !errors.Is(err, ErrStandardCycle) {
+		t.Errorf("expected ErrStandardCycle, got %v", err)
+	}
+}
+
+func TestExtendedMappingsArePartial(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"base_event":  `{"title": "The title", "severity": "The severity"}`,
+		"file_event":  `{"extends": "base_event", "severity": "The severity of the file", "file": "The file"}`,
+		"file_event2": `{"extends": "base_event", "severity": "The severity of the change", "file": "The changed file"}`,
+		"user_event":  `{"extends": "base_event", "user": "The user"}`,
+	})
+
+	asked := []string{}
+	requests := useFakeLLM(t, func(system, user string) string {
+		asked = append(asked, system+user)
+		return `{"title": "$subject", "severity": "$level", "file": "$path", "user": "$owner"}`
+	})
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Changed", "level": "high", "path": "/etc/passwd", "owner": "root"}`)
+	_, _, err := Translate(ctx, "file_event", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseMappingFile, err := MappingFile("base_event", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Never saved as the mapping of the base itself
+	_, err = store.Get(ctx, NamespaceMappings, baseMappingFile)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected no mapping for the base standard itself, got %v", err)
+	}
+
+	keys, err := store.List(ctx, NamespaceMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partialKey := ""
+	for _, key := range keys {
+		if strings.HasPrefix(key, baseMappingFile+partialMappingSeparator) {
+			partialKey = key
+		}
+	}
+
+	if len(partialKey) == 0 {
+		t.Fatalf("expected a partial mapping for the base standard, got %v", keys)
+	}
+
+	if MappingKeyStandard(partialKey) != "base_event" {
+		t.Errorf("expected the partial mapping to be listed with base_event, got %s", MappingKeyStandard(partialKey))
+	}
+
+	partial, _, err := GetExistingStructureContext(ctx, partialKey, ShuffleConfig{})
+	if err != nil || strings.Contains(string(partial), "severity") || !strings.Contains(string(partial), "$subject") {
+		t.Errorf("expected the partial mapping to leave out the overridden severity, got %s (%v)", partial, err)
+	}
+
+	// Overrides the same fields, so the title is reused and only the rest is asked for
+	asked = []string{}
+	_, _, err = Translate(ctx, "file_event2", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(asked) != 1 || strings.Contains(asked[0], `"The title"`) {
+		t.Errorf("expected a single request without the reused title, got %d: %v", len(asked), asked)
+	}
+
+	// Doesn't override severity, so the partial mapping can't be used
+	before := requests.Load()
+	asked = []string{}
+	_, _, err = Translate(ctx, "user_event", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests.Load() == before || !strings.Contains(asked[0], `"The title"`) {
+		t.Errorf("expected the whole standard to be asked for, got %v", asked)
+	}
+}
+
+func TestPartialBaseMappingIsNotReused(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"base_event": `{"title": "The title", "severity": "The severity"}`,
+		"user_event": `{"extends": "base_event", "user": "The user"}`,
+	})
+
+	asked := []string{}
+	useFakeLLM(t, func(system, user string) string {
+		asked = append(asked, system+user)
+		return `{"title": "$subject", "severity": "$level", "user": "$owner"}`
+	})
+
+	// Saved under the key of the base by a standard overriding severity, before partial mappings were kept apart
+	input := []byte(`{"subject": "Changed", "level": "high", "owner": "root"}`)
+	baseMappingFile := saveTestMapping(t, "base_event", input, `{"title": "$subject"}`)
+
+	parsedRaw := map[string]interface{}{"user": "The user"}
+	_, found := getBaseMapping(context.Background(), "base_event", baseMappingFile, parsedRaw, ShuffleConfig{})
+	if found {
+		t.Error("expected the mapping without the severity of the base not to be reused")
+	}
+
+	_, _, err := Translate(context.Background(), "user_event", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(asked) != 1 || !strings.Contains(asked[0], `"The title"`) {
+		t.Errorf("expected the whole standard to be asked for, got %v", asked)
+	}
+
+	// Made for the base itself
+	err = SaveTranslationContext(context.Background(), baseMappingFile, `{"title": "$subject", "severity": "$level"}`, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping, found := getBaseMapping(context.Background(), "base_event", baseMappingFile, parsedRaw, ShuffleConfig{})
+	if !found || mapping["severity"] != "$level" {
+		t.Errorf("expected the mapping of the base to be reused, got %v", mapping)
+	}
+}
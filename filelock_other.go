@@ -0,0 +1,16 @@
+//go:build !unix
+
+package schemaless
+
+import (
+	"os"
+)
+
+// File locks are only supported on unix. Writes from the same process are still serialized by the in-process locks.
+func tryLockFile(file *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package schemaless
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Tries to take an exclusive lock on the file, shared between processes. Returns false if another process holds it.
+func tryLockFile(file *os.File) (bool, error) {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return true, nil
+		}
+
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+
+		if err != syscall.EINTR {
+			return false, err
+		}
+	}
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,313 @@
+package schemaless
+
+/*
+Structural fingerprints of inputs. The input is decoded once and walked once to get both the key token its mapping file is
+named by and the sample with its values stripped, which is what the LLM gets to make a mapping. Gives the same results as
+RemoveJsonValues, which marshals and parses every nested object again on each level.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Keys ending with a number are left out of the structure. They are usually custom fields, e.g. custom_field_12.
+func isNumberedKey(key string) bool {
+	return len(key) > 0 && key[len(key)-1] >= '0' && key[len(key)-1] <= '9'
+}
+
+// Gets the structure of a JSON object: the object with its values stripped, and the key token of its structure.
+// Same result as RemoveJsonValues(input, 1).
+func StructureFingerprint(input []byte) ([]byte, string, error) {
+	_, stripped, keyToken, err := fingerprintInput(input)
+	if err != nil {
+		return input, keyToken, err
+	}
+
+	sample, err := json.MarshalIndent(stripped, "", "\t")
+	return sample, keyToken, err
+}
+
+// Decodes an input and fingerprints it. The decoded input is returned as well, so it doesn't have to be decoded again.
+func fingerprintInput(input []byte) (map[string]interface{}, map[string]interface{}, string, error) {
+	var parsed map[string]interface{}
+	err := json.Unmarshal(input, &parsed)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	stripped, keyToken := stripJsonValues(parsed, 1)
+	return parsed, stripped, keyToken, nil
+}
+
+// Copies an object with strings as "", numbers as 0 and booleans as false. The key token has the keys in order, followed by
+// the key tokens of nested objects down to depth 3. parsed is not changed.
+func stripJsonValues(parsed map[string]interface{}, depth int64) (map[string]interface{}, string) {
+	if parsed == nil {
+		// The input was null
+		return nil, ""
+	}
+
+	keys := make([]string, 0, len(parsed))
+	for key := range parsed {
+		if !isNumberedKey(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	keyToken := strings.Builder{}
+	stripped := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		keyToken.WriteString(key)
+
+		switch value := parsed[key].(type) {
+		case []interface{}:
+			stripped[key] = stripJsonList(value, depth)
+		case map[string]interface{}:
+			strippedValue, nestedToken := stripJsonValues(value, depth+1)
+			stripped[key] = strippedValue
+			if depth < 3 && len(nestedToken) > 0 {
+				keyToken.WriteString(".")
+				keyToken.WriteString(nestedToken)
+			}
+		default:
+			stripped[key] = stripJsonValue(value)
+		}
+	}
+
+	return stripped, keyToken.String()
+}
+
+// Objects in lists are stripped, but their keys aren't part of the key token. Lists in lists and nulls are left out.
+func stripJsonList(list []interface{}, depth int64) []interface{} {
+	stripped := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		switch value := item.(type) {
+		case map[string]interface{}:
+			strippedValue, _ := stripJsonValues(value, depth+1)
+			stripped = append(stripped, strippedValue)
+		case string, float64, bool:
+			stripped = append(stripped, stripJsonValue(value))
+		}
+	}
+
+	return stripped
+}
+
+func stripJsonValue(value interface{}) interface{} {
+	switch value.(type) {
+	case string:
+		return ""
+	case float64:
+		return 0
+	case bool:
+		return false
+	}
+
+	return value
+}
+
+// Gets the key token of a JSON object without decoding it, the same one stripJsonValues gives, along with the raw values of
+// its top level fields. Returns false if the input isn't a valid JSON object.
+func scanKeyToken(input []byte) (string, []scannedMember, bool) {
+	if !json.Valid(input) {
+		return "", nil, false
+	}
+
+	scanner := &jsonScanner{data: input, members: make([]scannedMember, 0, 16), keys: make([]scannedKey, 0, 32)}
+	scanner.skipSpace()
+	if scanner.pos >= len(input) || input[scanner.pos] != '{' {
+		return "", nil, false
+	}
+
+	return scanner.objectKeyToken(1), scanner.members, true
+}
+
+// A top level field of the input and its raw value
+type scannedMember struct {
+	key   []byte
+	value []byte
+}
+
+// Walks JSON that is known to be valid, without decoding the values it skips
+type jsonScanner struct {
+	data []byte
+	pos  int
+
+	// The top level fields, when they are collected
+	members []scannedMember
+
+	// The keys of the objects being scanned, shared so nested objects don't allocate their own
+	keys []scannedKey
+}
+
+func (scanner *jsonScanner) skipSpace() {
+	for scanner.pos < len(scanner.data) {
+		switch scanner.data[scanner.pos] {
+		case ' ', '\t', '\n', '\r':
+			scanner.pos += 1
+		default:
+			return
+		}
+	}
+}
+
+// Reads the string at the position. Strings without escapes or non-ASCII characters point into the data, and others are
+// decoded by encoding/json, so they get the same replacements for invalid UTF-8.
+func (scanner *jsonScanner) readString() []byte {
+	start := scanner.pos
+	scanner.skipString()
+	raw := scanner.data[start+1 : scanner.pos-1]
+	for _, char := range raw {
+		if char == '\\' || char >= 0x80 {
+			decoded := ""
+			json.Unmarshal(scanner.data[start:scanner.pos], &decoded)
+			return []byte(decoded)
+		}
+	}
+
+	return raw
+}
+
+func (scanner *jsonScanner) skipValue() {
+	scanner.skipSpace()
+	if scanner.pos >= len(scanner.data) {
+		return
+	}
+
+	switch scanner.data[scanner.pos] {
+	case '"':
+		scanner.skipString()
+	case '{', '[':
+		depth := 0
+		for scanner.pos < len(scanner.data) {
+			switch scanner.data[scanner.pos] {
+			case '"':
+				scanner.skipString()
+				continue
+			case '{', '[':
+				depth += 1
+			case '}', ']':
+				depth -= 1
+			}
+
+			scanner.pos += 1
+			if depth == 0 {
+				return
+			}
+		}
+	default:
+		for scanner.pos < len(scanner.data) {
+			switch scanner.data[scanner.pos] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return
+			}
+
+			scanner.pos += 1
+		}
+	}
+}
+
+func (scanner *jsonScanner) skipString() {
+	scanner.pos += 1
+	for {
+		end := bytes.IndexByte(scanner.data[scanner.pos:], '"')
+		if end < 0 {
+			scanner.pos = len(scanner.data)
+			return
+		}
+
+		// Quotes after an odd amount of backslashes are escaped
+		scanner.pos += end
+		backslashes := 0
+		for cnt := scanner.pos - 1; cnt >= 0 && scanner.data[cnt] == '\\'; cnt-- {
+			backslashes += 1
+		}
+
+		scanner.pos += 1
+		if backslashes%2 == 0 {
+			return
+		}
+	}
+}
+
+// Calls member with the key of each member of the object at the position, with the scanner at its value. member has to
+// read or skip the value.
+func (scanner *jsonScanner) objectMembers(member func(key []byte)) {
+	scanner.pos += 1
+	for scanner.pos < len(scanner.data) {
+		scanner.skipSpace()
+		switch scanner.data[scanner.pos] {
+		case '}':
+			scanner.pos += 1
+			return
+		case ',':
+			scanner.pos += 1
+			continue
+		}
+
+		key := scanner.readString()
+		scanner.skipSpace()
+
+		// The colon
+		scanner.pos += 1
+		scanner.skipSpace()
+		member(key)
+	}
+}
+
+type scannedKey struct {
+	key         []byte
+	nestedToken string
+}
+
+// Same key token as stripJsonValues. Later duplicates of a key replace the earlier ones, as when decoding to a map.
+func (scanner *jsonScanner) objectKeyToken(depth int64) string {
+	base := len(scanner.keys)
+	size := 0
+	scanner.objectMembers(func(key []byte) {
+		start := scanner.pos
+		nestedToken := ""
+		if depth < 3 && scanner.pos < len(scanner.data) && scanner.data[scanner.pos] == '{' {
+			nestedToken = scanner.objectKeyToken(depth + 1)
+		} else {
+			scanner.skipValue()
+		}
+
+		if depth == 1 && scanner.members != nil {
+			scanner.members = append(scanner.members, scannedMember{key: key, value: scanner.data[start:scanner.pos]})
+		}
+
+		if len(key) == 0 || key[len(key)-1] < '0' || key[len(key)-1] > '9' {
+			scanner.keys = append(scanner.keys, scannedKey{key: key, nestedToken: nestedToken})
+			size += len(key) + len(nestedToken) + 1
+		}
+	})
+
+	keys := scanner.keys[base:]
+	slices.SortStableFunc(keys, func(first, second scannedKey) int {
+		return bytes.Compare(first.key, second.key)
+	})
+
+	keyToken := strings.Builder{}
+	keyToken.Grow(size)
+	for cnt, key := range keys {
+		if cnt+1 < len(keys) && bytes.Equal(keys[cnt+1].key, key.key) {
+			continue
+		}
+
+		keyToken.Write(key.key)
+		if len(key.nestedToken) > 0 {
+			keyToken.WriteByte('.')
+			keyToken.WriteString(key.nestedToken)
+		}
+	}
+
+	scanner.keys = scanner.keys[:base]
+	return keyToken.String()
+}
@@ -0,0 +1,160 @@
+package schemaless
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStructureFingerprintMatchesRemoveJsonValues(t *testing.T) {
+	tests := map[string]string{
+		"flat":          `{"title": "Disk full", "count": 3, "open": true, "closed_at": null}`,
+		"empty":         `{}`,
+		"numbered keys": `{"custom_field_12": "x", "field_a": "y", "0": 1}`,
+		"nested maps":   `{"user": {"name": "alice", "manager": {"name": "bob", "org": {"name": "acme", "unit": {"name": "it"}}}}}`,
+		"empty nested":  `{"user": {}, "tags": []}`,
+		"list of maps":  `{"items": [{"id": 1, "owner": {"name": "alice"}}, {"id": 2, "extra": true}]}`,
+		"mixed list":    `{"values": ["a", 1, true, null, {"key": "value"}, ["nested"]]}`,
+		"lists in maps": `{"event": {"tags": ["a", "b"], "hosts": [{"ip": "10.0.0.1"}], "nested": {"ids": [1, 2]}}}`,
+		"mixed types":   `{"a": "x", "b": 1.5, "c": false, "d": {"e": [{"f": {"g": "h"}}]}, "i": [[1], [2]], "j": null}`,
+		"unicode keys":  `{"名前": "x", "ключ": {"ü": 1}}`,
+	}
+
+	for name, input := range tests {
+		removed, removedToken, err := RemoveJsonValues([]byte(input), 1)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		fingerprinted, fingerprintToken, err := StructureFingerprint([]byte(input))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		// Mappings are stored by the md5 of the key token, so it has to be the same
+		if md5.Sum([]byte(fingerprintToken)) != md5.Sum([]byte(removedToken)) {
+			t.Errorf("%s: got key token %q, expected %q", name, fingerprintToken, removedToken)
+		}
+
+		var removedParsed, fingerprintParsed interface{}
+		json.Unmarshal(removed, &removedParsed)
+		json.Unmarshal(fingerprinted, &fingerprintParsed)
+		if !reflect.DeepEqual(fingerprintParsed, removedParsed) {
+			t.Errorf("%s: got sample %s, expected %s", name, fingerprinted, removed)
+		}
+	}
+
+	for _, input := range []string{`[1, 2]`, `"text"`, `{"broken": `} {
+		_, _, removedErr := RemoveJsonValues([]byte(input), 1)
+		_, _, fingerprintErr := StructureFingerprint([]byte(input))
+		if (removedErr == nil) != (fingerprintErr == nil) {
+			t.Errorf("%s: got error %v, expected %v", input, fingerprintErr, removedErr)
+		}
+	}
+}
+
+// A medium sized event, with its padding nested a few levels down
+func benchFingerprintEvent(b *testing.B) []byte {
+	b.Helper()
+
+	event := BenchEvent(100)
+	event["group_0_values"] = map[string]interface{}{"nested": map[string]interface{}{"nested": event["group_0_values"]}}
+	event["items"] = []interface{}{event["user"], event["user"], "text"}
+
+	marshalled, err := json.Marshal(event)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return marshalled
+}
+
+func BenchmarkRemoveJsonValues(b *testing.B) {
+	event := benchFingerprintEvent(b)
+
+	b.SetBytes(int64(len(event)))
+	b.ReportAllocs()
+	for b.Loop() {
+		_, _, err := RemoveJsonValues(event, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStructureFingerprint(b *testing.B) {
+	event := benchFingerprintEvent(b)
+
+	b.SetBytes(int64(len(event)))
+	b.ReportAllocs()
+	for b.Loop() {
+		_, _, err := StructureFingerprint(event)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestScanKeyTokenMatchesStructureFingerprint(t *testing.T) {
+	tests := map[string]string{
+		"flat":          `{"title": "Disk full", "count": 3, "open": true, "closed_at": null}`,
+		"empty":         `{}`,
+		"numbered keys": `{"custom_field_12": "x", "field_a": "y", "0": 1}`,
+		"deep":          `{"user": {"name": "alice", "manager": {"name": "bob", "org": {"name": "acme", "unit": {"name": "it"}}}}}`,
+		"list of maps":  `{"items": [{"id": 1, "owner": {"name": "alice"}}, {"id": 2, "extra": true}], "after": "x"}`,
+		"mixed types":   `{"a": "x", "b": -1.5e3, "c": false, "d": {"e": [{"f": {"g": "h"}}]}, "i": [[1], [2]], "j": null}`,
+		"unicode keys":  `{"名前": "x", "ключ": {"ü": 1}}`,
+		"escapes":       `{"say \"hi\"": "a \"quoted\" \\ value", "tab\tkey": {"back\\slash": "}"}, "Abc": "{[", "x\\": 1}`,
+		"duplicates":    `{"b": {"first": 1}, "a": "x", "b": {"second": 2}}`,
+		"whitespace":    " \n\t{ \"a\" :\t[ 1 , { \"b\" : { } } ] ,\r\n \"c\" : { \"d\" : \"e\" } } \n",
+	}
+
+	for name, input := range tests {
+		_, expected, err := StructureFingerprint([]byte(input))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		keyToken, members, ok := scanKeyToken([]byte(input))
+		if !ok || keyToken != expected {
+			t.Errorf("%s: got key token %q (%t), expected %q", name, keyToken, ok, expected)
+		}
+
+		// The top level fields are the same as decoding the whole input, with later duplicates replacing earlier ones
+		parsed := map[string]interface{}{}
+		json.Unmarshal([]byte(input), &parsed)
+
+		scanned := map[string]interface{}{}
+		for _, member := range members {
+			value, err := decodeScannedValue(member.value)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			scanned[string(member.key)] = value
+		}
+
+		if !reflect.DeepEqual(scanned, parsed) {
+			t.Errorf("%s: got fields %v, expected %v", name, scanned, parsed)
+		}
+	}
+
+	for _, input := range []string{`[1, 2]`, `"text"`, `{"broken": `, `{"a": 1}}`, `{"a": tru}`, ``} {
+		if _, _, ok := scanKeyToken([]byte(input)); ok {
+			t.Errorf("%s: expected it not to be scanned", input)
+		}
+	}
+}
+
+func TestDecodeScannedValue(t *testing.T) {
+	for _, raw := range []string{`"plain"`, `""`, `"a \"b\" é"`, "\"\xff invalid\"", `"ünïcode"`, `0`, `-0`, `-12.5e-3`, `12345678901234567890`, `1e400`, `true`, `false`, `null`, `{"a": [1, "b"]}`, `[]`} {
+		var expected interface{}
+		expectedErr := json.Unmarshal([]byte(raw), &expected)
+
+		value, err := decodeScannedValue([]byte(raw))
+		if (err == nil) != (expectedErr == nil) || !reflect.DeepEqual(value, expected) {
+			t.Errorf("%s: got %#v (%v), expected %#v (%v)", raw, value, err, expected, expectedErr)
+		}
+	}
+}
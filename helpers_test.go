@@ -0,0 +1,91 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Gives the test its own memory store and cache, and only uses the bundled standards
+func useTestStore(t testing.TB) *MemoryStore {
+	t.Helper()
+
+	store := NewMemoryStore()
+	SetStore(store)
+	SetCacheBackend(NewMemoryCache())
+	SetOffline(true)
+	t.Cleanup(func() {
+		SetStore(nil)
+		SetCacheBackend(NewMemoryCache())
+		SetOffline(false)
+	})
+
+	return store
+}
+
+// Points the LLM at a fake server. respond gets the system and user messages and returns the answer.
+// Returns the amount of requests made.
+func useFakeLLM(t *testing.T, respond func(system, user string) string) *atomic.Int32 {
+	t.Helper()
+
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		requests.Add(1)
+
+		body := struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}{}
+
+		json.NewDecoder(request.Body).Decode(&body)
+		system, user := "", ""
+		for _, message := range body.Messages {
+			if message.Role == "system" {
+				system = message.Content
+			} else if message.Role == "user" {
+				user = message.Content
+			}
+		}
+
+		answer := map[string]interface{}{
+			"choices": []interface{}{
+				map[string]interface{}{
+					"message": map[string]interface{}{
+						"role":    "assistant",
+						"content": respond(system, user),
+					},
+				},
+			},
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(answer)
+	}))
+
+	t.Cleanup(server.Close)
+	t.Setenv("AI_API_URL", server.URL)
+	t.Setenv("AI_API_KEY", "test")
+	return requests
+}
+
+// Saves a mapping for the structure of input
+func saveTestMapping(t *testing.T, inputStandard string, input []byte, mapping string) string {
+	t.Helper()
+
+	mappingFile, err := MappingFile(inputStandard, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SaveTranslationContext(context.Background(), mappingFile, mapping, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mappingFile
+}
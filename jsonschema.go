@@ -0,0 +1,1273 @@
+package schemaless
+
+/*
+Handles standards written as JSON Schema (draft 2020-12). The property descriptions are turned into a regular standard for the LLM,
+while types, enums, required fields and formats are used to coerce and validate the translated output.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max depth of nested schemas and $ref lookups, in case a schema references itself
+var maxSchemaDepth = 32
+
+// A problem found when validating a translation against a JSON Schema standard
+type SchemaValidationError struct {
+	// JSON pointer (RFC 6901) to the value in the translation, e.g. /assignee/email
+	Pointer string `json:"pointer"`
+
+	// The schema keyword that failed, e.g. required or format
+	Keyword string `json:"keyword"`
+
+	Message string `json:"message"`
+}
+
+func (validationError SchemaValidationError) Error() string {
+	pointer := validationError.Pointer
+	if len(pointer) == 0 {
+		pointer = "/"
+	}
+
+	return fmt.Sprintf("%s: %s", pointer, validationError.Message)
+}
+
+type jsonSchema struct {
+	root map[string]interface{}
+}
+
+// Marks a standard without $schema as a JSON Schema, e.g. {"x-schemaless-schema": true, "type": "object", "properties": {...}}
+const jsonSchemaMarker = "x-schemaless-schema"
+
+// Checks if a standard is a JSON Schema instead of example-style JSON. Needs $schema or the marker, as an example-style
+// standard can have fields named type and properties as well.
+func isJSONSchema(parsed map[string]interface{}) bool {
+	if schemaVersion, ok := parsed["$schema"].(string); ok && len(strings.TrimSpace(schemaVersion)) > 0 {
+		return true
+	}
+
+	marker, _ := parsed[jsonSchemaMarker].(bool)
+	return marker
+}
+
+// Parses a standard as a JSON Schema. Returns false if it isn't one.
+func parseJSONSchema(standardFormat []byte) (*jsonSchema, bool) {
+	if !strings.Contains(string(standardFormat), "$schema") && !strings.Contains(string(standardFormat), jsonSchemaMarker) {
+		return nil, false
+	}
+
+	parsed := map[string]interface{}{}
+	err := json.Unmarshal(standardFormat, &parsed)
+	if err != nil || !isJSONSchema(parsed) {
+		return nil, false
+	}
+
+	return &jsonSchema{root: parsed}, true
+}
+
+// Gets the JSON Schema of a standard, if it is written as one or extends one. The properties of the standards
+// it extends are merged into it, e.g. ecs/8.11/security_event gets those of ecs/8.11/event and ecs/8.11/host.
+func getStandardSchema(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) (*jsonSchema, bool) {
+	root, found, err := composeStandardSchema(ctx, standardKey(inputStandard), []string{}, shuffleConfig)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed composing the JSON Schema of standard %s: %s", inputStandard, err)
+		return nil, false
+	}
+
+	if !found {
+		return nil, false
+	}
+
+	return &jsonSchema{root: root}, true
+}
+
+// Builds the schema of a standard with the schemas of its bases merged in, the same way composeStandard merges
+// the standards. Example-style parts get untyped properties with their description. Returns false if no part is a schema.
+func composeStandardSchema(ctx context.Context, inputStandard string, chain []string, shuffleConfig ShuffleConfig) (map[string]interface{}, bool, error) {
+	if err := checkStandardChain(inputStandard, chain); err != nil {
+		return nil, false, err
+	}
+
+	rawStandard, _, err := getRawStandard(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return nil, false, err
+	}
+
+	parsed := map[string]interface{}{}
+	if json.Unmarshal(rawStandard, &parsed) != nil {
+		return nil, false, nil
+	}
+
+	bases, err := getStandardBases(parsed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	isSchema := isJSONSchema(parsed)
+	if len(bases) == 0 {
+		return parsed, isSchema, nil
+	}
+
+	chain = append(chain, inputStandard)
+	composed := map[string]interface{}{
+		"$schema":    jsonSchemaDraft,
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	}
+
+	found := isSchema
+	for _, base := range bases {
+		baseSchema, baseIsSchema, err := composeStandardSchema(ctx, base, chain, shuffleConfig)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !baseIsSchema {
+			baseSchema = exampleToSchema(baseSchema)
+		}
+
+		found = found || baseIsSchema
+		composed = overlaySchema(composed, baseSchema)
+	}
+
+	delete(parsed, standardExtendsKey)
+	if !isSchema {
+		parsed = exampleToSchema(parsed)
+	}
+
+	return overlaySchema(composed, parsed), found, nil
+}
+
+// Describes an example-style standard as a schema, without types. Null fields are kept, as they remove base properties.
+func exampleToSchema(standard map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for key, value := range standard {
+		switch val := value.(type) {
+		case nil:
+			properties[key] = nil
+		case string:
+			properties[key] = map[string]interface{}{"description": val}
+		case map[string]interface{}:
+			if name, ok := getStandardRef(val); ok {
+				properties[key] = map[string]interface{}{"$ref": name}
+			} else {
+				properties[key] = exampleToSchema(val)
+			}
+		case []interface{}:
+			properties[key] = map[string]interface{}{"type": "array"}
+		default:
+			properties[key] = map[string]interface{}{}
+		}
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// Puts the schema src on top of dst. Properties are merged, with nested object schemas merged as well and null removing
+// a property. Required fields and $defs are combined. Other keywords of src replace the ones of dst.
+func overlaySchema(dst, src map[string]interface{}) map[string]interface{} {
+	composed := copyMap(dst)
+	for key, value := range src {
+		switch key {
+		case standardExtendsKey:
+		case "properties":
+			properties, _ := composed["properties"].(map[string]interface{})
+			srcProperties, _ := value.(map[string]interface{})
+			composed["properties"] = overlaySchemaProperties(properties, srcProperties)
+		case "$defs", "definitions":
+			defs, _ := composed[key].(map[string]interface{})
+			srcDefs, _ := value.(map[string]interface{})
+			merged := copyMap(defs)
+			for name, def := range srcDefs {
+				merged[name] = def
+			}
+
+			composed[key] = merged
+		case "required":
+			required, _ := composed["required"].([]interface{})
+			srcRequired, _ := value.([]interface{})
+			for _, field := range srcRequired {
+				if !containsValue(required, field) {
+					required = append(required, field)
+				}
+			}
+
+			composed["required"] = required
+		default:
+			composed[key] = value
+		}
+	}
+
+	// Removed properties can't be required
+	if required, ok := composed["required"].([]interface{}); ok {
+		properties, _ := composed["properties"].(map[string]interface{})
+		kept := []interface{}{}
+		for _, field := range required {
+			if name, ok := field.(string); ok && properties != nil {
+				if _, exists := properties[name]; !exists {
+					continue
+				}
+			}
+
+			kept = append(kept, field)
+		}
+
+		composed["required"] = kept
+	}
+
+	return composed
+}
+
+func overlaySchemaProperties(dst, src map[string]interface{}) map[string]interface{} {
+	properties := copyMap(dst)
+	for key, value := range src {
+		if value == nil {
+			delete(properties, key)
+			continue
+		}
+
+		srcProperty, srcOk := value.(map[string]interface{})
+		dstProperty, dstOk := properties[key].(map[string]interface{})
+		if srcOk && dstOk {
+			_, srcObject := srcProperty["properties"].(map[string]interface{})
+			_, dstObject := dstProperty["properties"].(map[string]interface{})
+			if srcObject && dstObject {
+				properties[key] = overlaySchema(dstProperty, srcProperty)
+				continue
+			}
+		}
+
+		properties[key] = value
+	}
+
+	return properties
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if jsonEqual(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Turns JSON Schema standards into example-style standards with the descriptions as values. Other standards are returned as-is.
+func ConvertStandardFormat(standardFormat []byte) ([]byte, error) {
+	schema, ok := parseJSONSchema(standardFormat)
+	if !ok {
+		return standardFormat, nil
+	}
+
+	standard, ok := schema.toStandard(schema.root, "", 0).(map[string]interface{})
+	if !ok {
+		return standardFormat, errors.New("JSON Schema standards must describe an object")
+	}
+
+	// Schemas can extend other standards as well
+	if bases, ok := schema.root[standardExtendsKey]; ok {
+		standard[standardExtendsKey] = bases
+	}
+
+	return json.MarshalIndent(standard, "", "\t")
+}
+
+// Follows local references such as #/$defs/user
+func (schema *jsonSchema) resolve(node map[string]interface{}) (map[string]interface{}, error) {
+	for depth := 0; depth < maxSchemaDepth; depth++ {
+		ref, ok := node["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#") {
+			return node, nil
+		}
+
+		var current interface{} = schema.root
+		for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+			if len(token) == 0 {
+				continue
+			}
+
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			currentMap, ok := current.(map[string]interface{})
+			if !ok {
+				return node, errors.New(fmt.Sprintf("Invalid schema reference %s", ref))
+			}
+
+			current, ok = currentMap[token]
+			if !ok {
+				return node, errors.New(fmt.Sprintf("Schema reference %s not found", ref))
+			}
+		}
+
+		resolved, ok := current.(map[string]interface{})
+		if !ok {
+			return node, errors.New(fmt.Sprintf("Schema reference %s is not a schema", ref))
+		}
+
+		// Keywords next to $ref apply as well
+		merged := copyMap(resolved)
+		for key, value := range node {
+			if key != "$ref" {
+				merged[key] = value
+			}
+		}
+
+		if _, ok := resolved["$ref"]; !ok {
+			return merged, nil
+		}
+
+		merged["$ref"] = resolved["$ref"]
+		node = merged
+	}
+
+	return node, errors.New("Schema references are nested too deep")
+}
+
+// References to other standards, e.g. {"$ref": "user"}, are kept as standard references
+func getSchemaStandardRef(node map[string]interface{}) (string, bool) {
+	ref, ok := node["$ref"].(string)
+	if !ok || strings.HasPrefix(ref, "#") || strings.Contains(ref, "://") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(ref, ".json"), true
+}
+
+func (schema *jsonSchema) toStandard(node map[string]interface{}, name string, depth int) interface{} {
+	if ref, ok := getSchemaStandardRef(node); ok {
+		return map[string]interface{}{
+			standardRefKey: ref,
+		}
+	}
+
+	node, err := schema.resolve(node)
+	if err != nil || depth > maxSchemaDepth {
+		return schemaDescription(node, name)
+	}
+
+	properties := schemaProperties(node)
+	if len(properties) > 0 {
+		standard := map[string]interface{}{}
+		for key, property := range properties {
+			if propertyMap, ok := property.(map[string]interface{}); ok {
+				standard[key] = schema.toStandard(propertyMap, key, depth+1)
+			}
+		}
+
+		return standard
+	}
+
+	if schemaHasType(node, "array") {
+		if items, ok := node["items"].(map[string]interface{}); ok {
+			return []interface{}{schema.toStandard(items, name, depth+1)}
+		}
+
+		return []interface{}{}
+	}
+
+	return schemaDescription(node, name)
+}
+
+// Gets the properties of a schema, including the ones from allOf. Can be the properties of the node itself, so it is only read.
+func schemaProperties(node map[string]interface{}) map[string]interface{} {
+	if _, ok := node["allOf"]; !ok {
+		properties, _ := node["properties"].(map[string]interface{})
+		return properties
+	}
+
+	properties := map[string]interface{}{}
+	if nodeProperties, ok := node["properties"].(map[string]interface{}); ok {
+		for key, value := range nodeProperties {
+			properties[key] = value
+		}
+	}
+
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		for _, subSchema := range allOf {
+			if subMap, ok := subSchema.(map[string]interface{}); ok {
+				for key, value := range schemaProperties(subMap) {
+					properties[key] = value
+				}
+			}
+		}
+	}
+
+	return properties
+}
+
+// Builds the description the LLM gets for a field, with the type, allowed values and format
+func schemaDescription(node map[string]interface{}, name string) string {
+	description := ""
+	if value, ok := node["description"].(string); ok {
+		description = value
+	} else if value, ok := node["title"].(string); ok {
+		description = value
+	} else {
+		description = fmt.Sprintf("The %s", strings.ReplaceAll(name, "_", " "))
+	}
+
+	description = strings.TrimSuffix(strings.TrimSpace(description), ".")
+	for _, schemaType := range schemaTypes(node) {
+		if schemaType == "integer" || schemaType == "number" || schemaType == "boolean" {
+			description = fmt.Sprintf("%s. Type: %s", description, schemaType)
+			break
+		}
+	}
+
+	if enum, ok := node["enum"].([]interface{}); ok && len(enum) > 0 {
+		values := []string{}
+		for _, value := range enum {
+			values = append(values, fmt.Sprintf("%v", value))
+		}
+
+		description = fmt.Sprintf("%s. One of: %s", description, strings.Join(values, ", "))
+	}
+
+	if format, ok := node["format"].(string); ok {
+		description = fmt.Sprintf("%s. Format: %s", description, format)
+	}
+
+	return description
+}
+
+func schemaTypes(node map[string]interface{}) []string {
+	switch val := node["type"].(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		types := []string{}
+		for _, item := range val {
+			if schemaType, ok := item.(string); ok {
+				types = append(types, schemaType)
+			}
+		}
+
+		return types
+	}
+
+	return []string{}
+}
+
+func schemaHasType(node map[string]interface{}, schemaType string) bool {
+	for _, foundType := range schemaTypes(node) {
+		if foundType == schemaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Coerces a translation to the types of the schema, and validates it. Values the translation couldn't find are
+// left out instead of being validated as empty strings.
+func (schema *jsonSchema) coerceAndValidate(translation []byte) ([]byte, []SchemaValidationError) {
+	var parsed interface{}
+	err := json.Unmarshal(translation, &parsed)
+	if err != nil {
+		return translation, []SchemaValidationError{
+			SchemaValidationError{Keyword: "type", Message: fmt.Sprintf("Translation is not valid JSON: %s", err)},
+		}
+	}
+
+	parsed, validationErrors := schema.coerceAndValidateValue(parsed)
+	coerced, err := json.MarshalIndent(parsed, "", "\t")
+	if err != nil {
+		return translation, validationErrors
+	}
+
+	return coerced, validationErrors
+}
+
+// Same as coerceAndValidate, for a translation that isn't marshalled yet. Changes maps and lists in place.
+func (schema *jsonSchema) coerceAndValidateValue(parsed interface{}) (interface{}, []SchemaValidationError) {
+	parsed = schema.coerce(schema.root, parsed, 0)
+	validationErrors := []SchemaValidationError{}
+	schema.validate(schema.root, parsed, "", 0, &validationErrors)
+
+	return parsed, validationErrors
+}
+
+// Validates JSON data against a JSON Schema
+func ValidateJSONSchema(schemaData, data []byte) ([]SchemaValidationError, error) {
+	parsedSchema := map[string]interface{}{}
+	err := json.Unmarshal(schemaData, &parsedSchema)
+	if err != nil {
+		return []SchemaValidationError{}, errors.New(fmt.Sprintf("Schema is not a JSON object: %s", err))
+	}
+
+	var parsed interface{}
+	err = json.Unmarshal(data, &parsed)
+	if err != nil {
+		return []SchemaValidationError{}, errors.New(fmt.Sprintf("Data is not valid JSON: %s", err))
+	}
+
+	schema := &jsonSchema{root: parsedSchema}
+	validationErrors := []SchemaValidationError{}
+	schema.validate(schema.root, parsed, "", 0, &validationErrors)
+	return validationErrors, nil
+}
+
+func (schema *jsonSchema) coerce(node map[string]interface{}, value interface{}, depth int) interface{} {
+	if _, ok := getSchemaStandardRef(node); ok || depth > maxSchemaDepth {
+		return value
+	}
+
+	node, err := schema.resolve(node)
+	if err != nil {
+		return value
+	}
+
+	types := schemaTypes(node)
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for key, property := range schemaProperties(node) {
+			propertyMap, ok := property.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			child, found := val[key]
+			if !found {
+				continue
+			}
+
+			// Fields the translation couldn't find are empty strings
+			if child == "" && !schema.allowsType(propertyMap, "string") {
+				delete(val, key)
+				continue
+			}
+
+			val[key] = schema.coerce(propertyMap, child, depth+1)
+		}
+
+		return val
+	case []interface{}:
+		if items, ok := node["items"].(map[string]interface{}); ok {
+			for index, item := range val {
+				val[index] = schema.coerce(items, item, depth+1)
+			}
+		}
+
+		return val
+	case string:
+		if len(types) > 0 && !schemaHasType(node, "string") {
+			trimmed := strings.TrimSpace(val)
+			for _, schemaType := range types {
+				switch schemaType {
+				case "integer":
+					if number, err := strconv.ParseFloat(trimmed, 64); err == nil && number == math.Trunc(number) {
+						return number
+					}
+				case "number":
+					if number, err := strconv.ParseFloat(trimmed, 64); err == nil {
+						return number
+					}
+				case "boolean":
+					if boolean, err := strconv.ParseBool(strings.ToLower(trimmed)); err == nil {
+						return boolean
+					}
+				case "null":
+					if len(trimmed) == 0 || trimmed == "null" {
+						return nil
+					}
+				case "array":
+					if len(trimmed) > 0 {
+						return []interface{}{schema.coerceItem(node, val, depth)}
+					}
+				}
+			}
+		}
+
+		return coerceEnum(node, coerceFormat(node, val))
+	case float64, bool:
+		if len(types) > 0 && schemaHasType(node, "array") && !schemaHasType(node, "number") && !schemaHasType(node, "integer") && !schemaHasType(node, "boolean") {
+			return []interface{}{schema.coerceItem(node, val, depth)}
+		}
+
+		if schemaHasType(node, "string") && !schemaHasType(node, "number") && !schemaHasType(node, "integer") && !schemaHasType(node, "boolean") {
+			if number, ok := val.(float64); ok {
+				return coerceEnum(node, strconv.FormatFloat(number, 'f', -1, 64))
+			}
+
+			return coerceEnum(node, fmt.Sprintf("%t", val))
+		}
+	}
+
+	return value
+}
+
+func (schema *jsonSchema) coerceItem(node map[string]interface{}, value interface{}, depth int) interface{} {
+	if items, ok := node["items"].(map[string]interface{}); ok {
+		return schema.coerce(items, value, depth+1)
+	}
+
+	return value
+}
+
+func (schema *jsonSchema) allowsType(node map[string]interface{}, schemaType string) bool {
+	if _, ok := getSchemaStandardRef(node); ok {
+		return false
+	}
+
+	resolved, err := schema.resolve(node)
+	if err != nil {
+		return true
+	}
+
+	types := schemaTypes(resolved)
+	return len(types) == 0 || schemaHasType(resolved, schemaType)
+}
+
+// Uses the casing of the schema for enum values only differing in case
+func coerceEnum(node map[string]interface{}, value string) string {
+	enum, ok := node["enum"].([]interface{})
+	if !ok {
+		return value
+	}
+
+	for _, allowed := range enum {
+		if allowedString, ok := allowed.(string); ok && allowedString == value {
+			return value
+		}
+	}
+
+	for _, allowed := range enum {
+		if allowedString, ok := allowed.(string); ok && strings.EqualFold(allowedString, strings.TrimSpace(value)) {
+			return allowedString
+		}
+	}
+
+	return value
+}
+
+// Common timestamp layouts converted to RFC 3339 for date-time and date formats
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.ANSIC,
+	time.UnixDate,
+	"2006-01-02",
+}
+
+// Shorter numbers are left as they are instead of read as a unix timestamp. 9 digits is from 1973.
+const minTimestampDigits = 9
+
+func coerceFormat(node map[string]interface{}, value string) string {
+	format, _ := node["format"].(string)
+	if format != "date-time" && format != "date" {
+		return value
+	}
+
+	trimmed := strings.TrimSpace(value)
+	var parsedTime time.Time
+	found := false
+	for _, layout := range timestampLayouts {
+		if foundTime, err := time.Parse(layout, trimmed); err == nil {
+			parsedTime = foundTime
+			found = true
+			break
+		}
+	}
+
+	// Unix timestamps in seconds or milliseconds
+	if !found {
+		if number, err := strconv.ParseInt(trimmed, 10, 64); err == nil && number > 0 && len(trimmed) >= minTimestampDigits {
+			if number > 100000000000 {
+				parsedTime = time.UnixMilli(number)
+			} else {
+				parsedTime = time.Unix(number, 0)
+			}
+
+			found = true
+		}
+	}
+
+	if !found {
+		return value
+	}
+
+	if format == "date" {
+		return parsedTime.UTC().Format("2006-01-02")
+	}
+
+	return parsedTime.UTC().Format(time.RFC3339)
+}
+
+func (schema *jsonSchema) validate(node map[string]interface{}, value interface{}, pointer string, depth int, validationErrors *[]SchemaValidationError) {
+	addError := func(keyword, message string) {
+		*validationErrors = append(*validationErrors, SchemaValidationError{
+			Pointer: pointer,
+			Keyword: keyword,
+			Message: message,
+		})
+	}
+
+	// Other standards are validated when they are translated
+	if _, ok := getSchemaStandardRef(node); ok {
+		return
+	}
+
+	if depth > maxSchemaDepth {
+		addError("$ref", "Schema is nested too deep")
+		return
+	}
+
+	node, err := schema.resolve(node)
+	if err != nil {
+		addError("$ref", err.Error())
+		return
+	}
+
+	types := schemaTypes(node)
+	if len(types) > 0 {
+		matched := false
+		for _, schemaType := range types {
+			if matchesSchemaType(value, schemaType) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			addError("type", fmt.Sprintf("Expected %s, got %s", strings.Join(types, " or "), jsonTypeName(value)))
+			return
+		}
+	}
+
+	if enum, ok := node["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			addError("enum", fmt.Sprintf("Value %v is not one of the allowed values", value))
+		}
+	}
+
+	if constValue, ok := node["const"]; ok && !jsonEqual(constValue, value) {
+		addError("const", fmt.Sprintf("Value should be %v", constValue))
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		subSchemas, ok := node[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+
+		matches := 0
+		subErrors := []SchemaValidationError{}
+		for _, subSchema := range subSchemas {
+			subMap, ok := subSchema.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			found := []SchemaValidationError{}
+			schema.validate(subMap, value, pointer, depth+1, &found)
+			if len(found) == 0 {
+				matches += 1
+			}
+
+			subErrors = append(subErrors, found...)
+		}
+
+		if keyword == "allOf" {
+			*validationErrors = append(*validationErrors, subErrors...)
+		} else if keyword == "anyOf" && matches == 0 {
+			addError(keyword, "Value doesn't match any of the schemas")
+		} else if keyword == "oneOf" && matches != 1 {
+			addError(keyword, fmt.Sprintf("Value should match exactly one schema, but matches %d", matches))
+		}
+	}
+
+	if notSchema, ok := node["not"]; ok && schema.matches(notSchema, value, depth+1) {
+		addError("not", "Value matches a schema it shouldn't")
+	}
+
+	if ifSchema, ok := node["if"]; ok {
+		branch := "else"
+		if schema.matches(ifSchema, value, depth+1) {
+			branch = "then"
+		}
+
+		if branchSchema, ok := node[branch]; ok {
+			schema.validateSubschema(branch, branchSchema, value, pointer, depth+1, validationErrors)
+		}
+	}
+
+	// Validating these would need a full 2020-12 implementation, so they are reported instead of passing silently
+	for _, keyword := range unsupportedSchemaKeywords {
+		if _, ok := node[keyword]; ok {
+			addError(keyword, fmt.Sprintf("The keyword %s is not supported", keyword))
+		}
+	}
+
+	if ref, ok := node["$ref"].(string); ok && strings.Contains(ref, "://") {
+		addError("$ref", fmt.Sprintf("Remote schema reference %s is not supported", ref))
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		schema.validateObject(node, val, pointer, depth, validationErrors)
+	case []interface{}:
+		if minItems, ok := node["minItems"].(float64); ok && float64(len(val)) < minItems {
+			addError("minItems", fmt.Sprintf("Should have at least %v items, has %d", minItems, len(val)))
+		}
+
+		if maxItems, ok := node["maxItems"].(float64); ok && float64(len(val)) > maxItems {
+			addError("maxItems", fmt.Sprintf("Should have at most %v items, has %d", maxItems, len(val)))
+		}
+
+		// Draft 7 tuples are a list in items, with additionalItems for the rest
+		prefixItems, _ := node["prefixItems"].([]interface{})
+		restKeyword := "items"
+		if tupleItems, ok := node["items"].([]interface{}); ok {
+			prefixItems = tupleItems
+			restKeyword = "additionalItems"
+		}
+
+		for index, item := range val {
+			itemPointer := fmt.Sprintf("%s/%d", pointer, index)
+			if index < len(prefixItems) {
+				schema.validateSubschema("prefixItems", prefixItems[index], item, itemPointer, depth+1, validationErrors)
+			} else if rest, ok := node[restKeyword]; ok {
+				schema.validateSubschema(restKeyword, rest, item, itemPointer, depth+1, validationErrors)
+			}
+		}
+
+		if unique, ok := node["uniqueItems"].(bool); ok && unique {
+		uniqueLoop:
+			for index := range val {
+				for previous := 0; previous < index; previous++ {
+					if jsonEqual(val[previous], val[index]) {
+						addError("uniqueItems", fmt.Sprintf("Item %d is the same as item %d", index, previous))
+						break uniqueLoop
+					}
+				}
+			}
+		}
+
+		if contains, ok := node["contains"]; ok {
+			matches := 0
+			for _, item := range val {
+				if schema.matches(contains, item, depth+1) {
+					matches += 1
+				}
+			}
+
+			minContains := float64(1)
+			if configured, ok := node["minContains"].(float64); ok {
+				minContains = configured
+			}
+
+			if float64(matches) < minContains {
+				addError("contains", fmt.Sprintf("Should have at least %v matching items, has %d", minContains, matches))
+			}
+
+			if maxContains, ok := node["maxContains"].(float64); ok && float64(matches) > maxContains {
+				addError("maxContains", fmt.Sprintf("Should have at most %v matching items, has %d", maxContains, matches))
+			}
+		}
+	case string:
+		length := float64(len([]rune(val)))
+		if minLength, ok := node["minLength"].(float64); ok && length < minLength {
+			addError("minLength", fmt.Sprintf("Should be at least %v characters", minLength))
+		}
+
+		if maxLength, ok := node["maxLength"].(float64); ok && length > maxLength {
+			addError("maxLength", fmt.Sprintf("Should be at most %v characters", maxLength))
+		}
+
+		if pattern, ok := node["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(val) {
+				addError("pattern", fmt.Sprintf("Doesn't match the pattern %s", pattern))
+			}
+		}
+
+		if format, ok := node["format"].(string); ok && !validFormat(format, val) {
+			addError("format", fmt.Sprintf("Not a valid %s", format))
+		}
+	case float64:
+		if minimum, ok := node["minimum"].(float64); ok && val < minimum {
+			addError("minimum", fmt.Sprintf("Should be at least %v", minimum))
+		}
+
+		if maximum, ok := node["maximum"].(float64); ok && val > maximum {
+			addError("maximum", fmt.Sprintf("Should be at most %v", maximum))
+		}
+
+		if minimum, ok := node["exclusiveMinimum"].(float64); ok && val <= minimum {
+			addError("exclusiveMinimum", fmt.Sprintf("Should be more than %v", minimum))
+		}
+
+		if maximum, ok := node["exclusiveMaximum"].(float64); ok && val >= maximum {
+			addError("exclusiveMaximum", fmt.Sprintf("Should be less than %v", maximum))
+		}
+
+		// With some room for floating point, as 0.3 / 0.1 isn't exactly 3
+		if multipleOf, ok := node["multipleOf"].(float64); ok && multipleOf > 0 {
+			quotient := val / multipleOf
+			if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				addError("multipleOf", fmt.Sprintf("Should be a multiple of %v", multipleOf))
+			}
+		}
+	}
+}
+
+// Keywords the validation doesn't handle
+var unsupportedSchemaKeywords = []string{"unevaluatedItems", "$dynamicRef", "$recursiveRef"}
+
+// Subschemas can be booleans as well, where false allows no value
+func (schema *jsonSchema) validateSubschema(keyword string, subSchema interface{}, value interface{}, pointer string, depth int, validationErrors *[]SchemaValidationError) {
+	switch sub := subSchema.(type) {
+	case bool:
+		if !sub {
+			*validationErrors = append(*validationErrors, SchemaValidationError{
+				Pointer: pointer,
+				Keyword: keyword,
+				Message: "No value is allowed here",
+			})
+		}
+	case map[string]interface{}:
+		schema.validate(sub, value, pointer, depth, validationErrors)
+	}
+}
+
+func (schema *jsonSchema) matches(subSchema interface{}, value interface{}, depth int) bool {
+	found := []SchemaValidationError{}
+	schema.validateSubschema("", subSchema, value, "", depth, &found)
+	return len(found) == 0
+}
+
+func matchingPatternProperties(node map[string]interface{}, key string) []interface{} {
+	patternProperties, ok := node["patternProperties"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	found := []interface{}{}
+	for pattern, subSchema := range patternProperties {
+		if re, err := regexp.Compile(pattern); err == nil && re.MatchString(key) {
+			found = append(found, subSchema)
+		}
+	}
+
+	return found
+}
+
+// Collects the fields of an object that a schema and the subschemas applying to it evaluate, for
+// unevaluatedProperties. Returns true when every field is evaluated, e.g. by additionalProperties.
+func (schema *jsonSchema) evaluatedProperties(node map[string]interface{}, value map[string]interface{}, depth int, evaluated map[string]bool) bool {
+	if depth > maxSchemaDepth {
+		return true
+	}
+
+	node, err := schema.resolve(node)
+	if err != nil {
+		return true
+	}
+
+	if _, ok := node["additionalProperties"]; ok {
+		return true
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	for key := range value {
+		if _, ok := properties[key]; ok || len(matchingPatternProperties(node, key)) > 0 {
+			evaluated[key] = true
+		}
+	}
+
+	subSchemas, _ := node["allOf"].([]interface{})
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		list, _ := node[keyword].([]interface{})
+		for _, subSchema := range list {
+			if schema.matches(subSchema, value, depth+1) {
+				subSchemas = append(subSchemas, subSchema)
+			}
+		}
+	}
+
+	if ifSchema, ok := node["if"]; ok {
+		if schema.matches(ifSchema, value, depth+1) {
+			subSchemas = append(subSchemas, ifSchema, node["then"])
+		} else {
+			subSchemas = append(subSchemas, node["else"])
+		}
+	}
+
+	if dependentSchemas, ok := node["dependentSchemas"].(map[string]interface{}); ok {
+		for key, subSchema := range dependentSchemas {
+			if _, found := value[key]; found {
+				subSchemas = append(subSchemas, subSchema)
+			}
+		}
+	}
+
+	for _, subSchema := range subSchemas {
+		subMap, ok := subSchema.(map[string]interface{})
+		if ok && schema.evaluatedProperties(subMap, value, depth+1, evaluated) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (schema *jsonSchema) validateObject(node map[string]interface{}, value map[string]interface{}, pointer string, depth int, validationErrors *[]SchemaValidationError) {
+	addError := func(pointer, keyword, message string) {
+		*validationErrors = append(*validationErrors, SchemaValidationError{
+			Pointer: pointer,
+			Keyword: keyword,
+			Message: message,
+		})
+	}
+
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, field := range required {
+			fieldName, ok := field.(string)
+			if !ok {
+				continue
+			}
+
+			if _, found := value[fieldName]; !found {
+				*validationErrors = append(*validationErrors, SchemaValidationError{
+					Pointer: fmt.Sprintf("%s/%s", pointer, escapeJSONPointer(fieldName)),
+					Keyword: "required",
+					Message: fmt.Sprintf("Required field '%s' is missing", fieldName),
+				})
+			}
+		}
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	keys := []string{}
+	for key := range value {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPointer := fmt.Sprintf("%s/%s", pointer, escapeJSONPointer(key))
+		if propertyNames, ok := node["propertyNames"]; ok && !schema.matches(propertyNames, key, depth+1) {
+			addError(childPointer, "propertyNames", fmt.Sprintf("Field name '%s' isn't allowed", key))
+		}
+
+		property, found := properties[key]
+		if found {
+			schema.validateSubschema("properties", property, value[key], childPointer, depth+1, validationErrors)
+		}
+
+		for _, patternSchema := range matchingPatternProperties(node, key) {
+			schema.validateSubschema("patternProperties", patternSchema, value[key], childPointer, depth+1, validationErrors)
+			found = true
+		}
+
+		// The original input kept with the translation isn't part of the standard
+		if found || (key == "unmapped_original" && len(pointer) == 0) {
+			continue
+		}
+
+		switch additional := node["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*validationErrors = append(*validationErrors, SchemaValidationError{
+					Pointer: childPointer,
+					Keyword: "additionalProperties",
+					Message: fmt.Sprintf("Field '%s' is not in the schema", key),
+				})
+			}
+		case map[string]interface{}:
+			schema.validate(additional, value[key], childPointer, depth+1, validationErrors)
+		}
+	}
+
+	if minProperties, ok := node["minProperties"].(float64); ok && float64(len(value)) < minProperties {
+		addError(pointer, "minProperties", fmt.Sprintf("Should have at least %v fields, has %d", minProperties, len(value)))
+	}
+
+	if maxProperties, ok := node["maxProperties"].(float64); ok && float64(len(value)) > maxProperties {
+		addError(pointer, "maxProperties", fmt.Sprintf("Should have at most %v fields, has %d", maxProperties, len(value)))
+	}
+
+	// Draft 7 has both in dependencies
+	dependentRequired, _ := node["dependentRequired"].(map[string]interface{})
+	dependentSchemas, _ := node["dependentSchemas"].(map[string]interface{})
+	if dependencies, ok := node["dependencies"].(map[string]interface{}); ok {
+		dependentRequired = copyMap(dependentRequired)
+		dependentSchemas = copyMap(dependentSchemas)
+		for key, dependency := range dependencies {
+			if _, ok := dependency.([]interface{}); ok {
+				dependentRequired[key] = dependency
+			} else {
+				dependentSchemas[key] = dependency
+			}
+		}
+	}
+
+	for _, key := range keys {
+		required, _ := dependentRequired[key].([]interface{})
+		for _, field := range required {
+			fieldName, ok := field.(string)
+			if _, found := value[fieldName]; ok && !found {
+				addError(fmt.Sprintf("%s/%s", pointer, escapeJSONPointer(fieldName)), "dependentRequired", fmt.Sprintf("Field '%s' is required with '%s'", fieldName, key))
+			}
+		}
+
+		if dependentSchema, ok := dependentSchemas[key]; ok {
+			schema.validateSubschema("dependentSchemas", dependentSchema, value, pointer, depth+1, validationErrors)
+		}
+	}
+
+	if unevaluated, ok := node["unevaluatedProperties"]; ok {
+		evaluated := map[string]bool{}
+		if schema.evaluatedProperties(node, value, depth, evaluated) {
+			return
+		}
+
+		for _, key := range keys {
+			if evaluated[key] || (key == "unmapped_original" && len(pointer) == 0) {
+				continue
+			}
+
+			schema.validateSubschema("unevaluatedProperties", unevaluated, value[key], fmt.Sprintf("%s/%s", pointer, escapeJSONPointer(key)), depth+1, validationErrors)
+		}
+	}
+}
+
+func matchesSchemaType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+
+	return true
+}
+
+func jsonTypeName(value interface{}) string {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonEqual(first, second interface{}) bool {
+	firstJson, err := json.Marshal(first)
+	if err != nil {
+		return false
+	}
+
+	secondJson, err := json.Marshal(second)
+	if err != nil {
+		return false
+	}
+
+	return string(firstJson) == string(secondJson)
+}
+
+var (
+	uuidPattern     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+)
+
+// Checks the formats with a clear definition. Others are only annotations.
+func validFormat(format, value string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, value)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	case "time":
+		_, err := time.Parse("15:04:05Z07:00", value)
+		return err == nil
+	case "email":
+		address, err := mail.ParseAddress(value)
+		return err == nil && address.Address == value
+	case "uri":
+		parsedUrl, err := url.Parse(value)
+		return err == nil && len(parsedUrl.Scheme) > 0
+	case "ipv4":
+		ip := net.ParseIP(value)
+		return ip != nil && ip.To4() != nil && !strings.Contains(value, ":")
+	case "ipv6":
+		ip := net.ParseIP(value)
+		return ip != nil && strings.Contains(value, ":")
+	case "uuid":
+		return uuidPattern.MatchString(value)
+	case "hostname":
+		return len(value) <= 253 && hostnamePattern.MatchString(value)
+	}
+
+	return true
+}
+
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// Turns a dot separated field into a JSON pointer
+func fieldPointer(field string) string {
+	return fmt.Sprintf("/%s", strings.Join(strings.Split(escapeJSONPointer(field), "."), "/"))
+}
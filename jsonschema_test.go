@@ -0,0 +1,208 @@
+package schemaless
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestIsJSONSchema(t *testing.T) {
+	tests := map[string]bool{
+		`{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "object", "properties": {"title": {"type": "string"}}}`: true,
+		`{"$schema": "http://json-schema.org/draft-07/schema#", "properties": {}}`:                                                   true,
+		`{"x-schemaless-schema": true, "type": "object", "properties": {"title": {"type": "string"}}}`:                               true,
+		`{"x-schemaless-schema": "yes", "type": "object", "properties": {}}`:                                                         false,
+
+		// Example-style standards with fields named type and properties
+		`{"type": "object", "properties": {"name": "The name of the property"}}`: false,
+		`{"title": "The title", "properties": {"color": "The color"}}`:           false,
+	}
+
+	for standard, expected := range tests {
+		_, isSchema := parseJSONSchema([]byte(standard))
+		if isSchema != expected {
+			t.Errorf("%s: got %t, expected %t", standard, isSchema, expected)
+		}
+	}
+
+	// Left as-is when it isn't a schema
+	standard := []byte(`{"type": "object", "properties": {"name": "The name of the property"}}`)
+	converted, err := ConvertStandardFormat(standard)
+	if err != nil || string(converted) != string(standard) {
+		t.Errorf("expected the example-style standard to be kept, got %s (%v)", converted, err)
+	}
+}
+
+func TestCoerceFormat(t *testing.T) {
+	dateTime := map[string]interface{}{"type": "string", "format": "date-time"}
+	date := map[string]interface{}{"type": "string", "format": "date"}
+
+	tests := []struct {
+		node     map[string]interface{}
+		value    string
+		expected string
+	}{
+		{dateTime, "2024-03-05T10:20:30Z", "2024-03-05T10:20:30Z"},
+		{dateTime, "2024-03-05 10:20:30", "2024-03-05T10:20:30Z"},
+		{dateTime, "2024-03-05T12:20:30+02:00", "2024-03-05T10:20:30Z"},
+		{dateTime, "1709634030", "2024-03-05T10:20:30Z"},
+		{dateTime, "1709634030000", "2024-03-05T10:20:30Z"},
+		{date, "2024-03-05T23:20:30Z", "2024-03-05"},
+
+		// Ambiguous between day and month first, so it isn't guessed
+		{dateTime, "03/05/2024 10:20:30", "03/05/2024 10:20:30"},
+
+		// Too short to be a timestamp, e.g. an ID or a count
+		{dateTime, "42", "42"},
+		{dateTime, "12345678", "12345678"},
+		{dateTime, "123456789", "1973-11-29T21:33:09Z"},
+		{dateTime, "-1709634030", "-1709634030"},
+
+		{map[string]interface{}{"type": "string"}, "1709634030", "1709634030"},
+	}
+
+	for _, test := range tests {
+		if coerced := coerceFormat(test.node, test.value); coerced != test.expected {
+			t.Errorf("%s as %v: got %s, expected %s", test.value, test.node["format"], coerced, test.expected)
+		}
+	}
+}
+
+func TestCoerceAndValidate(t *testing.T) {
+	schemaData := []byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"required": ["title", "severity"],
+		"properties": {
+			"title": {"type": "string"},
+			"count": {"type": "integer"},
+			"severity": {"type": "string", "enum": ["Low", "High"]},
+			"created": {"type": "string", "format": "date-time"},
+			"email": {"type": "string", "format": "email"}
+		}
+	}`)
+
+	schema, ok := parseJSONSchema(schemaData)
+	if !ok {
+		t.Fatal("expected a JSON Schema")
+	}
+
+	coerced, validationErrors := schema.coerceAndValidate([]byte(`{"title": "Disk full", "count": "42", "severity": "high", "created": "1709634030", "email": "not an email"}`))
+
+	parsed := map[string]interface{}{}
+	err := json.Unmarshal(coerced, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["count"] != float64(42) || parsed["severity"] != "High" || parsed["created"] != "2024-03-05T10:20:30Z" {
+		t.Errorf("unexpected coercion: %s", coerced)
+	}
+
+	if len(validationErrors) != 1 || validationErrors[0].Pointer != "/email" || validationErrors[0].Keyword != "format" {
+		t.Errorf("expected a format error for /email, got %v", validationErrors)
+	}
+
+	validationErrors, err = ValidateJSONSchema(schemaData, []byte(`{"title": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := []string{}
+	for _, validationError := range validationErrors {
+		found = append(found, validationError.Keyword)
+	}
+
+	if strings.Join(found, ",") != "required,type" && strings.Join(found, ",") != "type,required" {
+		t.Errorf("expected the missing severity and the type of title, got %v", validationErrors)
+	}
+}
+
+func TestValidateJSONSchemaKeywords(t *testing.T) {
+	schemaData := []byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$defs": {
+			"user": {"type": "object", "required": ["email"], "properties": {"email": {"type": "string", "format": "email"}}}
+		},
+		"type": "object",
+		"properties": {
+			"assignee": {"$ref": "#/$defs/user"},
+			"owner": {"allOf": [{"$ref": "#/$defs/user"}, {"required": ["name"]}]},
+			"status": {"oneOf": [{"type": "string"}, {"type": "integer"}]},
+			"port": {"oneOf": [{"type": "integer", "minimum": 1}, {"type": "integer", "maximum": 100}]},
+			"hosts": {"type": "array", "items": {"type": "object", "properties": {"ip": {"type": "string", "format": "ipv4"}}, "additionalProperties": false}},
+			"score": {"type": "number", "multipleOf": 0.1, "not": {"const": 0.5}},
+			"tags": {"type": "array", "uniqueItems": true, "contains": {"const": "alert"}},
+			"pair": {"type": "array", "prefixItems": [{"type": "string"}, {"type": "integer"}], "items": false},
+			"labels": {"type": "object", "patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false, "propertyNames": {"maxLength": 5}, "maxProperties": 2},
+			"kind": {"type": "string"},
+			"url": {"type": "string"}
+		},
+		"if": {"properties": {"kind": {"const": "web"}}, "required": ["kind"]},
+		"then": {"required": ["url"]},
+		"dependentRequired": {"port": ["hosts"]},
+		"additionalProperties": false
+	}`)
+
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{`{"assignee": {"email": "bob@example.com"}, "owner": {"email": "bob@example.com", "name": "Bob"}, "status": "open", "hosts": [{"ip": "10.0.0.1"}], "port": 443, "score": 0.3, "tags": ["alert", "disk"], "pair": ["a", 1], "labels": {"x-env": "prod"}}`, ""},
+		{`{"assignee": {"email": "bob"}}`, "/assignee/email format"},
+		{`{"assignee": {}}`, "/assignee/email required"},
+		{`{"owner": {"email": "bob@example.com"}}`, "/owner/name required"},
+		{`{"status": true}`, "/status oneOf"},
+		{`{"port": 50, "hosts": []}`, "/port oneOf"},
+		{`{"hosts": [{"ip": "10.0.0.1"}, {"ip": "300.0.0.1", "name": "web"}]}`, "/hosts/1/ip format,/hosts/1/name additionalProperties"},
+		{`{"score": 0.25}`, "/score multipleOf"},
+		{`{"score": 0.5}`, "/score not"},
+		{`{"tags": ["disk", "disk"]}`, "/tags uniqueItems,/tags contains"},
+		{`{"pair": [1, 2, 3]}`, "/pair/0 type,/pair/2 items"},
+		{`{"labels": {"x-env": 5, "other": "a", "x-long": "b"}}`, "/labels/other additionalProperties,/labels/x-env type,/labels/x-long propertyNames,/labels maxProperties"},
+		{`{"kind": "web"}`, "/url required"},
+		{`{"port": 200}`, "/hosts dependentRequired"},
+		{`{"extra": "x"}`, "/extra additionalProperties"},
+	}
+
+	for _, test := range tests {
+		validationErrors, err := ValidateJSONSchema(schemaData, []byte(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := []string{}
+		for _, validationError := range validationErrors {
+			found = append(found, validationError.Pointer+" "+validationError.Keyword)
+		}
+
+		if strings.Join(found, ",") != test.expected {
+			t.Errorf("%s: expected %q, got %v", test.data, test.expected, validationErrors)
+		}
+	}
+}
+
+func TestValidateJSONSchemaUnevaluatedProperties(t *testing.T) {
+	schemaData := []byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {"title": {"type": "string"}},
+		"allOf": [{"properties": {"severity": {"type": "string"}}}],
+		"unevaluatedProperties": false
+	}`)
+
+	validationErrors, err := ValidateJSONSchema(schemaData, []byte(`{"title": "Disk full", "severity": "High", "host": "web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(validationErrors) != 1 || validationErrors[0].Pointer != "/host" || validationErrors[0].Keyword != "unevaluatedProperties" {
+		t.Errorf("expected only /host to be unevaluated, got %v", validationErrors)
+	}
+
+	// Keywords it can't validate are reported instead of passing
+	validationErrors, err = ValidateJSONSchema([]byte(`{"type": "array", "unevaluatedItems": false}`), []byte(`[1]`))
+	if err != nil || len(validationErrors) != 1 || validationErrors[0].Keyword != "unevaluatedItems" {
+		t.Errorf("expected unevaluatedItems to be reported, got %v (%v)", validationErrors, err)
+	}
+}
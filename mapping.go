@@ -0,0 +1,409 @@
+package schemaless
+
+/*
+Handles the metadata stored alongside mappings in translation_output, such as human-authored or locked fields, and the audit trail of changes to them in translation_log.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Reserved key in stored mappings. It holds the mapping metadata and is never part of the translation itself.
+const mappingMetadataKey = "_schemaless"
+
+// The max amount of audit entries kept per mapping. The oldest are dropped first.
+var maxMappingAudit = 1000
+
+func init() {
+	if tok := os.Getenv("MAX_MAPPING_AUDIT"); tok != "" {
+		if t, err := strconv.Atoi(tok); err == nil && t > 0 {
+			maxMappingAudit = t
+		}
+	}
+}
+
+type MappingField struct {
+	// Set when a human wrote the value. Regeneration keeps the value.
+	HumanAuthored bool `json:"human_authored,omitempty"`
+
+	// Set when the field should never be changed automatically
+	Locked bool `json:"locked,omitempty"`
+
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+}
+
+type MappingAuditEntry struct {
+	Field     string      `json:"field"`
+	Action    string      `json:"action"`
+	User      string      `json:"user"`
+	OldValue  interface{} `json:"old_value,omitempty"`
+	NewValue  interface{} `json:"new_value,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+type MappingMetadata struct {
+	// The standard the mapping translates to. Mappings saved before it was kept, or without knowing it, have it in their key only.
+	Standard string `json:"standard,omitempty"`
+
+	// The filename_prefix the mapping was saved with, if any
+	Prefix string `json:"prefix,omitempty"`
+
+	Fields map[string]MappingField `json:"fields,omitempty"`
+
+	// New entries are moved to the audit log of the mapping when it is saved, see ListMappingAudit
+	Audit []MappingAuditEntry `json:"audit,omitempty"`
+
+	// The current version. Earlier mappings listed every version here as well, which are moved to the mapping log when it is saved.
+	Version  MappingVersion   `json:"version"`
+	Versions []MappingVersion `json:"versions,omitempty"`
+
+	// The first version, kept here as well so listing mappings doesn't read their logs. Mappings saved before it
+	// was kept get it on their next save.
+	Created MappingVersion `json:"created,omitzero"`
+
+	// Set when a standard the mapping depends on changed after it was made. Cleared by the next version of the mapping.
+	Stale *MappingStaleness `json:"stale,omitempty"`
+}
+
+type MappingStaleness struct {
+	Standard        string `json:"standard"`
+	StandardVersion string `json:"standard_version,omitempty"`
+	Reason          string `json:"reason"`
+	Timestamp       int64  `json:"timestamp"`
+}
+
+// Gets the standard a mapping translates to, from its metadata or else its key
+func (meta MappingMetadata) standard(keyTokenFile string) string {
+	if len(meta.Standard) > 0 {
+		return meta.Standard
+	}
+
+	return MappingKeyStandard(keyTokenFile)
+}
+
+// The fields that regeneration, repair and merges should keep as-is
+func (meta MappingMetadata) PinnedFields() []string {
+	pinned := []string{}
+	for field, fieldMeta := range meta.Fields {
+		if fieldMeta.Locked || fieldMeta.HumanAuthored {
+			pinned = append(pinned, field)
+		}
+	}
+
+	sort.Strings(pinned)
+	return pinned
+}
+
+func (meta MappingMetadata) isEmpty() bool {
+	return len(meta.Fields) == 0 && len(meta.Audit) == 0 && len(meta.Version.ID) == 0 && len(meta.Versions) == 0 && meta.Stale == nil
+}
+
+// Splits a stored mapping into the mapping itself and its metadata
+func ParseStoredMapping(data []byte) (map[string]interface{}, MappingMetadata, error) {
+	meta := MappingMetadata{}
+	mapping := map[string]interface{}{}
+
+	err := json.Unmarshal([]byte(FixTranslationStructure(string(data))), &mapping)
+	if err != nil {
+		return mapping, meta, err
+	}
+
+	rawMeta, ok := mapping[mappingMetadataKey]
+	if !ok {
+		return mapping, meta, nil
+	}
+
+	delete(mapping, mappingMetadataKey)
+
+	marshalled, err := json.Marshal(rawMeta)
+	if err != nil {
+		return mapping, meta, err
+	}
+
+	err = json.Unmarshal(marshalled, &meta)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed parsing mapping metadata. Ignoring it: %s", err)
+		return mapping, MappingMetadata{}, nil
+	}
+
+	return mapping, meta, nil
+}
+
+// Removes the metadata from a stored mapping, leaving only what is used for translation.
+// Data that isn't a JSON object is returned as-is.
+func stripMappingMetadata(data []byte) []byte {
+	if !bytes.Contains(data, []byte(mappingMetadataKey)) {
+		return data
+	}
+
+	mapping, _, err := ParseStoredMapping(data)
+	if err != nil {
+		return data
+	}
+
+	marshalled, err := json.MarshalIndent(mapping, "", "\t")
+	if err != nil {
+		return data
+	}
+
+	return marshalled
+}
+
+// Builds the stored format of a mapping with its metadata
+func buildStoredMapping(mapping map[string]interface{}, meta MappingMetadata) ([]byte, error) {
+	stored := make(map[string]interface{}, len(mapping)+1)
+	for k, v := range mapping {
+		stored[k] = v
+	}
+
+	if !meta.isEmpty() {
+		stored[mappingMetadataKey] = meta
+	}
+
+	return json.MarshalIndent(stored, "", "\t")
+}
+
+// Merges a newly generated mapping into the existing one. Pinned fields keep their existing value,
+// and every other changed field is added to the audit trail.
+func mergeStoredMapping(existing, generated []byte, user string) ([]byte, error) {
+	newMapping, newMeta, err := ParseStoredMapping(generated)
+	if err != nil {
+		return generated, err
+	}
+
+	oldMapping, meta, err := ParseStoredMapping(existing)
+	if err != nil {
+		// Nothing valid to keep
+		return buildStoredMapping(newMapping, newMeta)
+	}
+
+	// Metadata sent in with the new mapping is added on top
+	if meta.Fields == nil {
+		meta.Fields = map[string]MappingField{}
+	}
+
+	for field, fieldMeta := range newMeta.Fields {
+		meta.Fields[field] = fieldMeta
+	}
+
+	meta.Audit = append(meta.Audit, newMeta.Audit...)
+
+	// Generated from the current standard
+	meta.Stale = nil
+
+	pinned := meta.PinnedFields()
+	for _, field := range pinned {
+		if value, found := getMapPath(oldMapping, field); found {
+			setMapPath(newMapping, field, value)
+		}
+	}
+
+	oldFlat := flattenMapping(oldMapping)
+	newFlat := flattenMapping(newMapping)
+	changed := []string{}
+	for field, newValue := range newFlat {
+		if oldValue, ok := oldFlat[field]; !ok || !reflect.DeepEqual(oldValue, newValue) {
+			changed = append(changed, field)
+		}
+	}
+
+	sort.Strings(changed)
+	timestamp := time.Now().Unix()
+	for _, field := range changed {
+		if isPinnedField(field, pinned) {
+			continue
+		}
+
+		meta.Audit = append(meta.Audit, MappingAuditEntry{
+			Field:     field,
+			Action:    "regenerate",
+			User:      user,
+			OldValue:  oldFlat[field],
+			NewValue:  newFlat[field],
+			Timestamp: timestamp,
+		})
+	}
+
+	return buildStoredMapping(newMapping, meta)
+}
+
+// Returns the leaf values of a mapping by their field path (see splitFieldPath)
+func flattenMapping(mapping map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	flattenMappingInto(flat, mapping, []string{})
+	return flat
+}
+
+func flattenMappingInto(flat, mapping map[string]interface{}, prefix []string) {
+	for key, value := range mapping {
+		keys := append(prefix[:len(prefix):len(prefix)], key)
+		if subMap, ok := value.(map[string]interface{}); ok && len(subMap) > 0 {
+			flattenMappingInto(flat, subMap, keys)
+			continue
+		}
+
+		flat[joinFieldPath(keys)] = value
+	}
+}
+
+// Sets the value of a single field in a stored mapping as human-authored, optionally locking it.
+// The field is a dot separated path, or a JSON Pointer such as /user/first.name for keys with dots in them.
+// The change is added to the audit trail of the mapping.
+func EditMappingField(ctx context.Context, keyTokenFile, field string, value interface{}, user string, lock bool, shuffleConfig ShuffleConfig) error {
+	return updateMappingField(ctx, keyTokenFile, field, user, shuffleConfig, func(mapping map[string]interface{}, fieldMeta *MappingField) (string, interface{}, error) {
+		setMapPath(mapping, field, value)
+		fieldMeta.HumanAuthored = true
+		if lock {
+			fieldMeta.Locked = true
+		}
+
+		return "edit", value, nil
+	})
+}
+
+// Locks or unlocks a field in a stored mapping without changing its value
+func LockMappingField(ctx context.Context, keyTokenFile, field, user string, locked bool, shuffleConfig ShuffleConfig) error {
+	return updateMappingField(ctx, keyTokenFile, field, user, shuffleConfig, func(mapping map[string]interface{}, fieldMeta *MappingField) (string, interface{}, error) {
+		value, found := getMapPath(mapping, field)
+		if !found {
+			return "", nil, errors.New(fmt.Sprintf("Field '%s' not found in mapping", field))
+		}
+
+		fieldMeta.Locked = locked
+		if locked {
+			return "lock", value, nil
+		}
+
+		// Unlocking gives the field back to regeneration
+		fieldMeta.HumanAuthored = false
+		return "unlock", value, nil
+	})
+}
+
+func updateMappingField(ctx context.Context, keyTokenFile, field, user string, shuffleConfig ShuffleConfig, update func(map[string]interface{}, *MappingField) (string, interface{}, error)) error {
+	keys := splitFieldPath(field)
+	if len(field) == 0 || keys[0] == mappingMetadataKey {
+		return errors.New(fmt.Sprintf("Invalid mapping field '%s'", field))
+	}
+
+	// The same field always has the same metadata, however its path was written
+	field = joinFieldPath(keys)
+
+	_, err := commitMapping(ctx, keyTokenFile, "", fmt.Sprintf("human:%s", user), shuffleConfig, func(existing []byte) ([]byte, error) {
+		if len(existing) == 0 {
+			return existing, fmt.Errorf("Failed loading mapping %s: %w", keyTokenFile, ErrNotFound)
+		}
+
+		mapping, meta, err := ParseStoredMapping(existing)
+		if err != nil {
+			return existing, errors.New(fmt.Sprintf("Failed parsing mapping %s: %s", keyTokenFile, err))
+		}
+
+		if meta.Fields == nil {
+			meta.Fields = map[string]MappingField{}
+		}
+
+		oldValue, _ := getMapPath(mapping, field)
+		fieldMeta := meta.Fields[field]
+		action, newValue, err := update(mapping, &fieldMeta)
+		if err != nil {
+			return existing, err
+		}
+
+		timestamp := time.Now().Unix()
+		fieldMeta.UpdatedBy = user
+		fieldMeta.UpdatedAt = timestamp
+		meta.Fields[field] = fieldMeta
+		meta.Audit = append(meta.Audit, MappingAuditEntry{
+			Field:     field,
+			Action:    action,
+			User:      user,
+			OldValue:  oldValue,
+			NewValue:  newValue,
+			Timestamp: timestamp,
+		})
+
+		return buildStoredMapping(mapping, meta)
+	})
+
+	return err
+}
+
+// The versions and audit trail of a mapping, stored in NamespaceMappingLogs under the key of the mapping
+type mappingLog struct {
+	Versions []MappingVersion    `json:"versions,omitempty"`
+	Audit    []MappingAuditEntry `json:"audit,omitempty"`
+}
+
+func getMappingLog(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) (mappingLog, error) {
+	logged := mappingLog{}
+	data, err := GetStore(shuffleConfig).Get(ctx, NamespaceMappingLogs, keyTokenFile)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return logged, nil
+		}
+
+		return logged, err
+	}
+
+	err = json.Unmarshal(data, &logged)
+	if err != nil {
+		return logged, errors.New(fmt.Sprintf("Invalid log for mapping %s: %s", keyTokenFile, err))
+	}
+
+	return logged, nil
+}
+
+// Adds versions and audit entries to the log of a mapping. Versions already in it are skipped,
+// and only the latest maxMappingAudit (MAX_MAPPING_AUDIT) audit entries are kept.
+func appendMappingLog(ctx context.Context, keyTokenFile string, versions []MappingVersion, audit []MappingAuditEntry, shuffleConfig ShuffleConfig) error {
+	if len(versions) == 0 && len(audit) == 0 {
+		return nil
+	}
+
+	return updateStore(ctx, GetStore(shuffleConfig), NamespaceMappingLogs, keyTokenFile, func(existing []byte) ([]byte, error) {
+		logged := mappingLog{}
+		if len(existing) > 0 {
+			err := json.Unmarshal(existing, &logged)
+			if err != nil {
+				return existing, errors.New(fmt.Sprintf("Invalid log for mapping %s: %s", keyTokenFile, err))
+			}
+		}
+
+		logged.Versions = mergeMappingVersions(logged.Versions, versions)
+		logged.Audit = append(logged.Audit, audit...)
+		if len(logged.Audit) > maxMappingAudit {
+			logged.Audit = logged.Audit[len(logged.Audit)-maxMappingAudit:]
+		}
+
+		return json.MarshalIndent(logged, "", "\t")
+	})
+}
+
+// Lists the changes made to the fields of a mapping, oldest first
+func ListMappingAudit(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) ([]MappingAuditEntry, error) {
+	existing, _, err := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return []MappingAuditEntry{}, err
+	}
+
+	logged, err := getMappingLog(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return []MappingAuditEntry{}, err
+	}
+
+	// Mappings saved before the mapping log existed keep their entries until the next save
+	_, meta, _ := ParseStoredMapping(existing)
+	return append(meta.Audit, logged.Audit...), nil
+}
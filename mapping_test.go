@@ -0,0 +1,264 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFieldPaths(t *testing.T) {
+	tests := []struct {
+		path   string
+		keys   []string
+		joined string
+	}{
+		{"title", []string{"title"}, "title"},
+		{"user.name", []string{"user", "name"}, "user.name"},
+		{"/user/name", []string{"user", "name"}, "user.name"},
+		{"/user/first.name", []string{"user", "first.name"}, "/user/first.name"},
+		{"/a~1b/c~0d", []string{"a/b", "c~d"}, "a/b.c~d"},
+		{"/user/", []string{"user", ""}, "/user/"},
+		{"/~1start.", []string{"/start."}, "/~1start."},
+		{"/~1start", []string{"/start"}, "/~1start"},
+	}
+
+	for _, test := range tests {
+		keys := splitFieldPath(test.path)
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("split %#v: got %#v, expected %#v", test.path, keys, test.keys)
+		}
+
+		joined := joinFieldPath(keys)
+		if joined != test.joined {
+			t.Errorf("join %#v: got %#v, expected %#v", keys, joined, test.joined)
+		}
+
+		if !reflect.DeepEqual(splitFieldPath(joined), keys) {
+			t.Errorf("%#v doesn't split back into %#v", joined, keys)
+		}
+	}
+
+	if !isPinnedField("/user/first.name", []string{"user"}) {
+		t.Error("a field below a pinned field should be pinned")
+	}
+
+	if isPinnedField("user.first", []string{"/user/first.name"}) {
+		t.Error("user.first isn't below /user/first.name")
+	}
+}
+
+func TestMergeStoredMappingKeepsPinnedFields(t *testing.T) {
+	existing := []byte(`{"title": "$subject", "user": {"first.name": "$owner"}, "_schemaless": {"fields": {"/user/first.name": {"locked": true}}}}`)
+	generated := []byte(`{"title": "$summary", "user": {"first.name": "$assignee"}}`)
+
+	merged, err := mergeStoredMapping(existing, generated, "llm:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping, meta, err := ParseStoredMapping(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := getMapPath(mapping, "/user/first.name"); value != "$owner" {
+		t.Errorf("the locked field was changed to %v", value)
+	}
+
+	if mapping["title"] != "$summary" {
+		t.Errorf("title wasn't regenerated: %v", mapping["title"])
+	}
+
+	if len(meta.Audit) != 1 || meta.Audit[0].Field != "title" {
+		t.Errorf("expected only title in the audit trail, got %+v", meta.Audit)
+	}
+}
+
+func TestEditMappingFieldAuditLog(t *testing.T) {
+	useTestStore(t)
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Disk full", "owner": {"name": "alice"}}`)
+	keyTokenFile := saveTestMapping(t, "ticket", input, `{"title": "$subject", "user": {"first.name": ""}}`)
+
+	err := EditMappingField(ctx, keyTokenFile, "/user/first.name", "$owner.name", "bob", true, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = LockMappingField(ctx, keyTokenFile, "title", "bob", true, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = LockMappingField(ctx, keyTokenFile, "user.first.name", "bob", true, ShuffleConfig{})
+	if err == nil {
+		t.Error("user.first.name should not be found, as first.name is a single key")
+	}
+
+	err = EditMappingField(ctx, keyTokenFile, "_schemaless.fields", "", "bob", false, ShuffleConfig{})
+	if err == nil {
+		t.Error("the metadata key should not be editable")
+	}
+
+	err = EditMappingField(ctx, "ticket-missing", "title", "$subject", "bob", false, ShuffleConfig{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing mapping, got %v", err)
+	}
+
+	stored, _, err := GetExistingStructureContext(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping, meta, err := ParseStoredMapping(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := getMapPath(mapping, "/user/first.name"); value != "$owner.name" {
+		t.Errorf("the field wasn't edited: %v", value)
+	}
+
+	if pinned := meta.PinnedFields(); strings.Join(pinned, ",") != "/user/first.name,title" {
+		t.Errorf("unexpected pinned fields %v", pinned)
+	}
+
+	if len(meta.Audit) > 0 || strings.Contains(string(stored), `"audit"`) {
+		t.Errorf("the audit trail should not be in the stored mapping: %s", stored)
+	}
+
+	audit, err := ListMappingAudit(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := []string{}
+	for _, entry := range audit {
+		actions = append(actions, entry.Action+":"+entry.Field)
+	}
+
+	if strings.Join(actions, ",") != "edit:/user/first.name,lock:title" {
+		t.Errorf("unexpected audit trail %v", actions)
+	}
+}
+
+func TestMappingAuditLogIsCapped(t *testing.T) {
+	store := useTestStore(t)
+
+	maxAudit := maxMappingAudit
+	maxMappingAudit = 3
+	t.Cleanup(func() {
+		maxMappingAudit = maxAudit
+	})
+
+	ctx := context.Background()
+	keyTokenFile := saveTestMapping(t, "ticket", []byte(`{"subject": ""}`), `{"title": "$subject"}`)
+
+	// Entries from before the audit log are moved to it on the next save
+	legacy := []byte(`{"title": "$subject", "_schemaless": {"audit": [{"field": "title", "action": "edit", "user": "old", "timestamp": 1}]}}`)
+	err := store.Put(ctx, NamespaceMappings, keyTokenFile, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"$a", "$b", "$c"} {
+		err = EditMappingField(ctx, keyTokenFile, "title", value, "bob", false, ShuffleConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	audit, err := ListMappingAudit(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(audit) != 3 || audit[0].NewValue != "$a" || audit[2].NewValue != "$c" {
+		t.Errorf("expected the latest 3 entries, got %+v", audit)
+	}
+}
+
+func TestMappingMetadataNotInOutput(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket":  `{"title": "The title", "assignee": {"$ref": "user"}}`,
+		"user":    `{"name": "The name"}`,
+		"tickets": `[ticket]`,
+	})
+
+	useFakeLLM(t, func(system, user string) string {
+		return `{}`
+	})
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Disk full", "owner": {"login": "bob"}}`)
+	ticketKey := saveTestMapping(t, "ticket", input, `{"title": "$subject", "assignee": "$owner"}`)
+	userKey := saveTestMapping(t, "user", []byte(`{"login": "bob"}`), `{"name": "$login"}`)
+
+	// Both mappings carry metadata
+	err := EditMappingField(ctx, ticketKey, "title", "$subject", "alice", true, ShuffleConfig{})
+	if err == nil {
+		err = EditMappingField(ctx, userKey, "name", "$login", "alice", true, ShuffleConfig{})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _, err := GetExistingStructureContext(ctx, ticketKey, ShuffleConfig{})
+	if err != nil || !strings.Contains(string(stored), mappingMetadataKey) {
+		t.Fatalf("expected metadata in the stored mapping, got %s (%v)", stored, err)
+	}
+
+	outputs := map[string][]byte{}
+	translate := func(name, standard string, input []byte) {
+		output, _, err := Translate(ctx, standard, input)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		outputs[name] = output
+	}
+
+	translate("stored", "ticket", input)
+	translate("plan", "ticket", input)
+	translate("list", "tickets", []byte(`{"items": [{"subject": "Disk full", "owner": {"login": "bob"}}]}`))
+
+	preview, err := PreviewTranslate(ctx, "ticket", input, PreviewOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs["preview"] = preview.Output
+
+	SetMappingPlans(false)
+	t.Cleanup(func() {
+		SetMappingPlans(true)
+	})
+
+	translate("interpreted", "ticket", input)
+
+	// Given the stored mapping as-is
+	mapping, _, _ := ParseStoredMapping(stored)
+	mapping[mappingMetadataKey] = map[string]interface{}{"fields": map[string]interface{}{"title": map[string]interface{}{"locked": true}}}
+	outputs["runJsonTranslation"], _, err = runJsonTranslation(ctx, input, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs["compiled"], _ = json.Marshal(compileMappingPlan(mapping, nil).run(ctx, map[string]interface{}{"subject": "Disk full"}, input, false))
+
+	for name, output := range outputs {
+		if strings.Contains(string(output), mappingMetadataKey) || !strings.Contains(string(output), "Disk full") {
+			t.Errorf("%s: expected the translation without metadata, got %s", name, output)
+		}
+	}
+
+	if !strings.Contains(string(outputs["stored"]), `"bob"`) {
+		t.Errorf("expected the referenced user to be translated, got %s", outputs["stored"])
+	}
+}
@@ -0,0 +1,304 @@
+package schemaless
+
+/*
+Lists, inspects, deletes and regenerates the stored mappings, named <standard>-<md5 of the input structure>.
+Each mapping comes with the input structure it was made from, with the values removed, and how often it was used.
+*/
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+type MappingInfo struct {
+	Key      string `json:"key"`
+	Standard string `json:"standard"`
+	Prefix   string `json:"prefix,omitempty"`
+
+	// The current version, and the first version with when and how the mapping was made
+	Version MappingVersion `json:"version"`
+	Created MappingVersion `json:"created"`
+
+	// How many translations used the mapping. Always 0 for stores that don't count usage.
+	Hits int64 `json:"hits"`
+
+	Stale  *MappingStaleness `json:"stale,omitempty"`
+	Pinned []string          `json:"pinned,omitempty"`
+}
+
+type MappingDetails struct {
+	MappingInfo
+
+	Mapping  map[string]interface{} `json:"mapping"`
+	Metadata MappingMetadata        `json:"metadata"`
+
+	// The input structure the mapping was made from, with the values removed
+	Input interface{} `json:"input,omitempty"`
+}
+
+type llmOptionsKey struct{}
+
+// Overrides for the LLM calls made with a context
+type llmOptions struct {
+	Model string
+
+	// Asks the LLM again instead of using a cached answer
+	SkipCache bool
+}
+
+func withLLMOptions(ctx context.Context, options llmOptions) context.Context {
+	return context.WithValue(ctx, llmOptionsKey{}, options)
+}
+
+func getLLMOptions(ctx context.Context) llmOptions {
+	options, _ := ctx.Value(llmOptionsKey{}).(llmOptions)
+	if len(options.Model) == 0 {
+		options.Model = chosenModel
+	}
+
+	return options
+}
+
+// The model to use for LLM calls made with the context
+func llmModel(ctx context.Context) string {
+	return getLLMOptions(ctx).Model
+}
+
+// Gets the standard a mapping was made for from its key. Mappings saved with a filename prefix keep it,
+// use the standard in the metadata of the mapping instead, as GetMapping does.
+func MappingKeyStandard(keyTokenFile string) string {
+	// Partial mappings of a base standard are listed with the base
+	if partialIndex := strings.LastIndex(keyTokenFile, partialMappingSeparator); partialIndex > 0 {
+		keyTokenFile = keyTokenFile[:partialIndex]
+	}
+
+	index := strings.LastIndex(keyTokenFile, "-")
+	if index <= 0 || len(keyTokenFile)-index-1 != 32 {
+		return keyTokenFile
+	}
+
+	return strings.ReplaceAll(keyTokenFile[:index], "~", "/")
+}
+
+// Gets the filename prefix a mapping for a standard was saved with from its key, <prefix><standard>-<hash>
+func mappingKeyPrefix(keyTokenFile, inputStandard string) string {
+	if partialIndex := strings.LastIndex(keyTokenFile, partialMappingSeparator); partialIndex > 0 {
+		keyTokenFile = keyTokenFile[:partialIndex]
+	}
+
+	index := strings.LastIndex(keyTokenFile, "-")
+	if index <= 0 {
+		return ""
+	}
+
+	prefix, found := strings.CutSuffix(keyTokenFile[:index], standardFileKey(inputStandard))
+	if !found {
+		return ""
+	}
+
+	return prefix
+}
+
+// Gets the key of the mapping an input is translated to a standard with, the same way Translate does
+func MappingFile(inputStandard string, inputValue []byte) (string, error) {
+	startValue := strings.TrimSpace(string(inputValue))
+	if !strings.HasPrefix(startValue, "{") || !strings.HasSuffix(startValue, "}") {
+		output, err := YamlConvert(startValue)
+		if err != nil {
+			return "", err
+		}
+
+		startValue = output
+	}
+
+	_, keyToken, err := StructureFingerprint([]byte(startValue))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%x", standardFileKey(strings.TrimSuffix(inputStandard, ".json")), md5.Sum([]byte(keyToken))), nil
+}
+
+// Lists the stored mappings, for a single standard if inputStandard is set
+func ListMappings(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]MappingInfo, error) {
+	mappings := []MappingInfo{}
+	store := GetStore(shuffleConfig)
+	keys, err := store.List(ctx, NamespaceMappings)
+	if err != nil {
+		return mappings, err
+	}
+
+	// Only the mapping with its metadata is read, the log and input structure are left to GetMapping
+	inputStandard = standardKey(inputStandard)
+	for _, key := range keys {
+		existing, err := store.Get(ctx, NamespaceMappings, key)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Skipping mapping %s in list: %s", key, err)
+			continue
+		}
+
+		_, meta, err := ParseStoredMapping(existing)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Skipping invalid mapping %s in list: %s", key, err)
+			continue
+		}
+
+		// The standard is in the metadata, as the key of a mapping saved with a filename prefix doesn't start with it
+		if len(inputStandard) > 0 && meta.standard(key) != inputStandard {
+			continue
+		}
+
+		mappings = append(mappings, getMappingInfo(ctx, store, key, meta))
+	}
+
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Key < mappings[j].Key
+	})
+
+	return mappings, nil
+}
+
+func getMappingInfo(ctx context.Context, store Store, keyTokenFile string, meta MappingMetadata) MappingInfo {
+	info := MappingInfo{
+		Key:      keyTokenFile,
+		Standard: meta.standard(keyTokenFile),
+		Prefix:   meta.Prefix,
+		Version:  meta.Version,
+		Created:  meta.Created,
+		Stale:    meta.Stale,
+		Pinned:   meta.PinnedFields(),
+	}
+
+	if usageStore, ok := store.(UsageStore); ok {
+		hits, err := usageStore.GetUsage(ctx, NamespaceMappings, keyTokenFile)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed getting usage of mapping %s: %s", keyTokenFile, err)
+		}
+
+		info.Hits = hits
+	}
+
+	return info
+}
+
+// Gets a stored mapping with its metadata, usage and the input structure it was made from
+func GetMapping(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) (MappingDetails, error) {
+	details := MappingDetails{}
+	store := GetStore(shuffleConfig)
+
+	existing, err := store.Get(ctx, NamespaceMappings, keyTokenFile)
+	if err != nil {
+		return details, err
+	}
+
+	mapping, meta, err := ParseStoredMapping(existing)
+	if err != nil {
+		return details, errors.New(fmt.Sprintf("Invalid mapping %s: %s", keyTokenFile, err))
+	}
+
+	details.MappingInfo = getMappingInfo(ctx, store, keyTokenFile, meta)
+	details.Mapping = mapping
+	details.Metadata = meta
+
+	logged, err := getMappingLog(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed getting the log of mapping %s: %s", keyTokenFile, err)
+	}
+
+	details.Metadata.Versions = mergeMappingVersions(meta.Versions, logged.Versions)
+	details.Metadata.Audit = append(meta.Audit, logged.Audit...)
+	if len(details.Metadata.Versions) > 0 {
+		details.Created = details.Metadata.Versions[0]
+	}
+
+	input, err := GetParsedInput(ctx, keyTokenFile, shuffleConfig)
+	if err == nil {
+		var parsedInput interface{}
+		if json.Unmarshal(input, &parsedInput) == nil {
+			details.Input = parsedInput
+		} else {
+			details.Input = string(input)
+		}
+	}
+
+	return details, nil
+}
+
+// Deletes a stored mapping. It is generated again on the next translation of the same input structure. The versions are kept.
+func DeleteMapping(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) error {
+	deleteMappingPlan(shuffleConfig, keyTokenFile)
+	return GetStore(shuffleConfig).Delete(ctx, NamespaceMappings, keyTokenFile)
+}
+
+// Asks the LLM for a new mapping from the stored input structure, with a chosen model or the default if empty.
+// Locked and human-authored fields keep their values, and the result is saved as a new version.
+// Regenerations of the same mapping with the same model running at the same time share the LLM call, also between replicas.
+func RegenerateMapping(ctx context.Context, keyTokenFile, model string, shuffleConfig ShuffleConfig) (MappingVersion, error) {
+	input, err := GetParsedInput(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return MappingVersion{}, fmt.Errorf("No input structure saved for mapping %s: %w", keyTokenFile, err)
+	}
+
+	// The key of a mapping saved with a filename prefix doesn't start with the standard, so it is taken from the metadata
+	meta := MappingMetadata{}
+	existing, err := GetStore(shuffleConfig).Get(ctx, NamespaceMappings, keyTokenFile)
+	if err == nil {
+		_, meta, err = ParseStoredMapping(existing)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed reading metadata of mapping %s: %s", keyTokenFile, err)
+		}
+	}
+
+	inputStandard := meta.standard(keyTokenFile)
+	standardFormat, _, err := GetStandardContext(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return MappingVersion{}, errors.New(fmt.Sprintf("Failed loading standard %s for mapping %s: %s", inputStandard, keyTokenFile, err))
+	}
+
+	ctx = withLLMOptions(ctx, llmOptions{
+		Model:     model,
+		SkipCache: true,
+	})
+
+	source := fmt.Sprintf("llm:%s", llmModel(ctx))
+	flightKey := fmt.Sprintf("regenerate-%s-%s-%s", shuffleConfig.OrgId, keyTokenFile, llmModel(ctx))
+	regenerated, err := singleFlight(ctx, flightKey, func() (interface{}, bool) {
+		return findRegeneratedMapping(ctx, keyTokenFile, meta.Version.ID, source, shuffleConfig)
+	}, func() (interface{}, error) {
+		log.Printf("[INFO] Schemaless: Regenerating mapping %s with model %s", keyTokenFile, llmModel(ctx))
+		translated, err := LLMTranslateContext(ctx, keyTokenFile, describeStandardRefs(string(standardFormat)), string(input), shuffleConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		if !json.Valid([]byte(FixTranslationStructure(translated))) {
+			return nil, errors.New(fmt.Sprintf("The LLM returned an invalid mapping for %s", keyTokenFile))
+		}
+
+		return saveMapping(ctx, keyTokenFile, inputStandard, translated, source, shuffleConfig)
+	})
+
+	version, _ := regenerated.(MappingVersion)
+	return version, err
+}
+
+// Finds the version another replica regenerated a mapping to with the same model, after the version it was asked for on
+func findRegeneratedMapping(ctx context.Context, keyTokenFile, startVersion, source string, shuffleConfig ShuffleConfig) (interface{}, bool) {
+	existing, err := GetStore(shuffleConfig).Get(ctx, NamespaceMappings, keyTokenFile)
+	if err != nil {
+		return nil, false
+	}
+
+	_, meta, err := ParseStoredMapping(existing)
+	if err != nil || meta.Version.ID == startVersion || meta.Version.Source != source {
+		return nil, false
+	}
+
+	return meta.Version, true
+}
@@ -0,0 +1,190 @@
+package schemaless
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMappingKeyPrefix(t *testing.T) {
+	hash := strings.Repeat("a", 32)
+	tests := []struct {
+		key, standard, expected string
+	}{
+		{"ticket-" + hash, "ticket", ""},
+		{"acme_ticket-" + hash, "ticket", "acme_"},
+		{"acme_ecs~8.11~event-" + hash, "ecs/8.11/event", "acme_"},
+		{"acme_base_event-" + hash + partialMappingSeparator + hash, "base_event", "acme_"},
+		{"acme_ticket-" + hash, "alert", ""},
+		{"ticket", "ticket", ""},
+	}
+
+	for _, test := range tests {
+		if prefix := mappingKeyPrefix(test.key, test.standard); prefix != test.expected {
+			t.Errorf("%s for %s: got %q, expected %q", test.key, test.standard, prefix, test.expected)
+		}
+	}
+}
+
+func TestPrefixedMappings(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+
+	answer := `{"title": "$subject"}`
+	requests := useFakeLLM(t, func(system, user string) string {
+		return answer
+	})
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Disk full"}`)
+	_, prefixedKey, err := Translate(ctx, "ticket", input, "filename_prefix:acme_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(prefixedKey, "acme_ticket-") || MappingKeyStandard(prefixedKey) == "ticket" {
+		t.Fatalf("expected the prefix in the key, got %s", prefixedKey)
+	}
+
+	_, plainKey, err := Translate(ctx, "ticket", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details, err := GetMapping(ctx, prefixedKey, ShuffleConfig{})
+	if err != nil || details.Standard != "ticket" || details.Prefix != "acme_" || details.Metadata.Prefix != "acme_" {
+		t.Errorf("expected the standard and prefix from the metadata, got %+v (%v)", details.MappingInfo, err)
+	}
+
+	mappings, err := ListMappings(ctx, "ticket", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := []string{}
+	for _, mapping := range mappings {
+		found = append(found, mapping.Key)
+	}
+
+	if strings.Join(found, ",") != prefixedKey+","+plainKey {
+		t.Errorf("expected both mappings for ticket, got %v", found)
+	}
+
+	// The standard of the prefixed mapping isn't in its key
+	answer = `{"title": "Ticket: $subject"}`
+	before := requests.Load()
+	version, err := RegenerateMapping(ctx, prefixedKey, "", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests.Load() != before+1 || version.ID != "v2" {
+		t.Errorf("expected a new version from the LLM, got %+v after %d requests", version, requests.Load()-before)
+	}
+
+	details, err = GetMapping(ctx, prefixedKey, ShuffleConfig{})
+	if err != nil || details.Standard != "ticket" || details.Prefix != "acme_" {
+		t.Errorf("expected the metadata to be kept, got %+v (%v)", details.MappingInfo, err)
+	}
+}
+
+func TestRegenerateMappingSharesCall(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+
+	release := make(chan struct{})
+	requests := useFakeLLM(t, func(system, user string) string {
+		<-release
+		return `{"title": "$subject"}`
+	})
+
+	keyTokenFile := saveTestMapping(t, "ticket", []byte(`{"subject": "Disk full"}`), `{"title": "$name"}`)
+	err := SaveParsedInputContext(context.Background(), keyTokenFile, []byte(`{"subject": ""}`), ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make([]string, 3)
+	errs := make([]error, 3)
+	wg := sync.WaitGroup{}
+	for cnt := range versions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			version, err := RegenerateMapping(context.Background(), keyTokenFile, "", ShuffleConfig{})
+			versions[cnt], errs[cnt] = version.ID, err
+		}()
+
+		if cnt == 0 {
+			waitForFlight(t, flights, fmt.Sprintf("regenerate-%s-%s-%s", "", keyTokenFile, llmModel(context.Background())))
+		}
+	}
+
+	close(release)
+	wg.Wait()
+
+	for cnt := range versions {
+		if errs[cnt] != nil || versions[cnt] != versions[0] {
+			t.Errorf("expected every regeneration to get the same version, got %v (%v)", versions, errs)
+			break
+		}
+	}
+
+	if requests.Load() != 1 {
+		t.Errorf("expected a single LLM request, got %d", requests.Load())
+	}
+}
+
+// Counts the reads of each namespace
+type readCountingStore struct {
+	*MemoryStore
+
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func (store *readCountingStore) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	store.mu.Lock()
+	store.reads[namespace] += 1
+	store.mu.Unlock()
+
+	return store.MemoryStore.Get(ctx, namespace, key)
+}
+
+func TestListMappingsReadsMappingsOnly(t *testing.T) {
+	memoryStore := useTestStore(t)
+	ctx := context.Background()
+	keyTokenFile := saveTestMapping(t, "ticket", []byte(`{"subject": ""}`), `{"title": "$subject"}`)
+	err := SaveParsedInputContext(ctx, keyTokenFile, []byte(`{"subject": ""}`), ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = EditMappingField(ctx, keyTokenFile, "title", "$summary", "bob", false, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &readCountingStore{MemoryStore: memoryStore, reads: map[string]int{}}
+	SetStore(store)
+
+	mappings, err := ListMappings(ctx, "ticket", ShuffleConfig{})
+	if err != nil || len(mappings) != 1 {
+		t.Fatalf("expected the mapping, got %v (%v)", mappings, err)
+	}
+
+	if mappings[0].Version.ID != "v2" || mappings[0].Created.ID != "v1" || mappings[0].Standard != "ticket" {
+		t.Errorf("expected v2 created as v1, got %+v", mappings[0])
+	}
+
+	if fmt.Sprint(store.reads) != fmt.Sprintf("map[%s:1]", NamespaceMappings) {
+		t.Errorf("expected a single read of the mapping, got %v", store.reads)
+	}
+}
@@ -0,0 +1,397 @@
+package schemaless
+
+/*
+Imports OCSF event classes as JSON Schema standards, from an offline export of the schema (https://schema.ocsf.io/export/schema).
+A single class from the class API, e.g. base_standards/base_event.json, works as well, without nested object attributes.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+type OCSFImportOptions struct {
+	// Profiles to include attributes from, e.g. cloud or host. Attributes of other profiles are left out.
+	Profiles []string
+
+	// How many levels of objects to include attributes for. Deeper objects only get their description.
+	MaxDepth int
+}
+
+// Default depth of nested objects, as OCSF objects reference each other, e.g. process.parent_process
+var defaultOCSFDepth = 3
+
+type ocsfSchema struct {
+	Version string                            `json:"version"`
+	Classes map[string]map[string]interface{} `json:"classes"`
+	Objects map[string]map[string]interface{} `json:"objects"`
+	Types   map[string]map[string]interface{} `json:"types"`
+}
+
+// OCSF types with a matching JSON Schema type and format. Other types are looked up in the types of the export.
+var ocsfTypes = map[string][2]string{
+	"string_t":    {"string", ""},
+	"integer_t":   {"integer", ""},
+	"long_t":      {"integer", ""},
+	"float_t":     {"number", ""},
+	"boolean_t":   {"boolean", ""},
+	"timestamp_t": {"integer", ""},
+	"port_t":      {"integer", ""},
+	"datetime_t":  {"string", "date-time"},
+	"email_t":     {"string", "email"},
+	"url_t":       {"string", "uri"},
+	"uuid_t":      {"string", "uuid"},
+	"hostname_t":  {"string", "hostname"},
+	"object_t":    {"object", ""},
+	"json_t":      {"", ""},
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]+>`)
+
+func parseOCSFSchema(schemaExport []byte) (*ocsfSchema, error) {
+	schema := &ocsfSchema{}
+	err := json.Unmarshal(schemaExport, schema)
+	if err != nil {
+		return schema, errors.New(fmt.Sprintf("Invalid OCSF schema export: %s", err))
+	}
+
+	if len(schema.Classes) == 0 {
+		class := map[string]interface{}{}
+		err = json.Unmarshal(schemaExport, &class)
+		if err != nil || class["attributes"] == nil {
+			return schema, errors.New("No classes found in the OCSF schema export")
+		}
+
+		if name, ok := class["name"].(string); ok {
+			schema.Classes = map[string]map[string]interface{}{
+				name: class,
+			}
+		}
+	}
+
+	return schema, nil
+}
+
+// Lists the classes in an OCSF schema export
+func ListOCSFClasses(schemaExport []byte) ([]string, error) {
+	schema, err := parseOCSFSchema(schemaExport)
+	if err != nil {
+		return []string{}, err
+	}
+
+	classes := []string{}
+	for name := range schema.Classes {
+		classes = append(classes, name)
+	}
+
+	sort.Strings(classes)
+	return classes, nil
+}
+
+// Builds a JSON Schema standard for an OCSF class, by name or uid, from an offline OCSF schema export.
+// Nested objects, types, enums and their sibling captions (severity_id / severity) are included.
+func ImportOCSF(schemaExport []byte, className string, options OCSFImportOptions) ([]byte, error) {
+	schema, err := parseOCSFSchema(schemaExport)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	class, err := schema.findClass(className)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if options.MaxDepth <= 0 {
+		options.MaxDepth = defaultOCSFDepth
+	}
+
+	standard := schema.objectSchema(class, options, 0)
+	standard["$schema"] = jsonSchemaDraft
+	if caption, ok := class["caption"].(string); ok {
+		standard["title"] = caption
+	}
+
+	if name, ok := class["name"].(string); ok {
+		standard["$id"] = fmt.Sprintf("ocsf/%s", name)
+	}
+
+	if len(schema.Version) > 0 {
+		standard["$comment"] = fmt.Sprintf("Imported from OCSF %s", schema.Version)
+	}
+
+	return json.MarshalIndent(standard, "", "\t")
+}
+
+func (schema *ocsfSchema) findClass(className string) (map[string]interface{}, error) {
+	if class, ok := schema.Classes[className]; ok {
+		return class, nil
+	}
+
+	for name, class := range schema.Classes {
+		caption, _ := class["caption"].(string)
+		if strings.EqualFold(name, className) || strings.EqualFold(caption, className) || fmt.Sprintf("%v", class["uid"]) == className {
+			return class, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("OCSF class '%s' not found", className))
+}
+
+// Gets the attributes of a class or object. Exports have them as a map, while the class API has a list of single key maps.
+func ocsfAttributes(value interface{}) map[string]map[string]interface{} {
+	attributes := map[string]map[string]interface{}{}
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for key, attribute := range val {
+			if attributeMap, ok := attribute.(map[string]interface{}); ok {
+				attributes[key] = attributeMap
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				for key, attribute := range ocsfAttributes(itemMap) {
+					attributes[key] = attribute
+				}
+			}
+		}
+	}
+
+	return attributes
+}
+
+func (schema *ocsfSchema) objectSchema(object map[string]interface{}, options OCSFImportOptions, depth int) map[string]interface{} {
+	attributes := ocsfAttributes(object["attributes"])
+	properties := map[string]interface{}{}
+	required := []string{}
+	for name, attribute := range attributes {
+		if profile, ok := attribute["profile"].(string); ok && len(profile) > 0 && !ocsfProfileSelected(profile, options.Profiles) {
+			continue
+		}
+
+		properties[name] = schema.attributeSchema(attribute, options, depth)
+		if attribute["requirement"] == "required" {
+			required = append(required, name)
+		}
+	}
+
+	// Enum attributes get the captions of their values on the sibling, e.g. severity for severity_id
+	for name, attribute := range attributes {
+		sibling, ok := attribute["sibling"].(string)
+		if !ok || len(sibling) == 0 {
+			continue
+		}
+
+		if _, ok := properties[name]; !ok {
+			continue
+		}
+
+		siblingSchema, ok := properties[sibling].(map[string]interface{})
+		if !ok {
+			siblingSchema = map[string]interface{}{
+				"type": "string",
+			}
+		}
+
+		description, _ := siblingSchema["description"].(string)
+		captions := ocsfEnumCaptions(attribute["enum"])
+		if len(captions) > 0 {
+			description = joinSentences(description, fmt.Sprintf("The caption of %s, such as: %s", name, strings.Join(captions, ", ")))
+		} else if len(description) == 0 {
+			description = fmt.Sprintf("The caption of %s", name)
+		}
+
+		siblingSchema["description"] = description
+
+		properties[sibling] = siblingSchema
+	}
+
+	objectSchema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	if description := ocsfDescription(object); len(description) > 0 {
+		objectSchema["description"] = description
+	}
+
+	if len(required) > 0 {
+		sort.Strings(required)
+		objectSchema["required"] = required
+	}
+
+	return objectSchema
+}
+
+func (schema *ocsfSchema) attributeSchema(attribute map[string]interface{}, options OCSFImportOptions, depth int) map[string]interface{} {
+	ocsfType, _ := attribute["type"].(string)
+	jsonType, format := schema.jsonType(ocsfType)
+
+	attributeSchema := map[string]interface{}{}
+	if jsonType == "object" {
+		objectType, _ := attribute["object_type"].(string)
+		object, found := schema.Objects[objectType]
+		if found && depth+1 <= options.MaxDepth {
+			attributeSchema = schema.objectSchema(object, options, depth+1)
+		} else {
+			attributeSchema["type"] = "object"
+		}
+	} else if len(jsonType) > 0 {
+		attributeSchema["type"] = jsonType
+	}
+
+	if len(format) > 0 {
+		attributeSchema["format"] = format
+	}
+
+	description := ocsfDescription(attribute)
+	if ocsfType == "timestamp_t" {
+		description = joinSentences(description, "Milliseconds since the epoch")
+	}
+
+	if values := ocsfEnumValues(attribute["enum"], jsonType); len(values) > 0 {
+		attributeSchema["enum"] = values
+		description = joinSentences(description, fmt.Sprintf("Values: %s", strings.Join(ocsfEnumDescriptions(attribute["enum"]), ", ")))
+	}
+
+	if isArray, _ := attribute["is_array"].(bool); isArray {
+		return map[string]interface{}{
+			"type":        "array",
+			"items":       attributeSchema,
+			"description": description,
+		}
+	}
+
+	if len(description) > 0 {
+		attributeSchema["description"] = description
+	}
+
+	return attributeSchema
+}
+
+// Finds the JSON Schema type of an OCSF type, following types based on other types such as ip_t
+func (schema *ocsfSchema) jsonType(ocsfType string) (string, string) {
+	for depth := 0; depth < 5; depth++ {
+		if mapped, ok := ocsfTypes[ocsfType]; ok {
+			return mapped[0], mapped[1]
+		}
+
+		baseType, ok := schema.Types[ocsfType]["type"].(string)
+		if !ok || baseType == ocsfType {
+			break
+		}
+
+		ocsfType = baseType
+	}
+
+	return "string", ""
+}
+
+func ocsfProfileSelected(profile string, profiles []string) bool {
+	for _, selected := range profiles {
+		if selected == "all" || strings.EqualFold(selected, profile) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ocsfDescription(value map[string]interface{}) string {
+	description, _ := value["description"].(string)
+	if len(description) == 0 {
+		description, _ = value["caption"].(string)
+	}
+
+	description = htmlTagPattern.ReplaceAllString(description, "")
+	return strings.Join(strings.Fields(description), " ")
+}
+
+func ocsfEnumKeys(enum interface{}) []string {
+	enumMap, ok := enum.(map[string]interface{})
+	if !ok {
+		return []string{}
+	}
+
+	keys := []string{}
+	for key := range enumMap {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		first, firstErr := strconv.Atoi(keys[i])
+		second, secondErr := strconv.Atoi(keys[j])
+		if firstErr == nil && secondErr == nil {
+			return first < second
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+func ocsfEnumValues(enum interface{}, jsonType string) []interface{} {
+	values := []interface{}{}
+	for _, key := range ocsfEnumKeys(enum) {
+		if jsonType == "integer" || jsonType == "number" {
+			number, err := strconv.ParseFloat(key, 64)
+			if err != nil {
+				continue
+			}
+
+			values = append(values, number)
+		} else {
+			values = append(values, key)
+		}
+	}
+
+	return values
+}
+
+func ocsfEnumCaptions(enum interface{}) []string {
+	enumMap, _ := enum.(map[string]interface{})
+	captions := []string{}
+	for _, key := range ocsfEnumKeys(enum) {
+		if value, ok := enumMap[key].(map[string]interface{}); ok {
+			if caption, ok := value["caption"].(string); ok {
+				captions = append(captions, caption)
+			}
+		}
+	}
+
+	return captions
+}
+
+func ocsfEnumDescriptions(enum interface{}) []string {
+	enumMap, _ := enum.(map[string]interface{})
+	descriptions := []string{}
+	for _, key := range ocsfEnumKeys(enum) {
+		caption := key
+		if value, ok := enumMap[key].(map[string]interface{}); ok {
+			if foundCaption, ok := value["caption"].(string); ok {
+				caption = foundCaption
+			}
+		}
+
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", key, caption))
+	}
+
+	return descriptions
+}
+
+func joinSentences(first, second string) string {
+	first = strings.TrimSuffix(strings.TrimSpace(first), ".")
+	if len(first) == 0 {
+		return second
+	}
+
+	return fmt.Sprintf("%s. %s", first, second)
+}
@@ -0,0 +1,235 @@
+package schemaless
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A small part of an OCSF schema export, with an object referencing itself like the real process object
+var testOCSFExport = []byte(`{
+	"version": "1.1.0",
+	"classes": {
+		"file_activity": {
+			"name": "file_activity",
+			"caption": "File System Activity",
+			"uid": 1001,
+			"description": "File System Activity events report when a process performs an action on a file or folder.",
+			"attributes": {
+				"time": {"type": "timestamp_t", "caption": "Event Time", "requirement": "required"},
+				"start_time_dt": {"type": "datetime_t", "caption": "Start Time"},
+				"severity_id": {
+					"type": "integer_t",
+					"caption": "Severity ID",
+					"requirement": "required",
+					"sibling": "severity",
+					"enum": {
+						"0": {"caption": "Unknown"},
+						"1": {"caption": "Informational"},
+						"10": {"caption": "Other"},
+						"2": {"caption": "Low"}
+					}
+				},
+				"severity": {"type": "string_t", "caption": "Severity", "description": "The event severity, normalized to the caption of <code>severity_id</code>."},
+				"actor": {"type": "object_t", "object_type": "actor", "caption": "Actor"},
+				"observables": {"type": "object_t", "object_type": "observable", "is_array": true, "caption": "Observables"},
+				"src_ip": {"type": "ip_t", "caption": "Source IP"},
+				"cloud": {"type": "object_t", "object_type": "cloud", "profile": "cloud", "caption": "Cloud"},
+				"device": {"type": "object_t", "object_type": "device", "profile": "host", "caption": "Device"}
+			}
+		},
+		"process_activity": {
+			"name": "process_activity",
+			"caption": "Process Activity",
+			"uid": 1007,
+			"attributes": {}
+		}
+	},
+	"objects": {
+		"actor": {
+			"description": "The actor that performed the activity.",
+			"attributes": {
+				"process": {"type": "object_t", "object_type": "process", "caption": "Process"}
+			}
+		},
+		"process": {
+			"caption": "Process",
+			"attributes": {
+				"name": {"type": "string_t", "caption": "Name"},
+				"parent_process": {"type": "object_t", "object_type": "process", "caption": "Parent Process"}
+			}
+		},
+		"observable": {
+			"attributes": {
+				"name": {"type": "string_t", "caption": "Name", "requirement": "required"},
+				"value": {"type": "string_t", "caption": "Value"}
+			}
+		},
+		"cloud": {"attributes": {"provider": {"type": "string_t", "caption": "Provider"}}},
+		"device": {"attributes": {"hostname": {"type": "hostname_t", "caption": "Hostname"}}}
+	},
+	"types": {
+		"ip_t": {"type": "string_t", "caption": "IP Address"}
+	}
+}`)
+
+func importTestOCSF(t *testing.T, className string, options OCSFImportOptions) map[string]interface{} {
+	t.Helper()
+
+	imported, err := ImportOCSF(testOCSFExport, className, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := map[string]interface{}{}
+	err = json.Unmarshal(imported, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+// Gets a nested value by keys, e.g. "properties", "actor"
+func ocsfPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		value = valueMap[key]
+	}
+
+	return value
+}
+
+func TestImportOCSF(t *testing.T) {
+	imported := importTestOCSF(t, "file_activity", OCSFImportOptions{})
+
+	if imported["$schema"] != jsonSchemaDraft || imported["$id"] != "ocsf/file_activity" || imported["title"] != "File System Activity" || imported["$comment"] != "Imported from OCSF 1.1.0" {
+		t.Errorf("unexpected schema header: %v", imported)
+	}
+
+	if !reflect.DeepEqual(imported["required"], []interface{}{"severity_id", "time"}) {
+		t.Errorf("unexpected required attributes: %v", imported["required"])
+	}
+
+	tests := []struct {
+		path     []string
+		expected interface{}
+	}{
+		{[]string{"time", "type"}, "integer"},
+		{[]string{"time", "description"}, "Event Time. Milliseconds since the epoch"},
+		{[]string{"start_time_dt", "format"}, "date-time"},
+		{[]string{"src_ip", "type"}, "string"},
+		{[]string{"observables", "type"}, "array"},
+		{[]string{"observables", "items", "type"}, "object"},
+		{[]string{"observables", "items", "properties", "value", "type"}, "string"},
+		{[]string{"actor", "description"}, "Actor"},
+		{[]string{"severity_id", "description"}, "Severity ID. Values: 0 (Unknown), 1 (Informational), 2 (Low), 10 (Other)"},
+		{[]string{"severity", "description"}, "The event severity, normalized to the caption of severity_id. The caption of severity_id, such as: Unknown, Informational, Low, Other"},
+	}
+
+	for _, test := range tests {
+		if value := ocsfPath(imported["properties"], test.path...); value != test.expected {
+			t.Errorf("%s: got %v, expected %v", strings.Join(test.path, "."), value, test.expected)
+		}
+	}
+
+	if required := ocsfPath(imported, "properties", "observables", "items", "required"); !reflect.DeepEqual(required, []interface{}{"name"}) {
+		t.Errorf("expected the required attributes of nested objects, got %v", required)
+	}
+
+	// Integer enums stay numbers, in numeric order
+	enum := ocsfPath(imported, "properties", "severity_id", "enum")
+	if !reflect.DeepEqual(enum, []interface{}{float64(0), float64(1), float64(2), float64(10)}) {
+		t.Errorf("unexpected enum %v", enum)
+	}
+
+	// Attributes of profiles that aren't selected are left out
+	for _, attribute := range []string{"cloud", "device"} {
+		if ocsfPath(imported, "properties", attribute) != nil {
+			t.Errorf("expected %s to be left out without its profile", attribute)
+		}
+	}
+}
+
+func TestImportOCSFDepthAndProfiles(t *testing.T) {
+	imported := importTestOCSF(t, "1001", OCSFImportOptions{Profiles: []string{"host"}, MaxDepth: 2})
+
+	if ocsfPath(imported, "properties", "device", "properties", "hostname", "format") != "hostname" {
+		t.Errorf("expected the device of the host profile, got %v", ocsfPath(imported, "properties", "device"))
+	}
+
+	if ocsfPath(imported, "properties", "cloud") != nil {
+		t.Error("expected the cloud profile to be left out")
+	}
+
+	// actor (1) -> process (2) -> parent_process is past the depth, so it only gets its type and description
+	process := ocsfPath(imported, "properties", "actor", "properties", "process")
+	parent := ocsfPath(process, "properties", "parent_process")
+	if ocsfPath(process, "properties", "name", "type") != "string" || ocsfPath(parent, "properties") != nil || ocsfPath(parent, "type") != "object" {
+		t.Errorf("unexpected nesting: %v", process)
+	}
+
+	all := importTestOCSF(t, "File System Activity", OCSFImportOptions{Profiles: []string{"all"}})
+	if ocsfPath(all, "properties", "cloud") == nil || ocsfPath(all, "properties", "device") == nil {
+		t.Error("expected every profile with all")
+	}
+}
+
+func TestImportOCSFClassAPI(t *testing.T) {
+	// The class API lists the attributes as single key maps, and has no objects
+	class := []byte(`{
+		"name": "base_event",
+		"caption": "Base Event",
+		"attributes": [
+			{"message": {"type": "string_t", "description": "The description of the event."}},
+			{"metadata": {"type": "object_t", "object_type": "metadata", "requirement": "required", "caption": "Metadata"}}
+		]
+	}`)
+
+	imported, err := ImportOCSF(class, "base_event", OCSFImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Works as a standard
+	standard, err := ConvertStandardFormat(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := map[string]interface{}{}
+	err = json.Unmarshal(standard, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := parsed["message"].(string); !ok {
+		t.Errorf("expected message in the standard, got %s", standard)
+	}
+
+	if _, ok := parsed["metadata"]; !ok {
+		t.Errorf("expected metadata in the standard, got %s", standard)
+	}
+}
+
+func TestListOCSFClasses(t *testing.T) {
+	classes, err := ListOCSFClasses(testOCSFExport)
+	if err != nil || strings.Join(classes, ",") != "file_activity,process_activity" {
+		t.Errorf("got %v (%v)", classes, err)
+	}
+
+	_, err = ImportOCSF(testOCSFExport, "missing_activity", OCSFImportOptions{})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a missing class error, got %v", err)
+	}
+
+	_, err = ListOCSFClasses([]byte(`{"version": "1.1.0"}`))
+	if err == nil {
+		t.Error("expected an export without classes to fail")
+	}
+}
@@ -0,0 +1,198 @@
+package schemaless
+
+/*
+Bundled standard packs, embedded in the binary so they work offline. Standards are addressed as <pack>/<version>/<standard>,
+such as ecs/8.11/event or ocsf/1.0.0/authentication. Leaving out the version, e.g. ecs/event, uses the latest version of the pack.
+
+	packs/<pack>/<version>/pack.json		Name, version and description of the pack
+	packs/<pack>/<version>/<standard>.json	The standards
+*/
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed packs
+var embeddedPacks embed.FS
+
+const packsRoot = "packs"
+
+// Metadata file in each pack version
+const packMetadataFile = "pack.json"
+
+type StandardPack struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Description string   `json:"description,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Standards   []string `json:"standards"`
+}
+
+// Lists the bundled packs and their standards, sorted by name and version
+func ListStandardPacks() ([]StandardPack, error) {
+	packs := []StandardPack{}
+
+	names, err := fs.ReadDir(embeddedPacks, packsRoot)
+	if err != nil {
+		return packs, err
+	}
+
+	for _, name := range names {
+		if !name.IsDir() {
+			continue
+		}
+
+		for _, version := range packVersions(name.Name()) {
+			pack, err := getStandardPack(name.Name(), version)
+			if err != nil {
+				return packs, err
+			}
+
+			packs = append(packs, pack)
+		}
+	}
+
+	return packs, nil
+}
+
+func getStandardPack(name, version string) (StandardPack, error) {
+	pack := StandardPack{
+		Name:      name,
+		Version:   version,
+		Standards: []string{},
+	}
+
+	folder := path.Join(packsRoot, name, version)
+	if metadata, err := embeddedPacks.ReadFile(path.Join(folder, packMetadataFile)); err == nil {
+		err = json.Unmarshal(metadata, &pack)
+		if err != nil {
+			return pack, errors.New(fmt.Sprintf("Invalid %s for pack %s/%s: %s", packMetadataFile, name, version, err))
+		}
+
+		pack.Name, pack.Version = name, version
+	}
+
+	entries, err := fs.ReadDir(embeddedPacks, folder)
+	if err != nil {
+		return pack, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == packMetadataFile || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		pack.Standards = append(pack.Standards, fmt.Sprintf("%s/%s/%s", name, version, standardKey(entry.Name())))
+	}
+
+	return pack, nil
+}
+
+// Gets the versions of a pack, oldest first
+func packVersions(name string) []string {
+	versions := []string{}
+	entries, err := fs.ReadDir(embeddedPacks, path.Join(packsRoot, name))
+	if err != nil {
+		return versions
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+
+	return versions
+}
+
+// Compares dot separated versions numerically, so 8.11 is newer than 8.9
+func compareVersions(first, second string) int {
+	firstParts := strings.Split(strings.TrimPrefix(first, "v"), ".")
+	secondParts := strings.Split(strings.TrimPrefix(second, "v"), ".")
+	for cnt := 0; cnt < len(firstParts) || cnt < len(secondParts); cnt++ {
+		firstPart, secondPart := "0", "0"
+		if cnt < len(firstParts) {
+			firstPart = firstParts[cnt]
+		}
+
+		if cnt < len(secondParts) {
+			secondPart = secondParts[cnt]
+		}
+
+		firstNumber, firstErr := strconv.Atoi(firstPart)
+		secondNumber, secondErr := strconv.Atoi(secondPart)
+		if firstErr == nil && secondErr == nil {
+			if firstNumber != secondNumber {
+				if firstNumber < secondNumber {
+					return -1
+				}
+
+				return 1
+			}
+
+			continue
+		}
+
+		if comparison := strings.Compare(firstPart, secondPart); comparison != 0 {
+			return comparison
+		}
+	}
+
+	return 0
+}
+
+// Checks if a standard name points into a pack, e.g. ecs/8.11/event or ecs/event
+func isPackStandard(inputStandard string) bool {
+	return strings.Contains(inputStandard, "/")
+}
+
+// Gets a standard from the bundled packs. Returns ErrNotFound if the pack, version or standard doesn't exist.
+func GetPackStandard(inputStandard string) ([]byte, string, error) {
+	parts := strings.Split(standardKey(strings.Trim(inputStandard, "/")), "/")
+	for _, part := range parts {
+		if len(part) == 0 || part == "." || part == ".." {
+			return []byte{}, "", fmt.Errorf("%w: invalid pack standard '%s'", ErrNotFound, inputStandard)
+		}
+	}
+
+	name, version, standard := "", "", ""
+	switch len(parts) {
+	case 2:
+		name, standard = parts[0], parts[1]
+		versions := packVersions(name)
+		if len(versions) == 0 {
+			return []byte{}, "", fmt.Errorf("%w: no pack named '%s'", ErrNotFound, name)
+		}
+
+		version = versions[len(versions)-1]
+	case 3:
+		name, version, standard = parts[0], parts[1], parts[2]
+	default:
+		return []byte{}, "", fmt.Errorf("%w: '%s' is not a pack standard. Use <pack>/<version>/<standard> or <pack>/<standard>.", ErrNotFound, inputStandard)
+	}
+
+	filename := path.Join(packsRoot, name, version, fmt.Sprintf("%s.json", standard))
+	data, err := embeddedPacks.ReadFile(filename)
+	if err != nil {
+		return []byte{}, filename, fmt.Errorf("%w: %s", ErrNotFound, filename)
+	}
+
+	return data, filename, nil
+}
+
+// Turns a standard name into a key usable in mapping filenames, as pack standards contain slashes
+func standardFileKey(inputStandard string) string {
+	return strings.ReplaceAll(standardKey(inputStandard), "/", "~")
+}
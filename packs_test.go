@@ -0,0 +1,163 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGetPackStandard(t *testing.T) {
+	tests := map[string]string{
+		"ecs/8.11/event":      "packs/ecs/8.11/event.json",
+		"ecs/event":           "packs/ecs/8.11/event.json",
+		"ecs/8.11/event.json": "packs/ecs/8.11/event.json",
+		"/ecs/8.11/host/":     "packs/ecs/8.11/host.json",
+	}
+
+	for standard, expected := range tests {
+		data, filename, err := GetPackStandard(standard)
+		if err != nil || filename != expected || len(data) == 0 {
+			t.Errorf("%s: got %s (%v), expected %s", standard, filename, err, expected)
+		}
+	}
+
+	for _, standard := range []string{"ecs/7.0/event", "ecs/8.11/missing", "missing/event", "ecs/../ocsf/1.0.0/authentication", "ecs//event", "event", "a/b/c/d"} {
+		_, _, err := GetPackStandard(standard)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, got %v", standard, err)
+		}
+	}
+}
+
+func TestListStandardPacks(t *testing.T) {
+	packs, err := ListStandardPacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]StandardPack{}
+	for _, pack := range packs {
+		found[pack.Name+"/"+pack.Version] = pack
+	}
+
+	ecs, ok := found["ecs/8.11"]
+	if !ok {
+		t.Fatalf("expected the ecs pack, got %v", packs)
+	}
+
+	standards := strings.Join(ecs.Standards, ",")
+	if !strings.Contains(standards, "ecs/8.11/security_event") || strings.Contains(standards, "pack") {
+		t.Errorf("unexpected standards %s", standards)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		first, second string
+		expected      int
+	}{
+		{"8.11", "8.9", 1},
+		{"8.9", "8.11", -1},
+		{"1.0", "1.0.0", 0},
+		{"v2.0", "1.9", 1},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+	}
+
+	for _, test := range tests {
+		if comparison := compareVersions(test.first, test.second); comparison != test.expected {
+			t.Errorf("%s vs %s: got %d, expected %d", test.first, test.second, comparison, test.expected)
+		}
+	}
+}
+
+func TestPackStandardComposedSchema(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+
+	// security_event only extends other standards, so it has no schema of its own
+	schema, ok := getStandardSchema(ctx, "ecs/8.11/security_event", ShuffleConfig{})
+	if !ok {
+		t.Fatal("expected a schema composed from the bases")
+	}
+
+	properties, _ := schema.root["properties"].(map[string]interface{})
+	for _, field := range []string{"@timestamp", "message", "event", "host", "user", "source", "process", "threat"} {
+		if _, found := properties[field]; !found {
+			t.Errorf("expected %s from the bases in the composed schema", field)
+		}
+	}
+
+	if !containsValue(schema.root["required"].([]interface{}), "@timestamp") {
+		t.Errorf("expected @timestamp to be required from ecs/8.11/base, got %v", schema.root["required"])
+	}
+
+	// Coerced and validated with the schemas of the bases
+	coerced, validationErrors := schema.coerceAndValidate([]byte(`{"@timestamp": "1709634030", "event": {"kind": "ALERT"}, "host": {"name": "web-1"}}`))
+	parsed := map[string]interface{}{}
+	err := json.Unmarshal(coerced, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["@timestamp"] != "2024-03-05T10:20:30Z" || ocsfPath(parsed, "event", "kind") != "alert" {
+		t.Errorf("expected the output to be coerced with the base schemas, got %s", coerced)
+	}
+
+	if len(validationErrors) != 0 {
+		t.Errorf("unexpected validation errors %v", validationErrors)
+	}
+
+	_, validationErrors = schema.coerceAndValidate([]byte(`{"event": {"kind": "alert"}}`))
+	if len(validationErrors) != 1 || validationErrors[0].Keyword != "required" {
+		t.Errorf("expected the missing @timestamp, got %v", validationErrors)
+	}
+
+	// The composed standard has the fields of the bases as well
+	standard, _, err := GetStandardContext(ctx, "ecs/security_event", ShuffleConfig{})
+	if err != nil || !strings.Contains(string(standard), `"@timestamp"`) || !strings.Contains(string(standard), `"threat"`) {
+		t.Errorf("expected the fields of the bases, got %s (%v)", standard, err)
+	}
+}
+
+func TestComposedSchemaOverrides(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"alert_base": `{
+			"$schema": "https://json-schema.org/draft/2020-12/schema",
+			"type": "object",
+			"required": ["severity", "note"],
+			"properties": {
+				"severity": {"type": "integer"},
+				"note": {"type": "string"},
+				"device": {"type": "object", "properties": {"name": {"type": "string"}, "ip": {"type": "string", "format": "ipv4"}}}
+			}
+		}`,
+
+		// Example-style, overriding and removing fields of the schema
+		"alert": `{"extends": "alert_base", "note": null, "device": {"ip": null, "os": "The OS"}, "title": "The title"}`,
+		"plain": `{"title": "The title"}`,
+	})
+
+	schema, ok := getStandardSchema(context.Background(), "alert", ShuffleConfig{})
+	if !ok {
+		t.Fatal("expected a composed schema")
+	}
+
+	if ocsfPath(schema.root, "properties", "note") != nil || ocsfPath(schema.root, "properties", "device", "properties", "ip") != nil {
+		t.Errorf("expected null to remove the properties, got %v", schema.root["properties"])
+	}
+
+	if ocsfPath(schema.root, "properties", "device", "properties", "name", "type") != "string" || ocsfPath(schema.root, "properties", "title", "description") != "The title" {
+		t.Errorf("expected the nested properties to be merged, got %v", schema.root["properties"])
+	}
+
+	if required := schema.root["required"].([]interface{}); len(required) != 1 || required[0] != "severity" {
+		t.Errorf("expected the removed note not to be required, got %v", required)
+	}
+
+	if _, ok := getStandardSchema(context.Background(), "plain", ShuffleConfig{}); ok {
+		t.Error("expected no schema for an example-style standard")
+	}
+}
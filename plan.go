@@ -0,0 +1,476 @@
+package schemaless
+
+/*
+Compiled mappings. The first translation of an input structure compiles its mapping into a plan with the paths, templates
+and standard references parsed out, and keeps it in memory by mapping file. Later inputs with the same structure run the plan
+directly, without reading the mapping from the store or going through the cache.
+
+Plans are dropped when their mapping or any standard changes in this process. Changes made by other replicas are picked
+up once the plan expires, after CacheTTL(CacheKindPlan). Set SCHEMALESS_DISABLE_PLANS=true to always run mappings as before.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/patrickmn/go-cache"
+)
+
+var plansEnabled atomic.Bool
+
+// The same pattern as runJsonTranslation uses for $ references
+var planMatchPattern = regexp.MustCompile(`([$]{1}([a-zA-Z0-9_@()-]+\.?){1}([a-zA-Z0-9#_@\()-]+\.?){0,})`)
+
+var mappingPlans = cache.New(CacheTTL(CacheKindPlan), CacheTTL(CacheKindPlan))
+
+type planKind int
+
+const (
+	planConstant planKind = iota
+
+	// Looks up a path in the input, e.g. user.name or items.#.id
+	planLookup
+
+	// Replaces the $ references in a string with values from the input
+	planTemplate
+
+	// Builds an object from its own plan
+	planObject
+
+	// Lists are run through runJsonTranslation, as they depend on the values of the input
+	planInterpreted
+)
+
+type planMatch struct {
+	match    string
+	listForm string
+	path     string
+}
+
+type planStep struct {
+	key  string
+	kind planKind
+
+	// Field names that are used as-is if the input has them at the top level
+	direct string
+
+	value    interface{}
+	path     string
+	template string
+	matches  []planMatch
+	steps    []planStep
+}
+
+type mappingPlan struct {
+	// The mapping with standard references, which are translated on their own
+	mapping map[string]interface{}
+	steps   []planStep
+	refs    []standardRef
+
+	// The top level fields of the input the steps read. nil when they need all of it, e.g. for interpreted fields.
+	inputKeys map[string]bool
+
+	schema    *jsonSchema
+	hasSchema bool
+
+	mappingFile string
+	version     MappingVersion
+	stale       *MappingStaleness
+}
+
+// Turns plans on or off. Turning them off drops the compiled plans.
+func SetMappingPlans(enabled bool) {
+	plansEnabled.Store(enabled)
+	resetMappingPlans()
+}
+
+func resetMappingPlans() {
+	mappingPlans.Flush()
+}
+
+func mappingPlanKey(shuffleConfig ShuffleConfig, keyTokenFile string) string {
+	return fmt.Sprintf("%s-%s", shuffleConfig.OrgId, keyTokenFile)
+}
+
+// Previews always run the stored mapping
+func usingMappingPlans(ctx context.Context) bool {
+	return plansEnabled.Load() && !isPreview(ctx)
+}
+
+func getMappingPlan(ctx context.Context, shuffleConfig ShuffleConfig, keyTokenFile string) (*mappingPlan, bool) {
+	if !usingMappingPlans(ctx) {
+		return nil, false
+	}
+
+	plan, found := mappingPlans.Get(mappingPlanKey(shuffleConfig, keyTokenFile))
+	if !found {
+		return nil, false
+	}
+
+	return plan.(*mappingPlan), true
+}
+
+func setMappingPlan(ctx context.Context, shuffleConfig ShuffleConfig, keyTokenFile string, plan *mappingPlan) {
+	if !plansEnabled.Load() || isPreview(ctx) {
+		return
+	}
+
+	mappingPlans.Set(mappingPlanKey(shuffleConfig, keyTokenFile), plan, CacheTTL(CacheKindPlan))
+}
+
+// Drops the plan of a mapping after it changed
+func deleteMappingPlan(shuffleConfig ShuffleConfig, keyTokenFile string) {
+	mappingPlans.Delete(mappingPlanKey(shuffleConfig, keyTokenFile))
+}
+
+// Gets the plan of a stored mapping, compiling it from the store if it isn't in memory
+func loadMappingPlan(ctx context.Context, inputStandard, keyTokenFile string, shuffleConfig ShuffleConfig) (*mappingPlan, error) {
+	if plan, ok := getMappingPlan(ctx, shuffleConfig, keyTokenFile); ok {
+		return plan, nil
+	}
+
+	stored, location, err := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, meta, err := ParseStoredMapping(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []standardRef{}
+	standardFormat, _, err := GetStandardContext(ctx, inputStandard, shuffleConfig)
+	if err == nil {
+		refs = parseStandardRefs(standardFormat)
+	}
+
+	plan := compileMappingPlan(mapping, refs)
+	plan.schema, plan.hasSchema = getStandardSchema(ctx, inputStandard, shuffleConfig)
+	plan.mappingFile = keyTokenFile
+	if len(location) > 0 {
+		plan.mappingFile = location
+	}
+
+	plan.version = meta.Version
+	plan.stale = meta.Stale
+
+	setMappingPlan(ctx, shuffleConfig, keyTokenFile, plan)
+	return plan, nil
+}
+
+// Compiles a mapping. Fields referencing other standards are left to translateStandardRefs, and metadata is left out.
+func compileMappingPlan(mapping map[string]interface{}, refs []standardRef) *mappingPlan {
+	fields := withoutStandardRefs(mapping, refs)
+	delete(fields, mappingMetadataKey)
+
+	plan := &mappingPlan{
+		mapping:   mapping,
+		steps:     compilePlanSteps(fields),
+		refs:      refs,
+		inputKeys: map[string]bool{},
+	}
+
+	if !planInputKeys(plan.steps, plan.inputKeys) {
+		plan.inputKeys = nil
+	}
+
+	return plan
+}
+
+// Adds the top level fields of the input that the steps read. recurseFindKey only looks up the first key of a path in the input.
+// Returns false if a step needs the whole input.
+func planInputKeys(steps []planStep, inputKeys map[string]bool) bool {
+	for _, step := range steps {
+		if len(step.direct) > 0 {
+			inputKeys[step.direct] = true
+		}
+
+		switch step.kind {
+		case planLookup:
+			inputKeys[strings.Split(step.path, ".")[0]] = true
+		case planTemplate:
+			for _, match := range step.matches {
+				inputKeys[strings.Split(match.path, ".")[0]] = true
+			}
+		case planObject:
+			if !planInputKeys(step.steps, inputKeys) {
+				return false
+			}
+		case planInterpreted:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Decodes the fields of an input that the plan reads from the scanned top level fields, skipping the rest. Keeping the
+// original needs all of it.
+func (plan *mappingPlan) decodeInput(input []byte, members []scannedMember, keepOriginal bool) (map[string]interface{}, error) {
+	parsedInput := map[string]interface{}{}
+	if keepOriginal || plan.inputKeys == nil {
+		err := json.Unmarshal(input, &parsedInput)
+		return parsedInput, err
+	}
+
+	for _, member := range members {
+		if !plan.inputKeys[string(member.key)] {
+			continue
+		}
+
+		value, err := decodeScannedValue(member.value)
+		if err != nil {
+			return parsedInput, err
+		}
+
+		parsedInput[string(member.key)] = value
+	}
+
+	return parsedInput, nil
+}
+
+// Decodes a raw JSON value the same way as json.Unmarshal to an interface{}, without going through it for plain strings
+// and numbers
+func decodeScannedValue(raw []byte) (interface{}, error) {
+	switch {
+	case raw[0] == '"':
+		if plain := raw[1 : len(raw)-1]; bytes.IndexByte(plain, '\\') < 0 && utf8.Valid(plain) {
+			return string(plain), nil
+		}
+	case raw[0] == '-' || (raw[0] >= '0' && raw[0] <= '9'):
+		number, err := strconv.ParseFloat(string(raw), 64)
+		if err == nil {
+			return number, nil
+		}
+	}
+
+	var value interface{}
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// Parses each field the same way runJsonTranslation does for every input
+func compilePlanSteps(mapping map[string]interface{}) []planStep {
+	steps := []planStep{}
+	for key, value := range mapping {
+		step := planStep{
+			key:   key,
+			kind:  planConstant,
+			value: value,
+		}
+
+		switch val := value.(type) {
+		case string:
+			step.direct = val
+			compilePlanString(&step, val)
+		case []interface{}:
+			step.kind = planInterpreted
+		case map[string]interface{}:
+			if len(val) > 0 {
+				step.kind = planObject
+				step.steps = compilePlanSteps(val)
+			}
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps
+}
+
+func compilePlanString(step *planStep, val string) {
+	if strings.Contains(val, "[") || strings.Contains(val, "$") {
+		fields := TranslateBadFieldFormats([]Valuereplace{Valuereplace{Value: val}}, true)
+		if len(fields) == 1 {
+			val = fields[0].Value
+		}
+	}
+
+	step.value = val
+	if !strings.Contains(val, ".") && !strings.Contains(val, "$") {
+		return
+	}
+
+	val = strings.ReplaceAll(val, "[]", ".#")
+	val = strings.ReplaceAll(val, `"`, "")
+	if !strings.Contains(val, "$") {
+		step.kind = planLookup
+		step.path = val
+		return
+	}
+
+	step.kind = planTemplate
+	step.template = val
+	for _, match := range planMatchPattern.FindAllString(val, -1) {
+		step.matches = append(step.matches, planMatch{
+			match:    match,
+			listForm: strings.ReplaceAll(match, ".#", "[]"),
+			path:     getParsedMatch(match),
+		})
+	}
+}
+
+// Runs the plan on a parsed input. inputValue is the same input as JSON, for the fields that are interpreted.
+func (plan *mappingPlan) run(ctx context.Context, parsedInput map[string]interface{}, inputValue []byte, keepOriginal bool) map[string]interface{} {
+	translated := map[string]interface{}{}
+	if keepOriginal {
+		translated["unmapped_original"] = parsedInput
+	}
+
+	direct := runPlanSteps(ctx, plan.steps, parsedInput, inputValue, translated)
+
+	// Fields copied as-is are added to the original as well, like runJsonTranslation does
+	if keepOriginal {
+		for key, value := range direct {
+			parsedInput[string(key)] = value
+		}
+	}
+
+	return translated
+}
+
+// Fills translated with the output of each step, and returns the fields that were copied as-is from the input
+func runPlanSteps(ctx context.Context, steps []planStep, parsedInput map[string]interface{}, inputValue []byte, translated map[string]interface{}) map[string]interface{} {
+	direct := map[string]interface{}{}
+	for _, step := range steps {
+		if len(step.direct) > 0 {
+			if value, ok := parsedInput[step.direct]; ok {
+				translated[step.key] = value
+				direct[step.key] = value
+				continue
+			}
+		}
+
+		var value interface{}
+		switch step.kind {
+		case planConstant:
+			value = step.value
+		case planLookup:
+			value, _ = recurseFindKey(parsedInput, step.path, 0)
+		case planTemplate:
+			output := step.template
+			for _, match := range step.matches {
+				recursed, err := recurseFindKey(parsedInput, match.path, 0)
+				if err != nil && debug {
+					log.Printf("[DEBUG] Schemaless: Error in RecurseFindKey for match %#v: %v", match.match, err)
+				}
+
+				output = strings.ReplaceAll(output, match.match, recursed)
+				output = strings.ReplaceAll(output, match.listForm, recursed)
+			}
+
+			value = output
+		case planObject:
+			object := map[string]interface{}{}
+			runPlanSteps(ctx, step.steps, parsedInput, inputValue, object)
+			value = object
+		case planInterpreted:
+			value = interpretPlanStep(ctx, step, inputValue)
+		}
+
+		if stringValue, ok := value.(string); ok {
+			value = parseSchemalessList(stringValue)
+		}
+
+		translated[step.key] = value
+	}
+
+	return direct
+}
+
+func interpretPlanStep(ctx context.Context, step planStep, inputValue []byte) interface{} {
+	output, _, err := runJsonTranslation(ctx, inputValue, map[string]interface{}{step.key: step.value}, false)
+	if err != nil {
+		return step.value
+	}
+
+	parsedOutput := map[string]interface{}{}
+	err = json.Unmarshal(output, &parsedOutput)
+	if err != nil {
+		return step.value
+	}
+
+	return parsedOutput[step.key]
+}
+
+// Picks the first value of schemaless_list["a","b"] strings made by list lookups
+func parseSchemalessList(value string) interface{} {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(value, "{{"), "}}")
+	if !strings.Contains(trimmed, "schemaless_list[") || !strings.HasSuffix(trimmed, "]") {
+		return value
+	}
+
+	parsedList := []string{}
+	err := json.Unmarshal([]byte(strings.TrimPrefix(trimmed, "schemaless_list")), &parsedList)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error in unmarshalling schemaless_list '%s': %v", value, err)
+		return value
+	}
+
+	for _, item := range parsedList {
+		if len(item) > 0 {
+			return item
+		}
+	}
+
+	return ""
+}
+
+// Runs a compiled mapping on an input, with the standard references and the JSON Schema of the standard.
+// parsedInput is inputValue decoded, and may be changed.
+func (plan *mappingPlan) translate(ctx context.Context, info *TranslationInfo, inputStandard string, refChain []string, parsedInput map[string]interface{}, inputValue []byte, keepOriginal bool, authConfig string) ([]byte, error) {
+	if parsedInput == nil {
+		parsedInput = map[string]interface{}{}
+	}
+
+	var translated interface{} = plan.run(ctx, parsedInput, inputValue, keepOriginal)
+
+	// Without references to translate first, the output is coerced before it is marshalled instead of being parsed again
+	coerced := false
+	if plan.hasSchema && len(plan.refs) == 0 {
+		translated, info.ValidationErrors = plan.schema.coerceAndValidateValue(translated)
+		coerced = true
+	}
+
+	translation, err := json.MarshalIndent(translated, "", "\t")
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error in translatedInput marshal: %v", err)
+		return []byte{}, err
+	}
+
+	// Fields referencing other standards are translated with their own mappings
+	if len(plan.refs) > 0 {
+		translation, err = translateStandardRefs(ctx, info, plan.refs, append(refChain, inputStandard), plan.mapping, inputValue, translation, authConfig)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Error translating standard references of %s: %v", inputStandard, err)
+			return []byte{}, err
+		}
+	}
+
+	// Output of JSON Schema standards gets the types of the schema, and is validated against it
+	if plan.hasSchema {
+		if !coerced {
+			translation, info.ValidationErrors = plan.schema.coerceAndValidate(translation)
+		}
+
+		if len(info.ValidationErrors) > 0 {
+			log.Printf("[WARNING] Schemaless: Translation to %s has %d schema validation error(s). First: %s", inputStandard, len(info.ValidationErrors), info.ValidationErrors[0].Error())
+		}
+	}
+
+	return translation, nil
+}
+
+func init() {
+	plansEnabled.Store(os.Getenv("SCHEMALESS_DISABLE_PLANS") != "true")
+}
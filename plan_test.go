@@ -0,0 +1,214 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// Translates an input to ticket and gets the title
+func translateTicketTitle(t *testing.T, input []byte) string {
+	t.Helper()
+
+	output, _, err := Translate(context.Background(), "ticket", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := map[string]interface{}{}
+	err = json.Unmarshal(output, &parsed)
+	if err != nil {
+		t.Fatalf("invalid output %s: %s", output, err)
+	}
+
+	title, _ := parsed["title"].(string)
+	return title
+}
+
+func TestMappingPlanStalenessWindow(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Disk full", "summary": "The disk is full"}`)
+	keyTokenFile := saveTestMapping(t, "ticket", input, `{"title": "$subject"}`)
+
+	if title := translateTicketTitle(t, input); title != "Disk full" {
+		t.Fatalf("got %s", title)
+	}
+
+	if _, ok := getMappingPlan(ctx, ShuffleConfig{}, keyTokenFile); !ok {
+		t.Fatal("expected the mapping to be compiled")
+	}
+
+	// Changed by another replica, so the plan isn't dropped
+	err := store.Put(ctx, NamespaceMappings, keyTokenFile, []byte(`{"title": "$summary"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if title := translateTicketTitle(t, input); title != "Disk full" {
+		t.Errorf("expected the plan to be used until it expires, got %s", title)
+	}
+
+	// Expired
+	deleteMappingPlan(ShuffleConfig{}, keyTokenFile)
+	if title := translateTicketTitle(t, input); title != "The disk is full" {
+		t.Errorf("expected the changed mapping, got %s", title)
+	}
+
+	// Changes made in this process drop the plan right away
+	err = EditMappingField(ctx, keyTokenFile, "title", "$subject", "bob", false, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if title := translateTicketTitle(t, input); title != "Disk full" {
+		t.Errorf("expected the edited mapping, got %s", title)
+	}
+}
+
+// Compiled plans have to give the same output as runJsonTranslation did on its own for every input
+func TestMappingPlanMatchesRunJsonTranslation(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"user": `{"name": "The name", "email": "The email"}`,
+	})
+
+	ctx := context.Background()
+	input := []byte(`{
+		"subject": "Disk full",
+		"level": 3,
+		"open": true,
+		"labels": ["disk", "prod"],
+		"hosts": [{"name": "web", "ip": "10.0.0.1"}, {"name": "db", "ip": "10.0.0.2"}],
+		"device": {"hostname": "web-1", "os": {"name": "linux", "version": "6.1"}},
+		"owner": {"login": "bob", "mail": "bob@example.com"},
+		"extra": {"note": "Not mapped"}
+	}`)
+
+	saveTestMapping(t, "user", []byte(`{"login": "bob", "mail": "bob@example.com"}`), `{"name": "login", "email": "mail"}`)
+
+	tests := []struct {
+		name         string
+		mapping      string
+		refs         []standardRef
+		keepOriginal bool
+	}{
+		{name: "direct", mapping: `{"title": "subject", "severity": "level", "open": "open", "missing": "nowhere"}`},
+		{name: "nested", mapping: `{"title": "subject", "host": {"name": "device.hostname", "os": {"name": "device.os.name", "version": "device.os.version"}}, "empty": {}}`},
+		{name: "template", mapping: `{"description": "$subject on $device.hostname", "missing": "$nowhere.at.all", "quoted": "\"$subject\""}`},
+		{name: "list", mapping: `{"ip": "hosts.#.ip", "names": "$hosts.#.name", "label": "$labels.#", "tags": ["$labels.#", "static"], "brackets": "hosts[].name"}`},
+		{name: "schemaless_list", mapping: `{"first": "schemaless_list[\"\", \"second\"]", "ip": "{{ $hosts.#.ip }}"}`},
+		{name: "constants", mapping: `{"kind": "alert", "count": 5, "enabled": false, "nothing": null}`},
+		{name: "ref", mapping: `{"title": "subject", "assignee": "$owner"}`, refs: []standardRef{{Field: "assignee", Standard: "user"}}},
+		{name: "keepOriginal", mapping: `{"title": "subject", "severity": "level", "host": {"name": "device.hostname"}, "ip": "hosts.#.ip"}`, keepOriginal: true},
+	}
+
+	for _, test := range tests {
+		mapping := map[string]interface{}{}
+		err := json.Unmarshal([]byte(test.mapping), &mapping)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		expected, _, err := runJsonTranslation(ctx, input, mapping, test.keepOriginal)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if len(test.refs) > 0 {
+			expected, err = translateStandardRefs(ctx, &TranslationInfo{}, test.refs, []string{"ticket"}, mapping, input, expected, "")
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+
+		// Decoded the way translate does for inputs with a plan
+		plan := compileMappingPlan(mapping, test.refs)
+		_, members, ok := scanKeyToken(input)
+		if !ok {
+			t.Fatalf("%s: expected the input to be scanned", test.name)
+		}
+
+		parsedInput, err := plan.decodeInput(input, members, test.keepOriginal)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		output, err := plan.translate(ctx, &TranslationInfo{}, "ticket", nil, parsedInput, input, test.keepOriginal, "")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if string(output) != string(expected) {
+			t.Errorf("%s: the plan gave\n%s\nexpected\n%s", test.name, output, expected)
+		}
+	}
+}
+
+// Translates an event of the size with a compiled plan and with the mapping interpreted from the store on every event
+func benchmarkTranslate(b *testing.B, fields int) {
+	useTestStore(b)
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		SetMappingPlans(true)
+	})
+
+	ctx := context.Background()
+	event, _ := json.Marshal(BenchEvent(fields))
+	mappingFile, err := MappingFile(BenchStandard, event)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	mapping, _ := json.Marshal(BenchMapping())
+	err = SaveTranslationContext(ctx, mappingFile, string(mapping), ShuffleConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, plans := range []bool{false, true} {
+		name := "interpreted"
+		if plans {
+			name = "plan"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			SetMappingPlans(plans)
+
+			// The first translation loads the standard and compiles the plan
+			_, _, err := Translate(ctx, BenchStandard, event)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(len(event)))
+			b.ReportAllocs()
+			for b.Loop() {
+				_, _, err := Translate(ctx, BenchStandard, event)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTranslateSmall(b *testing.B) {
+	benchmarkTranslate(b, 10)
+}
+
+func BenchmarkTranslateMedium(b *testing.B) {
+	benchmarkTranslate(b, 100)
+}
+
+func BenchmarkTranslateLarge(b *testing.B) {
+	benchmarkTranslate(b, 1000)
+}
@@ -0,0 +1,250 @@
+package schemaless
+
+/*
+Translates without side effects, to try out a mapping before saving it. Nothing is written to the store or the cache,
+and the LLM is only asked for a mapping when it is allowed. An LLM-made mapping is returned, but not saved.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returned by previews when there is no mapping for the input structure, and the LLM isn't allowed to make one
+var ErrNoMapping = errors.New("No mapping for the input structure")
+
+type PreviewOptions struct {
+	// Used instead of the stored mapping for the input structure. Nested standards still use their stored mappings.
+	Mapping map[string]interface{} `json:"mapping,omitempty"`
+
+	// Asks the LLM for mappings that don't exist yet
+	AllowLLM bool `json:"allow_llm,omitempty"`
+}
+
+// Where the value of an output field came from
+type FieldProvenance struct {
+	Field string `json:"field"`
+
+	// The mapping of the field, such as the input path or template
+	Mapping interface{} `json:"mapping"`
+	Value   interface{} `json:"value"`
+
+	HumanAuthored bool `json:"human_authored,omitempty"`
+	Locked        bool `json:"locked,omitempty"`
+}
+
+type PreviewResult struct {
+	Output json.RawMessage `json:"output"`
+
+	MappingFile string `json:"mapping_file"`
+
+	// candidate, stored or llm
+	MappingSource  string                 `json:"mapping_source"`
+	MappingVersion MappingVersion         `json:"mapping_version"`
+	Mapping        map[string]interface{} `json:"mapping"`
+
+	Fields []FieldProvenance `json:"fields"`
+
+	// Fields of the standard without a value in the output
+	MissingFields []string `json:"missing_fields"`
+
+	// Fields of the mapping that aren't in the standard
+	UnknownFields []string `json:"unknown_fields"`
+
+	ValidationErrors []SchemaValidationError `json:"validation_errors,omitempty"`
+	References       []ReferenceResult       `json:"references,omitempty"`
+	Items            []ListItemResult        `json:"items,omitempty"`
+	Stale            *MappingStaleness       `json:"stale,omitempty"`
+	Warnings         []string                `json:"warnings,omitempty"`
+}
+
+type previewKey struct{}
+
+// Shared by the translations of a preview, including the nested ones
+type previewState struct {
+	options PreviewOptions
+
+	mu      sync.Mutex
+	mapping map[string]interface{}
+	source  string
+	meta    MappingMetadata
+}
+
+func isPreview(ctx context.Context) bool {
+	_, ok := ctx.Value(previewKey{}).(*previewState)
+	return ok
+}
+
+func getPreview(ctx context.Context) (*previewState, bool) {
+	state, ok := ctx.Value(previewKey{}).(*previewState)
+	return state, ok
+}
+
+// Gets the candidate mapping of a preview. It only replaces the mapping of the top level translation, not of nested standards.
+func previewCandidate(ctx context.Context, refChain []string) ([]byte, bool) {
+	state, ok := getPreview(ctx)
+	if !ok || state.options.Mapping == nil || len(refChain) > 0 {
+		return []byte{}, false
+	}
+
+	marshalled, err := json.Marshal(state.options.Mapping)
+	if err != nil {
+		return []byte{}, false
+	}
+
+	return marshalled, true
+}
+
+// Checks if a preview may ask the LLM for a missing mapping. Translations that aren't previews always may.
+func previewAllowsLLM(ctx context.Context) bool {
+	state, ok := getPreview(ctx)
+	return !ok || state.options.AllowLLM
+}
+
+// Keeps the mapping used by the top level translation of a preview, for the report
+func recordPreviewMapping(ctx context.Context, refChain []string, mapping map[string]interface{}, source string, meta MappingMetadata) {
+	state, ok := getPreview(ctx)
+	if !ok || len(refChain) > 0 {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.mapping = mapping
+	state.source = source
+	state.meta = meta
+}
+
+// Translates an input without saving or caching anything, and reports where each output field came from and how the output
+// matches the standard. Returns ErrNoMapping if there is no mapping for the input and options.AllowLLM isn't set.
+func PreviewTranslate(ctx context.Context, inputStandard string, inputValue []byte, options PreviewOptions, inputConfig ...string) (PreviewResult, error) {
+	result := PreviewResult{
+		Fields:        []FieldProvenance{},
+		MissingFields: []string{},
+		UnknownFields: []string{},
+	}
+
+	state := &previewState{
+		options: options,
+	}
+
+	ctx = context.WithValue(ctx, previewKey{}, state)
+	output, info, err := TranslateWithInfo(ctx, inputStandard, inputValue, inputConfig...)
+	if err != nil {
+		return result, err
+	}
+
+	result.Output = json.RawMessage(output)
+	if !json.Valid(output) {
+		result.Output, _ = json.Marshal(string(output))
+	}
+
+	result.MappingFile = info.MappingFile
+	result.MappingVersion = info.MappingVersion
+	result.ValidationErrors = info.ValidationErrors
+	result.References = info.References
+	result.Items = info.Items
+	result.Stale = info.Stale
+	result.Warnings = info.Warnings
+
+	state.mu.Lock()
+	result.Mapping = state.mapping
+	result.MappingSource = state.source
+	meta := state.meta
+	state.mu.Unlock()
+
+	parsedOutput := map[string]interface{}{}
+	json.Unmarshal(output, &parsedOutput)
+
+	flatMapping := flattenMapping(result.Mapping)
+	for field, mapping := range flatMapping {
+		value, _ := getMapPath(parsedOutput, field)
+		result.Fields = append(result.Fields, FieldProvenance{
+			Field:         field,
+			Mapping:       mapping,
+			Value:         value,
+			HumanAuthored: meta.Fields[field].HumanAuthored,
+			Locked:        meta.Fields[field].Locked,
+		})
+	}
+
+	sort.Slice(result.Fields, func(i, j int) bool {
+		return result.Fields[i].Field < result.Fields[j].Field
+	})
+
+	// The standard is looked up where the translation found it, e.g. in the store of the org
+	shuffleConfig := ShuffleConfig{}
+	if len(inputConfig) > 0 {
+		shuffleConfig, _ = parseAuthConfig(inputConfig[0])
+	}
+
+	standardFields, err := GetStandardFields(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Failed checking the output against standard %s: %s", inputStandard, err))
+		return result, nil
+	}
+
+	paths := leafFieldPaths(standardFields)
+	for _, path := range paths {
+		value, found := getMapPath(parsedOutput, path)
+		if !found || isEmptyValue(value) {
+			result.MissingFields = append(result.MissingFields, path)
+		}
+	}
+
+	for field := range flatMapping {
+		if !isStandardPath(field, paths) {
+			result.UnknownFields = append(result.UnknownFields, field)
+		}
+	}
+
+	sort.Strings(result.UnknownFields)
+	return result, nil
+}
+
+// The paths of the fields without children. Lists and fields referencing other standards count as a single field.
+func leafFieldPaths(fields []StandardField) []string {
+	paths := []string{}
+	for _, field := range fields {
+		if len(field.Fields) == 0 || field.Type == "array" || len(field.Standard) > 0 {
+			paths = append(paths, field.Path)
+			continue
+		}
+
+		paths = append(paths, leafFieldPaths(field.Fields)...)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// Checks if a mapped field is a field of the standard, inside one, or a whole object of the standard
+func isStandardPath(field string, paths []string) bool {
+	for _, path := range paths {
+		if field == path || strings.HasPrefix(field, path+".") || strings.HasPrefix(path, field+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	switch val := reflect.ValueOf(value); val.Kind() {
+	case reflect.String, reflect.Map, reflect.Slice:
+		return val.Len() == 0
+	}
+
+	return false
+}
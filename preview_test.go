@@ -0,0 +1,191 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPreviewTranslateUsesConfig(t *testing.T) {
+	store := useTestSQLStore(t)
+	SetStore(store)
+	SetCacheBackend(NewMemoryCache())
+	SetOffline(true)
+	t.Cleanup(func() {
+		SetStore(nil)
+		SetOffline(false)
+	})
+
+	// Only in the store of the org
+	putTestStandards(t, store.WithOrg("acme"), map[string]string{
+		"ticket": `{"title": "The title", "severity": "The severity"}`,
+	})
+
+	useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject", "priority": "$level"}`
+	})
+
+	result, err := PreviewTranslate(context.Background(), "ticket", []byte(`{"subject": "Disk full", "level": "high"}`), PreviewOptions{AllowLLM: true}, "false,,,acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Warnings) != 0 {
+		t.Errorf("expected the standard to be found in the org, got %v", result.Warnings)
+	}
+
+	if strings.Join(result.MissingFields, ",") != "severity" || strings.Join(result.UnknownFields, ",") != "priority" {
+		t.Errorf("expected the output to be checked against the standard of the org, got missing %v and unknown %v", result.MissingFields, result.UnknownFields)
+	}
+}
+
+// Counts what is written to a store and a cache, to check that previews write nothing
+type writeCounter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (counter *writeCounter) add(write string) {
+	counter.mu.Lock()
+	counter.writes = append(counter.writes, write)
+	counter.mu.Unlock()
+}
+
+func (counter *writeCounter) reset() []string {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	writes := counter.writes
+	counter.writes = nil
+	return writes
+}
+
+type writeCountingStore struct {
+	*MemoryStore
+	counter *writeCounter
+}
+
+func (store *writeCountingStore) Put(ctx context.Context, namespace, key string, data []byte) error {
+	store.counter.add("put " + namespace + "/" + key)
+	return store.MemoryStore.Put(ctx, namespace, key, data)
+}
+
+func (store *writeCountingStore) Delete(ctx context.Context, namespace, key string) error {
+	store.counter.add("delete " + namespace + "/" + key)
+	return store.MemoryStore.Delete(ctx, namespace, key)
+}
+
+func (store *writeCountingStore) IncrementUsage(ctx context.Context, namespace, key string) error {
+	store.counter.add("usage " + namespace + "/" + key)
+	return store.MemoryStore.IncrementUsage(ctx, namespace, key)
+}
+
+type writeCountingCache struct {
+	*MemoryCache
+	counter *writeCounter
+}
+
+func (cache *writeCountingCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	cache.counter.add("cache set " + key)
+	return cache.MemoryCache.Set(ctx, key, value, ttl)
+}
+
+func (cache *writeCountingCache) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	cache.counter.add("cache add " + key)
+	return cache.MemoryCache.Add(ctx, key, value, ttl)
+}
+
+func (cache *writeCountingCache) Renew(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	cache.counter.add("cache renew " + key)
+	return cache.MemoryCache.Renew(ctx, key, value, ttl)
+}
+
+func (cache *writeCountingCache) Release(ctx context.Context, key string, value []byte) (bool, error) {
+	cache.counter.add("cache release " + key)
+	return cache.MemoryCache.Release(ctx, key, value)
+}
+
+func (cache *writeCountingCache) Delete(ctx context.Context, key string) error {
+	cache.counter.add("cache delete " + key)
+	return cache.MemoryCache.Delete(ctx, key)
+}
+
+func TestPreviewTranslateWritesNothing(t *testing.T) {
+	memoryStore := useTestStore(t)
+	putTestStandards(t, memoryStore, map[string]string{
+		"ticket": `{"title": "The title", "severity": "The severity", "assignee": {"$ref": "user"}}`,
+		"user":   `{"name": "The name"}`,
+	})
+
+	requests := useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject", "severity": "$level"}`
+	})
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Disk full", "level": "high", "owner": {"login": "bob"}}`)
+	keyTokenFile := saveTestMapping(t, "ticket", input, `{"title": "$subject", "assignee": "$owner"}`)
+	saveTestMapping(t, "user", []byte(`{"login": "bob"}`), `{"name": "$login"}`)
+
+	counter := &writeCounter{}
+	SetStore(&writeCountingStore{MemoryStore: memoryStore, counter: counter})
+	SetCacheBackend(&writeCountingCache{MemoryCache: NewMemoryCache(), counter: counter})
+
+	// The stored mapping, with the referenced standard translated by its own stored mapping
+	result, err := PreviewTranslate(ctx, "ticket", input, PreviewOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.MappingSource != "stored" || !strings.HasSuffix(result.MappingFile, keyTokenFile) || !strings.Contains(string(result.Output), `"bob"`) {
+		t.Errorf("expected the stored mapping with the assignee translated, got %s from %s %s", result.Output, result.MappingSource, result.MappingFile)
+	}
+
+	// A candidate mapping
+	result, err = PreviewTranslate(ctx, "ticket", input, PreviewOptions{Mapping: map[string]interface{}{"title": "$level"}})
+	if err != nil || result.MappingSource != "candidate" || !strings.Contains(string(result.Output), `"high"`) {
+		t.Errorf("expected the candidate mapping to be used, got %s from %s (%v)", result.Output, result.MappingSource, err)
+	}
+
+	// A new input structure, only mapped when the LLM is allowed
+	newInput := []byte(`{"subject": "CPU high", "level": "low", "host": "web"}`)
+	_, err = PreviewTranslate(ctx, "ticket", newInput, PreviewOptions{})
+	if !errors.Is(err, ErrNoMapping) || requests.Load() != 0 {
+		t.Errorf("expected ErrNoMapping without asking the LLM, got %v after %d requests", err, requests.Load())
+	}
+
+	result, err = PreviewTranslate(ctx, "ticket", newInput, PreviewOptions{AllowLLM: true})
+	if err != nil || result.MappingSource != "llm" || requests.Load() != 1 {
+		t.Errorf("expected a mapping from the LLM, got %s from %s after %d requests (%v)", result.Output, result.MappingSource, requests.Load(), err)
+	}
+
+	if writes := counter.reset(); len(writes) != 0 {
+		t.Errorf("expected previews not to write anything, got %v", writes)
+	}
+
+	if _, ok := getMappingPlan(ctx, ShuffleConfig{}, keyTokenFile); ok {
+		t.Error("expected previews not to compile a plan")
+	}
+
+	// Nothing was kept for the new structure, so it is still missing afterwards
+	newKey, err := MappingFile("ticket", newInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := GetExistingStructureContext(ctx, newKey, ShuffleConfig{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected no mapping to be saved for %s, got %v", newKey, err)
+	}
+
+	// Translations still write as usual, so the counting works
+	_, _, err = Translate(ctx, "ticket", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if writes := counter.reset(); len(writes) == 0 {
+		t.Error("expected the translation to record its usage")
+	}
+}
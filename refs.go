@@ -0,0 +1,379 @@
+package schemaless
+
+/*
+Handles references to other standards inside a standard, such as {"assignee": {"$ref": "user"}} or {"observables": [{"$ref": "observable"}]}.
+The LLM maps each referenced field to the location of the object or list in the input, and the value there is translated with its own standard and mapping.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returned when standards reference each other in a loop
+var ErrStandardCycle = errors.New("Standard reference cycle")
+
+// Max depth of standards referencing other standards
+var maxStandardRefDepth = 10
+
+// Key used in a standard to reference another standard
+const standardRefKey = "$ref"
+
+// Used in the translation config to pass the standards already being translated down to nested translations
+const refChainConfigPrefix = "ref_chain:"
+
+// A field in a standard which references another standard
+type standardRef struct {
+	// Dot separated path of the field in the standard
+	Field string
+
+	// The name of the referenced standard
+	Standard string
+
+	// Set when the field is a list of the referenced standard
+	List bool
+}
+
+// The result of translating a referenced field
+type ReferenceResult struct {
+	Field       string `json:"field"`
+	Standard    string `json:"standard"`
+	MappingFile string `json:"mapping_file,omitempty"`
+
+	// One per list item for list references
+	Items []ListItemResult `json:"items,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Gets the name of a referenced standard if value is {"$ref": "name"}
+func getStandardRef(value interface{}) (string, bool) {
+	refMap, ok := value.(map[string]interface{})
+	if !ok || len(refMap) != 1 {
+		return "", false
+	}
+
+	name, ok := refMap[standardRefKey].(string)
+	if !ok || len(strings.TrimSpace(name)) == 0 {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimSpace(name), ".json"), true
+}
+
+// Finds all fields referencing other standards, sorted by field
+func findStandardRefs(standard map[string]interface{}, prefix string) []standardRef {
+	refs := []standardRef{}
+	for key, value := range standard {
+		field := key
+		if len(prefix) > 0 {
+			field = fmt.Sprintf("%s.%s", prefix, key)
+		}
+
+		if name, ok := getStandardRef(value); ok {
+			refs = append(refs, standardRef{Field: field, Standard: name})
+			continue
+		}
+
+		if list, ok := value.([]interface{}); ok && len(list) == 1 {
+			if name, ok := getStandardRef(list[0]); ok {
+				refs = append(refs, standardRef{Field: field, Standard: name, List: true})
+			}
+
+			continue
+		}
+
+		if subMap, ok := value.(map[string]interface{}); ok {
+			refs = append(refs, findStandardRefs(subMap, field)...)
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Field < refs[j].Field
+	})
+
+	return refs
+}
+
+// Parses a standard and finds its references. Standards that aren't JSON objects have none.
+func parseStandardRefs(standardFormat []byte) []standardRef {
+	if !strings.Contains(string(standardFormat), standardRefKey) {
+		return []standardRef{}
+	}
+
+	parsedStandard := map[string]interface{}{}
+	err := json.Unmarshal(standardFormat, &parsedStandard)
+	if err != nil {
+		return []standardRef{}
+	}
+
+	return findStandardRefs(parsedStandard, "")
+}
+
+// Replaces references in a standard with instructions for the LLM to map the field to the location of the whole object or list
+func describeStandardRefs(standardFormat string) string {
+	refs := parseStandardRefs([]byte(standardFormat))
+	if len(refs) == 0 {
+		return standardFormat
+	}
+
+	parsedStandard := map[string]interface{}{}
+	err := json.Unmarshal([]byte(standardFormat), &parsedStandard)
+	if err != nil {
+		return standardFormat
+	}
+
+	for _, ref := range refs {
+		description := fmt.Sprintf("The path of the whole '%s' object in the user input, such as $data.%s. Must be a single path to the object, as it is translated separately.", ref.Standard, ref.Standard)
+		if ref.List {
+			description = fmt.Sprintf("The path of the list of '%s' objects in the user input, such as $data.items. Must be a single path to the list, NOT an array, as each item is translated separately.", ref.Standard)
+		}
+
+		setMapPath(parsedStandard, ref.Field, description)
+	}
+
+	described, err := json.MarshalIndent(parsedStandard, "", "\t")
+	if err != nil {
+		return standardFormat
+	}
+
+	return string(described)
+}
+
+// Loads every standard referenced from inputStandard, recursively, and fails if they reference each other in a loop
+func resolveStandardRefs(ctx context.Context, inputStandard string, chain []string, shuffleConfig ShuffleConfig) error {
+	if err := checkStandardChain(inputStandard, chain); err != nil {
+		return err
+	}
+
+	standardFormat, _, err := GetStandardContext(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed loading referenced standard %s: %s", inputStandard, err))
+	}
+
+	chain = append(chain, inputStandard)
+	for _, ref := range parseStandardRefs(standardFormat) {
+		err = resolveStandardRefs(ctx, ref.Standard, chain, shuffleConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fails if the standard is already being translated further up, or the references go too deep
+func checkStandardChain(inputStandard string, chain []string) error {
+	for _, parent := range chain {
+		if standardKey(parent) == standardKey(inputStandard) {
+			return fmt.Errorf("%w: %s -> %s", ErrStandardCycle, strings.Join(chain, " -> "), inputStandard)
+		}
+	}
+
+	if len(chain) >= maxStandardRefDepth {
+		return errors.New(fmt.Sprintf("Standard references are deeper than %d: %s -> %s", maxStandardRefDepth, strings.Join(chain, " -> "), inputStandard))
+	}
+
+	return nil
+}
+
+// Translates the referenced fields of a translation. Each value the mapping points to is translated
+// with the referenced standard, and replaces the field in the translation.
+func translateStandardRefs(ctx context.Context, info *TranslationInfo, refs []standardRef, chain []string, mapping map[string]interface{}, inputValue, translation []byte, authConfig string) ([]byte, error) {
+	parsedInput := map[string]interface{}{}
+	err := json.Unmarshal(inputValue, &parsedInput)
+	if err != nil {
+		return translation, err
+	}
+
+	parsedTranslation := map[string]interface{}{}
+	err = json.Unmarshal(translation, &parsedTranslation)
+	if err != nil {
+		return translation, err
+	}
+
+	refChain := fmt.Sprintf("%s%s", refChainConfigPrefix, strings.Join(chain, ","))
+	for _, ref := range refs {
+		if err := checkStandardChain(ref.Standard, chain); err != nil {
+			return translation, err
+		}
+
+		result := ReferenceResult{
+			Field:    ref.Field,
+			Standard: ref.Standard,
+		}
+
+		var emptyValue interface{}
+		if ref.List {
+			emptyValue = []interface{}{}
+		}
+
+		value, found := findReferencedValue(mapping, parsedInput, ref.Field)
+		if !found {
+			if debug {
+				log.Printf("[DEBUG] Schemaless: No value found for the '%s' reference in field '%s'", ref.Standard, ref.Field)
+			}
+
+			setMapPath(parsedTranslation, ref.Field, emptyValue)
+			info.References = append(info.References, result)
+			continue
+		}
+
+		marshalledValue, err := json.Marshal(value)
+		if err != nil {
+			return translation, err
+		}
+
+		subInfo := TranslationInfo{}
+		var output []byte
+		if ref.List {
+			output, result.MappingFile, err = handleSubStandard(ctx, &subInfo, ref.Standard, string(marshalledValue), authConfig, refChain)
+			result.Items = subInfo.Items
+		} else if _, ok := value.(map[string]interface{}); ok {
+			output, result.MappingFile, err = translate(ctx, &subInfo, ref.Standard, marshalledValue, authConfig, refChain)
+		} else {
+			err = errors.New(fmt.Sprintf("Value for the '%s' reference is not an object", ref.Standard))
+		}
+
+		for _, warning := range subInfo.Warnings {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("%s: %s", ref.Field, warning))
+		}
+
+		info.References = append(info.References, subInfo.References...)
+		for _, validationError := range subInfo.ValidationErrors {
+			validationError.Pointer = fmt.Sprintf("%s%s", fieldPointer(ref.Field), validationError.Pointer)
+			info.ValidationErrors = append(info.ValidationErrors, validationError)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrStandardCycle) {
+				return translation, err
+			}
+
+			log.Printf("[WARNING] Schemaless: Failed translating field '%s' to standard '%s': %s", ref.Field, ref.Standard, err)
+			result.Error = err.Error()
+			info.References = append(info.References, result)
+			info.Warnings = append(info.Warnings, fmt.Sprintf("Failed translating field '%s' to standard '%s': %s", ref.Field, ref.Standard, err))
+			setMapPath(parsedTranslation, ref.Field, emptyValue)
+			continue
+		}
+
+		var parsedOutput interface{}
+		err = json.Unmarshal(output, &parsedOutput)
+		if err != nil {
+			return translation, errors.New(fmt.Sprintf("Invalid output for the '%s' reference in field '%s': %s", ref.Standard, ref.Field, err))
+		}
+
+		info.References = append(info.References, result)
+		setMapPath(parsedTranslation, ref.Field, parsedOutput)
+	}
+
+	return json.MarshalIndent(parsedTranslation, "", "\t")
+}
+
+// Finds the input value the mapping points to for a referenced field
+func findReferencedValue(mapping, parsedInput map[string]interface{}, field string) (interface{}, bool) {
+	mapped, found := getMapPath(mapping, field)
+	if !found {
+		return nil, false
+	}
+
+	path, ok := mapped.(string)
+	if !ok || !strings.Contains(path, "$") {
+		return nil, false
+	}
+
+	// Lists may be written as $data.items[] or $data.items.#
+	path = getParsedMatch(path)
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "[]"), ".#")
+
+	value, found := getInputPath(parsedInput, path)
+	if !found || value == nil {
+		return nil, false
+	}
+
+	return value, true
+}
+
+// Gets a value from parsed JSON based on a path such as data.items.#0.user or data.items[0].user
+func getInputPath(input interface{}, path string) (interface{}, bool) {
+	path = strings.ReplaceAll(strings.ReplaceAll(path, "[", ".#"), "]", "")
+
+	current := input
+	for _, key := range strings.Split(path, ".") {
+		if len(key) == 0 {
+			continue
+		}
+
+		switch value := current.(type) {
+		case map[string]interface{}:
+			next, ok := value[key]
+			if !ok {
+				return nil, false
+			}
+
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(strings.TrimPrefix(key, "#"))
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, false
+			}
+
+			current = value[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// Removes the referenced fields from a mapping, as they are translated on their own
+func withoutStandardRefs(mapping map[string]interface{}, refs []standardRef) map[string]interface{} {
+	stripped := copyMap(mapping)
+	for _, ref := range refs {
+		keys := strings.Split(ref.Field, ".")
+		parent := stripped
+		for _, key := range keys[:len(keys)-1] {
+			subMap, ok := parent[key].(map[string]interface{})
+			if !ok {
+				parent = nil
+				break
+			}
+
+			parent = subMap
+		}
+
+		if parent != nil {
+			delete(parent, keys[len(keys)-1])
+		}
+	}
+
+	return stripped
+}
+
+// Gets the standards already being translated from the translation config
+func parseRefChain(inputConfig []string) []string {
+	for _, config := range inputConfig {
+		if !strings.HasPrefix(config, refChainConfigPrefix) {
+			continue
+		}
+
+		chain := []string{}
+		for _, name := range strings.Split(strings.TrimPrefix(config, refChainConfigPrefix), ",") {
+			if len(name) > 0 {
+				chain = append(chain, name)
+			}
+		}
+
+		return chain
+	}
+
+	return []string{}
+}
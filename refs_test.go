@@ -0,0 +1,170 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Saves standards in the test store by name
+func putTestStandards(t *testing.T, store Store, standards map[string]string) {
+	t.Helper()
+
+	for name, standard := range standards {
+		err := store.Put(context.Background(), NamespaceStandards, name, []byte(standard))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindStandardRefs(t *testing.T) {
+	standard := []byte(`{
+		"title": "The title",
+		"assignee": {"$ref": "user"},
+		"observables": [{"$ref": "observable.json"}],
+		"source": {"host": {"$ref": " host "}, "ip": "The IP"},
+		"not_a_ref": {"$ref": "user", "extra": "Two keys"},
+		"empty": {"$ref": ""}
+	}`)
+
+	found := []string{}
+	for _, ref := range parseStandardRefs(standard) {
+		found = append(found, fmt.Sprintf("%s=%s:%t", ref.Field, ref.Standard, ref.List))
+	}
+
+	expected := "assignee=user:false,observables=observable:true,source.host=host:false"
+	if strings.Join(found, ",") != expected {
+		t.Errorf("got %s, expected %s", strings.Join(found, ","), expected)
+	}
+
+	if refs := parseStandardRefs([]byte(`[ticket]`)); len(refs) != 0 {
+		t.Errorf("expected no references in a list standard, got %v", refs)
+	}
+}
+
+func TestResolveStandardRefCycles(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket":     `{"title": "The title", "assignee": {"$ref": "user"}, "related": [{"$ref": "ticket_ref"}]}`,
+		"user":       `{"name": "The name", "manager": {"$ref": "manager"}}`,
+		"manager":    `{"name": "The name", "reports": [{"$ref": "user"}]}`,
+		"ticket_ref": `{"id": "The ID"}`,
+		"self":       `{"parent": {"$ref": "self.json"}}`,
+
+		// Two fields referencing the same standard isn't a cycle
+		"alert":   `{"source": {"$ref": "host"}, "target": {"$ref": "host"}}`,
+		"host":    `{"name": "The host name", "os": {"$ref": "os"}}`,
+		"os":      `{"name": "The OS name"}`,
+		"missing": `{"owner": {"$ref": "nowhere"}}`,
+	})
+
+	ctx := context.Background()
+	tests := map[string]string{
+		"ticket":  "ticket -> user -> manager -> user",
+		"user":    "user -> manager -> user",
+		"self":    "self -> self",
+		"alert":   "",
+		"missing": "nowhere",
+	}
+
+	for standard, expected := range tests {
+		err := resolveStandardRefs(ctx, standard, []string{}, ShuffleConfig{})
+		if len(expected) == 0 {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", standard, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error with %q, got %v", standard, expected, err)
+		}
+
+		if standard != "missing" && !errors.Is(err, ErrStandardCycle) {
+			t.Errorf("%s: expected ErrStandardCycle, got %v", standard, err)
+		}
+	}
+}
+
+func TestStandardRefDepth(t *testing.T) {
+	store := useTestStore(t)
+
+	standards := map[string]string{}
+	for cnt := 0; cnt < maxStandardRefDepth+1; cnt++ {
+		standards[fmt.Sprintf("level%d", cnt)] = fmt.Sprintf(`{"next": {"$ref": "level%d"}}`, cnt+1)
+	}
+
+	standards[fmt.Sprintf("level%d", maxStandardRefDepth+1)] = `{"name": "The end"}`
+	putTestStandards(t, store, standards)
+
+	err := resolveStandardRefs(context.Background(), "level0", []string{}, ShuffleConfig{})
+	if err == nil || errors.Is(err, ErrStandardCycle) || !strings.Contains(err.Error(), "deeper than") {
+		t.Errorf("expected the depth limit, got %v", err)
+	}
+
+	err = resolveStandardRefs(context.Background(), "level2", []string{}, ShuffleConfig{})
+	if err != nil {
+		t.Errorf("expected references within the limit to resolve, got %v", err)
+	}
+}
+
+func TestTranslateStandardRefCycle(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"user":    `{"name": "The name", "manager": {"$ref": "manager"}}`,
+		"manager": `{"name": "The name", "reports": [{"$ref": "user"}]}`,
+	})
+
+	requests := useFakeLLM(t, func(system, user string) string {
+		return `{"name": "$name"}`
+	})
+
+	_, _, err := Translate(context.Background(), "user", []byte(`{"name": "alice"}`))
+	if !errors.Is(err, ErrStandardCycle) {
+		t.Errorf("expected ErrStandardCycle, got %v", err)
+	}
+
+	if requests.Load() != 0 {
+		t.Errorf("expected the cycle to fail before asking the LLM, got %d requests", requests.Load())
+	}
+
+	// Nested translations get the chain of the standards above them
+	chain := parseRefChain([]string{"auth", refChainConfigPrefix + "ticket,user"})
+	if strings.Join(chain, ",") != "ticket,user" {
+		t.Errorf("unexpected chain %v", chain)
+	}
+
+	err = checkStandardChain("user.json", chain)
+	if !errors.Is(err, ErrStandardCycle) {
+		t.Errorf("expected user.json to be found in the chain, got %v", err)
+	}
+}
+
+func TestGetInputPath(t *testing.T) {
+	input := map[string]interface{}{
+		"data": map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{"user": "alice"},
+				map[string]interface{}{"user": "bob"},
+			},
+		},
+	}
+
+	tests := map[string]interface{}{
+		"data.items.#1.user": "bob",
+		"data.items[0].user": "alice",
+		"data.items.#2.user": nil,
+		"data.missing":       nil,
+	}
+
+	for path, expected := range tests {
+		value, found := getInputPath(input, path)
+		if found != (expected != nil) || (found && value != expected) {
+			t.Errorf("%s: got %v (%t), expected %v", path, value, found, expected)
+		}
+	}
+}
@@ -0,0 +1,716 @@
+package schemaless
+
+/*
+Manages the standards in the store: saving, validating, versioning and deleting them, describing their fields,
+and finding the mappings that depend on them. Mappings depending on a changed standard are flagged as stale, or removed
+so they are generated again on the next translation.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned when saving a standard that fails validation
+var ErrInvalidStandard = errors.New("Invalid standard")
+
+type StandardVersion struct {
+	ID        string `json:"id"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+	User      string `json:"user,omitempty"`
+
+	// Where a standard loaded from a remote standard source was downloaded from, e.g. github.com/shuffle/standards/translation_standards/ticket.json@4f2c1e9
+	Source string `json:"source,omitempty"`
+
+	// Set on the version recording that the standard was deleted
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// A field of a standard, with its children for objects and lists of objects
+type StandardField struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	// string, number, integer, boolean, object or array. Fields without a known type are strings.
+	Type string `json:"type"`
+
+	// The type of the items of arrays
+	Items string `json:"items,omitempty"`
+
+	Description string        `json:"description,omitempty"`
+	Format      string        `json:"format,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+
+	// The standard the field references, translated on its own
+	Standard string `json:"standard,omitempty"`
+
+	// The standard the field is inherited from, for standards extending other standards
+	Inherited string `json:"inherited,omitempty"`
+
+	Fields []StandardField `json:"fields,omitempty"`
+}
+
+// What depends on a standard
+type StandardDependents struct {
+	// Standards extending or referencing the standard, directly or through other standards
+	Standards []string `json:"standards"`
+
+	// Mappings made for the standard or one of the dependent standards
+	Mappings []string `json:"mappings"`
+}
+
+// Lists the standards in the store
+func ListStandards(ctx context.Context, shuffleConfig ShuffleConfig) ([]string, error) {
+	keys, err := GetStore(shuffleConfig).List(ctx, NamespaceStandards)
+	if err != nil {
+		return []string{}, err
+	}
+
+	standards := []string{}
+	for _, key := range keys {
+		standards = append(standards, standardKey(key))
+	}
+
+	sort.Strings(standards)
+	return standards, nil
+}
+
+func checkStandardName(inputStandard string) (string, error) {
+	inputStandard = standardKey(strings.TrimSpace(inputStandard))
+	if len(inputStandard) == 0 || strings.Contains(inputStandard, "..") || strings.ContainsAny(inputStandard, `\`) {
+		return inputStandard, fmt.Errorf("%w: bad name '%s'", ErrInvalidStandard, inputStandard)
+	}
+
+	if isPackStandard(inputStandard) {
+		return inputStandard, fmt.Errorf("%w: '%s' is a pack standard, which can't be changed. Save it with another name, and extend it to build on it.", ErrInvalidStandard, inputStandard)
+	}
+
+	return inputStandard, nil
+}
+
+// Checks a standard before it is saved. Returns the problems found, which is empty for a valid standard.
+// Standards it extends or references must exist, and must not lead back to it.
+func ValidateStandard(ctx context.Context, inputStandard string, standardFormat []byte, shuffleConfig ShuffleConfig) []SchemaValidationError {
+	problems := []SchemaValidationError{}
+	inputStandard = standardKey(inputStandard)
+
+	trimmedStandard := strings.TrimSpace(string(standardFormat))
+	if len(trimmedStandard) == 0 {
+		return append(problems, SchemaValidationError{Keyword: "json", Message: "The standard is empty"})
+	}
+
+	// Older standards can be [name] for a list of another standard, or name.json to side-load another standard
+	if !json.Valid([]byte(trimmedStandard)) {
+		linked := ""
+		if len(trimmedStandard) > 2 && strings.HasPrefix(trimmedStandard, "[") && strings.HasSuffix(trimmedStandard, "]") {
+			linked = strings.TrimSuffix(strings.TrimPrefix(trimmedStandard, "["), "]")
+		} else if strings.HasSuffix(trimmedStandard, ".json") && !strings.ContainsAny(trimmedStandard, "{}[] \n") {
+			linked = trimmedStandard
+		}
+
+		if len(linked) == 0 {
+			return append(problems, SchemaValidationError{Keyword: "json", Message: "The standard is not valid JSON"})
+		}
+
+		if standardKey(linked) == inputStandard {
+			return append(problems, SchemaValidationError{Keyword: "$ref", Message: fmt.Sprintf("The standard links to itself: %s", linked)})
+		}
+
+		if _, _, err := GetStandardContext(ctx, linked, shuffleConfig); err != nil {
+			problems = append(problems, SchemaValidationError{Keyword: "$ref", Message: fmt.Sprintf("Linked standard %s not found: %s", linked, err)})
+		}
+
+		return problems
+	}
+
+	parsedStandard := map[string]interface{}{}
+	err := json.Unmarshal([]byte(trimmedStandard), &parsedStandard)
+	if err != nil {
+		return append(problems, SchemaValidationError{Keyword: "json", Message: "The standard must be a JSON object"})
+	}
+
+	converted, err := ConvertStandardFormat([]byte(trimmedStandard))
+	if err != nil {
+		return append(problems, SchemaValidationError{Keyword: "schema", Message: err.Error()})
+	}
+
+	bases, err := getStandardBases(parsedStandard)
+	if err != nil {
+		problems = append(problems, SchemaValidationError{Pointer: "/" + standardExtendsKey, Keyword: standardExtendsKey, Message: err.Error()})
+	} else if len(bases) > 0 {
+		_, err = composeStandard(ctx, inputStandard, converted, []string{}, shuffleConfig)
+		if err != nil {
+			problems = append(problems, SchemaValidationError{Pointer: "/" + standardExtendsKey, Keyword: standardExtendsKey, Message: err.Error()})
+		}
+	}
+
+	fields := map[string]interface{}{}
+	json.Unmarshal(converted, &fields)
+	delete(fields, standardExtendsKey)
+	if len(fields) == 0 && len(bases) == 0 {
+		problems = append(problems, SchemaValidationError{Keyword: "properties", Message: "The standard has no fields"})
+	}
+
+	for _, ref := range findStandardRefs(fields, "") {
+		err = resolveStandardRefs(ctx, ref.Standard, []string{inputStandard}, shuffleConfig)
+		if err != nil {
+			problems = append(problems, SchemaValidationError{Pointer: fieldPointer(ref.Field), Keyword: standardRefKey, Message: err.Error()})
+		}
+	}
+
+	return problems
+}
+
+// Saves a standard after validating it, as a new version if it changed. Mappings depending on the standard
+// are flagged as stale, or removed if invalidate is set.
+func SaveStandard(ctx context.Context, inputStandard string, standardFormat []byte, user string, invalidate bool, shuffleConfig ShuffleConfig) (StandardVersion, error) {
+	inputStandard, err := checkStandardName(inputStandard)
+	if err != nil {
+		return StandardVersion{}, err
+	}
+
+	problems := ValidateStandard(ctx, inputStandard, standardFormat, shuffleConfig)
+	if len(problems) > 0 {
+		messages := []string{}
+		for _, problem := range problems {
+			messages = append(messages, problem.Error())
+		}
+
+		return StandardVersion{}, fmt.Errorf("%w: %s", ErrInvalidStandard, strings.Join(messages, ", "))
+	}
+
+	store := GetStore(shuffleConfig)
+	existing, err := store.Get(ctx, NamespaceStandards, inputStandard)
+	if err == nil && string(existing) == string(standardFormat) {
+		versions, _ := ListStandardVersions(ctx, inputStandard, shuffleConfig)
+		if len(versions) > 0 && !versions[len(versions)-1].Deleted {
+			return versions[len(versions)-1], nil
+		}
+	}
+
+	err = store.Put(ctx, NamespaceStandards, inputStandard, standardFormat)
+	if err != nil {
+		return StandardVersion{}, err
+	}
+
+	// Plans hold on to the references and schema of the standards they were compiled with
+	resetMappingPlans()
+
+	version, err := addStandardVersion(ctx, store, inputStandard, standardFormat, user, "", false)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed saving version of standard %s: %s", inputStandard, err)
+	}
+
+	// A new standard has nothing depending on it yet
+	if len(existing) > 0 {
+		staleDependents(ctx, inputStandard, version, "changed", invalidate, shuffleConfig)
+	}
+
+	return version, nil
+}
+
+// Deletes a standard. Its versions are kept. Mappings depending on it are flagged as stale, or removed if invalidate is set.
+func DeleteStandard(ctx context.Context, inputStandard, user string, invalidate bool, shuffleConfig ShuffleConfig) error {
+	inputStandard, err := checkStandardName(inputStandard)
+	if err != nil {
+		return err
+	}
+
+	store := GetStore(shuffleConfig)
+	existing, err := store.Get(ctx, NamespaceStandards, inputStandard)
+	if err != nil {
+		return err
+	}
+
+	// Found before deleting, while the standard can still be loaded
+	dependents, err := GetStandardDependents(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed finding what depends on standard %s: %s", inputStandard, err)
+	}
+
+	err = store.Delete(ctx, NamespaceStandards, inputStandard)
+	if err != nil {
+		return err
+	}
+
+	resetMappingPlans()
+
+	version, err := addStandardVersion(ctx, store, inputStandard, existing, user, "", true)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed saving deletion of standard %s: %s", inputStandard, err)
+	}
+
+	updateDependentMappings(ctx, inputStandard, version, "deleted", dependents.Mappings, invalidate, shuffleConfig)
+	return nil
+}
+
+func standardHistoryKey(inputStandard, versionID string) string {
+	return fmt.Sprintf("%s-%s", inputStandard, versionID)
+}
+
+// Adds a version to the version list of a standard, and saves a copy of the standard for it
+func addStandardVersion(ctx context.Context, store Store, inputStandard string, standardFormat []byte, user, source string, deleted bool) (StandardVersion, error) {
+	version := StandardVersion{}
+	err := updateStore(ctx, store, NamespaceStandardHistory, inputStandard, func(existing []byte) ([]byte, error) {
+		versions := []StandardVersion{}
+		if len(existing) > 0 {
+			err := json.Unmarshal(existing, &versions)
+			if err != nil {
+				return existing, errors.New(fmt.Sprintf("Invalid version list for standard %s: %s", inputStandard, err))
+			}
+		}
+
+		version = StandardVersion{
+			ID:        fmt.Sprintf("v%d", len(versions)+1),
+			Hash:      fmt.Sprintf("%x", sha256.Sum256(standardFormat)),
+			Timestamp: time.Now().Unix(),
+			User:      user,
+			Source:    source,
+			Deleted:   deleted,
+		}
+
+		versions = append(versions, version)
+		return json.MarshalIndent(versions, "", "\t")
+	})
+	if err != nil {
+		return version, err
+	}
+
+	if deleted {
+		return version, nil
+	}
+
+	return version, store.Put(ctx, NamespaceStandardHistory, standardHistoryKey(inputStandard, version.ID), standardFormat)
+}
+
+// Lists the versions of a standard, oldest first
+func ListStandardVersions(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]StandardVersion, error) {
+	versions := []StandardVersion{}
+	data, err := GetStore(shuffleConfig).Get(ctx, NamespaceStandardHistory, standardKey(inputStandard))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return versions, nil
+		}
+
+		return versions, err
+	}
+
+	err = json.Unmarshal(data, &versions)
+	return versions, err
+}
+
+// Gets a standard as it was in a specific version
+func GetStandardVersion(ctx context.Context, inputStandard, versionID string, shuffleConfig ShuffleConfig) ([]byte, error) {
+	return GetStore(shuffleConfig).Get(ctx, NamespaceStandardHistory, standardHistoryKey(standardKey(inputStandard), versionID))
+}
+
+// Describes the fields of a standard, including the ones it inherits, sorted by name
+func GetStandardFields(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]StandardField, error) {
+	return getStandardFields(ctx, standardKey(inputStandard), []string{}, shuffleConfig)
+}
+
+func getStandardFields(ctx context.Context, inputStandard string, chain []string, shuffleConfig ShuffleConfig) ([]StandardField, error) {
+	if err := checkStandardChain(inputStandard, chain); err != nil {
+		return []StandardField{}, err
+	}
+
+	rawStandard, _, err := getRawStandard(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return []StandardField{}, err
+	}
+
+	parsedStandard := map[string]interface{}{}
+	err = json.Unmarshal(rawStandard, &parsedStandard)
+	if err != nil {
+		return []StandardField{}, errors.New(fmt.Sprintf("Standard %s is not a JSON object", inputStandard))
+	}
+
+	bases, err := getStandardBases(parsedStandard)
+	if err != nil {
+		return []StandardField{}, err
+	}
+
+	fields := map[string]StandardField{}
+	for _, base := range bases {
+		baseFields, err := getStandardFields(ctx, base, append(chain, inputStandard), shuffleConfig)
+		if err != nil {
+			return []StandardField{}, err
+		}
+
+		for _, field := range baseFields {
+			if len(field.Inherited) == 0 {
+				field.Inherited = base
+			}
+
+			fields[field.Name] = field
+		}
+	}
+
+	ownFields := []StandardField{}
+	if schema, ok := parseJSONSchema(rawStandard); ok {
+		ownFields = schema.fields(schema.root, "", 0)
+	} else {
+		delete(parsedStandard, standardExtendsKey)
+		ownFields = exampleFields(parsedStandard, "")
+	}
+
+	for _, field := range ownFields {
+		fields[field.Name] = field
+	}
+
+	// null removes an inherited field
+	for key, value := range parsedStandard {
+		if value == nil {
+			delete(fields, key)
+		}
+	}
+
+	return sortedFields(fields), nil
+}
+
+func sortedFields(fields map[string]StandardField) []StandardField {
+	sorted := []StandardField{}
+	for _, field := range fields {
+		sorted = append(sorted, field)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted
+}
+
+func fieldPath(prefix, name string) string {
+	if len(prefix) == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%s.%s", prefix, name)
+}
+
+// Describes the fields of an example-style standard, where the values are descriptions or examples
+func exampleFields(standard map[string]interface{}, prefix string) []StandardField {
+	fields := map[string]StandardField{}
+	for key, value := range standard {
+		if value == nil {
+			continue
+		}
+
+		fields[key] = exampleField(key, fieldPath(prefix, key), value)
+	}
+
+	return sortedFields(fields)
+}
+
+func exampleField(name, path string, value interface{}) StandardField {
+	field := StandardField{
+		Name: name,
+		Path: path,
+		Type: "string",
+	}
+
+	if refName, ok := getStandardRef(value); ok {
+		field.Type = "object"
+		field.Standard = refName
+		return field
+	}
+
+	switch val := value.(type) {
+	case string:
+		field.Description = val
+	case float64:
+		field.Type = "number"
+	case bool:
+		field.Type = "boolean"
+	case map[string]interface{}:
+		field.Type = "object"
+		field.Fields = exampleFields(val, path)
+	case []interface{}:
+		field.Type = "array"
+		field.Items = "string"
+		if len(val) > 0 {
+			item := exampleField(name, path, val[0])
+			field.Items = item.Type
+			field.Standard = item.Standard
+			field.Fields = item.Fields
+			field.Description = item.Description
+		}
+	}
+
+	return field
+}
+
+// Describes the properties of a JSON Schema node
+func (schema *jsonSchema) fields(node map[string]interface{}, prefix string, depth int) []StandardField {
+	fields := map[string]StandardField{}
+	if depth > maxSchemaDepth {
+		return []StandardField{}
+	}
+
+	node, err := schema.resolve(node)
+	if err != nil {
+		return []StandardField{}
+	}
+
+	required := map[string]bool{}
+	if requiredList, ok := node["required"].([]interface{}); ok {
+		for _, name := range requiredList {
+			if nameString, ok := name.(string); ok {
+				required[nameString] = true
+			}
+		}
+	}
+
+	for name, property := range schemaProperties(node) {
+		propertyNode, ok := property.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		field := schema.field(name, fieldPath(prefix, name), propertyNode, depth+1)
+		field.Required = required[name]
+		fields[name] = field
+	}
+
+	return sortedFields(fields)
+}
+
+func (schema *jsonSchema) field(name, path string, node map[string]interface{}, depth int) StandardField {
+	field := StandardField{
+		Name:        name,
+		Path:        path,
+		Type:        "string",
+		Description: fieldDescription(node),
+	}
+
+	if refName, ok := getSchemaStandardRef(node); ok {
+		field.Type = "object"
+		field.Standard = refName
+		return field
+	}
+
+	resolved, err := schema.resolve(node)
+	if err != nil || depth > maxSchemaDepth {
+		return field
+	}
+
+	if len(field.Description) == 0 {
+		field.Description = fieldDescription(resolved)
+	}
+
+	for _, schemaType := range schemaTypes(resolved) {
+		if schemaType != "null" {
+			field.Type = schemaType
+			break
+		}
+	}
+
+	field.Format, _ = resolved["format"].(string)
+	if enum, ok := resolved["enum"].([]interface{}); ok {
+		field.Enum = enum
+	}
+
+	switch field.Type {
+	case "object":
+		field.Fields = schema.fields(resolved, path, depth)
+	case "array":
+		field.Items = "string"
+		if items, ok := resolved["items"].(map[string]interface{}); ok {
+			item := schema.field(name, path, items, depth+1)
+			field.Items = item.Type
+			field.Standard = item.Standard
+			field.Fields = item.Fields
+			if len(field.Enum) == 0 {
+				field.Enum = item.Enum
+			}
+		}
+	}
+
+	return field
+}
+
+// The description of a schema node as written, as the type, format and enum are fields of their own
+func fieldDescription(node map[string]interface{}) string {
+	if description, ok := node["description"].(string); ok {
+		return description
+	}
+
+	title, _ := node["title"].(string)
+	return title
+}
+
+// Finds the standards and mappings depending on a standard. Mappings are found by the standard in their metadata,
+// or by their name, <standard>-<hash>, for mappings saved without it.
+func GetStandardDependents(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) (StandardDependents, error) {
+	inputStandard = standardKey(inputStandard)
+	dependents := StandardDependents{
+		Standards: []string{},
+		Mappings:  []string{},
+	}
+
+	store := GetStore(shuffleConfig)
+	standards, err := ListStandards(ctx, shuffleConfig)
+	if err != nil {
+		return dependents, err
+	}
+
+	// The standards each standard extends or references
+	uses := map[string][]string{}
+	for _, name := range standards {
+		data, err := store.Get(ctx, NamespaceStandards, name)
+		if err != nil {
+			continue
+		}
+
+		uses[name] = standardDependencies(data)
+	}
+
+	found := map[string]bool{inputStandard: true}
+	for changed := true; changed; {
+		changed = false
+		for name, used := range uses {
+			if found[name] {
+				continue
+			}
+
+			for _, dependency := range used {
+				if found[dependency] {
+					found[name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	for name := range found {
+		if name != inputStandard {
+			dependents.Standards = append(dependents.Standards, name)
+		}
+	}
+
+	mappings, err := store.List(ctx, NamespaceMappings)
+	if err != nil {
+		return dependents, err
+	}
+
+	for _, key := range mappings {
+		data, err := store.Get(ctx, NamespaceMappings, key)
+		if err != nil {
+			continue
+		}
+
+		_, meta, err := ParseStoredMapping(data)
+		if err != nil {
+			continue
+		}
+
+		if found[meta.standard(key)] {
+			dependents.Mappings = append(dependents.Mappings, key)
+		}
+	}
+
+	sort.Strings(dependents.Standards)
+	sort.Strings(dependents.Mappings)
+	return dependents, nil
+}
+
+// Gets the names of the standards a stored standard extends, references or links to
+func standardDependencies(standardFormat []byte) []string {
+	dependencies := []string{}
+	trimmedStandard := strings.TrimSpace(string(standardFormat))
+	if !json.Valid([]byte(trimmedStandard)) {
+		if strings.HasPrefix(trimmedStandard, "[") && strings.HasSuffix(trimmedStandard, "]") {
+			return append(dependencies, standardKey(strings.TrimSuffix(strings.TrimPrefix(trimmedStandard, "["), "]")))
+		}
+
+		if strings.HasSuffix(trimmedStandard, ".json") {
+			return append(dependencies, standardKey(trimmedStandard))
+		}
+
+		return dependencies
+	}
+
+	parsedStandard := map[string]interface{}{}
+	if json.Unmarshal([]byte(trimmedStandard), &parsedStandard) != nil {
+		return dependencies
+	}
+
+	bases, _ := getStandardBases(parsedStandard)
+	dependencies = append(dependencies, bases...)
+
+	converted, err := ConvertStandardFormat([]byte(trimmedStandard))
+	if err != nil {
+		return dependencies
+	}
+
+	for _, ref := range parseStandardRefs(converted) {
+		dependencies = append(dependencies, ref.Standard)
+	}
+
+	return dependencies
+}
+
+func staleDependents(ctx context.Context, inputStandard string, version StandardVersion, reason string, invalidate bool, shuffleConfig ShuffleConfig) {
+	dependents, err := GetStandardDependents(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed finding what depends on standard %s: %s", inputStandard, err)
+		return
+	}
+
+	updateDependentMappings(ctx, inputStandard, version, reason, dependents.Mappings, invalidate, shuffleConfig)
+}
+
+// Flags mappings as stale, or removes them so they are generated again
+func updateDependentMappings(ctx context.Context, inputStandard string, version StandardVersion, reason string, mappings []string, invalidate bool, shuffleConfig ShuffleConfig) {
+	store := GetStore(shuffleConfig)
+	for _, keyTokenFile := range mappings {
+		deleteMappingPlan(shuffleConfig, keyTokenFile)
+		if invalidate {
+			err := store.Delete(ctx, NamespaceMappings, keyTokenFile)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				log.Printf("[WARNING] Schemaless: Failed removing mapping %s after standard %s %s: %s", keyTokenFile, inputStandard, reason, err)
+			}
+
+			continue
+		}
+
+		err := updateStore(ctx, store, NamespaceMappings, keyTokenFile, func(existing []byte) ([]byte, error) {
+			mapping, meta, err := ParseStoredMapping(existing)
+			if err != nil {
+				return existing, err
+			}
+
+			meta.Stale = &MappingStaleness{
+				Standard:        inputStandard,
+				StandardVersion: version.ID,
+				Reason:          fmt.Sprintf("Standard %s %s", inputStandard, reason),
+				Timestamp:       time.Now().Unix(),
+			}
+
+			return buildStoredMapping(mapping, meta)
+		})
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed flagging mapping %s as stale after standard %s %s: %s", keyTokenFile, inputStandard, reason, err)
+		}
+	}
+
+	if len(mappings) > 0 {
+		log.Printf("[INFO] Schemaless: Standard %s %s. Invalidated: %t. Mappings depending on it: %d", inputStandard, reason, invalidate, len(mappings))
+	}
+}
+
+// Gets a standard as it is written, without the standards it extends and without converting JSON Schema
+func GetRawStandard(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
+	return getRawStandard(ctx, inputStandard, shuffleConfig)
+}
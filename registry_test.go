@@ -0,0 +1,193 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGetStandardDependents(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"base_event": `{"title": "The title"}`,
+		"file_event": `{"extends": "base_event", "file": "The file"}`,
+		"ticket":     `{"title": "The title"}`,
+	})
+
+	useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject", "file": "$path"}`
+	})
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "Changed", "path": "/etc/passwd"}`)
+
+	// Saved with a filename prefix, so the key doesn't start with the standard
+	_, prefixedKey, err := Translate(ctx, "file_event", input, "filename_prefix:acme_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details, err := GetMapping(ctx, prefixedKey, ShuffleConfig{})
+	if err != nil || details.Metadata.Standard != "file_event" || details.Standard != "file_event" {
+		t.Errorf("expected the standard in the metadata of %s, got %+v (%v)", prefixedKey, details.MappingInfo, err)
+	}
+
+	// Saved before the standard was kept in the metadata
+	legacyKey := saveTestMapping(t, "base_event", []byte(`{"name": "old"}`), `{"title": "$name"}`)
+
+	// Named like a mapping of base_event, but made for ticket
+	ticketKey, err := MappingFile("base_event", []byte(`{"summary": "x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = saveMapping(ctx, ticketKey, "ticket", `{"title": "$summary"}`, "system", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dependents, err := GetStandardDependents(ctx, "base_event", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(dependents.Standards, ",") != "file_event" {
+		t.Errorf("unexpected standards %v", dependents.Standards)
+	}
+
+	mappings := strings.Join(dependents.Mappings, ",")
+	if !strings.Contains(mappings, prefixedKey) || !strings.Contains(mappings, legacyKey) || strings.Contains(mappings, ticketKey) {
+		t.Errorf("expected %s and %s without %s, got %v", prefixedKey, legacyKey, ticketKey, dependents.Mappings)
+	}
+
+	dependents, err = GetStandardDependents(ctx, "ticket", ShuffleConfig{})
+	if err != nil || strings.Join(dependents.Mappings, ",") != ticketKey {
+		t.Errorf("expected %s to depend on ticket, got %v (%v)", ticketKey, dependents.Mappings, err)
+	}
+}
+
+func TestValidateStandard(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"user": `{"name": "The name"}`,
+	})
+
+	tests := map[string]string{
+		`{"title": "The title", "assignee": {"$ref": "user"}}`: "",
+		`{"extends": "user", "title": "The title"}`:            "",
+		`[user]`:     "",
+		``:           "json",
+		`{"title": `: "json",
+		`[1, 2]`:     "json",
+		`[missing]`:  "$ref",
+		`[ticket]`:   "$ref",
+		`{}`:         "properties",
+		`{"extends": "missing", "title": "The title"}`:         "extends",
+		`{"title": "The title", "owner": {"$ref": "missing"}}`: "$ref",
+	}
+
+	for standard, expected := range tests {
+		found := []string{}
+		for _, problem := range ValidateStandard(context.Background(), "ticket", []byte(standard), ShuffleConfig{}) {
+			found = append(found, problem.Keyword)
+		}
+
+		if strings.Join(found, ",") != expected {
+			t.Errorf("%q: got problems %v, expected %q", standard, found, expected)
+		}
+	}
+}
+
+func TestSaveStandardVersions(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+
+	first, err := SaveStandard(ctx, "ticket", []byte(`{"title": "The title"}`), "alice", false, ShuffleConfig{})
+	if err != nil || first.ID != "v1" || first.User != "alice" {
+		t.Fatalf("expected v1 by alice, got %+v (%v)", first, err)
+	}
+
+	// Unchanged, so no new version
+	same, err := SaveStandard(ctx, "ticket", []byte(`{"title": "The title"}`), "bob", false, ShuffleConfig{})
+	if err != nil || same.ID != "v1" {
+		t.Errorf("expected the unchanged standard to stay at v1, got %+v (%v)", same, err)
+	}
+
+	mappingKey := saveTestMapping(t, "ticket", []byte(`{"subject": "Disk full"}`), `{"title": "$subject"}`)
+	second, err := SaveStandard(ctx, "ticket", []byte(`{"title": "The title", "severity": "The severity"}`), "bob", false, ShuffleConfig{})
+	if err != nil || second.ID != "v2" {
+		t.Fatalf("expected v2, got %+v (%v)", second, err)
+	}
+
+	details, err := GetMapping(ctx, mappingKey, ShuffleConfig{})
+	if err != nil || details.Stale == nil || details.Stale.StandardVersion != "v2" {
+		t.Errorf("expected %s to be stale after v2, got %+v (%v)", mappingKey, details.MappingInfo, err)
+	}
+
+	old, err := GetStandardVersion(ctx, "ticket", "v1", ShuffleConfig{})
+	if err != nil || string(old) != `{"title": "The title"}` {
+		t.Errorf("expected v1 as it was saved, got %s (%v)", old, err)
+	}
+
+	// Deleting keeps the versions, and removes the mappings when invalidating
+	err = DeleteStandard(ctx, "ticket", "carol", true, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := GetRawStandard(ctx, "ticket", ShuffleConfig{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the deleted standard not to be found, got %v", err)
+	}
+
+	if _, err := GetMapping(ctx, mappingKey, ShuffleConfig{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %s to be removed, got %v", mappingKey, err)
+	}
+
+	versions, err := ListStandardVersions(ctx, "ticket", ShuffleConfig{})
+	if err != nil || len(versions) != 3 || !versions[2].Deleted || versions[2].User != "carol" {
+		t.Errorf("expected v1, v2 and the deletion, got %+v (%v)", versions, err)
+	}
+
+	for _, name := range []string{"", "../ticket", `a\b`, "ecs/8.11/event"} {
+		if _, err := SaveStandard(ctx, name, []byte(`{"title": "The title"}`), "alice", false, ShuffleConfig{}); !errors.Is(err, ErrInvalidStandard) {
+			t.Errorf("%q: expected ErrInvalidStandard, got %v", name, err)
+		}
+	}
+
+	if _, err := SaveStandard(ctx, "alert", []byte(`{}`), "alice", false, ShuffleConfig{}); !errors.Is(err, ErrInvalidStandard) {
+		t.Errorf("expected a standard without fields to be rejected, got %v", err)
+	}
+}
+
+func TestGetStandardFields(t *testing.T) {
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"user":       `{"name": "The name"}`,
+		"base_event": `{"title": "The title"}`,
+		"ticket":     `{"extends": "base_event", "assignee": {"$ref": "user"}, "source": {"ip": "The IP", "port": 443}, "tags": ["The tags"]}`,
+	})
+
+	fields, err := GetStandardFields(context.Background(), "ticket", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := []string{}
+	var describe func(fields []StandardField)
+	describe = func(fields []StandardField) {
+		for _, field := range fields {
+			found = append(found, strings.Join(strings.Fields(fmt.Sprintf("%s %s %s %s", field.Path, field.Type, field.Standard, field.Inherited)), " "))
+			describe(field.Fields)
+		}
+	}
+
+	describe(fields)
+
+	// References aren't expanded, and inherited fields say where they are from
+	expected := "assignee object user,source object,source.ip string,source.port number,tags array,title string base_event"
+	if strings.Join(found, ",") != expected {
+		t.Errorf("got %s, expected %s", strings.Join(found, ","), expected)
+	}
+}
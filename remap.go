@@ -0,0 +1,338 @@
+package schemaless
+
+/*
+Re-maps only the unresolved fields of an existing mapping, instead of running a full translation again.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Finds the fields (see splitFieldPath) in a mapping that are empty, missing, left as the standard description,
+// or that point to a location which does not exist in the sample input.
+func FindUnresolvedFields(standard, mapping, sampleInput map[string]interface{}) []string {
+	unresolved := findUnresolvedFields(standard, mapping, sampleInput, []string{})
+	sort.Strings(unresolved)
+	return unresolved
+}
+
+func findUnresolvedFields(standard, mapping, sampleInput map[string]interface{}, prefix []string) []string {
+	unresolved := []string{}
+	for key, standardValue := range standard {
+		keys := append(prefix[:len(prefix):len(prefix)], key)
+		fieldPath := joinFieldPath(keys)
+
+		mappedValue, ok := mapping[key]
+		if !ok || mappedValue == nil {
+			unresolved = append(unresolved, fieldPath)
+			continue
+		}
+
+		if subStandard, ok := standardValue.(map[string]interface{}); ok && len(subStandard) > 0 {
+			if subMapping, ok := mappedValue.(map[string]interface{}); ok {
+				unresolved = append(unresolved, findUnresolvedFields(subStandard, subMapping, sampleInput, keys)...)
+			} else if !isMappedValue(mappedValue) {
+				unresolved = append(unresolved, fieldPath)
+			}
+
+			continue
+		}
+
+		switch val := mappedValue.(type) {
+		case string:
+			if len(strings.TrimSpace(val)) == 0 {
+				unresolved = append(unresolved, fieldPath)
+			} else if standardString, ok := standardValue.(string); ok && val == standardString && len(standardString) > 0 {
+				unresolved = append(unresolved, fieldPath)
+			} else if strings.Contains(val, "$") && len(sampleInput) > 0 && !mappedPathsExist(val, sampleInput) {
+				unresolved = append(unresolved, fieldPath)
+			}
+		case []interface{}:
+			if len(val) == 0 {
+				unresolved = append(unresolved, fieldPath)
+			}
+		case map[string]interface{}:
+			if len(val) == 0 {
+				unresolved = append(unresolved, fieldPath)
+			}
+		}
+	}
+
+	return unresolved
+}
+
+// Checks if all $paths in a mapped value can be found in the input
+func mappedPathsExist(value string, sampleInput map[string]interface{}) bool {
+	fields := TranslateBadFieldFormats([]Valuereplace{
+		Valuereplace{
+			Value: value,
+		},
+	}, true)
+
+	if len(fields) == 1 {
+		value = fields[0].Value
+	}
+
+	value = strings.ReplaceAll(value, "[]", ".#")
+	value = strings.ReplaceAll(value, `"`, "")
+
+	re := regexp.MustCompile(`([$]{1}([a-zA-Z0-9_@()-]+\.?){1}([a-zA-Z0-9#_@\()-]+\.?){0,})`)
+	for _, match := range re.FindAllString(value, -1) {
+		if _, err := recurseFindKey(sampleInput, getParsedMatch(match), 0); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Asks the LLM about only the given fields of a mapping, and merges the answers into it.
+// If fields is empty, the unresolved fields are found with FindUnresolvedFields.
+// Fields in pinnedFields, or below them, are never changed.
+func RemapFields(ctx context.Context, keyTokenFile, standardFormat string, mapping, sampleInput []byte, fields, pinnedFields []string, shuffleConfig ShuffleConfig) (string, error) {
+	parsedStandard := map[string]interface{}{}
+	err := json.Unmarshal([]byte(standardFormat), &parsedStandard)
+	if err != nil {
+		return string(mapping), errors.New(fmt.Sprintf("Standard is not a JSON object: %s", err))
+	}
+
+	parsedMapping := map[string]interface{}{}
+	err = json.Unmarshal([]byte(FixTranslationStructure(string(mapping))), &parsedMapping)
+	if err != nil {
+		return string(mapping), errors.New(fmt.Sprintf("Mapping is not a JSON object: %s", err))
+	}
+
+	parsedSample := map[string]interface{}{}
+	err = json.Unmarshal(sampleInput, &parsedSample)
+	if err != nil {
+		return string(mapping), errors.New(fmt.Sprintf("Sample input is not a JSON object: %s", err))
+	}
+
+	if len(fields) == 0 {
+		fields = FindUnresolvedFields(parsedStandard, parsedMapping, parsedSample)
+	}
+
+	remapFields := []string{}
+	for _, field := range fields {
+		if isPinnedField(field, pinnedFields) {
+			if debug {
+				log.Printf("[DEBUG] Schemaless: Skipping re-mapping of pinned field '%s' in %s", field, keyTokenFile)
+			}
+
+			continue
+		}
+
+		if _, found := getMapPath(parsedStandard, field); !found {
+			log.Printf("[WARNING] Schemaless: Field '%s' is not in the standard. Skipping re-mapping of it.", field)
+			continue
+		}
+
+		remapFields = append(remapFields, field)
+	}
+
+	if len(remapFields) == 0 {
+		return string(mapping), nil
+	}
+
+	// Only send the fields we want answers for
+	partialStandard := map[string]interface{}{}
+	for _, field := range remapFields {
+		value, _ := getMapPath(parsedStandard, field)
+		setMapPath(partialStandard, field, value)
+	}
+
+	marshalledStandard, err := json.MarshalIndent(partialStandard, "", "\t")
+	if err != nil {
+		return string(mapping), err
+	}
+
+	// Values are stripped before sending to the LLM
+	strippedSample, _, err := StructureFingerprint(sampleInput)
+	if err != nil {
+		return string(mapping), err
+	}
+
+	log.Printf("[INFO] Schemaless: Re-mapping %d field(s) in %s: %s", len(remapFields), keyTokenFile, strings.Join(remapFields, ", "))
+
+	answer, err := LLMTranslateContext(ctx, fmt.Sprintf("%s-remap", keyTokenFile), string(marshalledStandard), string(strippedSample), shuffleConfig)
+	if err != nil {
+		return string(mapping), err
+	}
+
+	parsedAnswer := map[string]interface{}{}
+	err = json.Unmarshal([]byte(FixTranslationStructure(answer)), &parsedAnswer)
+	if err != nil {
+		return string(mapping), errors.New(fmt.Sprintf("Failed unmarshalling re-mapped fields: %s", err))
+	}
+
+	for _, field := range remapFields {
+		value, found := getMapPath(parsedAnswer, field)
+		if !found || value == nil {
+			continue
+		}
+
+		if stringValue, ok := value.(string); ok && len(strings.TrimSpace(stringValue)) == 0 {
+			continue
+		}
+
+		setMapPath(parsedMapping, field, value)
+	}
+
+	merged, err := json.MarshalIndent(parsedMapping, "", "\t")
+	if err != nil {
+		return string(mapping), err
+	}
+
+	return string(merged), nil
+}
+
+// Loads a stored mapping along with its standard and sample input, re-maps the unresolved or
+// given fields, and saves it again.
+func RemapTranslation(ctx context.Context, inputStandard, keyTokenFile string, fields, pinnedFields []string, shuffleConfig ShuffleConfig) (string, error) {
+	mapping, _, err := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Failed loading mapping %s: %s", keyTokenFile, err))
+	}
+
+	standardFormat, _, err := GetStandardContext(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return string(mapping), errors.New(fmt.Sprintf("Failed loading standard %s: %s", inputStandard, err))
+	}
+
+	sampleInput, err := GetParsedInput(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return string(mapping), fmt.Errorf("Failed loading sample input for %s: %w", keyTokenFile, err)
+	}
+
+	// Fields marked in the mapping metadata are kept as well
+	parsedMapping, meta, err := ParseStoredMapping(mapping)
+	if err != nil {
+		return string(mapping), errors.New(fmt.Sprintf("Failed parsing mapping %s: %s", keyTokenFile, err))
+	}
+
+	pinnedFields = append(pinnedFields, meta.PinnedFields()...)
+	mapping, err = json.MarshalIndent(parsedMapping, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	remapped, err := RemapFields(ctx, keyTokenFile, describeStandardRefs(string(standardFormat)), mapping, sampleInput, fields, pinnedFields, shuffleConfig)
+	if err != nil {
+		return remapped, err
+	}
+
+	_, err = saveMapping(ctx, keyTokenFile, inputStandard, remapped, fmt.Sprintf("llm:%s", llmModel(ctx)), shuffleConfig)
+	if err != nil {
+		return remapped, err
+	}
+
+	return remapped, nil
+}
+
+// Gets the value-stripped input a mapping was built from (see SaveParsedInput).
+// Returns ErrNotStored in Shuffle mode, as sample inputs aren't uploaded there.
+func GetParsedInput(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]byte, error) {
+	return GetStore(shuffleConfig).Get(ctx, NamespaceInputs, inputStandard)
+}
+
+func isPinnedField(field string, pinnedFields []string) bool {
+	keys := splitFieldPath(field)
+	for _, pinned := range pinnedFields {
+		pinnedKeys := splitFieldPath(pinned)
+		if len(pinnedKeys) <= len(keys) && reflect.DeepEqual(pinnedKeys, keys[:len(pinnedKeys)]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Splits the path of a field in a mapping or standard into its keys. Paths are dot separated, e.g. user.name,
+// or JSON Pointers (RFC 6901) starting with a slash for keys that have dots in them, e.g. /user/first.name
+func splitFieldPath(path string) []string {
+	if !strings.HasPrefix(path, "/") {
+		return strings.Split(path, ".")
+	}
+
+	keys := strings.Split(path[1:], "/")
+	for cnt, key := range keys {
+		keys[cnt] = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+	}
+
+	return keys
+}
+
+// Builds the path of a field from its keys. It is dot separated, unless that can't be split back into the same keys.
+func joinFieldPath(keys []string) string {
+	dotted := len(keys) > 0 && !strings.HasPrefix(keys[0], "/")
+	for _, key := range keys {
+		if len(key) == 0 || strings.Contains(key, ".") {
+			dotted = false
+			break
+		}
+	}
+
+	if dotted {
+		return strings.Join(keys, ".")
+	}
+
+	pointer := ""
+	for _, key := range keys {
+		pointer += "/" + strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+	}
+
+	return pointer
+}
+
+// Gets a value from a nested map based on a field path (see splitFieldPath)
+func getMapPath(m map[string]interface{}, path string) (interface{}, bool) {
+	keys := splitFieldPath(path)
+	current := m
+	for cnt, key := range keys {
+		value, ok := current[key]
+		if !ok {
+			return nil, false
+		}
+
+		if cnt == len(keys)-1 {
+			return value, true
+		}
+
+		subMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		current = subMap
+	}
+
+	return nil, false
+}
+
+// Sets a value in a nested map based on a field path (see splitFieldPath), creating parent maps as needed
+func setMapPath(m map[string]interface{}, path string, value interface{}) {
+	keys := splitFieldPath(path)
+	current := m
+	for cnt, key := range keys {
+		if cnt == len(keys)-1 {
+			current[key] = value
+			return
+		}
+
+		subMap, ok := current[key].(map[string]interface{})
+		if !ok {
+			subMap = map[string]interface{}{}
+			current[key] = subMap
+		}
+
+		current = subMap
+	}
+}
@@ -0,0 +1,104 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFindUnresolvedFields(t *testing.T) {
+	standard := map[string]interface{}{
+		"title":    "The title of the ticket",
+		"assignee": "Who the ticket is assigned to",
+		"status":   "The status",
+		"source":   "Where it came from",
+		"labels":   []interface{}{},
+		"user": map[string]interface{}{
+			"name":  "The name of the user",
+			"email": "The email of the user",
+		},
+	}
+
+	mapping := map[string]interface{}{
+		"title":    "$message",
+		"assignee": "",
+		"status":   "The status",
+		"source":   "$missing.field",
+		"labels":   []interface{}{},
+		"user": map[string]interface{}{
+			"name": "$user.name",
+		},
+	}
+
+	sample := map[string]interface{}{
+		"message": "",
+		"user": map[string]interface{}{
+			"name": "",
+		},
+	}
+
+	expected := []string{"assignee", "labels", "source", "status", "user.email"}
+	if unresolved := FindUnresolvedFields(standard, mapping, sample); strings.Join(unresolved, ",") != strings.Join(expected, ",") {
+		t.Errorf("got %v, expected %v", unresolved, expected)
+	}
+}
+
+func TestRemapFieldsKeepsPinnedFields(t *testing.T) {
+	useTestStore(t)
+
+	var asked string
+	useFakeLLM(t, func(system, user string) string {
+		asked = system + user
+		return `{"title": "$subject", "assignee": "$owner.name", "status": "$state"}`
+	})
+
+	standard := `{"title": "The title", "assignee": "The assignee", "status": "The status"}`
+	mapping := []byte(`{"title": "", "assignee": "", "status": "closed"}`)
+	sample := []byte(`{"subject": "Disk full", "owner": {"name": "alice"}, "state": "open"}`)
+
+	remapped, err := RemapFields(context.Background(), "ticket-remap-test", standard, mapping, sample, []string{}, []string{"assignee"}, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := map[string]interface{}{}
+	err = json.Unmarshal([]byte(remapped), &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["title"] != "$subject" {
+		t.Errorf("title wasn't re-mapped: %v", parsed["title"])
+	}
+
+	if parsed["assignee"] != "" {
+		t.Errorf("the pinned field assignee was changed to %v", parsed["assignee"])
+	}
+
+	if parsed["status"] != "closed" {
+		t.Errorf("the resolved field status was changed to %v", parsed["status"])
+	}
+
+	// Only values from the structure are sent, not the values of the input
+	if strings.Contains(asked, "Disk full") || strings.Contains(asked, "alice") {
+		t.Errorf("input values were sent to the LLM")
+	}
+}
+
+func TestParsedInputNotStoredInShuffle(t *testing.T) {
+	shuffleConfig := ShuffleConfig{
+		URL: "http://127.0.0.1:1",
+	}
+
+	_, err := GetParsedInput(context.Background(), "ticket-abc", shuffleConfig)
+	if !errors.Is(err, ErrNotStored) {
+		t.Errorf("expected ErrNotStored, got %v", err)
+	}
+
+	_, err = RegenerateMapping(context.Background(), "ticket-abc", "", shuffleConfig)
+	if !errors.Is(err, ErrNotStored) {
+		t.Errorf("expected ErrNotStored from RegenerateMapping, got %v", err)
+	}
+}
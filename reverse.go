@@ -5,6 +5,7 @@ Runs a reverse search through JSON, to find the schemaless based on two inputs
 */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -509,3 +510,35 @@ func testMapToLocation() {
 	mappedBodyJSON, _ := json.MarshalIndent(returnValue, "", "  ")
 	log.Printf("Returned value: %s", string(mappedBodyJSON))
 }
+
+// Builds a mapping from already translated data with ReverseTranslate, and saves it as a new
+// version of the mapping with the source "reverse". Standard fields that are not found are left empty.
+func SaveReverseTranslation(ctx context.Context, keyTokenFile string, sourceMap, searchInMap map[string]interface{}, shuffleConfig ShuffleConfig) (MappingVersion, error) {
+	reversed, err := ReverseTranslate(sourceMap, searchInMap)
+	if err != nil {
+		return MappingVersion{}, err
+	}
+
+	reversedMap := make(map[string]string)
+	err = json.Unmarshal([]byte(reversed), &reversedMap)
+	if err != nil {
+		return MappingVersion{}, err
+	}
+
+	mapping := make(map[string]interface{})
+	for key, location := range reversedMap {
+		if len(location) == 0 {
+			mapping[key] = ""
+			continue
+		}
+
+		mapping[key] = fmt.Sprintf("$%s", location)
+	}
+
+	marshalled, err := json.MarshalIndent(mapping, "", "\t")
+	if err != nil {
+		return MappingVersion{}, err
+	}
+
+	return saveMapping(ctx, keyTokenFile, "", string(marshalled), "reverse", shuffleConfig)
+}
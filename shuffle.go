@@ -20,17 +20,8 @@ import (
 	"encoding/json"
 	"mime/multipart"
 
-	"github.com/patrickmn/go-cache"
-	"google.golang.org/appengine/memcache"
-	gomemcache "github.com/bradfitz/gomemcache/memcache"
 )
 
-var mc = gomemcache.New(memcached)
-var memcached = os.Getenv("SHUFFLE_MEMCACHED")
-var requestCache = cache.New(60*time.Minute, 60*time.Minute)
-
-var maxCacheSize = 1020000
-
 type File struct {
 	Name string `json:"name"`
 	Id string `json:"id"`
@@ -133,7 +124,12 @@ type FileCreateResp struct {
 	Duplicate bool `json:"duplicate"`
 }
 
-func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleConfig) error { 
+// Deprecated: Use AddShuffleFileContext
+func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleConfig) error {
+	return AddShuffleFileContext(context.Background(), name, namespace, data, shuffleConfig)
+}
+
+func AddShuffleFileContext(ctx context.Context, name, namespace string, data []byte, shuffleConfig ShuffleConfig) error { 
 	if len(shuffleConfig.URL) < 1 {
 		return errors.New("Shuffle URL not set when adding file")
 	}
@@ -155,12 +151,10 @@ func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleCo
 
 	// Check if the file has already been uploaded based on shuffleConfig.OrgId+namespace+data. No point in overwriting with the same data.
 	hasher := md5.New()
-	ctx := context.Background()
 	hasher.Write([]byte(fmt.Sprintf("%s%s%s%s", shuffleConfig.OrgId, name, namespace, string(data))))
 	cacheKey := hex.EncodeToString(hasher.Sum(nil))
-	cache, err := GetCache(ctx, cacheKey)
+	cacheData, err := GetCache(ctx, cacheKey)
 	if err == nil {
-		cacheData := []byte(cache.([]uint8))
 		if len(cacheData) > 0 { 
 			return nil
 		}
@@ -171,7 +165,8 @@ func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleCo
 		return err
 	}
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"POST", 
 		fileUrl,
 		bytes.NewBuffer(fileDataJson),
@@ -253,7 +248,8 @@ func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleCo
 
 
     // Create a new form-data field with the original data
-	req, err = http.NewRequest(
+	req, err = http.NewRequestWithContext(
+		ctx,
 		"POST", 
 		fileUploadUrl, 
 		&requestBody,
@@ -288,7 +284,7 @@ func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleCo
 	}
 
 	// Update with basically nothing, as the point isn't to get the file itself
-	err = SetCache(ctx, cacheKey, []byte("1"), 10)
+	err = SetCacheWithTTL(ctx, cacheKey, []byte("1"), CacheTTL(CacheKindShuffleUpload))
 	if err != nil {
 		log.Printf("[ERROR] Schemaless (8): Error setting cache for file %#v from Shuffle backend: %s", name, err)
 	}
@@ -296,7 +292,12 @@ func AddShuffleFile(name, namespace string, data []byte, shuffleConfig ShuffleCo
 	return nil
 }
 
+// Deprecated: Use GetShuffleFileByIdContext
 func GetShuffleFileById(id string, shuffleConfig ShuffleConfig) ([]byte, error) {
+	return GetShuffleFileByIdContext(context.Background(), id, shuffleConfig)
+}
+
+func GetShuffleFileByIdContext(ctx context.Context, id string, shuffleConfig ShuffleConfig) ([]byte, error) {
 	if len(shuffleConfig.URL) < 1 {
 		return []byte{}, errors.New("Shuffle URL not set")
 	}
@@ -304,7 +305,6 @@ func GetShuffleFileById(id string, shuffleConfig ShuffleConfig) ([]byte, error)
 	client := GetExternalClient(shuffleConfig.URL)
 	fileUrl := fmt.Sprintf("%s/api/v1/files/%s/content", shuffleConfig.URL, id)
 
-	ctx := context.Background()
 	var body []byte
 
 	hasher := md5.New()
@@ -313,17 +313,17 @@ func GetShuffleFileById(id string, shuffleConfig ShuffleConfig) ([]byte, error)
 
 	// The file will be grabbed a ton, hence the cache actually speeding things up and reducing requests
 
-	cache, err := GetCache(ctx, cacheKey)
+	cacheData, err := GetCache(ctx, cacheKey)
 	if err == nil {
-		body = []byte(cache.([]uint8))
-		return body, nil
+		return cacheData, nil
 	}
 
 	if len(shuffleConfig.ExecutionId) > 0 {
 		fileUrl += "?execution_id=" + shuffleConfig.ExecutionId
 	}
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"GET", 
 		fileUrl,
 		nil,
@@ -351,7 +351,7 @@ func GetShuffleFileById(id string, shuffleConfig ShuffleConfig) ([]byte, error)
 		return []byte{}, err
 	}
 
-	go SetCache(ctx, cacheKey, body, 10)
+	go SetCacheWithTTL(context.WithoutCancel(ctx), cacheKey, body, CacheTTL(CacheKindShuffleFile))
 	if resp.StatusCode != 200 {
 		log.Printf("[ERROR] Schemaless: Bad status code (1) for %s: %s", fileUrl, resp.Status)
 		return []byte{}, errors.New(fmt.Sprintf("Bad status code when downloading file %s: %s", id, resp.Status))
@@ -360,9 +360,14 @@ func GetShuffleFileById(id string, shuffleConfig ShuffleConfig) ([]byte, error)
 	return body, nil
 }
 
+// Deprecated: Use FindShuffleFileContext
+func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
+	return FindShuffleFileContext(context.Background(), name, category, shuffleConfig)
+}
+
 // Finds a file in shuffle in a specified category
 // The string return is the filepath OR the file ID, with priority on file ID.
-func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
+func FindShuffleFileContext(ctx context.Context, name, category string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
 	filename := ""
 	if len(shuffleConfig.URL) < 1 {
 		return []byte{}, filename, errors.New("Shuffle URL not set")
@@ -373,7 +378,6 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 	// 2. Find the file in the category output
 	// 3. Read the file data
 	// 4. Return it
-	client := GetExternalClient(shuffleConfig.URL)
 
 	// Specifically for handling default standards we deal with all the time
 	newName := name
@@ -381,6 +385,57 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 		newName = strings.TrimPrefix(newName, "get_")
 	}
 
+	files, err := getShuffleCategory(ctx, category, newName, shuffleConfig)
+	if err != nil {
+		return []byte{}, filename, err
+	}
+
+	newName = strings.TrimSpace(strings.ToLower(strings.Replace(newName, " ", "_", -1)))
+	if strings.HasSuffix(newName, ".json") {
+		newName = newName[:len(name)-5]
+	}
+
+	for _, file := range files.List {
+		if file.Status != "active" {
+			continue
+		}
+
+		innerfilename := strings.TrimSpace(strings.ToLower(strings.Replace(file.Name, " ", "_", -1)))
+		if strings.HasSuffix(innerfilename, ".json") {
+			innerfilename = innerfilename[:len(innerfilename)-5]
+		}
+
+		if innerfilename != newName { 
+			continue
+		}
+
+		filename = innerfilename
+		downloadedFile, err := GetShuffleFileByIdContext(ctx, file.Id, shuffleConfig)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless (6): Error getting file %#v from Shuffle backend: %s", newName, err)
+			return []byte{}, filename, err
+		}
+
+		// This is the important part. Returning an ID is perfect
+		return downloadedFile, file.Id, nil
+	}
+
+	// Validation
+	//if debug { 
+	//	log.Printf("File search: %s", newName)
+	//	log.Printf("FILES: %d", len(files.List))
+	//	log.Printf("BODY: %s", body)
+	//	os.Exit(3)
+	//}
+
+	return []byte{}, filename, fmt.Errorf("Failed to find translation file matching name '%s' in category '%s': %w", newName, category, ErrNotFound)
+}
+
+// Lists the files in a Shuffle file category. newName filters the list by filename.
+func getShuffleCategory(ctx context.Context, category, newName string, shuffleConfig ShuffleConfig) (Filestructure, error) {
+	client := GetExternalClient(shuffleConfig.URL)
+	files := Filestructure{}
+
 	categoryUrl := fmt.Sprintf("%s/api/v1/files/namespaces/%s?ids=true&filename=%s", shuffleConfig.URL, category, newName)
 
 	hasher := md5.New()
@@ -388,12 +443,11 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 	cacheKey := hex.EncodeToString(hasher.Sum(nil))
 
 	// Get the cache 
-	ctx := context.Background()
 	var body []byte
-	cache, err := GetCache(ctx, cacheKey)
+	cacheData, err := GetCache(ctx, cacheKey)
 	if err == nil {
 		//log.Printf("[INFO] Schemaless: FOUND file %#v in category %#v from cache", name, category)
-		body = []byte(cache.([]uint8))
+		body = cacheData
 		//return cacheData, filename, nil
 	} else {
 		if debug { 
@@ -412,7 +466,8 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 			log.Printf("[DEBUG] Getting category WITHOUT cache from '%s'", categoryUrl)
 		}
 
-		req, err := http.NewRequest(
+		req, err := http.NewRequestWithContext(
+			ctx,
 			"GET", 
 			categoryUrl,
 			nil,
@@ -420,7 +475,7 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 
 		if err != nil {
 			log.Printf("[ERROR] Schemaless (2): Error getting category %#v from Shuffle backend: %s", category, err)
-			return []byte{}, filename, err
+			return files, err
 		}
 
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", shuffleConfig.Authorization))
@@ -431,20 +486,20 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Printf("[ERROR] Schemaless (3): Error getting category %#v from Shuffle backend: %s", category, err)
-			return []byte{}, filename, err
+			return files, err
 		}
 
 
 		body, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
 			log.Printf("[ERROR] Schemaless (4): Error reading category %#v from Shuffle backend: %s", category, err)
-			return []byte{}, filename, err
+			return files, err
 		}
 
-		go SetCache(ctx, cacheKey, body, 3)
+		go SetCacheWithTTL(context.WithoutCancel(ctx), cacheKey, body, CacheTTL(CacheKindShuffleListing))
 		if resp.StatusCode != 200 {
 			log.Printf("[ERROR] Schemaless: Bad status code (2) getting category %#v from Shuffle backend %#v: %s", category, categoryUrl, resp.Status)
-			return []byte{}, filename, errors.New(fmt.Sprintf("Bad status code: %s", resp.Status))
+			return files, errors.New(fmt.Sprintf("Bad status code: %s", resp.Status))
 		}
 
 		if debug { 
@@ -453,287 +508,116 @@ func FindShuffleFile(name, category string, shuffleConfig ShuffleConfig) ([]byte
 	}
 
 	// Unmarshal to Filestructure struct
-	files := Filestructure{}
 	err = json.Unmarshal(body, &files)
 	if err != nil {
 		log.Printf("[ERROR] Schemaless (5): Error unmarshalling category %#v from Shuffle backend: %s", category, err)
-		return []byte{}, filename, err
+		return files, err
 	}
 
-	newName = strings.TrimSpace(strings.ToLower(strings.Replace(newName, " ", "_", -1)))
-	if strings.HasSuffix(newName, ".json") {
-		newName = newName[:len(name)-5]
+	return files, nil
+}
+
+// Deletes a file in Shuffle by its ID
+func DeleteShuffleFile(ctx context.Context, id string, shuffleConfig ShuffleConfig) error {
+	if len(shuffleConfig.URL) < 1 {
+		return errors.New("Shuffle URL not set when deleting file")
 	}
 
-	for _, file := range files.List {
-		if file.Status != "active" {
-			continue
-		}
+	client := GetExternalClient(shuffleConfig.URL)
+	fileUrl := fmt.Sprintf("%s/api/v1/files/%s", shuffleConfig.URL, id)
+	if len(shuffleConfig.ExecutionId) > 0 {
+		fileUrl += "?execution_id=" + shuffleConfig.ExecutionId
+	}
 
-		innerfilename := strings.TrimSpace(strings.ToLower(strings.Replace(file.Name, " ", "_", -1)))
-		if strings.HasSuffix(innerfilename, ".json") {
-			innerfilename = innerfilename[:len(innerfilename)-5]
-		}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"DELETE",
+		fileUrl,
+		nil,
+	)
 
-		if innerfilename != newName { 
-			continue
-		}
+	if err != nil {
+		return err
+	}
 
-		filename = innerfilename
-		downloadedFile, err := GetShuffleFileById(file.Id, shuffleConfig)
-		if err != nil {
-			log.Printf("[ERROR] Schemaless (6): Error getting file %#v from Shuffle backend: %s", newName, err)
-			return []byte{}, filename, err
-		}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", shuffleConfig.Authorization))
+	if len(shuffleConfig.OrgId) > 0 {
+		req.Header.Add("Org-Id", shuffleConfig.OrgId)
+	}
 
-		// This is the important part. Returning an ID is perfect
-		return downloadedFile, file.Id, nil
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error deleting file %#v in Shuffle backend: %s", id, err)
+		return err
 	}
 
-	// Validation
-	//if debug { 
-	//	log.Printf("File search: %s", newName)
-	//	log.Printf("FILES: %d", len(files.List))
-	//	log.Printf("BODY: %s", body)
-	//	os.Exit(3)
-	//}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("[ERROR] Schemaless: Bad status code when deleting file %s: %s", id, resp.Status)
+		return errors.New(fmt.Sprintf("Bad status code when deleting file %s: %s", id, resp.Status))
+	}
 
-	return []byte{}, filename, errors.New(fmt.Sprintf("Failed to find translation file matching name '%s' in category '%s'", newName, category)) 
+	return nil
 }
 
-// Cache handlers
-func DeleteCache(ctx context.Context, name string) error {
-	if len(memcached) > 0 {
-		return mc.Delete(name)
-	}
-
-	if false {
-		return memcache.Delete(ctx, name)
+// Stores values as files in Shuffle, with the namespace as the file category
+type ShuffleStore struct {
+	Config ShuffleConfig
+}
 
-	} else {
-		requestCache.Delete(name)
-		return nil
+func NewShuffleStore(shuffleConfig ShuffleConfig) *ShuffleStore {
+	return &ShuffleStore{
+		Config: shuffleConfig,
 	}
-
-	return errors.New(fmt.Sprintf("No cache found for %s when DELETING cache", name))
 }
 
-// Cache handlers
-func GetCache(ctx context.Context, name string) (interface{}, error) {
-	if len(name) == 0 {
-		log.Printf("[ERROR] No name provided for cache")
-		return "", nil
-	}
-
-	name = strings.Replace(name, " ", "_", -1)
-
-	if len(memcached) > 0 {
-		item, err := mc.Get(name)
-		if err == gomemcache.ErrCacheMiss {
-			//log.Printf("[DEBUG] Cache miss for %s: %s", name, err)
-		} else if err != nil {
-			//log.Printf("[DEBUG] Failed to find cache for key %s: %s", name, err)
-		} else {
-			//log.Printf("[INFO] Got new cache: %s", item)
-
-			if len(item.Value) == maxCacheSize {
-				totalData := item.Value
-				keyCount := 1
-				keyname := fmt.Sprintf("%s_%d", name, keyCount)
-				for {
-					if item, err := mc.Get(keyname); err != nil {
-						break
-					} else {
-						if totalData != nil && item != nil && item.Value != nil {
-							totalData = append(totalData, item.Value...)
-						}
-
-						//log.Printf("%d - %d = ", len(item.Value), maxCacheSize)
-						if len(item.Value) != maxCacheSize {
-							break
-						}
-					}
-
-					keyCount += 1
-					keyname = fmt.Sprintf("%s_%d", name, keyCount)
-				}
-
-				// Random~ high number
-				if len(totalData) > 10062147 {
-					//log.Printf("[WARNING] CACHE: TOTAL SIZE FOR %s: %d", name, len(totalData))
-				}
-				return totalData, nil
-			} else {
-				return item.Value, nil
-			}
-		}
+func (store *ShuffleStore) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	data, _, err := store.GetWithLocation(ctx, namespace, key)
+	return data, err
+}
 
-		return "", errors.New(fmt.Sprintf("No cache found in SHUFFLE_MEMCACHED for %s", name))
-	}
-
-	if false {
-
-		if item, err := memcache.Get(ctx, name); err != nil {
-
-		} else if err != nil {
-			return "", errors.New(fmt.Sprintf("Failed getting CLOUD cache for %s: %s", name, err))
-		} else {
-			// Loops if cachesize is more than max allowed in memcache (multikey)
-			if len(item.Value) == maxCacheSize {
-				totalData := item.Value
-				keyCount := 1
-				keyname := fmt.Sprintf("%s_%d", name, keyCount)
-				for {
-					if item, err := memcache.Get(ctx, keyname); err != nil {
-						break
-					} else {
-						totalData = append(totalData, item.Value...)
-
-						//log.Printf("%d - %d = ", len(item.Value), maxCacheSize)
-						if len(item.Value) != maxCacheSize {
-							break
-						}
-					}
-
-					keyCount += 1
-					keyname = fmt.Sprintf("%s_%d", name, keyCount)
-				}
-
-				// Random~ high number
-				if len(totalData) > 10062147 {
-					//log.Printf("[WARNING] CACHE: TOTAL SIZE FOR %s: %d", name, len(totalData))
-				}
-				return totalData, nil
-			} else {
-				return item.Value, nil
-			}
-		}
-	} else {
-		if value, found := requestCache.Get(name); found {
-			return value, nil
-		} else {
-			return "", errors.New(fmt.Sprintf("Failed getting ONPREM cache for %s", name))
-		}
+// The location is the Shuffle file ID
+func (store *ShuffleStore) GetWithLocation(ctx context.Context, namespace, key string) ([]byte, string, error) {
+	if namespace == NamespaceInputs {
+		return []byte{}, "", fmt.Errorf("%w: sample inputs aren't uploaded to Shuffle, so they can't be used for re-mapping or regenerating mappings in Shuffle mode", ErrNotStored)
 	}
 
-	return "", errors.New(fmt.Sprintf("No cache found for %s", name))
+	return FindShuffleFileContext(ctx, key, namespace, store.Config)
 }
 
-// Sets a key in cache. Expiration is in minutes.
-func SetCache(ctx context.Context, name string, data []byte, expiration int32) error {
-	// Set cache verbose
-	//if strings.Contains(name, "execution") || strings.Contains(name, "action") && len(data) > 1 {
-	//}
-
-	if len(name) == 0 {
-		log.Printf("[WARNING] Key '%s' is empty with value length %d and expiration %d. Skipping cache.", name, len(data), expiration)
+func (store *ShuffleStore) Put(ctx context.Context, namespace, key string, data []byte) error {
+	// FIXME: Should we upload everything? I think not
+	// Sample inputs are left out, and reading them returns ErrNotStored
+	if namespace == NamespaceInputs {
 		return nil
 	}
 
-	// Maxsize ish~
-	name = strings.Replace(name, " ", "_", -1)
+	return AddShuffleFileContext(ctx, key, namespace, data, store.Config)
+}
 
-	// Splitting into multiple cache items
-	if len(memcached) > 0 {
-		comparisonNumber := 50
-		if len(data) > maxCacheSize*comparisonNumber {
-			return errors.New(fmt.Sprintf("Couldn't set cache for %s - too large: %d > %d", name, len(data), maxCacheSize*comparisonNumber))
-		}
+func (store *ShuffleStore) List(ctx context.Context, namespace string) ([]string, error) {
+	files, err := getShuffleCategory(ctx, namespace, "", store.Config)
+	if err != nil {
+		return []string{}, err
+	}
 
-		loop := false
-		if len(data) > maxCacheSize {
-			loop = true
-			//log.Printf("Should make multiple cache items for %s", name)
+	keys := []string{}
+	for _, file := range files.List {
+		if file.Status != "active" {
+			continue
 		}
 
-		// Custom for larger sizes. Max is maxSize*10 when being set
-		if loop {
-			currentChunk := 0
-			keyAmount := 0
-			totalAdded := 0
-			chunkSize := maxCacheSize
-			nextStep := chunkSize
-			keyname := name
-
-			for {
-				if len(data) < nextStep {
-					nextStep = len(data)
-				}
-
-				parsedData := data[currentChunk:nextStep]
-				item := &memcache.Item{
-					Key:        keyname,
-					Value:      parsedData,
-					Expiration: time.Minute * time.Duration(expiration),
-				}
-
-				var err error
-				if len(memcached) > 0 {
-					newitem := &gomemcache.Item{
-						Key:        keyname,
-						Value:      parsedData,
-						Expiration: expiration * 60,
-					}
-
-					err = mc.Set(newitem)
-				} else {
-					err = memcache.Set(ctx, item)
-				}
-
-				if err != nil {
-					if !strings.Contains(fmt.Sprintf("%s", err), "App Engine context") {
-						log.Printf("[ERROR] Failed setting cache for '%s' (1): %s", keyname, err)
-					}
-					break
-				} else {
-					totalAdded += chunkSize
-					currentChunk = nextStep
-					nextStep += chunkSize
-
-					keyAmount += 1
-					//log.Printf("%s: %d: %d", keyname, totalAdded, len(data))
-
-					keyname = fmt.Sprintf("%s_%d", name, keyAmount)
-					if totalAdded > len(data) {
-						break
-					}
-				}
-			}
-
-			//log.Printf("[INFO] Set app cache with length %d and %d keys", len(data), keyAmount)
-		} else {
-			item := &memcache.Item{
-				Key:        name,
-				Value:      data,
-				Expiration: time.Minute * time.Duration(expiration),
-			}
-
-			var err error
-			if len(memcached) > 0 {
-				newitem := &gomemcache.Item{
-					Key:        name,
-					Value:      data,
-					Expiration: expiration * 60,
-				}
-
-				err = mc.Set(newitem)
-			} else {
-				err = memcache.Set(ctx, item)
-			}
+		keys = append(keys, strings.TrimSuffix(file.Name, ".json"))
+	}
 
-			if err != nil {
-				if !strings.Contains(fmt.Sprintf("%s", err), "App Engine context") {
-					log.Printf("[WARNING] Failed setting cache for key '%s' with data size %d (2): %s", name, len(data), err)
-				} else {
-					log.Printf("[ERROR] Something bad with App Engine context for memcache (key: %s): %s", name, err)
-				}
-			}
-		}
+	return keys, nil
+}
 
-		return nil
-	} else {
-		requestCache.Set(name, data, time.Minute*time.Duration(expiration))
+func (store *ShuffleStore) Delete(ctx context.Context, namespace, key string) error {
+	_, id, err := FindShuffleFileContext(ctx, key, namespace, store.Config)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return DeleteShuffleFile(ctx, id, store.Config)
 }
@@ -0,0 +1,213 @@
+package schemaless
+
+/*
+Makes sure the same LLM translation only runs once at a time, both between goroutines and between replicas sharing a cache.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+
+	// Set when the caller running fn had its context end, so the error isn't meant for the others
+	cancelled bool
+}
+
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+var flights = &flightGroup{
+	calls: map[string]*flightCall{},
+}
+
+// Runs fn for a key unless it is already running, in which case the result of the running call is returned.
+// The last return value tells if the result came from another caller. If the context of the running call ends,
+// callers that are still waiting run fn again instead of getting its error.
+func (group *flightGroup) Do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	group.mu.Lock()
+	for {
+		call, ok := group.calls[key]
+		if !ok {
+			break
+		}
+
+		group.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+
+		if !call.cancelled || ctx.Err() != nil {
+			return call.value, call.err, true
+		}
+
+		group.mu.Lock()
+	}
+
+	call := &flightCall{
+		done: make(chan struct{}),
+	}
+
+	group.calls[key] = call
+	group.mu.Unlock()
+
+	finished := false
+	defer func() {
+		// Waiters get an error instead of an empty result. The panic continues in this caller.
+		recovered := recover()
+		if !finished {
+			call.value = nil
+			call.err = errors.New(fmt.Sprintf("Translation for %s failed: %v", key, recovered))
+		}
+
+		call.cancelled = call.err != nil && ctx.Err() != nil
+
+		group.mu.Lock()
+		delete(group.calls, key)
+		group.mu.Unlock()
+
+		close(call.done)
+
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+
+	call.value, call.err = fn()
+	finished = true
+	return call.value, call.err, false
+}
+
+// How often replicas waiting for a lease check for the result, at most
+var maxLeaseWait = 1 * time.Second
+
+// Runs fn at most once at a time per key. Goroutines asking for the same key wait for and get the result of the running call.
+// With a LeaseCache, other replicas wait until lookup finds the result of the replica holding the lease. If the lease is released
+// or expires without a result, e.g. because the call failed, the next waiter takes over.
+func singleFlight(ctx context.Context, key string, lookup func() (interface{}, bool), fn func() (interface{}, error)) (interface{}, error) {
+	value, err, shared := flights.Do(ctx, key, func() (interface{}, error) {
+		if value, found := lookup(); found {
+			return value, nil
+		}
+
+		// Previews don't take leases, as they don't save the result for others to find
+		leaseCache, ok := cacheBackend.(LeaseCache)
+		if !ok || isPreview(ctx) {
+			return fn()
+		}
+
+		leaseKey := fmt.Sprintf("lease-%s", key)
+		wait := 50 * time.Millisecond
+		for {
+			token := make([]byte, 16)
+			rand.Read(token)
+			leaseToken := []byte(fmt.Sprintf("%x", token))
+
+			acquired, err := leaseCache.Add(ctx, leaseKey, leaseToken, CacheTTL(CacheKindLease))
+			if err != nil {
+				log.Printf("[WARNING] Schemaless: Failed getting lease %s. Running without it: %s", leaseKey, err)
+				return fn()
+			}
+
+			if acquired {
+				defer releaseLease(leaseCache, leaseKey, leaseToken)
+				defer renewLease(leaseCache, leaseKey, leaseToken)()
+				return fn()
+			}
+
+			if debug {
+				log.Printf("[DEBUG] Schemaless: Waiting for lease %s held by another replica", leaseKey)
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(wait):
+				}
+
+				if wait < maxLeaseWait {
+					wait *= 2
+				}
+
+				if value, found := lookup(); found {
+					return value, nil
+				}
+
+				if _, err := leaseCache.Get(ctx, leaseKey); err != nil {
+					break
+				}
+			}
+		}
+	})
+
+	if shared && debug {
+		log.Printf("[DEBUG] Schemaless: Used the result of a running call for %s", key)
+	}
+
+	return value, err
+}
+
+// Extends the lease while the call runs, as calls such as chunked generation or regeneration can take longer than its TTL.
+// Returns a function stopping the renewal.
+func renewLease(leaseCache LeaseCache, leaseKey string, leaseToken []byte) func() {
+	ttl := CacheTTL(CacheKindLease)
+	if ttl/3 <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			renewed, err := leaseCache.Renew(context.Background(), leaseKey, leaseToken, ttl)
+			if err != nil {
+				log.Printf("[WARNING] Schemaless: Failed renewing lease %s. Trying again: %s", leaseKey, err)
+				continue
+			}
+
+			if !renewed {
+				log.Printf("[WARNING] Schemaless: Lost lease %s, so another replica may run the same call", leaseKey)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Only removes the lease if it is still ours, as it may have expired and been taken by someone else
+func releaseLease(leaseCache LeaseCache, leaseKey string, leaseToken []byte) {
+	_, err := leaseCache.Release(context.Background(), leaseKey, leaseToken)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed releasing lease %s: %s", leaseKey, err)
+	}
+}
@@ -0,0 +1,272 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Waits until a call for key is running in the group
+func waitForFlight(t *testing.T, group *flightGroup, key string) {
+	t.Helper()
+
+	for cnt := 0; cnt < 500; cnt++ {
+		group.mu.Lock()
+		_, ok := group.calls[key]
+		group.mu.Unlock()
+		if ok {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("no call for %s started", key)
+}
+
+func TestFlightGroupSharesResult(t *testing.T) {
+	group := &flightGroup{calls: map[string]*flightCall{}}
+	release := make(chan struct{})
+	calls := &atomic.Int32{}
+
+	fn := func() (interface{}, error) {
+		calls.Add(1)
+		<-release
+		return "result", nil
+	}
+
+	wg := sync.WaitGroup{}
+	results := make([]interface{}, 5)
+	for cnt := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[cnt], _, _ = group.Do(context.Background(), "key", fn)
+		}()
+	}
+
+	waitForFlight(t, group, "key")
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected a single call, got %d", calls.Load())
+	}
+
+	for _, result := range results {
+		if result != "result" {
+			t.Errorf("expected every caller to get the result, got %v", results)
+			break
+		}
+	}
+}
+
+func TestFlightGroupRetriesWhenLeaderIsCancelled(t *testing.T) {
+	group := &flightGroup{calls: map[string]*flightCall{}}
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	calls := &atomic.Int32{}
+
+	leaderDone := make(chan error)
+	go func() {
+		_, err, _ := group.Do(leaderCtx, "key", func() (interface{}, error) {
+			calls.Add(1)
+			<-leaderCtx.Done()
+			return nil, leaderCtx.Err()
+		})
+
+		leaderDone <- err
+	}()
+
+	waitForFlight(t, group, "key")
+
+	waiterDone := make(chan struct{})
+	var value interface{}
+	var err error
+	var shared bool
+	go func() {
+		defer close(waiterDone)
+		value, err, shared = group.Do(context.Background(), "key", func() (interface{}, error) {
+			calls.Add(1)
+			return "result", nil
+		})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if leaderErr := <-leaderDone; leaderErr != context.Canceled {
+		t.Errorf("expected the leader to get its own cancellation, got %v", leaderErr)
+	}
+
+	<-waiterDone
+	if err != nil || value != "result" || shared {
+		t.Errorf("expected the waiter to run the call itself, got %v, %v, shared %t", value, err, shared)
+	}
+
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+func TestFlightGroupWaiterCancelled(t *testing.T) {
+	group := &flightGroup{calls: map[string]*flightCall{}}
+	release := make(chan struct{})
+	defer close(release)
+
+	go group.Do(context.Background(), "key", func() (interface{}, error) {
+		<-release
+		return "result", nil
+	})
+
+	waitForFlight(t, group, "key")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err, _ := group.Do(ctx, "key", func() (interface{}, error) {
+		return "other", nil
+	})
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the waiter to stop with its own context, got %v", err)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	group := &flightGroup{calls: map[string]*flightCall{}}
+	release := make(chan struct{})
+
+	leaderPanic := make(chan interface{})
+	go func() {
+		defer func() {
+			leaderPanic <- recover()
+		}()
+
+		group.Do(context.Background(), "key", func() (interface{}, error) {
+			<-release
+			panic("broken mapping")
+		})
+	}()
+
+	waitForFlight(t, group, "key")
+
+	waiterDone := make(chan struct{})
+	var value interface{}
+	var err error
+	go func() {
+		defer close(waiterDone)
+		value, err, _ = group.Do(context.Background(), "key", func() (interface{}, error) {
+			return "other", nil
+		})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if recovered := <-leaderPanic; recovered != "broken mapping" {
+		t.Errorf("expected the panic to continue in the leader, got %v", recovered)
+	}
+
+	<-waiterDone
+	if value != nil || err == nil || !strings.Contains(err.Error(), "broken mapping") {
+		t.Errorf("expected the waiter to get an error, got %v, %v", value, err)
+	}
+
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	if len(group.calls) != 0 {
+		t.Errorf("expected the call to be removed, got %v", group.calls)
+	}
+}
+
+func TestSingleFlightLeaseBetweenReplicas(t *testing.T) {
+	useTestStore(t)
+
+	// Another replica holds the lease, then saves its result
+	leaseCache := cacheBackend.(LeaseCache)
+	ctx := context.Background()
+	_, err := leaseCache.Add(ctx, "lease-key", []byte("other"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &atomic.Value{}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		result.Store("from other replica")
+		leaseCache.Delete(ctx, "lease-key")
+	}()
+
+	calls := 0
+	value, err := singleFlight(ctx, "key", func() (interface{}, bool) {
+		found := result.Load()
+		return found, found != nil
+	}, func() (interface{}, error) {
+		calls += 1
+		return "ours", nil
+	})
+
+	if err != nil || value != "from other replica" || calls != 0 {
+		t.Errorf("expected the result of the other replica, got %v (%v) after %d calls", value, err, calls)
+	}
+}
+
+func TestSingleFlightRenewsLease(t *testing.T) {
+	useTestStore(t)
+
+	previous := CacheTTL(CacheKindLease)
+	SetCacheTTL(CacheKindLease, 60*time.Millisecond)
+	t.Cleanup(func() {
+		SetCacheTTL(CacheKindLease, previous)
+	})
+
+	// The call runs for several TTLs, and the lease is still held by the end of it
+	ctx := context.Background()
+	leaseCache := cacheBackend.(LeaseCache)
+	_, err := singleFlight(ctx, "key", func() (interface{}, bool) {
+		return nil, false
+	}, func() (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+
+		if _, err := leaseCache.Get(ctx, "lease-key"); err != nil {
+			t.Errorf("expected the lease to be renewed, got %v", err)
+		}
+
+		added, _ := leaseCache.Add(ctx, "lease-key", []byte("other"), time.Minute)
+		if added {
+			t.Error("another replica took the lease while the call ran")
+		}
+
+		return "ours", nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaseCache.Get(ctx, "lease-key"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected the lease to be released, got %v", err)
+	}
+}
+
+func TestReleaseLeaseOfAnotherReplica(t *testing.T) {
+	useTestStore(t)
+
+	// Our lease expired and was taken over
+	ctx := context.Background()
+	leaseCache := cacheBackend.(LeaseCache)
+	_, err := leaseCache.Add(ctx, "lease-key", []byte("other"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseLease(leaseCache, "lease-key", []byte("ours"))
+	if value, err := leaseCache.Get(ctx, "lease-key"); err != nil || string(value) != "other" {
+		t.Errorf("expected the lease of the other replica to be kept, got %s (%v)", value, err)
+	}
+}
@@ -0,0 +1,605 @@
+package schemaless
+
+/*
+Sources standards are loaded from when they aren't in the store. Sources are tried in order, and a standard is only
+found by its exact name. Standards from remote sources are saved in the store, so they are only downloaded once.
+
+	SCHEMALESS_STANDARD_SOURCES=dir:/etc/standards,packs,git:shuffle/standards/translation_standards@<commit>,http:https://example.com/standards/index.json@1.2
+	SCHEMALESS_OFFLINE=true		Never use remote sources
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v28/github"
+)
+
+// Returned when a downloaded standard doesn't match the hash it is pinned to
+var ErrStandardIntegrity = errors.New("Standard integrity check failed")
+
+type StandardSource interface {
+	// Gets a standard by its exact name, along with where it was found. Returns ErrNotFound if the source doesn't have it.
+	GetStandard(ctx context.Context, name string) ([]byte, string, error)
+
+	// Remote sources are skipped in offline mode, and the standards they return are saved in the store
+	Remote() bool
+
+	String() string
+}
+
+var standardSourcesMutex sync.RWMutex
+var standardSources = defaultStandardSources()
+var offline = false
+
+// Sets the sources to load standards from when they aren't in the store, in order
+func SetStandardSources(sources ...StandardSource) {
+	standardSourcesMutex.Lock()
+	defer standardSourcesMutex.Unlock()
+
+	standardSources = sources
+}
+
+// Gets the configured standard sources, in order
+func GetStandardSources() []StandardSource {
+	standardSourcesMutex.RLock()
+	defer standardSourcesMutex.RUnlock()
+
+	return append([]StandardSource{}, standardSources...)
+}
+
+// Turns remote standard sources off or on. In offline mode only the store, local folders and packs are used.
+func SetOffline(enabled bool) {
+	standardSourcesMutex.Lock()
+	defer standardSourcesMutex.Unlock()
+
+	offline = enabled
+}
+
+func isOffline() bool {
+	standardSourcesMutex.RLock()
+	defer standardSourcesMutex.RUnlock()
+
+	return offline
+}
+
+// The bundled packs, then Shuffle's standards on Github
+func defaultStandardSources() []StandardSource {
+	owner := "shuffle"
+	repo := "standards"
+	if os.Getenv("GIT_DOWNLOAD_USER") != "" {
+		owner = os.Getenv("GIT_DOWNLOAD_USER")
+	}
+
+	if os.Getenv("GIT_DOWNLOAD_REPO") != "" {
+		repo = os.Getenv("GIT_DOWNLOAD_REPO")
+	}
+
+	return []StandardSource{
+		&PackSource{},
+		&GitSource{
+			Owner: owner,
+			Repo:  repo,
+			Path:  "translation_standards",
+			Ref:   os.Getenv("GIT_DOWNLOAD_REF"),
+			Token: os.Getenv("GITHUB_TOKEN"),
+		},
+	}
+}
+
+// Parses a comma separated list of sources: dir:<folder>, packs, git:<owner>/<repo>[/<path>][@<ref>][#<name>=<sha256>;...] and http:<index url>[@<version>]
+func ParseStandardSources(value string) ([]StandardSource, error) {
+	sources := []StandardSource{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		kind, location, _ := strings.Cut(item, ":")
+		switch kind {
+		case "dir":
+			if len(location) == 0 {
+				return sources, errors.New(fmt.Sprintf("Missing folder in standard source '%s'", item))
+			}
+
+			sources = append(sources, &DirectorySource{Folder: location})
+		case "packs":
+			sources = append(sources, &PackSource{})
+		case "git":
+			location, hashes, _ := strings.Cut(location, "#")
+			location, ref, _ := strings.Cut(location, "@")
+			parts := strings.SplitN(location, "/", 3)
+			if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+				return sources, errors.New(fmt.Sprintf("Invalid git standard source '%s'. Use git:<owner>/<repo>[/<path>][@<ref>][#<name>=<sha256>;...].", item))
+			}
+
+			pinned, err := parseStandardHashes(hashes)
+			if err != nil {
+				return sources, errors.New(fmt.Sprintf("Invalid git standard source '%s': %s", item, err))
+			}
+
+			source := &GitSource{
+				Owner:  parts[0],
+				Repo:   parts[1],
+				Ref:    ref,
+				Token:  os.Getenv("GITHUB_TOKEN"),
+				SHA256: pinned,
+			}
+
+			if len(parts) == 3 {
+				source.Path = parts[2]
+			}
+
+			sources = append(sources, source)
+		case "http", "https":
+			if kind == "https" {
+				location = item
+			}
+
+			location, version := splitSourceVersion(location)
+			if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+				return sources, errors.New(fmt.Sprintf("Invalid HTTP standard source '%s'. Use http:<index url>[@<version>].", item))
+			}
+
+			sources = append(sources, &HTTPIndexSource{URL: location, Version: version})
+		default:
+			return sources, errors.New(fmt.Sprintf("Unknown standard source '%s'. Use dir:, packs, git: or http:.", item))
+		}
+	}
+
+	return sources, nil
+}
+
+// Parses the hashes standards are pinned to, such as ticket=<sha256>;alert=sha256:<sha256>
+func parseStandardHashes(value string) (map[string]string, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	hashes := map[string]string{}
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		name, hash, _ := strings.Cut(item, "=")
+		name = standardKey(strings.TrimSpace(name))
+		hash = strings.TrimPrefix(strings.TrimSpace(hash), "sha256:")
+		decoded, err := hex.DecodeString(hash)
+		if len(name) == 0 || err != nil || len(decoded) != sha256.Size {
+			return hashes, errors.New(fmt.Sprintf("Invalid hash '%s'. Use <name>=<sha256 as hex>.", item))
+		}
+
+		hashes[name] = strings.ToLower(hash)
+	}
+
+	return hashes, nil
+}
+
+// Splits the version off an index URL, such as https://example.com/index.json@1.2. An @ before the last slash is part of the URL.
+func splitSourceVersion(location string) (string, string) {
+	index := strings.LastIndex(location, "@")
+	if index <= strings.LastIndex(location, "/") {
+		return location, ""
+	}
+
+	return location[:index], location[index+1:]
+}
+
+// Finds a standard in the configured sources. Standards from remote sources are saved in the store.
+func loadStandard(ctx context.Context, inputStandard string, store Store) ([]byte, string, error) {
+	inputStandard = standardKey(inputStandard)
+	if len(inputStandard) == 0 || strings.Contains(inputStandard, "..") || strings.HasPrefix(inputStandard, "/") || strings.Contains(inputStandard, `\`) {
+		return []byte{}, "", errors.New(fmt.Sprintf("Invalid standard name '%s'", inputStandard))
+	}
+
+	skipRemote := isOffline()
+	var firstErr error
+	for _, source := range GetStandardSources() {
+		if skipRemote && source.Remote() {
+			continue
+		}
+
+		data, location, err := source.GetStandard(ctx, inputStandard)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrStandardIntegrity) {
+				return []byte{}, location, err
+			}
+
+			if !errors.Is(err, ErrNotFound) {
+				log.Printf("[WARNING] Schemaless: Failed getting standard %s from %s: %s", inputStandard, source, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+
+			continue
+		}
+
+		if debug {
+			log.Printf("[DEBUG] Schemaless: Found standard %s in %s: %s", inputStandard, source, location)
+		}
+
+		// Previews use remote standards without saving them
+		if !source.Remote() || isPreview(ctx) {
+			return data, location, nil
+		}
+
+		err = store.Put(ctx, NamespaceStandards, inputStandard, data)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed saving standard %s from %s: %s", inputStandard, source, err)
+			return data, location, nil
+		}
+
+		// Records where the standard came from and its hash, to be able to tell later what was downloaded
+		_, err = addStandardVersion(ctx, store, inputStandard, data, "", location, false)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed saving version of standard %s from %s: %s", inputStandard, source, err)
+		}
+
+		_, storedLocation, err := storeGet(ctx, store, NamespaceStandards, inputStandard)
+		if err == nil {
+			location = storedLocation
+		}
+
+		log.Printf("[INFO] Schemaless: Done loading standard '%s' from %s. Path: %s", inputStandard, source, location)
+		return data, location, nil
+	}
+
+	if firstErr != nil {
+		return []byte{}, "", firstErr
+	}
+
+	if skipRemote {
+		return []byte{}, "", fmt.Errorf("%w: standard '%s' in the local standard sources (offline)", ErrNotFound, inputStandard)
+	}
+
+	return []byte{}, "", fmt.Errorf("%w: standard '%s' in any standard source", ErrNotFound, inputStandard)
+}
+
+// Fails unless data has the expected hex encoded sha256 hash
+func verifyStandardHash(name string, data []byte, expected string) error {
+	hash := sha256.Sum256(data)
+	actual := hex.EncodeToString(hash[:])
+	if !strings.EqualFold(actual, strings.TrimPrefix(expected, "sha256:")) {
+		return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrStandardIntegrity, name, actual, expected)
+	}
+
+	return nil
+}
+
+// Standards as <name>.json files in a local folder. Names with slashes are looked up in subfolders.
+type DirectorySource struct {
+	Folder string
+}
+
+func (source *DirectorySource) GetStandard(ctx context.Context, name string) ([]byte, string, error) {
+	filename := filepath.Join(source.Folder, filepath.FromSlash(name)+".json")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []byte{}, filename, fmt.Errorf("%w: %s", ErrNotFound, filename)
+		}
+
+		return []byte{}, filename, err
+	}
+
+	return data, filename, nil
+}
+
+func (source *DirectorySource) Remote() bool {
+	return false
+}
+
+func (source *DirectorySource) String() string {
+	return fmt.Sprintf("dir:%s", source.Folder)
+}
+
+// The packs bundled in the binary, such as ecs/8.11/event
+type PackSource struct{}
+
+func (source *PackSource) GetStandard(ctx context.Context, name string) ([]byte, string, error) {
+	if !isPackStandard(name) {
+		return []byte{}, "", fmt.Errorf("%w: %s is not a pack standard", ErrNotFound, name)
+	}
+
+	return GetPackStandard(name)
+}
+
+func (source *PackSource) Remote() bool {
+	return false
+}
+
+func (source *PackSource) String() string {
+	return "packs"
+}
+
+// Standards as <path>/<name>.json files in a Github repository
+type GitSource struct {
+	Owner string
+	Repo  string
+	Path  string
+
+	// Commit, tag or branch to load standards from. Defaults to the default branch of the repository.
+	Ref string
+
+	// Optional token, to get past the rate limit of unauthenticated requests and read private repositories
+	Token string
+
+	// Optional hex encoded sha256 hashes of standards by name. Standards not matching their hash are rejected.
+	SHA256 map[string]string
+
+	// API URL for Github Enterprise, e.g. https://github.example.com/api/v3/
+	APIURL string
+}
+
+func (source *GitSource) client() (*github.Client, error) {
+	httpClient := &http.Client{}
+	if len(source.Token) > 0 {
+		httpClient.Transport = &tokenTransport{token: source.Token}
+	}
+
+	client := github.NewClient(httpClient)
+	if len(source.APIURL) > 0 {
+		apiURL, err := url.Parse(strings.TrimSuffix(source.APIURL, "/") + "/")
+		if err != nil {
+			return client, err
+		}
+
+		client.BaseURL = apiURL
+	}
+
+	return client, nil
+}
+
+func (source *GitSource) GetStandard(ctx context.Context, name string) ([]byte, string, error) {
+	filePath := path.Join(source.Path, fmt.Sprintf("%s.json", name))
+	location := fmt.Sprintf("github.com/%s/%s/%s", source.Owner, source.Repo, filePath)
+	if len(source.Ref) > 0 {
+		location = fmt.Sprintf("%s@%s", location, source.Ref)
+	}
+
+	client, err := source.client()
+	if err != nil {
+		return []byte{}, location, err
+	}
+
+	fileContent, _, resp, err := client.Repositories.GetContents(ctx, source.Owner, source.Repo, filePath, &github.RepositoryContentGetOptions{Ref: source.Ref})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return []byte{}, location, fmt.Errorf("%w: %s", ErrNotFound, location)
+		}
+
+		return []byte{}, location, err
+	}
+
+	if fileContent == nil {
+		return []byte{}, location, fmt.Errorf("%w: %s is not a file", ErrNotFound, location)
+	}
+
+	content, err := fileContent.GetContent()
+	if err != nil {
+		return []byte{}, location, errors.New(fmt.Sprintf("Failed decoding standard file %s: %s", location, err))
+	}
+
+	if expected, ok := source.SHA256[name]; ok {
+		err = verifyStandardHash(location, []byte(content), expected)
+		if err != nil {
+			return []byte{}, location, err
+		}
+	}
+
+	return []byte(content), location, nil
+}
+
+func (source *GitSource) Remote() bool {
+	return true
+}
+
+func (source *GitSource) String() string {
+	value := fmt.Sprintf("git:%s/%s", source.Owner, source.Repo)
+	if len(source.Path) > 0 {
+		value = fmt.Sprintf("%s/%s", value, source.Path)
+	}
+
+	if len(source.Ref) > 0 {
+		value = fmt.Sprintf("%s@%s", value, source.Ref)
+	}
+
+	return value
+}
+
+type tokenTransport struct {
+	token string
+}
+
+func (transport *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", transport.token))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Standards listed in a JSON index file served over HTTP:
+//
+//	{"standards": [{"name": "ticket", "version": "1.2", "url": "ticket-1.2.json", "sha256": "..."}]}
+//
+// URLs are relative to the index. Every standard needs a sha256 hash, which it is checked against.
+type HTTPIndexSource struct {
+	URL string
+
+	// Only use standards of this version. Defaults to the latest version of each standard.
+	Version string
+
+	Client *http.Client
+}
+
+type standardIndex struct {
+	Standards []standardIndexEntry `json:"standards"`
+}
+
+type standardIndexEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+}
+
+func (source *HTTPIndexSource) httpClient() *http.Client {
+	if source.Client != nil {
+		return source.Client
+	}
+
+	return http.DefaultClient
+}
+
+func (source *HTTPIndexSource) get(ctx context.Context, location string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	resp, err := source.httpClient().Do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []byte{}, fmt.Errorf("%w: %s", ErrNotFound, location)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, errors.New(fmt.Sprintf("Bad status code %d from %s", resp.StatusCode, location))
+	}
+
+	return body, nil
+}
+
+func (source *HTTPIndexSource) getIndex(ctx context.Context) (*standardIndex, error) {
+	index := &standardIndex{}
+	cacheKey := fmt.Sprintf("standard_index_%s", source.URL)
+	data, err := GetCache(ctx, cacheKey)
+	if err != nil {
+		data, err = source.get(ctx, source.URL)
+		if err != nil {
+			return index, err
+		}
+
+		err = SetCacheWithTTL(ctx, cacheKey, data, CacheTTL(CacheKindGithub))
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed setting cache for standard index '%s': %s", source.URL, err)
+		}
+	}
+
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return index, errors.New(fmt.Sprintf("Invalid standard index %s: %s", source.URL, err))
+	}
+
+	return index, nil
+}
+
+func (source *HTTPIndexSource) GetStandard(ctx context.Context, name string) ([]byte, string, error) {
+	index, err := source.getIndex(ctx)
+	if err != nil {
+		return []byte{}, source.URL, err
+	}
+
+	var found *standardIndexEntry
+	for cnt, entry := range index.Standards {
+		if standardKey(entry.Name) != name {
+			continue
+		}
+
+		if len(source.Version) > 0 {
+			if entry.Version == source.Version {
+				found = &index.Standards[cnt]
+				break
+			}
+
+			continue
+		}
+
+		if found == nil || compareVersions(entry.Version, found.Version) > 0 {
+			found = &index.Standards[cnt]
+		}
+	}
+
+	if found == nil {
+		return []byte{}, source.URL, fmt.Errorf("%w: %s in %s", ErrNotFound, name, source)
+	}
+
+	baseURL, err := url.Parse(source.URL)
+	if err != nil {
+		return []byte{}, source.URL, err
+	}
+
+	standardURL, err := baseURL.Parse(found.URL)
+	if err != nil {
+		return []byte{}, source.URL, errors.New(fmt.Sprintf("Invalid URL '%s' for standard %s in %s: %s", found.URL, name, source.URL, err))
+	}
+
+	location := standardURL.String()
+	if len(found.SHA256) == 0 {
+		return []byte{}, location, fmt.Errorf("%w: no sha256 for standard %s in %s", ErrStandardIntegrity, name, source.URL)
+	}
+
+	data, err := source.get(ctx, location)
+	if err != nil {
+		return []byte{}, location, err
+	}
+
+	err = verifyStandardHash(location, data, found.SHA256)
+	if err != nil {
+		return []byte{}, location, err
+	}
+
+	return data, location, nil
+}
+
+func (source *HTTPIndexSource) Remote() bool {
+	return true
+}
+
+func (source *HTTPIndexSource) String() string {
+	if len(source.Version) > 0 {
+		return fmt.Sprintf("http:%s@%s", source.URL, source.Version)
+	}
+
+	return fmt.Sprintf("http:%s", source.URL)
+}
+
+func init() {
+	if value := os.Getenv("SCHEMALESS_STANDARD_SOURCES"); len(value) > 0 {
+		sources, err := ParseStandardSources(value)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Invalid SCHEMALESS_STANDARD_SOURCES: %s", err)
+		} else {
+			standardSources = sources
+		}
+	}
+
+	if os.Getenv("SCHEMALESS_OFFLINE") == "true" {
+		offline = true
+	}
+}
@@ -0,0 +1,120 @@
+package schemaless
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Every source type is a StandardSource
+var _ = []StandardSource{&DirectorySource{}, &PackSource{}, &GitSource{}, &HTTPIndexSource{}}
+
+func testHash(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
+
+// Only uses sources for the test, with remote sources turned on
+func useTestSources(t *testing.T, sources ...StandardSource) {
+	t.Helper()
+
+	previous := GetStandardSources()
+	SetStandardSources(sources...)
+	SetOffline(false)
+	t.Cleanup(func() {
+		SetStandardSources(previous...)
+	})
+}
+
+func TestParseStandardSources(t *testing.T) {
+	ticketHash := testHash("ticket")
+	alertHash := testHash("alert")
+
+	sources, err := ParseStandardSources(fmt.Sprintf("dir:/etc/standards, packs, git:myorg/standards/translation_standards@4f2c1e9#ticket=%s; alert.json=sha256:%s, http:https://example.com/@v1/index.json@1.2", ticketHash, strings.ToUpper(alertHash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := []string{}
+	for _, source := range sources {
+		found = append(found, source.String())
+	}
+
+	expected := "dir:/etc/standards,packs,git:myorg/standards/translation_standards@4f2c1e9,http:https://example.com/@v1/index.json@1.2"
+	if strings.Join(found, ",") != expected {
+		t.Errorf("got %s, expected %s", strings.Join(found, ","), expected)
+	}
+
+	git := sources[2].(*GitSource)
+	if len(git.SHA256) != 2 || git.SHA256["ticket"] != ticketHash || git.SHA256["alert"] != alertHash {
+		t.Errorf("unexpected hashes %v", git.SHA256)
+	}
+
+	sources, err = ParseStandardSources("git:myorg/standards")
+	if err != nil || sources[0].(*GitSource).SHA256 != nil {
+		t.Errorf("expected no hashes, got %v (%v)", sources, err)
+	}
+
+	for _, value := range []string{"git:myorg", "git:myorg/standards#ticket=abc", "git:myorg/standards#ticket", fmt.Sprintf("git:myorg/standards#=%s", ticketHash), "dir:", "http:example.com/index.json", "ftp:example.com"} {
+		_, err := ParseStandardSources(value)
+		if err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestLoadStandardRecordsSource(t *testing.T) {
+	store := useTestStore(t)
+
+	standard := `{"title": "The title"}`
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/index.json":
+			fmt.Fprintf(resp, `{"standards": [{"name": "ticket", "version": "1.0", "url": "ticket.json", "sha256": "%s"}, {"name": "alert", "version": "1.0", "url": "alert.json", "sha256": "%s"}]}`, testHash(standard), testHash("changed"))
+		case "/ticket.json", "/alert.json":
+			resp.Write([]byte(standard))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	useTestSources(t, &HTTPIndexSource{URL: server.URL + "/index.json"})
+
+	ctx := context.Background()
+	data, _, err := loadStandard(ctx, "ticket", store)
+	if err != nil || string(data) != standard {
+		t.Fatalf("got %s (%v)", data, err)
+	}
+
+	stored, err := store.Get(ctx, NamespaceStandards, "ticket")
+	if err != nil || string(stored) != standard {
+		t.Errorf("expected the standard to be saved, got %s (%v)", stored, err)
+	}
+
+	versions, err := ListStandardVersions(ctx, "ticket", ShuffleConfig{})
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("expected a version for the download, got %v (%v)", versions, err)
+	}
+
+	if versions[0].Source != server.URL+"/ticket.json" || versions[0].Hash != testHash(standard) {
+		t.Errorf("expected the source and hash of the download, got %+v", versions[0])
+	}
+
+	// Not matching its hash, so it is neither saved nor recorded
+	_, _, err = loadStandard(ctx, "alert", store)
+	if !errors.Is(err, ErrStandardIntegrity) {
+		t.Errorf("expected ErrStandardIntegrity, got %v", err)
+	}
+
+	versions, _ = ListStandardVersions(ctx, "alert", ShuffleConfig{})
+	if _, err := store.Get(ctx, NamespaceStandards, "alert"); !errors.Is(err, ErrNotFound) || len(versions) != 0 {
+		t.Errorf("expected nothing stored for the mismatching standard, got %v (%v)", versions, err)
+	}
+}
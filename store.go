@@ -0,0 +1,322 @@
+package schemaless
+
+/*
+Storage for standards, mappings and everything around them. All persistence goes through the Store interface,
+meaning other backends can be plugged in with SetStore().
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Namespaces used to group stored values
+const (
+	NamespaceStandards       = "translation_standards"
+	NamespaceMappings        = "translation_output"
+	NamespaceHistory         = "translation_history"
+	NamespaceInputs          = "translation_input"
+	NamespaceQueries         = "translation_ai_queries"
+	NamespaceStandardHistory = "translation_standard_history"
+
+	// The audit trail of each mapping. Kept apart from the mapping, as mappings are read on every translation.
+	NamespaceMappingLogs = "translation_log"
+)
+
+// Returned by stores when a key doesn't exist in a namespace
+var ErrNotFound = errors.New("Not found in store")
+
+// Returned by stores that don't keep a namespace at all, such as the sample inputs in Shuffle
+var ErrNotStored = errors.New("Not kept by this store")
+
+// Returned by conditional writes when the value changed since it was read
+var ErrConflict = errors.New("Value changed in store")
+
+// How many times a conditional update is retried before giving up
+var maxConflictRetries = 5
+
+type Store interface {
+	Get(ctx context.Context, namespace, key string) ([]byte, error)
+	Put(ctx context.Context, namespace, key string, data []byte) error
+	List(ctx context.Context, namespace string) ([]string, error)
+	Delete(ctx context.Context, namespace, key string) error
+}
+
+// Implemented by stores that can tell where a value is stored, such as a filepath or a Shuffle file ID
+type LocatingStore interface {
+	GetWithLocation(ctx context.Context, namespace, key string) ([]byte, string, error)
+}
+
+// Implemented by stores that can write a value only if it is unchanged since it was read.
+// The version is opaque to callers, e.g. an ETag. An empty version means the key must not exist yet.
+type ConditionalStore interface {
+	GetWithVersion(ctx context.Context, namespace, key string) ([]byte, string, error)
+	PutIfVersion(ctx context.Context, namespace, key string, data []byte, version string) error
+}
+
+// Implemented by stores that can lock a key while it is read, changed and written back
+type LockingStore interface {
+	Lock(ctx context.Context, namespace, key string) (func(), error)
+}
+
+// Implemented by stores that keep the data of each org apart
+type OrgStore interface {
+	WithOrg(orgId string) Store
+}
+
+// Implemented by stores that count how often values are used. Stores may keep counts in memory for a while,
+// and write them with FlushUsage, e.g. before shutting down.
+type UsageStore interface {
+	IncrementUsage(ctx context.Context, namespace, key string) error
+	GetUsage(ctx context.Context, namespace, key string) (int64, error)
+	FlushUsage(ctx context.Context) error
+}
+
+var defaultStore Store
+var envStoreOnce sync.Once
+
+// Sets the store used when no Shuffle URL is configured. Defaults to the filesystem in FILE_LOCATION.
+//
+// Compiled mappings are kept in memory and aren't checked against the store when they are used. Mappings changed outside
+// this process, by other replicas or directly in the store, are picked up once the plan expires, after CacheTTL(CacheKindPlan)
+// (1 minute by default, SCHEMALESS_CACHE_TTL_PLAN). Until then, translations of the same input structure use the old mapping.
+// Setting the store drops the plans.
+func SetStore(store Store) {
+	envStoreOnce.Do(func() {})
+	defaultStore = store
+	resetMappingPlans()
+}
+
+// Sets up the store from environment variables. Done on first use rather than in init(),
+// as SQL drivers register themselves in the init() of the users package.
+func setStoreFromEnv() {
+	if len(os.Getenv("SCHEMALESS_S3_BUCKET")) > 0 {
+		defaultStore = NewS3StoreFromEnv()
+		return
+	}
+
+	// e.g. sqlite and files/schemaless.db
+	driverName := os.Getenv("SCHEMALESS_SQL_DRIVER")
+	if len(driverName) > 0 {
+		store, err := OpenSQLStore(driverName, os.Getenv("SCHEMALESS_SQL_DSN"))
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Failed opening SQL store with driver '%s'. Is the driver imported? %s", driverName, err)
+			return
+		}
+
+		defaultStore = store
+	}
+}
+
+// Gets the store to use for a config. Shuffle is used when its URL is set.
+func GetStore(shuffleConfig ShuffleConfig) Store {
+	if len(shuffleConfig.URL) > 0 {
+		return NewShuffleStore(shuffleConfig)
+	}
+
+	envStoreOnce.Do(setStoreFromEnv)
+	if defaultStore != nil {
+		if orgStore, ok := defaultStore.(OrgStore); ok && len(shuffleConfig.OrgId) > 0 {
+			return orgStore.WithOrg(shuffleConfig.OrgId)
+		}
+
+		return defaultStore
+	}
+
+	return NewFilesystemStore(getRootFolder())
+}
+
+// Gets a value along with where it is stored
+func storeGet(ctx context.Context, store Store, namespace, key string) ([]byte, string, error) {
+	if locating, ok := store.(LocatingStore); ok {
+		return locating.GetWithLocation(ctx, namespace, key)
+	}
+
+	data, err := store.Get(ctx, namespace, key)
+	return data, fmt.Sprintf("%s/%s", namespace, key), err
+}
+
+// Reads a value, changes it and writes it back. With a ConditionalStore the write only goes through
+// if nobody else changed the value in between, otherwise it is retried. A LockingStore holds a lock on the key instead.
+// update gets an empty value if the key doesn't exist.
+func updateStore(ctx context.Context, store Store, namespace, key string, update func(existing []byte) ([]byte, error)) error {
+	conditional, ok := store.(ConditionalStore)
+	if !ok {
+		if locking, ok := store.(LockingStore); ok {
+			unlock, err := locking.Lock(ctx, namespace, key)
+			if err != nil {
+				return err
+			}
+
+			defer unlock()
+		}
+
+		existing, err := store.Get(ctx, namespace, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		updated, err := update(existing)
+		if err != nil {
+			return err
+		}
+
+		return store.Put(ctx, namespace, key, updated)
+	}
+
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		existing, version, err := conditional.GetWithVersion(ctx, namespace, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		updated, err := update(existing)
+		if err != nil {
+			return err
+		}
+
+		err = conditional.PutIfVersion(ctx, namespace, key, updated, version)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+
+		log.Printf("[WARNING] Schemaless: %s/%s changed while updating it. Retrying (%d/%d)", namespace, key, attempt+1, maxConflictRetries)
+	}
+
+	return fmt.Errorf("%w: gave up updating %s/%s after %d attempts", ErrConflict, namespace, key, maxConflictRetries)
+}
+
+// Writes a value only if the key doesn't exist yet. Returns ErrConflict if it does.
+// Stores that can neither write conditionally nor lock keys only check for the key before writing.
+func storeCreate(ctx context.Context, store Store, namespace, key string, data []byte) error {
+	if conditional, ok := store.(ConditionalStore); ok {
+		return conditional.PutIfVersion(ctx, namespace, key, data, "")
+	}
+
+	if locking, ok := store.(LockingStore); ok {
+		unlock, err := locking.Lock(ctx, namespace, key)
+		if err != nil {
+			return err
+		}
+
+		defer unlock()
+	}
+
+	_, err := store.Get(ctx, namespace, key)
+	if err == nil {
+		return fmt.Errorf("%w: %s/%s already exists", ErrConflict, namespace, key)
+	}
+
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	return store.Put(ctx, namespace, key, data)
+}
+
+// Counts a use of the value if the store supports it
+func recordUsage(ctx context.Context, store Store, namespace, key string) {
+	usageStore, ok := store.(UsageStore)
+	if !ok || isPreview(ctx) {
+		return
+	}
+
+	err := usageStore.IncrementUsage(ctx, namespace, key)
+	if err != nil {
+		log.Printf("[WARNING] Schemaless: Failed counting usage of %s/%s: %s", namespace, key, err)
+	}
+}
+
+// An in-memory store. Mostly useful for tests and short-lived processes.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	data  map[string]map[string][]byte
+	usage map[string]int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:  map[string]map[string][]byte{},
+		usage: map[string]int64{},
+	}
+}
+
+func (store *MemoryStore) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	value, ok := store.data[namespace][key]
+	if !ok {
+		return []byte{}, fmt.Errorf("%w: %s/%s", ErrNotFound, namespace, key)
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+func (store *MemoryStore) Put(ctx context.Context, namespace, key string, data []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.data[namespace]; !ok {
+		store.data[namespace] = map[string][]byte{}
+	}
+
+	store.data[namespace][key] = append([]byte{}, data...)
+	return nil
+}
+
+func (store *MemoryStore) List(ctx context.Context, namespace string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	keys := []string{}
+	for key := range store.data[namespace] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (store *MemoryStore) Delete(ctx context.Context, namespace, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.data[namespace][key]; !ok {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, namespace, key)
+	}
+
+	delete(store.data[namespace], key)
+	return nil
+}
+
+func (store *MemoryStore) IncrementUsage(ctx context.Context, namespace, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.usage[fmt.Sprintf("%s/%s", namespace, key)]++
+	return nil
+}
+
+func (store *MemoryStore) GetUsage(ctx context.Context, namespace, key string) (int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.usage[fmt.Sprintf("%s/%s", namespace, key)], nil
+}
+
+// Counts are kept in memory only, so there is nothing to write
+func (store *MemoryStore) FlushUsage(ctx context.Context) error {
+	return nil
+}
+
+// Standards are stored without their file extension
+func standardKey(name string) string {
+	return strings.TrimSuffix(name, ".json")
+}
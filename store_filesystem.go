@@ -0,0 +1,444 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Holds the usage counts of the other namespaces
+const namespaceUsage = "usage"
+
+// Stores values as files in folders below a root folder, e.g. files/schemaless/translation_output/<key>.json
+type FilesystemStore struct {
+	Root string
+}
+
+func NewFilesystemStore(root string) *FilesystemStore {
+	return &FilesystemStore{
+		Root: root,
+	}
+}
+
+// The folder and file extension used for each namespace
+func (store *FilesystemStore) folder(namespace string) (string, string) {
+	switch namespace {
+	case NamespaceStandards:
+		return "standards", ".json"
+	case NamespaceMappings:
+		return "translation_output", ".json"
+	case NamespaceHistory:
+		return "translation_history", ".json"
+	case NamespaceInputs:
+		return "input", ""
+	case NamespaceQueries:
+		return "queries", ""
+	case NamespaceStandardHistory:
+		return "standard_history", ".json"
+	case NamespaceMappingLogs:
+		return "translation_log", ".json"
+	case namespaceUsage:
+		return "usage", ".json"
+	}
+
+	return namespace, ""
+}
+
+func (store *FilesystemStore) filename(namespace, key string) (string, error) {
+	if len(key) == 0 || strings.Contains(key, "..") || strings.ContainsAny(key, `/\`) {
+		return "", errors.New(fmt.Sprintf("Invalid key '%s' for namespace %s", key, namespace))
+	}
+
+	folder, extension := store.folder(namespace)
+	return fmt.Sprintf("%s%s/%s%s", store.Root, folder, key, extension), nil
+}
+
+func (store *FilesystemStore) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	data, _, err := store.GetWithLocation(ctx, namespace, key)
+	return data, err
+}
+
+func (store *FilesystemStore) GetWithLocation(ctx context.Context, namespace, key string) ([]byte, string, error) {
+	filename, err := store.filename(namespace, key)
+	if err != nil {
+		return []byte{}, filename, err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []byte{}, filename, fmt.Errorf("%w: %s", ErrNotFound, filename)
+		}
+
+		log.Printf("[ERROR] Schemaless: Error reading file %s: %v", filename, err)
+		return []byte{}, filename, err
+	}
+
+	return data, filename, nil
+}
+
+// Writes to a temporary file which is renamed over the old one, meaning readers never see a partially written file
+func (store *FilesystemStore) Put(ctx context.Context, namespace, key string, data []byte) error {
+	filename, err := store.filename(namespace, key)
+	if err != nil {
+		return err
+	}
+
+	folder := filepath.Dir(filename)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error creating folder for '%s': %v", filename, err)
+		return err
+	}
+
+	// Starts with a dot so it isn't listed
+	tmpFile, err := os.CreateTemp(folder, fmt.Sprintf(".%s.tmp-*", filepath.Base(filename)))
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error creating temporary file for %s: %v", filename, err)
+		return err
+	}
+
+	tmpFilename := tmpFile.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(tmpFilename)
+		}
+	}()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmpFilename, 0644)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error writing to file %s: %v", filename, err)
+		return err
+	}
+
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Error moving temporary file to %s: %v", filename, err)
+		return err
+	}
+
+	renamed = true
+	syncFolder(folder)
+
+	if debug {
+		log.Printf("[DEBUG] Schemaless: Saved %s", filename)
+	}
+
+	return nil
+}
+
+// Makes the rename itself durable. Not supported on all platforms, so errors are ignored.
+func syncFolder(folder string) {
+	dir, err := os.Open(folder)
+	if err != nil {
+		return
+	}
+
+	dir.Sync()
+	dir.Close()
+}
+
+// How often a lock file held by another process is tried again while waiting for it
+var fileLockPollInterval = 10 * time.Millisecond
+
+// A lock within the process. The channel holds a value while the lock is taken, so waiting for it can be cancelled.
+type fileLock struct {
+	taken chan struct{}
+	refs  int
+}
+
+// Used for all FilesystemStores, as a new one is made for every GetStore() call.
+// Entries are removed when nobody holds or waits for them.
+var fileLocks = map[string]*fileLock{}
+var fileLocksMu sync.Mutex
+
+func acquireFileLock(ctx context.Context, filename string) (func(), error) {
+	fileLocksMu.Lock()
+	lock, ok := fileLocks[filename]
+	if !ok {
+		lock = &fileLock{
+			taken: make(chan struct{}, 1),
+		}
+
+		fileLocks[filename] = lock
+	}
+
+	lock.refs += 1
+	fileLocksMu.Unlock()
+
+	release := func() {
+		fileLocksMu.Lock()
+		lock.refs -= 1
+		if lock.refs == 0 {
+			delete(fileLocks, filename)
+		}
+
+		fileLocksMu.Unlock()
+	}
+
+	select {
+	case lock.taken <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return func() {}, ctx.Err()
+	}
+
+	return func() {
+		<-lock.taken
+		release()
+	}, nil
+}
+
+// Locks a key for read-modify-write cycles, both within the process and between processes using the same folder.
+// Put does not take the lock, as writes are atomic by themselves. Waiting for the lock stops when ctx is done.
+func (store *FilesystemStore) Lock(ctx context.Context, namespace, key string) (func(), error) {
+	filename, err := store.filename(namespace, key)
+	if err != nil {
+		return func() {}, err
+	}
+
+	unlockProcess, err := acquireFileLock(ctx, filename)
+	if err != nil {
+		return func() {}, err
+	}
+
+	folder := filepath.Dir(filename)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		unlockProcess()
+		return func() {}, err
+	}
+
+	lockFilename := filepath.Join(folder, fmt.Sprintf(".%s.lock", filepath.Base(filename)))
+	file, err := os.OpenFile(lockFilename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		unlockProcess()
+		log.Printf("[ERROR] Schemaless: Error opening lock file %s: %v", lockFilename, err)
+		return func() {}, err
+	}
+
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			unlockProcess()
+			log.Printf("[ERROR] Schemaless: Error locking %s: %v", lockFilename, err)
+			return func() {}, err
+		}
+
+		if locked {
+			break
+		}
+
+		// Held by another process
+		select {
+		case <-time.After(fileLockPollInterval):
+		case <-ctx.Done():
+			file.Close()
+			unlockProcess()
+			return func() {}, ctx.Err()
+		}
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+		unlockProcess()
+	}, nil
+}
+
+func (store *FilesystemStore) List(ctx context.Context, namespace string) ([]string, error) {
+	folder, extension := store.folder(namespace)
+	entries, err := os.ReadDir(fmt.Sprintf("%s%s", store.Root, folder))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, nil
+		}
+
+		return []string{}, err
+	}
+
+	keys := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		if len(extension) > 0 && !strings.HasSuffix(entry.Name(), extension) {
+			continue
+		}
+
+		keys = append(keys, strings.TrimSuffix(entry.Name(), extension))
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (store *FilesystemStore) Delete(ctx context.Context, namespace, key string) error {
+	filename, err := store.filename(namespace, key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, filename)
+	}
+
+	return err
+}
+
+// Usage counts are kept in memory and written to usage/<namespace>.json at most this often, as a write per translation is too slow
+var usageFlushInterval = 10 * time.Second
+
+type pendingFileUsage struct {
+	namespace string
+
+	mu        sync.Mutex
+	counts    map[string]int64
+	lastFlush time.Time
+}
+
+// Counts not yet written, by usage file. Shared between FilesystemStores like fileLocks.
+var fileUsage sync.Map
+
+func (store *FilesystemStore) pendingUsage(namespace string) (*pendingFileUsage, error) {
+	filename, err := store.filename(namespaceUsage, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingValue, _ := fileUsage.LoadOrStore(filename, &pendingFileUsage{
+		namespace: namespace,
+		counts:    map[string]int64{},
+		lastFlush: time.Now(),
+	})
+
+	return pendingValue.(*pendingFileUsage), nil
+}
+
+func (store *FilesystemStore) IncrementUsage(ctx context.Context, namespace, key string) error {
+	pending, err := store.pendingUsage(namespace)
+	if err != nil {
+		return err
+	}
+
+	pending.mu.Lock()
+	pending.counts[key]++
+	flush := time.Since(pending.lastFlush) >= usageFlushInterval
+	pending.mu.Unlock()
+
+	if !flush {
+		return nil
+	}
+
+	return store.flushUsage(ctx, pending)
+}
+
+// Writes the usage counts kept in memory for every namespace, e.g. before shutting down
+func (store *FilesystemStore) FlushUsage(ctx context.Context) error {
+	var err error
+	fileUsage.Range(func(filename, pendingValue interface{}) bool {
+		pending := pendingValue.(*pendingFileUsage)
+
+		// Other stores with another root share the map
+		if ownFilename, _ := store.filename(namespaceUsage, pending.namespace); ownFilename != filename {
+			return true
+		}
+
+		if flushErr := store.flushUsage(ctx, pending); flushErr != nil {
+			err = flushErr
+		}
+
+		return true
+	})
+
+	return err
+}
+
+// Takes the pending counts and adds them to the usage file. The file is written without holding the lock of the counts,
+// so translations counting usage don't wait for it.
+func (store *FilesystemStore) flushUsage(ctx context.Context, pending *pendingFileUsage) error {
+	pending.mu.Lock()
+	counts := pending.counts
+	pending.counts = map[string]int64{}
+	pending.lastFlush = time.Now()
+	pending.mu.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := updateStore(ctx, store, namespaceUsage, pending.namespace, func(existing []byte) ([]byte, error) {
+		stored := map[string]int64{}
+		if len(existing) > 0 {
+			if err := json.Unmarshal(existing, &stored); err != nil {
+				log.Printf("[WARNING] Schemaless: Resetting invalid usage counts for %s: %s", pending.namespace, err)
+			}
+		}
+
+		for countKey, count := range counts {
+			stored[countKey] += count
+		}
+
+		return json.Marshal(stored)
+	})
+	if err != nil {
+		// Kept for the next flush
+		pending.mu.Lock()
+		for countKey, count := range counts {
+			pending.counts[countKey] += count
+		}
+		pending.mu.Unlock()
+	}
+
+	return err
+}
+
+func (store *FilesystemStore) GetUsage(ctx context.Context, namespace, key string) (int64, error) {
+	pending, err := store.pendingUsage(namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	pending.mu.Lock()
+	count := pending.counts[key]
+	pending.mu.Unlock()
+
+	data, err := store.Get(ctx, namespaceUsage, namespace)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return count, nil
+		}
+
+		return count, err
+	}
+
+	stored := map[string]int64{}
+	err = json.Unmarshal(data, &stored)
+	return count + stored[key], err
+}
@@ -0,0 +1,191 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fileLockCount() int {
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+	return len(fileLocks)
+}
+
+func TestFilesystemStoreConcurrentUpdates(t *testing.T) {
+	store := NewFilesystemStore(t.TempDir() + "/")
+	ctx := context.Background()
+
+	wg := sync.WaitGroup{}
+	for cnt := 0; cnt < 20; cnt++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := updateStore(ctx, store, namespaceUsage, "counter", func(existing []byte) ([]byte, error) {
+				count, _ := strconv.Atoi(string(existing))
+				return []byte(strconv.Itoa(count + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	data, err := store.Get(ctx, namespaceUsage, "counter")
+	if err != nil || string(data) != "20" {
+		t.Errorf("expected 20 updates, got %q (%v)", data, err)
+	}
+
+	if count := fileLockCount(); count != 0 {
+		t.Errorf("expected the locks to be removed after unlocking, %d left", count)
+	}
+}
+
+func TestFilesystemStoreLockHonoursContext(t *testing.T) {
+	store := NewFilesystemStore(t.TempDir() + "/")
+
+	unlock, err := store.Lock(context.Background(), NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = store.Lock(ctx, NamespaceMappings, "ticket-abc")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to end with the context, got %v", err)
+	}
+
+	unlock()
+
+	unlock, err = store.Lock(context.Background(), NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock()
+	if count := fileLockCount(); count != 0 {
+		t.Errorf("expected the locks to be removed after unlocking, %d left", count)
+	}
+}
+
+func TestFilesystemStoreLockBetweenProcesses(t *testing.T) {
+	root := t.TempDir() + "/"
+	store := NewFilesystemStore(root)
+
+	// Another process holding the lock file. Locks are per open file, so this works within one process as well.
+	folder := filepath.Join(root, "translation_output")
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := os.OpenFile(filepath.Join(folder, ".ticket-abc.json.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	locked, err := tryLockFile(other)
+	if err != nil || !locked {
+		t.Fatalf("failed locking the file: %v", err)
+	}
+
+	probe, err := os.Open(other.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probeLocked, _ := tryLockFile(probe)
+	probe.Close()
+	if probeLocked {
+		unlockFile(other)
+		t.Skip("file locks aren't supported on this platform")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = store.Lock(ctx, NamespaceMappings, "ticket-abc")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait for the other process to end with the context, got %v", err)
+	}
+
+	// Released while the store may be waiting for it. The goroutine is done before the deferred Close.
+	done := make(chan struct{})
+	go func() {
+		unlockFile(other)
+		close(done)
+	}()
+
+	unlock, err := store.Lock(context.Background(), NamespaceMappings, "ticket-abc")
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock()
+}
+
+func TestFilesystemStoreFlushUsage(t *testing.T) {
+	store := NewFilesystemStore(t.TempDir() + "/")
+	ctx := context.Background()
+
+	previous := usageFlushInterval
+	usageFlushInterval = time.Hour
+	t.Cleanup(func() {
+		usageFlushInterval = previous
+	})
+
+	for cnt := 0; cnt < 3; cnt++ {
+		err := store.IncrementUsage(ctx, NamespaceMappings, "ticket-abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := store.GetUsage(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil || count != 3 {
+		t.Errorf("expected 3 pending hits, got %d (%v)", count, err)
+	}
+
+	if _, err := store.Get(ctx, namespaceUsage, NamespaceMappings); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected nothing written before the flush, got %v", err)
+	}
+
+	// Doesn't write the counts of stores in other folders
+	other := NewFilesystemStore(t.TempDir() + "/")
+	err = other.FlushUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ctx, namespaceUsage, NamespaceMappings); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the counts to be kept by the other store, got %v", err)
+	}
+
+	var usageStore UsageStore = store
+	err = usageStore.FlushUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := store.Get(ctx, namespaceUsage, NamespaceMappings)
+	if err != nil || string(data) != `{"ticket-abc":3}` {
+		t.Errorf("expected the counts to be written, got %s (%v)", data, err)
+	}
+
+	count, err = store.GetUsage(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil || count != 3 {
+		t.Errorf("expected 3 hits after the flush, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,424 @@
+package schemaless
+
+/*
+A store for any S3 compatible object storage, e.g. AWS S3, MinIO or Cloudflare R2. Requests are signed with AWS Signature Version 4.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	// e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint     string `json:"endpoint"`
+	Region       string `json:"region"`
+	Bucket       string `json:"bucket"`
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+
+	// All keys are put below this prefix, e.g. schemaless/
+	Prefix string `json:"prefix"`
+
+	// Uses bucket.endpoint/key instead of endpoint/bucket/key
+	VirtualHostStyle bool `json:"virtual_host_style"`
+}
+
+// Objects are stored as <prefix>/<org>/<namespace>/<key>
+type S3Store struct {
+	Config S3Config
+	OrgId  string
+
+	client *http.Client
+}
+
+func NewS3Store(config S3Config) *S3Store {
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3Store{
+		Config: config,
+		client: GetExternalClient(config.Endpoint),
+	}
+}
+
+// Reads the config from SCHEMALESS_S3_* environment variables, falling back to the AWS ones for credentials
+func NewS3StoreFromEnv() *S3Store {
+	config := S3Config{
+		Endpoint:     os.Getenv("SCHEMALESS_S3_ENDPOINT"),
+		Region:       os.Getenv("SCHEMALESS_S3_REGION"),
+		Bucket:       os.Getenv("SCHEMALESS_S3_BUCKET"),
+		AccessKey:    os.Getenv("SCHEMALESS_S3_ACCESS_KEY"),
+		SecretKey:    os.Getenv("SCHEMALESS_S3_SECRET_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Prefix:       os.Getenv("SCHEMALESS_S3_PREFIX"),
+
+		VirtualHostStyle: os.Getenv("SCHEMALESS_S3_VIRTUAL_HOST_STYLE") == "true",
+	}
+
+	if len(config.AccessKey) == 0 {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	if len(config.SecretKey) == 0 {
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if len(config.Region) == 0 {
+		config.Region = os.Getenv("AWS_REGION")
+	}
+
+	if len(config.Endpoint) == 0 {
+		region := config.Region
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	return NewS3Store(config)
+}
+
+// Returns a copy of the store where all keys are below the org
+func (store *S3Store) WithOrg(orgId string) Store {
+	orgStore := *store
+	orgStore.OrgId = orgId
+	return &orgStore
+}
+
+func (store *S3Store) objectKey(namespace, key string) string {
+	orgId := store.OrgId
+	if len(orgId) == 0 {
+		orgId = "default"
+	}
+
+	parts := []string{}
+	if prefix := strings.Trim(store.Config.Prefix, "/"); len(prefix) > 0 {
+		parts = append(parts, prefix)
+	}
+
+	parts = append(parts, orgId, namespace)
+	if len(key) > 0 {
+		parts = append(parts, key)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func (store *S3Store) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	data, _, err := store.GetWithVersion(ctx, namespace, key)
+	return data, err
+}
+
+// The version is the ETag of the object
+func (store *S3Store) GetWithVersion(ctx context.Context, namespace, key string) ([]byte, string, error) {
+	resp, err := store.do(ctx, "GET", store.objectKey(namespace, key), nil, nil, nil)
+	if err != nil {
+		return []byte{}, "", err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, "", err
+	}
+
+	if resp.StatusCode == 404 {
+		return []byte{}, "", fmt.Errorf("%w: %s/%s", ErrNotFound, namespace, key)
+	}
+
+	if resp.StatusCode != 200 {
+		log.Printf("[ERROR] Schemaless: Bad status code from S3 for %s/%s: %s", namespace, key, resp.Status)
+		return []byte{}, "", errors.New(fmt.Sprintf("Bad status code from S3: %s. Raw: %s", resp.Status, string(body)))
+	}
+
+	return body, resp.Header.Get("ETag"), nil
+}
+
+func (store *S3Store) Put(ctx context.Context, namespace, key string, data []byte) error {
+	return store.put(ctx, namespace, key, data, nil)
+}
+
+// Only writes if the object still has the given ETag. An empty version means the object must not exist yet.
+func (store *S3Store) PutIfVersion(ctx context.Context, namespace, key string, data []byte, version string) error {
+	headers := map[string]string{}
+	if len(version) == 0 {
+		headers["If-None-Match"] = "*"
+	} else {
+		headers["If-Match"] = version
+	}
+
+	return store.put(ctx, namespace, key, data, headers)
+}
+
+func (store *S3Store) put(ctx context.Context, namespace, key string, data []byte, headers map[string]string) error {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+
+	headers["Content-Type"] = "application/json"
+	resp, err := store.do(ctx, "PUT", store.objectKey(namespace, key), nil, headers, data)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	// 409 is returned when a conditional write races with another one
+	if resp.StatusCode == 412 || resp.StatusCode == 409 {
+		return fmt.Errorf("%w: %s/%s", ErrConflict, namespace, key)
+	}
+
+	if resp.StatusCode != 200 {
+		log.Printf("[ERROR] Schemaless: Bad status code from S3 when writing %s/%s: %s", namespace, key, resp.Status)
+		return errors.New(fmt.Sprintf("Bad status code from S3: %s. Raw: %s", resp.Status, string(body)))
+	}
+
+	return nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+func (store *S3Store) List(ctx context.Context, namespace string) ([]string, error) {
+	prefix := store.objectKey(namespace, "") + "/"
+
+	keys := []string{}
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if len(continuationToken) > 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := store.do(ctx, "GET", "", query, nil, nil)
+		if err != nil {
+			return keys, err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return keys, err
+		}
+
+		if resp.StatusCode != 200 {
+			return keys, errors.New(fmt.Sprintf("Bad status code from S3 when listing %s: %s. Raw: %s", namespace, resp.Status, string(body)))
+		}
+
+		result := s3ListResult{}
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return keys, err
+		}
+
+		for _, item := range result.Contents {
+			key := strings.TrimPrefix(item.Key, prefix)
+			if len(key) > 0 {
+				keys = append(keys, key)
+			}
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			break
+		}
+
+		continuationToken = result.NextContinuationToken
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (store *S3Store) Delete(ctx context.Context, namespace, key string) error {
+	resp, err := store.do(ctx, "DELETE", store.objectKey(namespace, key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, namespace, key)
+	}
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("Bad status code from S3 when deleting %s/%s: %s. Raw: %s", namespace, key, resp.Status, string(body)))
+	}
+
+	return nil
+}
+
+// Runs a signed request against the bucket. An empty objectKey targets the bucket itself.
+func (store *S3Store) do(ctx context.Context, method, objectKey string, query url.Values, headers map[string]string, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(store.Config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	host := endpoint.Host
+	path := "/" + store.Config.Bucket
+	if store.Config.VirtualHostStyle {
+		host = fmt.Sprintf("%s.%s", store.Config.Bucket, endpoint.Host)
+		path = ""
+	}
+
+	if len(objectKey) > 0 {
+		path += "/" + objectKey
+	}
+
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	canonicalPath := awsURIEncode(path, false)
+	canonicalQuery := ""
+	if len(query) > 0 {
+		canonicalQuery = awsCanonicalQuery(query)
+	}
+
+	requestUrl := fmt.Sprintf("%s://%s%s", endpoint.Scheme, host, canonicalPath)
+	if len(canonicalQuery) > 0 {
+		requestUrl += "?" + canonicalQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	store.sign(req, host, canonicalPath, canonicalQuery, body, time.Now().UTC())
+	return store.client.Do(req)
+}
+
+// AWS Signature Version 4: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (store *S3Store) sign(req *http.Request, host, canonicalPath, canonicalQuery string, body []byte, now time.Time) {
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Host = host
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(store.Config.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", store.Config.SessionToken)
+	}
+
+	signedHeaderNames := []string{"host"}
+	canonicalHeaders := map[string]string{
+		"host": host,
+	}
+
+	for key, values := range req.Header {
+		lowerKey := strings.ToLower(key)
+		if lowerKey != "content-type" && !strings.HasPrefix(lowerKey, "x-amz-") && !strings.HasPrefix(lowerKey, "if-") {
+			continue
+		}
+
+		signedHeaderNames = append(signedHeaderNames, lowerKey)
+		canonicalHeaders[lowerKey] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	sort.Strings(signedHeaderNames)
+
+	headerLines := ""
+	for _, name := range signedHeaderNames {
+		headerLines += fmt.Sprintf("%s:%s\n", name, canonicalHeaders[name])
+	}
+
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		canonicalQuery,
+		headerLines,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, store.Config.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+store.Config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, store.Config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", store.Config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	hasher := hmac.New(sha256.New, key)
+	hasher.Write([]byte(data))
+	return hasher.Sum(nil)
+}
+
+// URI encodes everything except unreserved characters (A-Z, a-z, 0-9, -, _, ., ~)
+func awsURIEncode(value string, encodeSlash bool) string {
+	encoded := strings.Builder{}
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+
+	return encoded.String()
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, fmt.Sprintf("%s=%s", awsURIEncode(key, true), awsURIEncode(value, true)))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,730 @@
+package schemaless
+
+/*
+A store for SQL databases through database/sql. SQLite and Postgres are supported. The driver has to be imported by the user, e.g.:
+
+	import _ "modernc.org/sqlite"
+	import _ "github.com/lib/pq"
+
+Mappings are indexed by standard, referenced input field and version, meaning they can be queried with QueryMappings().
+Every row has the org it belongs to, see WithOrg().
+*/
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SQLDialectSQLite   = "sqlite"
+	SQLDialectPostgres = "postgres"
+)
+
+type SQLStore struct {
+	DB      *sql.DB
+	Dialect string
+
+	// Empty for values that don't belong to an org
+	OrgId string
+
+	usage *pendingSQLUsage
+}
+
+// A mapping as indexed in the database
+type MappingRecord struct {
+	Key       string `json:"key"`
+	Standard  string `json:"standard"`
+	Version   string `json:"version"`
+	Hash      string `json:"hash"`
+	Source    string `json:"source"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// Filters for QueryMappings. Empty fields are ignored.
+type MappingQuery struct {
+	Standard string `json:"standard"`
+
+	// A value referenced by the mapping, e.g. $fields.priority. Also matches sub-paths such as $fields.priority.name
+	References string `json:"references"`
+
+	// Only mappings with a version generated by this model, e.g. gpt-5-mini. The same as Source llm:<model>.
+	Model string `json:"model"`
+
+	// Only mappings with a version from this source, e.g. human:username or reverse. Can't be another source than Model.
+	Source string `json:"source"`
+
+	// Only mappings with a version created in this time range
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	Limit int `json:"limit"`
+}
+
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS schemaless_standards (
+		org_id TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		data TEXT NOT NULL,
+		revision INTEGER NOT NULL DEFAULT 1,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (org_id, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schemaless_mappings (
+		org_id TEXT NOT NULL DEFAULT '',
+		key TEXT NOT NULL,
+		standard TEXT NOT NULL,
+		data TEXT NOT NULL,
+		version TEXT NOT NULL DEFAULT '',
+		hash TEXT NOT NULL DEFAULT '',
+		source TEXT NOT NULL DEFAULT '',
+		revision INTEGER NOT NULL DEFAULT 1,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (org_id, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS schemaless_mappings_standard ON schemaless_mappings (org_id, standard)`,
+	`CREATE TABLE IF NOT EXISTS schemaless_mapping_fields (
+		org_id TEXT NOT NULL DEFAULT '',
+		mapping_key TEXT NOT NULL,
+		field TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (org_id, mapping_key, field)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schemaless_mapping_refs (
+		org_id TEXT NOT NULL DEFAULT '',
+		mapping_key TEXT NOT NULL,
+		field TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		PRIMARY KEY (org_id, mapping_key, field, ref)
+	)`,
+	`CREATE INDEX IF NOT EXISTS schemaless_mapping_refs_ref ON schemaless_mapping_refs (org_id, ref)`,
+	`CREATE TABLE IF NOT EXISTS schemaless_versions (
+		org_id TEXT NOT NULL DEFAULT '',
+		mapping_key TEXT NOT NULL,
+		version TEXT NOT NULL,
+		data TEXT NOT NULL,
+		hash TEXT NOT NULL DEFAULT '',
+		source TEXT NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (org_id, mapping_key, version)
+	)`,
+	`CREATE INDEX IF NOT EXISTS schemaless_versions_source ON schemaless_versions (org_id, source, created_at)`,
+	`CREATE TABLE IF NOT EXISTS schemaless_values (
+		org_id TEXT NOT NULL DEFAULT '',
+		namespace TEXT NOT NULL,
+		key TEXT NOT NULL,
+		data TEXT NOT NULL,
+		revision INTEGER NOT NULL DEFAULT 1,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (org_id, namespace, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schemaless_usage (
+		org_id TEXT NOT NULL DEFAULT '',
+		namespace TEXT NOT NULL,
+		key TEXT NOT NULL,
+		count BIGINT NOT NULL DEFAULT 0,
+		last_used BIGINT NOT NULL,
+		PRIMARY KEY (org_id, namespace, key)
+	)`,
+}
+
+// Creates the tables if they don't exist. The dialect is either SQLDialectSQLite or SQLDialectPostgres.
+func NewSQLStore(db *sql.DB, dialect string) (*SQLStore, error) {
+	if dialect != SQLDialectSQLite && dialect != SQLDialectPostgres {
+		return nil, errors.New(fmt.Sprintf("Unsupported SQL dialect '%s'", dialect))
+	}
+
+	store := &SQLStore{
+		DB:      db,
+		Dialect: dialect,
+		usage: &pendingSQLUsage{
+			counts:    map[sqlUsageKey]int64{},
+			lastFlush: time.Now(),
+		},
+	}
+
+	for _, statement := range sqlSchema {
+		_, err := db.Exec(statement)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Failed creating SQL tables: %s", err)
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Opens a database with a registered driver. Drivers named postgres or pgx use the Postgres dialect, everything else SQLite.
+func OpenSQLStore(driverName, dataSourceName string) (*SQLStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect := SQLDialectSQLite
+	if strings.HasPrefix(driverName, "postgres") || driverName == "pgx" {
+		dialect = SQLDialectPostgres
+	}
+
+	return NewSQLStore(db, dialect)
+}
+
+// Returns a copy of the store where all values belong to the org. Usage counts are still written together.
+func (store *SQLStore) WithOrg(orgId string) Store {
+	orgStore := *store
+	orgStore.OrgId = orgId
+	return &orgStore
+}
+
+// Queries are written with ? placeholders, which Postgres wants as $1, $2...
+func (store *SQLStore) rebind(query string) string {
+	if store.Dialect != SQLDialectPostgres {
+		return query
+	}
+
+	rebound := strings.Builder{}
+	index := 0
+	for _, char := range query {
+		if char == '?' {
+			index += 1
+			rebound.WriteString("$" + strconv.Itoa(index))
+			continue
+		}
+
+		rebound.WriteRune(char)
+	}
+
+	return rebound.String()
+}
+
+// History keys are <mapping key>-<version>
+func splitHistoryKey(key string) (string, string) {
+	index := strings.LastIndex(key, "-v")
+	if index <= 0 {
+		return key, ""
+	}
+
+	return key[:index], key[index+1:]
+}
+
+// Mapping keys are <standard>-<md5 of the input structure>, with the slashes of pack standards as ~
+func mappingStandard(key string) string {
+	index := strings.LastIndex(key, "-")
+	if index <= 0 || len(key)-index-1 != 32 {
+		return key
+	}
+
+	return strings.ReplaceAll(key[:index], "~", "/")
+}
+
+func (store *SQLStore) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	data, _, err := store.GetWithVersion(ctx, namespace, key)
+	return data, err
+}
+
+// The version is the revision of the row, increased on every write
+func (store *SQLStore) GetWithVersion(ctx context.Context, namespace, key string) ([]byte, string, error) {
+	var row *sql.Row
+	switch namespace {
+	case NamespaceStandards:
+		row = store.DB.QueryRowContext(ctx, store.rebind(`SELECT data, revision FROM schemaless_standards WHERE org_id = ? AND name = ?`), store.OrgId, key)
+	case NamespaceMappings:
+		row = store.DB.QueryRowContext(ctx, store.rebind(`SELECT data, revision FROM schemaless_mappings WHERE org_id = ? AND key = ?`), store.OrgId, key)
+	case NamespaceHistory:
+		mappingKey, version := splitHistoryKey(key)
+		row = store.DB.QueryRowContext(ctx, store.rebind(`SELECT data, 0 FROM schemaless_versions WHERE org_id = ? AND mapping_key = ? AND version = ?`), store.OrgId, mappingKey, version)
+	default:
+		row = store.DB.QueryRowContext(ctx, store.rebind(`SELECT data, revision FROM schemaless_values WHERE org_id = ? AND namespace = ? AND key = ?`), store.OrgId, namespace, key)
+	}
+
+	data := ""
+	revision := int64(0)
+	err := row.Scan(&data, &revision)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return []byte{}, "", fmt.Errorf("%w: %s/%s", ErrNotFound, namespace, key)
+		}
+
+		log.Printf("[ERROR] Schemaless: Failed reading %s/%s from SQL: %s", namespace, key, err)
+		return []byte{}, "", err
+	}
+
+	return []byte(data), strconv.FormatInt(revision, 10), nil
+}
+
+func (store *SQLStore) Put(ctx context.Context, namespace, key string, data []byte) error {
+	return store.put(ctx, namespace, key, data, nil)
+}
+
+// Only writes if the row still has the given revision. An empty version means the row must not exist yet.
+// Versions in the history have no revision, and can only be created or overwritten.
+func (store *SQLStore) PutIfVersion(ctx context.Context, namespace, key string, data []byte, version string) error {
+	if namespace == NamespaceHistory && len(version) > 0 {
+		return store.put(ctx, namespace, key, data, nil)
+	}
+
+	revision := int64(0)
+	if len(version) > 0 {
+		parsed, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid version '%s' for %s/%s", version, namespace, key))
+		}
+
+		revision = parsed
+	}
+
+	return store.put(ctx, namespace, key, data, &revision)
+}
+
+// A nil revision overwrites. Revision 0 only inserts, anything else only updates that revision.
+func (store *SQLStore) put(ctx context.Context, namespace, key string, data []byte, revision *int64) error {
+	tx, err := store.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	timestamp := time.Now().Unix()
+	table, keyColumns, keyValues := "", []string{}, []interface{}{}
+	columns, values := []string{}, []interface{}{}
+	switch namespace {
+	case NamespaceStandards:
+		table, keyColumns, keyValues = "schemaless_standards", []string{"name"}, []interface{}{key}
+		columns, values = []string{"data", "updated_at"}, []interface{}{string(data), timestamp}
+	case NamespaceMappings:
+		version, hash, source := "", "", ""
+		if _, meta, err := ParseStoredMapping(data); err == nil {
+			version, hash, source = meta.Version.ID, meta.Version.Hash, meta.Version.Source
+		}
+
+		table, keyColumns, keyValues = "schemaless_mappings", []string{"key"}, []interface{}{key}
+		columns, values = []string{"standard", "data", "version", "hash", "source", "updated_at"}, []interface{}{mappingStandard(key), string(data), version, hash, source, timestamp}
+	case NamespaceHistory:
+		mappingKey, versionID := splitHistoryKey(key)
+		hash, source, createdAt := "", "", timestamp
+		if _, meta, err := ParseStoredMapping(data); err == nil {
+			hash, source = meta.Version.Hash, meta.Version.Source
+			if meta.Version.Timestamp > 0 {
+				createdAt = meta.Version.Timestamp
+			}
+		}
+
+		table, keyColumns, keyValues = "schemaless_versions", []string{"mapping_key", "version"}, []interface{}{mappingKey, versionID}
+		columns, values = []string{"data", "hash", "source", "created_at"}, []interface{}{string(data), hash, source, createdAt}
+	default:
+		table, keyColumns, keyValues = "schemaless_values", []string{"namespace", "key"}, []interface{}{namespace, key}
+		columns, values = []string{"data", "updated_at"}, []interface{}{string(data), timestamp}
+	}
+
+	keyColumns = append([]string{"org_id"}, keyColumns...)
+	keyValues = append([]interface{}{store.OrgId}, keyValues...)
+
+	hasRevision := namespace != NamespaceHistory
+	var result sql.Result
+	if revision != nil && *revision > 0 {
+		assignments := []string{}
+		for _, column := range columns {
+			assignments = append(assignments, column+" = ?")
+		}
+
+		conditions := []string{}
+		for _, column := range keyColumns {
+			conditions = append(conditions, column+" = ?")
+		}
+
+		query := fmt.Sprintf("UPDATE %s SET %s, revision = revision + 1 WHERE %s AND revision = ?", table, strings.Join(assignments, ", "), strings.Join(conditions, " AND "))
+		args := append(append(append([]interface{}{}, values...), keyValues...), *revision)
+		result, err = tx.ExecContext(ctx, store.rebind(query), args...)
+	} else {
+		allColumns := append(append([]string{}, keyColumns...), columns...)
+		args := append(append([]interface{}{}, keyValues...), values...)
+		if namespace == NamespaceMappings {
+			allColumns = append(allColumns, "created_at")
+			args = append(args, timestamp)
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(allColumns)), ", ")
+		conflict := "DO NOTHING"
+		if revision == nil {
+			assignments := []string{}
+			for _, column := range columns {
+				assignments = append(assignments, fmt.Sprintf("%s = excluded.%s", column, column))
+			}
+
+			if hasRevision {
+				assignments = append(assignments, fmt.Sprintf("revision = %s.revision + 1", table))
+			}
+
+			conflict = "DO UPDATE SET " + strings.Join(assignments, ", ")
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) %s", table, strings.Join(allColumns, ", "), placeholders, strings.Join(keyColumns, ", "), conflict)
+		result, err = tx.ExecContext(ctx, store.rebind(query), args...)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Failed writing %s/%s to SQL: %s", namespace, key, err)
+		return err
+	}
+
+	if revision != nil {
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if affected == 0 {
+			return fmt.Errorf("%w: %s/%s", ErrConflict, namespace, key)
+		}
+	}
+
+	if namespace == NamespaceMappings {
+		err = store.indexMappingFields(ctx, tx, key, data)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Failed indexing fields of mapping %s: %s", key, err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Keeps a row per field of a mapping, and one per value of the input each field references, so mappings can be found by them
+func (store *SQLStore) indexMappingFields(ctx context.Context, tx *sql.Tx, key string, data []byte) error {
+	_, err := tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_mapping_fields WHERE org_id = ? AND mapping_key = ?`), store.OrgId, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_mapping_refs WHERE org_id = ? AND mapping_key = ?`), store.OrgId, key)
+	if err != nil {
+		return err
+	}
+
+	mapping, _, err := ParseStoredMapping(data)
+	if err != nil {
+		return nil
+	}
+
+	for field, value := range flattenMapping(mapping) {
+		stringValue, ok := value.(string)
+		if !ok {
+			marshalled, err := json.Marshal(value)
+			if err != nil {
+				continue
+			}
+
+			stringValue = string(marshalled)
+		}
+
+		_, err = tx.ExecContext(ctx, store.rebind(`INSERT INTO schemaless_mapping_fields (org_id, mapping_key, field, value) VALUES (?, ?, ?, ?)`), store.OrgId, key, field, stringValue)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range mappingValueRefs(value) {
+			_, err = tx.ExecContext(ctx, store.rebind(`INSERT INTO schemaless_mapping_refs (org_id, mapping_key, field, ref) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`), store.OrgId, key, field, ref)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds the values of the input a mapped value references, e.g. $fields.summary and $user.name in
+// "$fields.summary by $user.name", including the ones in lists. Lists of the input are written as .#
+func mappingValueRefs(value interface{}) []string {
+	refs := []string{}
+	switch val := value.(type) {
+	case string:
+		if !strings.Contains(val, "$") {
+			break
+		}
+
+		val = strings.ReplaceAll(val, "$.", "$")
+		val = strings.ReplaceAll(val, "[]", ".#")
+		val = strings.ReplaceAll(val, `"`, "")
+		for _, match := range planMatchPattern.FindAllString(val, -1) {
+			refs = append(refs, "$"+getParsedMatch(match))
+		}
+	case []interface{}:
+		for _, item := range val {
+			refs = append(refs, mappingValueRefs(item)...)
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			refs = append(refs, mappingValueRefs(item)...)
+		}
+	}
+
+	return refs
+}
+
+func (store *SQLStore) List(ctx context.Context, namespace string) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	switch namespace {
+	case NamespaceStandards:
+		rows, err = store.DB.QueryContext(ctx, store.rebind(`SELECT name FROM schemaless_standards WHERE org_id = ?`), store.OrgId)
+	case NamespaceMappings:
+		rows, err = store.DB.QueryContext(ctx, store.rebind(`SELECT key FROM schemaless_mappings WHERE org_id = ?`), store.OrgId)
+	case NamespaceHistory:
+		rows, err = store.DB.QueryContext(ctx, store.rebind(`SELECT mapping_key || '-' || version FROM schemaless_versions WHERE org_id = ?`), store.OrgId)
+	default:
+		rows, err = store.DB.QueryContext(ctx, store.rebind(`SELECT key FROM schemaless_values WHERE org_id = ? AND namespace = ?`), store.OrgId, namespace)
+	}
+
+	if err != nil {
+		return []string{}, err
+	}
+
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		key := ""
+		err = rows.Scan(&key)
+		if err != nil {
+			return keys, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys, rows.Err()
+}
+
+func (store *SQLStore) Delete(ctx context.Context, namespace, key string) error {
+	tx, err := store.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var result sql.Result
+	switch namespace {
+	case NamespaceStandards:
+		result, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_standards WHERE org_id = ? AND name = ?`), store.OrgId, key)
+	case NamespaceMappings:
+		result, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_mappings WHERE org_id = ? AND key = ?`), store.OrgId, key)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_mapping_fields WHERE org_id = ? AND mapping_key = ?`), store.OrgId, key)
+		}
+
+		if err == nil {
+			_, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_mapping_refs WHERE org_id = ? AND mapping_key = ?`), store.OrgId, key)
+		}
+	case NamespaceHistory:
+		mappingKey, version := splitHistoryKey(key)
+		result, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_versions WHERE org_id = ? AND mapping_key = ? AND version = ?`), store.OrgId, mappingKey, version)
+	default:
+		result, err = tx.ExecContext(ctx, store.rebind(`DELETE FROM schemaless_values WHERE org_id = ? AND namespace = ? AND key = ?`), store.OrgId, namespace, key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, namespace, key)
+	}
+
+	return tx.Commit()
+}
+
+type sqlUsageKey struct {
+	orgId     string
+	namespace string
+	key       string
+}
+
+// Usage counts not written yet. Shared between the org copies of a store.
+type pendingSQLUsage struct {
+	mu        sync.Mutex
+	counts    map[sqlUsageKey]int64
+	lastFlush time.Time
+}
+
+// Counts how often a value is used, e.g. how many times a mapping translated something.
+// Like for the filesystem store, counts are kept in memory and written at most every usageFlushInterval, as a write per translation is too slow.
+func (store *SQLStore) IncrementUsage(ctx context.Context, namespace, key string) error {
+	usageKey := sqlUsageKey{store.OrgId, namespace, key}
+	if store.usage == nil {
+		return store.writeUsage(ctx, map[sqlUsageKey]int64{usageKey: 1})
+	}
+
+	store.usage.mu.Lock()
+	defer store.usage.mu.Unlock()
+
+	store.usage.counts[usageKey]++
+	if time.Since(store.usage.lastFlush) < usageFlushInterval {
+		return nil
+	}
+
+	return store.flushUsage(ctx)
+}
+
+// Writes the usage counts kept in memory, e.g. before shutting down
+func (store *SQLStore) FlushUsage(ctx context.Context) error {
+	if store.usage == nil {
+		return nil
+	}
+
+	store.usage.mu.Lock()
+	defer store.usage.mu.Unlock()
+	return store.flushUsage(ctx)
+}
+
+// Has to be called with the usage lock held
+func (store *SQLStore) flushUsage(ctx context.Context) error {
+	counts := store.usage.counts
+	store.usage.counts = map[sqlUsageKey]int64{}
+	store.usage.lastFlush = time.Now()
+
+	err := store.writeUsage(ctx, counts)
+	if err != nil {
+		// Kept for the next flush
+		for usageKey, count := range counts {
+			store.usage.counts[usageKey] += count
+		}
+	}
+
+	return err
+}
+
+// Adds the counts in a single transaction
+func (store *SQLStore) writeUsage(ctx context.Context, counts map[sqlUsageKey]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	tx, err := store.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	timestamp := time.Now().Unix()
+	for usageKey, count := range counts {
+		_, err = tx.ExecContext(ctx, store.rebind(`INSERT INTO schemaless_usage (org_id, namespace, key, count, last_used) VALUES (?, ?, ?, ?, ?) ON CONFLICT (org_id, namespace, key) DO UPDATE SET count = schemaless_usage.count + excluded.count, last_used = excluded.last_used`), usageKey.orgId, usageKey.namespace, usageKey.key, count, timestamp)
+		if err != nil {
+			log.Printf("[ERROR] Schemaless: Failed writing usage counts to SQL: %s", err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *SQLStore) GetUsage(ctx context.Context, namespace, key string) (int64, error) {
+	pending := int64(0)
+	if store.usage != nil {
+		store.usage.mu.Lock()
+		pending = store.usage.counts[sqlUsageKey{store.OrgId, namespace, key}]
+		store.usage.mu.Unlock()
+	}
+
+	count := int64(0)
+	err := store.DB.QueryRowContext(ctx, store.rebind(`SELECT count FROM schemaless_usage WHERE org_id = ? AND namespace = ? AND key = ?`), store.OrgId, namespace, key).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pending, nil
+	}
+
+	return count + pending, err
+}
+
+// Finds mappings matching all the filters in the query, most recently updated first
+func (store *SQLStore) QueryMappings(ctx context.Context, query MappingQuery) ([]MappingRecord, error) {
+	conditions := []string{"m.org_id = ?"}
+	args := []interface{}{store.OrgId}
+
+	if len(query.Standard) > 0 {
+		conditions = append(conditions, "m.standard = ?")
+		args = append(args, standardKey(query.Standard))
+	}
+
+	if len(query.References) > 0 {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM schemaless_mapping_refs r WHERE r.org_id = m.org_id AND r.mapping_key = m.key AND (r.ref = ? OR substr(r.ref, 1, ?) = ?))")
+		args = append(args, query.References, len(query.References)+1, query.References+".")
+	}
+
+	// A version has a single source, so the model and source are a single condition
+	source := query.Source
+	if len(query.Model) > 0 {
+		modelSource := fmt.Sprintf("llm:%s", query.Model)
+		if len(source) > 0 && source != modelSource {
+			return []MappingRecord{}, errors.New(fmt.Sprintf("Can't query for both model %s and source %s, as a version has a single source", query.Model, query.Source))
+		}
+
+		source = modelSource
+	}
+
+	versionConditions := []string{}
+	if len(source) > 0 {
+		versionConditions = append(versionConditions, "v.source = ?")
+		args = append(args, source)
+	}
+
+	if !query.Since.IsZero() {
+		versionConditions = append(versionConditions, "v.created_at >= ?")
+		args = append(args, query.Since.Unix())
+	}
+
+	if !query.Until.IsZero() {
+		versionConditions = append(versionConditions, "v.created_at < ?")
+		args = append(args, query.Until.Unix())
+	}
+
+	if len(versionConditions) > 0 {
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM schemaless_versions v WHERE v.org_id = m.org_id AND v.mapping_key = m.key AND %s)", strings.Join(versionConditions, " AND ")))
+	}
+
+	sqlQuery := `SELECT m.key, m.standard, m.version, m.hash, m.source, m.created_at, m.updated_at FROM schemaless_mappings m WHERE ` + strings.Join(conditions, " AND ")
+
+	sqlQuery += " ORDER BY m.updated_at DESC, m.key"
+	if query.Limit > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+
+	rows, err := store.DB.QueryContext(ctx, store.rebind(sqlQuery), args...)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Failed querying mappings: %s", err)
+		return []MappingRecord{}, err
+	}
+
+	defer rows.Close()
+
+	records := []MappingRecord{}
+	for rows.Next() {
+		record := MappingRecord{}
+		err = rows.Scan(&record.Key, &record.Standard, &record.Version, &record.Hash, &record.Source, &record.CreatedAt, &record.UpdatedAt)
+		if err != nil {
+			return records, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
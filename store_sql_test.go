@@ -0,0 +1,303 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func useTestSQLStore(t *testing.T) *SQLStore {
+	t.Helper()
+
+	store, err := OpenSQLStore("sqlite", t.TempDir()+"/schemaless.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		store.DB.Close()
+	})
+
+	return store
+}
+
+func queryMappingKeys(t *testing.T, store *SQLStore, query MappingQuery) string {
+	t.Helper()
+
+	records, err := store.QueryMappings(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestSQLStoreMappingReferences(t *testing.T) {
+	store := useTestSQLStore(t)
+	ctx := context.Background()
+
+	mappings := map[string]string{
+		"ticket-template": `{"title": "$fields.summary by $user.name", "priority": "$fields.priority.name"}`,
+		"ticket-list":     `{"tags": ["$labels.#", "static"], "comments": [{"text": "{{ $.comments[].body }}"}]}`,
+		"ticket-none":     `{"title": "fields.summary", "status": "open"}`,
+	}
+
+	for key, mapping := range mappings {
+		err := store.Put(ctx, NamespaceMappings, key, []byte(mapping))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		"$fields.summary":   "ticket-template",
+		"$fields.priority":  "ticket-template",
+		"$fields":           "ticket-template",
+		"$user.name":        "ticket-template",
+		"$use":              "",
+		"$labels.#":         "ticket-list",
+		"$comments.#.body":  "ticket-list",
+		"$comments":         "ticket-list",
+		"$fields.summary.x": "",
+	}
+
+	for references, expected := range tests {
+		if keys := queryMappingKeys(t, store, MappingQuery{References: references}); keys != expected {
+			t.Errorf("references %s: got %q, expected %q", references, keys, expected)
+		}
+	}
+
+	// Re-indexed when the mapping changes
+	err := store.Put(ctx, NamespaceMappings, "ticket-template", []byte(`{"title": "$subject"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := queryMappingKeys(t, store, MappingQuery{References: "$fields"}); keys != "" {
+		t.Errorf("expected the old references to be removed, got %q", keys)
+	}
+}
+
+func TestSQLStoreOrgs(t *testing.T) {
+	store := useTestSQLStore(t)
+	ctx := context.Background()
+	orgStore := store.WithOrg("org1").(*SQLStore)
+
+	err := store.Put(ctx, NamespaceMappings, "ticket-abc", []byte(`{"title": "$subject"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = orgStore.Put(ctx, NamespaceMappings, "ticket-abc", []byte(`{"title": "$summary"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = orgStore.Put(ctx, NamespaceStandards, "ticket", []byte(`{"title": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := store.Get(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil || !strings.Contains(string(data), "$subject") {
+		t.Errorf("the mapping without an org was changed: %s (%v)", data, err)
+	}
+
+	_, err = store.Get(ctx, NamespaceStandards, "ticket")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the standard of org1 to be hidden, got %v", err)
+	}
+
+	keys, err := orgStore.List(ctx, NamespaceStandards)
+	if err != nil || strings.Join(keys, ",") != "ticket" {
+		t.Errorf("expected the standard in org1, got %v (%v)", keys, err)
+	}
+
+	if keys := queryMappingKeys(t, orgStore, MappingQuery{References: "$subject"}); keys != "" {
+		t.Errorf("found the mapping of another org: %s", keys)
+	}
+
+	if keys := queryMappingKeys(t, orgStore, MappingQuery{References: "$summary"}); keys != "ticket-abc" {
+		t.Errorf("expected the mapping of org1, got %q", keys)
+	}
+
+	err = orgStore.Delete(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Get(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Errorf("deleting in org1 removed the mapping without an org: %v", err)
+	}
+}
+
+func TestSQLStoreUsageIsBatched(t *testing.T) {
+	store := useTestSQLStore(t)
+	ctx := context.Background()
+	orgStore := store.WithOrg("org1").(*SQLStore)
+
+	for cnt := 0; cnt < 3; cnt++ {
+		err := store.IncrementUsage(ctx, NamespaceMappings, "ticket-abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := orgStore.IncrementUsage(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := 0
+	err = store.DB.QueryRow(`SELECT COUNT(*) FROM schemaless_usage`).Scan(&rows)
+	if err != nil || rows != 0 {
+		t.Errorf("expected no writes before the flush, got %d rows (%v)", rows, err)
+	}
+
+	count, err := store.GetUsage(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil || count != 3 {
+		t.Errorf("expected the pending count of 3, got %d (%v)", count, err)
+	}
+
+	err = store.FlushUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.IncrementUsage(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := int64(0)
+	err = store.DB.QueryRow(`SELECT count FROM schemaless_usage WHERE org_id = '' AND key = 'ticket-abc'`).Scan(&stored)
+	if err != nil || stored != 3 {
+		t.Errorf("expected 3 written, got %d (%v)", stored, err)
+	}
+
+	for _, usageStore := range []*SQLStore{store, orgStore} {
+		count, err = usageStore.GetUsage(ctx, NamespaceMappings, "ticket-abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := int64(4)
+		if usageStore == orgStore {
+			expected = 1
+		}
+
+		if count != expected {
+			t.Errorf("org %q: expected %d uses, got %d", usageStore.OrgId, expected, count)
+		}
+	}
+}
+
+func TestSQLStoreConditionalWrites(t *testing.T) {
+	store := useTestSQLStore(t)
+	ctx := context.Background()
+
+	err := store.PutIfVersion(ctx, NamespaceMappings, "ticket-abc", []byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.PutIfVersion(ctx, NamespaceMappings, "ticket-abc", []byte("second"), "")
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict when creating an existing row, got %v", err)
+	}
+
+	_, version, err := store.GetWithVersion(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.PutIfVersion(ctx, NamespaceMappings, "ticket-abc", []byte("second"), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.PutIfVersion(ctx, NamespaceMappings, "ticket-abc", []byte("third"), version)
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict for an outdated revision, got %v", err)
+	}
+
+	// Versions in the history can be reserved
+	err = storeCreate(ctx, store, NamespaceHistory, "ticket-abc-v1", []byte(`{"title": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storeCreate(ctx, store, NamespaceHistory, "ticket-abc-v1", []byte(`{"title": "$subject"}`))
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict for an existing version, got %v", err)
+	}
+}
+
+func TestSQLStoreMappingVersions(t *testing.T) {
+	store := useTestSQLStore(t)
+	SetStore(store)
+	SetCacheBackend(NewMemoryCache())
+	SetOffline(true)
+	t.Cleanup(func() {
+		SetStore(nil)
+		SetOffline(false)
+	})
+
+	ctx := context.Background()
+	keyTokenFile := saveTestMapping(t, "ticket", []byte(`{"subject": ""}`), `{"title": "$subject"}`)
+	err := EditMappingField(ctx, keyTokenFile, "title", "$summary", "bob", false, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := queryMappingKeys(t, store, MappingQuery{Standard: "ticket", Source: "human:bob"}); keys != keyTokenFile {
+		t.Errorf("expected the edited mapping, got %q", keys)
+	}
+
+	versions, err := ListMappingVersions(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil || versionIDs(versions) != "v1,v2" {
+		t.Errorf("expected v1,v2, got %v (%v)", versions, err)
+	}
+}
+
+func TestSQLStoreQueryModelAndSource(t *testing.T) {
+	store := useTestSQLStore(t)
+	ctx := context.Background()
+
+	err := store.Put(ctx, NamespaceMappings, "ticket-abc", []byte(`{"title": "$subject"}`))
+	if err == nil {
+		err = store.Put(ctx, NamespaceHistory, "ticket-abc-v1", []byte(`{"title": "$subject", "_schemaless": {"version": {"id": "v1", "source": "llm:gpt-5-mini"}}}`))
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []MappingQuery{
+		{Model: "gpt-5-mini"},
+		{Source: "llm:gpt-5-mini"},
+		{Model: "gpt-5-mini", Source: "llm:gpt-5-mini"},
+	}
+
+	for _, query := range queries {
+		if keys := queryMappingKeys(t, store, query); keys != "ticket-abc" {
+			t.Errorf("%+v: expected ticket-abc, got %q", query, keys)
+		}
+	}
+
+	_, err = store.QueryMappings(ctx, MappingQuery{Model: "gpt-5-mini", Source: "human:bob"})
+	if err == nil {
+		t.Error("expected an error for a model and another source")
+	}
+}
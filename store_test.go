@@ -0,0 +1,143 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A memory store with versions, where another writer changes the value before the first conflicts writes
+type conflictingStore struct {
+	*MemoryStore
+
+	mu        sync.Mutex
+	versions  map[string]int
+	conflicts int
+	writes    int
+}
+
+func (store *conflictingStore) GetWithVersion(ctx context.Context, namespace, key string) ([]byte, string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	data, err := store.MemoryStore.Get(ctx, namespace, key)
+	if err != nil {
+		return data, "", err
+	}
+
+	return data, strconv.Itoa(store.versions[namespace+"/"+key]), nil
+}
+
+func (store *conflictingStore) PutIfVersion(ctx context.Context, namespace, key string, data []byte, version string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	current := ""
+	if _, err := store.MemoryStore.Get(ctx, namespace, key); err == nil {
+		current = strconv.Itoa(store.versions[namespace+"/"+key])
+	}
+
+	if store.conflicts > 0 {
+		// Someone else wrote in between
+		store.conflicts -= 1
+		store.versions[namespace+"/"+key] += 1
+		current = "changed"
+	}
+
+	if current != version {
+		return fmt.Errorf("%w: %s/%s", ErrConflict, namespace, key)
+	}
+
+	store.writes += 1
+	store.versions[namespace+"/"+key] += 1
+	return store.MemoryStore.Put(ctx, namespace, key, data)
+}
+
+func TestUpdateStoreRetriesConflicts(t *testing.T) {
+	store := &conflictingStore{
+		MemoryStore: NewMemoryStore(),
+		versions:    map[string]int{},
+		conflicts:   2,
+	}
+
+	ctx := context.Background()
+	calls := 0
+	err := updateStore(ctx, store, NamespaceMappings, "ticket-abc", func(existing []byte) ([]byte, error) {
+		calls += 1
+		return append(existing, 'a'), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 || store.writes != 1 {
+		t.Errorf("expected 3 attempts and 1 write, got %d attempts and %d writes", calls, store.writes)
+	}
+
+	data, err := store.Get(ctx, NamespaceMappings, "ticket-abc")
+	if err != nil || string(data) != "a" {
+		t.Errorf("expected a single update to be written, got %q (%v)", data, err)
+	}
+
+	// Keeps failing
+	store.conflicts = maxConflictRetries
+	err = updateStore(ctx, store, NamespaceMappings, "ticket-abc", func(existing []byte) ([]byte, error) {
+		return append(existing, 'b'), nil
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict after %d attempts, got %v", maxConflictRetries, err)
+	}
+
+	data, _ = store.Get(ctx, NamespaceMappings, "ticket-abc")
+	if string(data) != "a" {
+		t.Errorf("nothing should be written after giving up, got %q", data)
+	}
+}
+
+func TestUpdateStoreStopsOnError(t *testing.T) {
+	store := NewMemoryStore()
+
+	failed := errors.New("failed")
+	err := updateStore(context.Background(), store, NamespaceMappings, "ticket-abc", func(existing []byte) ([]byte, error) {
+		return existing, failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("expected the error of the update, got %v", err)
+	}
+
+	_, err = store.Get(context.Background(), NamespaceMappings, "ticket-abc")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("nothing should be written when the update fails, got %v", err)
+	}
+}
+
+func TestStoreCreate(t *testing.T) {
+	stores := map[string]Store{
+		"memory":      NewMemoryStore(),
+		"conditional": &conflictingStore{MemoryStore: NewMemoryStore(), versions: map[string]int{}},
+		"filesystem":  NewFilesystemStore(t.TempDir() + "/"),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			err := storeCreate(ctx, store, NamespaceHistory, "ticket-abc-v1", []byte("first"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = storeCreate(ctx, store, NamespaceHistory, "ticket-abc-v1", []byte("second"))
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("expected ErrConflict for an existing key, got %v", err)
+			}
+
+			data, err := store.Get(ctx, NamespaceHistory, "ticket-abc-v1")
+			if err != nil || string(data) != "first" {
+				t.Errorf("the existing value was changed to %q (%v)", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package schemaless
+
+/*
+Translates large documents with a list of events in them, such as CloudTrail exports ({"Records": [...]}) or asset inventories,
+without loading the whole document. The list is found the same way as for list standards, or by its path, and each item is
+translated as soon as it is decoded and written out as part of a JSON list. Only the items being translated are held in memory.
+*/
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Returned by TranslateStream when the list to translate isn't in the input
+var ErrListNotFound = errors.New("List not found in the input")
+
+// Max item structures a stream keeps the plans of. Others are still found in the plan cache.
+var maxStreamPlans = 256
+
+// Translates the items of the list in input and writes them to output as a JSON list, in the order of the input.
+// The list is the input itself or a top level field of it that is a list, e.g. Records in {"Records": [...]}. Lists further down,
+// or a specific one of several, are chosen with a "list_path:<path>" inputConfig such as "list_path:$data.items.#".
+// Returns ErrListNotFound without writing anything if there is no such list.
+//
+// Items are translated to the item standard of list standards such as [alert], and to the standard itself otherwise. Items with
+// the same structure share a mapping, which is compiled once and used for the rest of them. Items that fail are null in the output,
+// like for list standards, so the output lines up with the input, and are counted in the stats.
+func TranslateStream(ctx context.Context, inputStandard string, input io.Reader, output io.Writer, inputConfig ...string) (BatchStats, error) {
+	stats := BatchStats{}
+
+	// Like handleSubStandard, items aren't searched for lists of their own
+	var listPath []string
+	filenamePrefix := ""
+	itemConfig := []string{}
+	for _, config := range inputConfig {
+		if strings.HasPrefix(strings.ToLower(config), "list_path:") {
+			listPath = parseStreamListPath(config[len("list_path:"):])
+			config = ""
+		} else if strings.HasPrefix(strings.ToLower(config), "filename_prefix:") {
+			filenamePrefix = strings.TrimPrefix(config, "filename_prefix:")
+		}
+
+		itemConfig = append(itemConfig, config)
+	}
+
+	if len(itemConfig) == 0 {
+		itemConfig = append(itemConfig, "")
+	}
+
+	itemConfig = append(itemConfig, "skip_substandard")
+	shuffleConfig, keepOriginal := parseAuthConfig(itemConfig[0])
+
+	itemStandard := strings.TrimSuffix(inputStandard, ".json")
+	standardFormat, _, err := GetStandardContext(ctx, itemStandard, shuffleConfig)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Problem in GetStandard for streaming translation to %#v: %v", inputStandard, err)
+		return stats, err
+	}
+
+	trimmedStandard := strings.TrimSpace(string(standardFormat))
+	if len(trimmedStandard) > 2 && strings.HasPrefix(trimmedStandard, "[") && strings.HasSuffix(trimmedStandard, "]") {
+		itemStandard = strings.TrimSuffix(strings.TrimPrefix(trimmedStandard, "["), "]")
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(input))
+	err = findStreamList(decoder, listPath)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Failed finding the list to translate to %s: %s", inputStandard, err)
+		return stats, err
+	}
+
+	index := 0
+	next := func() (*batchJob, error) {
+		if !decoder.More() {
+			// The rest of the document isn't needed
+			return nil, io.EOF
+		}
+
+		item := json.RawMessage{}
+		err := decoder.Decode(&item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid list item %d: %s", index, err))
+		}
+
+		index += 1
+		return &batchJob{
+			line: index - 1,
+			data: item,
+		}, nil
+	}
+
+	writer := bufio.NewWriter(output)
+	written := 0
+	write := func(result BatchResult, flush bool) error {
+		if len(result.Error) > 0 {
+			log.Printf("[ERROR] Schemaless: Failed translating list item %d to %s: %s", result.Line, itemStandard, result.Error)
+			result.Output = []byte("null")
+		}
+
+		separator := "[\n"
+		if written > 0 {
+			separator = ",\n"
+		}
+
+		written += 1
+		_, err := writer.WriteString(separator)
+		if err == nil {
+			_, err = writer.Write(result.Output)
+		}
+
+		if err == nil && flush {
+			err = flushBatchOutput(writer, output)
+		}
+
+		return err
+	}
+
+	// The auth config is passed on to the translations of standard references
+	authConfig := itemConfig[0]
+	if strings.HasPrefix(authConfig, refChainConfigPrefix) {
+		authConfig = ""
+	}
+
+	refChain := parseRefChain(itemConfig)
+
+	// The plan of each item structure is looked up once. Items without a mapping yet are translated on their own, which
+	// makes the mapping for the ones after them, and items of the same structure running at the same time share the LLM call.
+	plans := map[string]*mappingPlan{}
+	plansMu := sync.Mutex{}
+	getItemPlan := func(ctx context.Context, data []byte) (*mappingPlan, string) {
+		if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+			return nil, ""
+		}
+
+		keyTokenFile, err := MappingFile(itemStandard, data)
+		if err != nil {
+			return nil, ""
+		}
+
+		itemKey := filenamePrefix + keyTokenFile
+		plansMu.Lock()
+		plan, found := plans[itemKey]
+		plansMu.Unlock()
+		if found {
+			return plan, itemKey
+		}
+
+		plan, err = loadMappingPlan(ctx, itemStandard, itemKey, shuffleConfig)
+		if err != nil {
+			return nil, itemKey
+		}
+
+		plansMu.Lock()
+		if len(plans) < maxStreamPlans {
+			plans[itemKey] = plan
+		}
+		plansMu.Unlock()
+
+		return plan, itemKey
+	}
+
+	translate := func(ctx context.Context, data []byte) ([]byte, string, error) {
+		plan, itemKey := getItemPlan(ctx, data)
+		if plan == nil {
+			return Translate(ctx, itemStandard, data, itemConfig...)
+		}
+
+		parsedItem := map[string]interface{}{}
+		err := json.Unmarshal(data, &parsedItem)
+		if err != nil || parsedItem == nil {
+			return Translate(ctx, itemStandard, data, itemConfig...)
+		}
+
+		recordUsage(ctx, GetStore(shuffleConfig), NamespaceMappings, itemKey)
+		output, err := plan.translate(ctx, &TranslationInfo{}, itemStandard, refChain, parsedItem, data, keepOriginal, authConfig)
+		return output, plan.mappingFile, contextError(ctx, err)
+	}
+
+	// The results before a failure are sent as well, even though the list isn't closed
+	stats, err = runBatchJobs(ctx, translate, next, write)
+	if err != nil {
+		flushBatchOutput(writer, output)
+		return stats, err
+	}
+
+	closing := "\n]\n"
+	if written == 0 {
+		closing = "[]\n"
+	}
+
+	_, err = writer.WriteString(closing)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, flushBatchOutput(writer, output)
+}
+
+// Parses a list path such as $data.items.#, data.items[] or data.items into the keys leading to the list.
+// An empty path, e.g. $, is the input itself.
+func parseStreamListPath(path string) []string {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "[]"), "#")
+	path = strings.Trim(path, ".")
+
+	keys := []string{}
+	if len(path) > 0 {
+		keys = strings.Split(path, ".")
+	}
+
+	return keys
+}
+
+// Reads up to the start of the list to translate. Other fields are skipped without being decoded.
+// Without a path the list is the input itself or its first top level field that is a list.
+func findStreamList(decoder *json.Decoder, path []string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if path == nil {
+		if token == json.Delim('[') {
+			return nil
+		}
+
+		if token != json.Delim('{') {
+			return errors.New("The input has to be a JSON object or list")
+		}
+
+		for decoder.More() {
+			// The key
+			_, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+
+			if token == json.Delim('[') {
+				return nil
+			}
+
+			if token == json.Delim('{') {
+				err = skipStreamValue(decoder)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return fmt.Errorf("%w: No top level field is a list. Set list_path to the path of the list, e.g. list_path:$data.items.#", ErrListNotFound)
+	}
+
+	for cnt, key := range path {
+		if token != json.Delim('{') {
+			return fmt.Errorf("%w: $%s is not an object", ErrListNotFound, strings.Join(path[:cnt], "."))
+		}
+
+		found := false
+		for decoder.More() {
+			name, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+
+			token, err = decoder.Token()
+			if err != nil {
+				return err
+			}
+
+			if name == key {
+				found = true
+				break
+			}
+
+			if token == json.Delim('{') || token == json.Delim('[') {
+				err = skipStreamValue(decoder)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%w: $%s is missing", ErrListNotFound, strings.Join(path[:cnt+1], "."))
+		}
+	}
+
+	if token != json.Delim('[') {
+		return fmt.Errorf("%w: $%s is not a list", ErrListNotFound, strings.Join(path, "."))
+	}
+
+	return nil
+}
+
+// Skips the rest of an object or list after its opening token
+func skipStreamValue(decoder *json.Decoder) error {
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth += 1
+		case json.Delim('}'), json.Delim(']'):
+			depth -= 1
+		}
+	}
+
+	return nil
+}
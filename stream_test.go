@@ -0,0 +1,162 @@
+package schemaless
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func useStreamTicket(t *testing.T) {
+	t.Helper()
+
+	store := useTestStore(t)
+	putTestStandards(t, store, map[string]string{
+		"ticket": `{"title": "The title"}`,
+	})
+}
+
+func TestTranslateStreamFraming(t *testing.T) {
+	useStreamTicket(t)
+	useBatchWorkers(t, 2)
+	useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject"}`
+	})
+
+	// Numbers can't be translated, so they are null
+	tests := []struct {
+		input, expected string
+		stats           BatchStats
+	}{
+		{`{"Records": []}`, "[]\n", BatchStats{}},
+		{`[7]`, "[\nnull\n]\n", BatchStats{Events: 1, Failed: 1}},
+		{`[{"subject": "first"}]`, "[\n{\"title\":\"first\"}\n]\n", BatchStats{Events: 1, Translated: 1}},
+		{`{"count": 4, "meta": {"tags": ["x"]}, "Records": [5, {"subject": "first"}, 7, {"subject": "second"}], "Other": [{"subject": "skipped"}]}`, "[\nnull,\n{\"title\":\"first\"},\nnull,\n{\"title\":\"second\"}\n]\n", BatchStats{Events: 4, Translated: 2, Failed: 2}},
+	}
+
+	for _, test := range tests {
+		output := bytes.Buffer{}
+		stats, err := TranslateStream(context.Background(), "ticket", strings.NewReader(test.input), &output)
+		if err != nil {
+			t.Errorf("%s: %s", test.input, err)
+			continue
+		}
+
+		if output.String() != test.expected || stats != test.stats {
+			t.Errorf("%s: expected %q with %+v, got %q with %+v", test.input, test.expected, test.stats, output.String(), stats)
+		}
+	}
+
+	// The items before a failure are sent, without closing the list
+	output := bytes.Buffer{}
+	reader := io.MultiReader(strings.NewReader(`{"Records": [{"subject": "first"}, `), &failingReader{})
+	stats, err := TranslateStream(context.Background(), "ticket", reader, &output)
+	if err == nil || !strings.Contains(err.Error(), "Connection reset") {
+		t.Errorf("expected the read error, got %v", err)
+	}
+
+	if stats.Translated != 1 || output.String() != "[\n{\"title\":\"first\"}" {
+		t.Errorf("expected the item before the error, got %+v: %q", stats, output.String())
+	}
+}
+
+func TestTranslateStreamListPath(t *testing.T) {
+	useStreamTicket(t)
+	useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject"}`
+	})
+
+	input := `{"count": 1, "data": {"other": [{"subject": "skipped"}], "items": [{"subject": "nested"}]}}`
+	for _, path := range []string{"$data.items.#", "data.items[]", "data.items"} {
+		output := bytes.Buffer{}
+		_, err := TranslateStream(context.Background(), "ticket", strings.NewReader(input), &output, "", "list_path:"+path)
+		if err != nil || output.String() != "[\n{\"title\":\"nested\"}\n]\n" {
+			t.Errorf("%s: got %q (%v)", path, output.String(), err)
+		}
+	}
+
+	output := bytes.Buffer{}
+	_, err := TranslateStream(context.Background(), "ticket", strings.NewReader(`[{"subject": "top"}]`), &output, "", "list_path:$")
+	if err != nil || output.String() != "[\n{\"title\":\"top\"}\n]\n" {
+		t.Errorf("expected the input itself, got %q (%v)", output.String(), err)
+	}
+
+	// Nested lists aren't guessed
+	tests := []struct {
+		input, path, expected string
+	}{
+		{input, "", "No top level field is a list"},
+		{input, "$data.missing.#", "$data.missing is missing"},
+		{input, "$data.#", "$data is not a list"},
+		{input, "$count.items.#", "$count is not an object"},
+		{`[{"subject": "top"}]`, "$data.items.#", "$ is not an object"},
+	}
+
+	for _, test := range tests {
+		config := []string{""}
+		if len(test.path) > 0 {
+			config = append(config, "list_path:"+test.path)
+		}
+
+		output := bytes.Buffer{}
+		_, err := TranslateStream(context.Background(), "ticket", strings.NewReader(test.input), &output, config...)
+		if !errors.Is(err, ErrListNotFound) || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected ErrListNotFound with %q, got %v", test.path, test.expected, err)
+		}
+
+		if output.Len() > 0 {
+			t.Errorf("%s: expected no output, got %q", test.path, output.String())
+		}
+	}
+}
+
+func TestTranslateStreamSharesItemMapping(t *testing.T) {
+	useStreamTicket(t)
+	useBatchWorkers(t, 3)
+	requests := useFakeLLM(t, func(system, user string) string {
+		if strings.Contains(user, "host") {
+			return `{"title": "$host.name"}`
+		}
+
+		return `{"title": "$subject"}`
+	})
+
+	// Two item structures, each with its own mapping
+	items := []string{}
+	expected := []string{}
+	for cnt := 0; cnt < 4; cnt++ {
+		items = append(items, fmt.Sprintf(`{"subject": "ticket %d"}`, cnt), fmt.Sprintf(`{"host": {"name": "web %d"}}`, cnt))
+		expected = append(expected, fmt.Sprintf(`{"title":"ticket %d"}`, cnt), fmt.Sprintf(`{"title":"web %d"}`, cnt))
+	}
+
+	input := fmt.Sprintf(`{"Records": [%s]}`, strings.Join(items, ", "))
+	output := bytes.Buffer{}
+	stats, err := TranslateStream(context.Background(), "ticket", strings.NewReader(input), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedOutput := fmt.Sprintf("[\n%s\n]\n", strings.Join(expected, ",\n"))
+	if output.String() != expectedOutput || stats.Translated != 8 {
+		t.Errorf("expected %q, got %q with %+v", expectedOutput, output.String(), stats)
+	}
+
+	if requests.Load() != 2 {
+		t.Errorf("expected a LLM request for each item structure, got %d", requests.Load())
+	}
+
+	// Compiled from the store when plans are turned off
+	SetMappingPlans(false)
+	t.Cleanup(func() {
+		SetMappingPlans(true)
+	})
+
+	output.Reset()
+	_, err = TranslateStream(context.Background(), "ticket", strings.NewReader(input), &output)
+	if err != nil || output.String() != expectedOutput || requests.Load() != 2 {
+		t.Errorf("expected the stored item mappings to be used, got %q after %d requests (%v)", output.String(), requests.Load(), err)
+	}
+}
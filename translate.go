@@ -5,13 +5,12 @@ A package for translating from a JSON input to a standard format using OpenAI's
 */
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"reflect"
 	"sort"
@@ -21,7 +20,6 @@ import (
 	"regexp"
 	"strconv"
 
-	"encoding/base64"
 	"gopkg.in/yaml.v3"
 	"github.com/osteele/liquid"
 	"github.com/google/go-github/v28/github"
@@ -35,12 +33,28 @@ var chosenModel = "gpt-5-mini"
 var debug = os.Getenv("DEBUG") == "true"
 var maxInputSize = 15000 
 
+// How many list items are translated to a substandard at the same time, and how many are translated at most
+var subStandardWorkers = 10
+var maxSubStandardItems = 100
+
 func init() {
 	if tok := os.Getenv("MAX_AI_INPUT_SIZE"); tok != "" {
 		if t, err := strconv.Atoi(tok); err == nil {
 			maxInputSize = t
 		}
 	}
+
+	if tok := os.Getenv("SUBSTANDARD_WORKERS"); tok != "" {
+		if t, err := strconv.Atoi(tok); err == nil && t > 0 {
+			subStandardWorkers = t
+		}
+	}
+
+	if tok := os.Getenv("MAX_SUBSTANDARD_ITEMS"); tok != "" {
+		if t, err := strconv.Atoi(tok); err == nil && t > 0 {
+			maxSubStandardItems = t
+		}
+	}
 }
 
 func getRootFolder() string {
@@ -70,39 +84,35 @@ func getRootFolder() string {
 
 
 
-func SaveQuery(inputStandard, gptTranslated string, shuffleConfig ShuffleConfig) error {
-	if len(shuffleConfig.URL) > 0 {
-		//return nil
-		return AddShuffleFile(inputStandard, "translation_ai_queries", []byte(gptTranslated), shuffleConfig)
+func SaveQueryContext(ctx context.Context, inputStandard, gptTranslated string, shuffleConfig ShuffleConfig) error {
+	if isPreview(ctx) {
+		return nil
 	}
 
-	// Write it to file in the example folder
-	filename := fmt.Sprintf("%squeries/%s", getRootFolder(), inputStandard)
-
-	// Open the file
-	f, err := os.OpenFile(filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		//log.Printf("[ERROR] Error opening file %s (1): %v", filename, err)
-		return err
-	}
+	return GetStore(shuffleConfig).Put(ctx, NamespaceQueries, inputStandard, []byte(gptTranslated))
+}
 
-	// Write the translated value
-	if _, err := f.Write([]byte(gptTranslated)); err != nil {
-		log.Printf("[ERROR] Schemaless: Error writing to file %s: %v", filename, err)
-		return err
-	}
+// Deprecated: Use SaveQueryContext
+func SaveQuery(inputStandard, gptTranslated string, shuffleConfig ShuffleConfig) error {
+	return SaveQueryContext(context.Background(), inputStandard, gptTranslated, shuffleConfig)
+}
 
-	if debug {
-		log.Printf("[DEBUG] Schemaless: Translation saved to %s (1)", filename)
+func LLMTranslateContext(ctx context.Context, keyTokenFile, standardFormat, inputDataFormat string, shuffleConfig ShuffleConfig) (string, error) {
+	// Large inputs are split into multiple requests and merged afterwards
+	if len(inputDataFormat) > maxInputSize {
+		return chunkedLLMTranslate(ctx, keyTokenFile, standardFormat, inputDataFormat, shuffleConfig)
 	}
 
-	return nil
+	return llmTranslate(ctx, keyTokenFile, standardFormat, inputDataFormat, "", shuffleConfig)
 }
 
+// Deprecated: Use LLMTranslateContext
 func LLMTranslate(keyTokenFile, standardFormat, inputDataFormat string, shuffleConfig ShuffleConfig) (string, error) {
+	return LLMTranslateContext(context.Background(), keyTokenFile, standardFormat, inputDataFormat, shuffleConfig)
+}
 
-	additionalCondition := fmt.Sprintf("")
-
+// additionalCondition is added to the parsing rules of the system message
+func llmTranslate(ctx context.Context, keyTokenFile, standardFormat, inputDataFormat, additionalCondition string, shuffleConfig ShuffleConfig) (string, error) {
 	systemMessage := fmt.Sprintf(`INTRODUCTION 
 
 Translate the given user input JSON structure to the provided standard format in the jq format. Use the values from the standard to guide you what to look for. 
@@ -143,52 +153,43 @@ END FORMATTING RULES
 	}
 
 	// Make md5 of the query, and put it in cache to check
-	ctx := context.Background()
-	md5Query := fmt.Sprintf("%x", md5.Sum([]byte(shuffleConfig.OrgId+systemMessage+userQuery)))
+	// Queries for another model than the default are cached separately
+	options := getLLMOptions(ctx)
+	modelKey := ""
+	if options.Model != chosenModel {
+		modelKey = options.Model
+	}
 
-	// 0 - 500ms delay to ensure 50+ queries don't run for the same query at the same time
-	// This ensures we MAY get very few requests instead of a ton of them
-	randomSleeptime := time.Duration(rand.Intn(500))
-	time.Sleep(randomSleeptime * time.Millisecond)
+	md5Query := fmt.Sprintf("%x", md5.Sum([]byte(shuffleConfig.OrgId+modelKey+systemMessage+userQuery)))
 
+	// Identical queries running at the same time, here or on other replicas, wait for the first one
 	cacheKey := fmt.Sprintf("translationquery-%s", md5Query)
-	cacheKeyStarted := fmt.Sprintf("translationquery-%s-started", md5Query)
-	found, err := GetCache(ctx, cacheKeyStarted)
-	if err == nil && found != nil {
-		// ~30 seconds to finish the query should be enough
-		maxIter := 6
-		sleepTime := 5
-		cnt := 0
-		for {
-			cache, err := GetCache(ctx, cacheKey)
-			if err == nil {
-				contentOutput := string([]byte(cache.([]uint8)))
-				return contentOutput, nil
-			}
-
-			if cnt >= maxIter {
-				break
-			}
-
-			cnt += 1
-			time.Sleep(time.Duration(sleepTime) * time.Second)
+	output, err := singleFlight(ctx, cacheKey, func() (interface{}, bool) {
+		if options.SkipCache {
+			return "", false
 		}
 
-	} else {
-		SetCache(ctx, cacheKeyStarted, []byte("started"), 1)
-	}
+		cacheData, err := GetCache(ctx, cacheKey)
+		return string(cacheData), err == nil
+	}, func() (interface{}, error) {
+		return runLLMQuery(ctx, keyTokenFile, cacheKey, systemMessage, userQuery, shuffleConfig)
+	})
 
-	cache, err := GetCache(ctx, cacheKey)
-	if err == nil {
-		contentOutput := string([]byte(cache.([]uint8)))
-		return contentOutput, nil
+	if err != nil {
+		return standardFormat, err
 	}
 
+	return output.(string), nil
+}
+
+// Sends a query to the LLM and caches the result
+func runLLMQuery(ctx context.Context, keyTokenFile, cacheKey, systemMessage, userQuery string, shuffleConfig ShuffleConfig) (string, error) {
+	var err error
 	if debug {
 		log.Printf("[DEBUG] Schemaless: Running GPT (2) with system message: %s", systemMessage)
 	}
 
-	SaveQuery(keyTokenFile, userQuery, shuffleConfig)
+	SaveQueryContext(ctx, keyTokenFile, userQuery, shuffleConfig)
 
 	apiKey := os.Getenv("AI_API_KEY")
 	if len(apiKey) == 0 {
@@ -208,7 +209,7 @@ END FORMATTING RULES
 
 
 	if len(apiKey) == 0 {
-		return standardFormat, errors.New("AI_API_KEY not set")
+		return "", errors.New("AI_API_KEY not set")
 	}
 
 	config := openai.DefaultConfig(apiKey)
@@ -238,13 +239,13 @@ END FORMATTING RULES
 		if cnt >= 5 {
 			log.Printf("[ERROR] Schemaless: Failed to match Formatting in standard translation after 5 tries. Returning empty string.")
 
-			return standardFormat, errors.New(fmt.Sprintf("Failed to match Formatting in standard translation after 5 tries. Raw error: %s", err.Error()))
+			return "", errors.New(fmt.Sprintf("Failed to match Formatting in standard translation after 5 tries. Raw error: %s", err.Error()))
 		}
 
 		openaiResp2, err = openaiClient.CreateChatCompletion(
-			context.Background(),
+			ctx,
 			openai.ChatCompletionRequest{
-				Model: chosenModel,
+				Model: llmModel(ctx),
 				Messages: []openai.ChatCompletionMessage{
 					{
 						Role:    openai.ChatMessageRoleSystem,
@@ -261,15 +262,25 @@ END FORMATTING RULES
 		)
 
 		if err != nil {
+			// No point in retrying when the caller is gone or out of time
+			if ctx.Err() != nil {
+				return "", contextError(ctx, err)
+			}
+
 			log.Printf("[ERROR] Schemaless: Failed to create chat completion in runActionAI. Retrying in 3 seconds (1): %s", err)
 
 			// Handling specifically a 429 response, as this rarely randomly
 			// fixes itself within 10 seconds~.
 			if cnt == 0 && strings.Contains(err.Error(), "429") {
-				return standardFormat, errors.New(fmt.Sprintf("LLM Rate limit hit during single translation: %s", err.Error()))
+				return "", errors.New(fmt.Sprintf("LLM Rate limit hit during single translation: %s", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return "", contextError(ctx, err)
+			case <-time.After(3 * time.Second):
 			}
 
-			time.Sleep(3 * time.Second)
 			cnt += 1
 			continue
 		}
@@ -281,10 +292,10 @@ END FORMATTING RULES
 		break
 	}
 
-	err = SetCache(ctx, cacheKey, []byte(contentOutput), 30)
+	// Other replicas waiting for this query look for the result here
+	err = SetCacheWithTTL(ctx, cacheKey, []byte(contentOutput), CacheTTL(CacheKindLLMResult))
 	if err != nil {
 		log.Printf("[ERROR] Schemaless: Error setting cache for key %s: %v", cacheKey, err)
-		return contentOutput, err
 	}
 
 	return contentOutput, nil
@@ -451,7 +462,7 @@ func GetStructureFromCache(ctx context.Context, inputKeyToken string) (map[strin
 	}
 
 	// Setting the structure AGAIN to make it not time out
-	cacheData := []byte(returnCache.([]uint8))
+	cacheData := returnCache
 	fixedCache := FixTranslationStructure(string(cacheData))
 	err = json.Unmarshal([]byte(fixedCache), &returnStructure)
 	if err != nil {
@@ -471,7 +482,7 @@ func GetStructureFromCache(ctx context.Context, inputKeyToken string) (map[strin
 func SetStructureCache(ctx context.Context, inputKeyToken string, inputStructure []byte) error {
 	inputKeyTokenMd5 := fmt.Sprintf("%x", md5.Sum([]byte(inputKeyToken)))
 
-	err := SetCache(ctx, inputKeyTokenMd5, inputStructure, 86400)
+	err := SetCacheWithTTL(ctx, inputKeyTokenMd5, inputStructure, CacheTTL(CacheKindStructure))
 	if err != nil {
 		log.Printf("[ERROR] Schemaless: Error setting cache for key %s: %v", inputKeyToken, err)
 		return err
@@ -499,6 +510,9 @@ func YamlToJson(i interface{}) interface{} {
 	return i
 }
 
+// Strips the values of a JSON object and gets the key token of its structure.
+//
+// Deprecated: Use StructureFingerprint, which gives the same result for depth 1 without marshalling and parsing each nested object again.
 func RemoveJsonValues(input []byte, depth int64) ([]byte, string, error) {
 	// Make the byte into a map[string]interface{} so we can iterate over it
 	keyToken := ""
@@ -684,85 +698,70 @@ func FixTranslationStructure(gptTranslated string) string {
 	return gptTranslated
 }
 
+func SaveTranslationContext(ctx context.Context, inputStandard, gptTranslated string, shuffleConfig ShuffleConfig) error {
+	_, err := saveMapping(ctx, inputStandard, "", gptTranslated, "system", shuffleConfig)
+	return err
+}
+
+// Deprecated: Use SaveTranslationContext
 func SaveTranslation(inputStandard, gptTranslated string, shuffleConfig ShuffleConfig) error {
+	return SaveTranslationContext(context.Background(), inputStandard, gptTranslated, shuffleConfig)
+}
+
+// Saves a generated mapping as a new version while keeping the human-authored and locked fields of the existing one.
+// The source (e.g. llm:<model>) is added to the audit trail for every changed field.
+// The standard is kept in the metadata, unless it is empty.
+func saveMapping(ctx context.Context, keyTokenFile, inputStandard, gptTranslated, source string, shuffleConfig ShuffleConfig) (MappingVersion, error) {
 	// Due to {} or similar. Don't want to save empty standards.
-	if len(inputStandard) <= 4 {
-		return nil
+	if len(keyTokenFile) <= 4 {
+		return MappingVersion{}, nil
 	}
 
-	// Check if the data starts with ``` or ```json and ends with ``` or ```json
-	gptTranslated = FixTranslationStructure(gptTranslated)
-	if len(shuffleConfig.URL) > 0 {
-		// Used to be a goroutine
-		return AddShuffleFile(inputStandard, "translation_output", []byte(gptTranslated), shuffleConfig)
-		return nil
+	// Mappings made during previews are only returned
+	if isPreview(ctx) {
+		return MappingVersion{Source: source}, nil
 	}
 
-	// Write it to file in the example folder
-	filename := fmt.Sprintf("%stranslation_output/%s.json", getRootFolder(), inputStandard)
-
-	// Open the file
-	f, err := os.OpenFile(filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		//log.Printf("[ERROR] Error opening file %s (2): %v", filename, err)
-		return err
-	}
+	// Check if the data starts with ``` or ```json and ends with ``` or ```json
+	gptTranslated = FixTranslationStructure(gptTranslated)
+	toSave := []byte(gptTranslated)
 
-	// Write the translated value
-	if _, err := f.Write([]byte(gptTranslated)); err != nil {
-		log.Printf("[ERROR] Schemaless: Error writing to file %s: %v", filename, err)
-		return err
-	}
+	return commitMapping(ctx, keyTokenFile, inputStandard, source, shuffleConfig, func(existing []byte) ([]byte, error) {
+		if len(existing) == 0 {
+			return toSave, nil
+		}
 
-	if debug {
-		log.Printf("[DEBUG] Schemaless: Translation saved to %s (2)", filename)
-	}
+		merged, err := mergeStoredMapping(existing, toSave, source)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: Failed merging mapping %s with the existing one: %s", keyTokenFile, err)
+			return toSave, nil
+		}
 
-	return nil
+		return merged, nil
+	})
 }
 
-func SaveParsedInput(inputStandard string, gptTranslated []byte, shuffleConfig ShuffleConfig) error {
-	if len(shuffleConfig.URL) > 0 {
-		// FIXME: Should we upload everything? I think not
+func SaveParsedInputContext(ctx context.Context, inputStandard string, gptTranslated []byte, shuffleConfig ShuffleConfig) error {
+	if isPreview(ctx) {
 		return nil
-		return AddShuffleFile(inputStandard, "translation_input", gptTranslated, shuffleConfig)
-	}
-
-	// Write it to file in the example folder
-	filename := fmt.Sprintf("%sinput/%s", getRootFolder(), inputStandard)
-
-	// Open the file
-	f, err := os.OpenFile(filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		//log.Printf("[ERROR] Schemaless: Error opening file %s (3): %v", filename, err)
-		return err
-	}
-
-	// Write the translated value
-	if _, err := f.Write(gptTranslated); err != nil {
-		log.Printf("[ERROR] Schemaless: Error writing to file %s: %v", filename, err)
-		return err
 	}
 
-	/*
-		if debug {
-			log.Printf("[DEBUG] Schemaless: Response keys saved to %s (3)", filename)
-		}
-	*/
+	return GetStore(shuffleConfig).Put(ctx, NamespaceInputs, inputStandard, gptTranslated)
+}
 
-	return nil
+// Deprecated: Use SaveParsedInputContext
+func SaveParsedInput(inputStandard string, gptTranslated []byte, shuffleConfig ShuffleConfig) error {
+	return SaveParsedInputContext(context.Background(), inputStandard, gptTranslated, shuffleConfig)
 }
 
-func LoadStandardFromGithub(client github.Client, owner, repo, path, filename string) ([]*github.RepositoryContent, error) {
+func LoadStandardFromGithubContext(ctx context.Context, client *github.Client, owner, repo, path, filename string) ([]*github.RepositoryContent, error) {
 	var err error
 
-	ctx := context.Background()
 	files := []*github.RepositoryContent{}
 
 	cacheKey := fmt.Sprintf("github_%s_%s_%s_%s", owner, repo, path, filename)
-	cache, err := GetCache(ctx, cacheKey)
+	cacheData, err := GetCache(ctx, cacheKey)
 	if err == nil {
-		cacheData := []byte(cache.([]uint8))
 		err = json.Unmarshal(cacheData, &files)
 		if err == nil && len(files) > 0 {
 			return files, nil
@@ -788,7 +787,7 @@ func LoadStandardFromGithub(client github.Client, owner, repo, path, filename st
 
 	for _, item := range files {
 		itemName := strings.ToLower(strings.ReplaceAll(*item.Name, " ", "_"))
-		if len(itemName) > 0 && strings.HasPrefix(itemName, searchname) {
+		if len(itemName) > 0 && standardKey(itemName) == standardKey(searchname) {
 			matchingFiles = append(matchingFiles, item)
 		}
 	}
@@ -800,7 +799,7 @@ func LoadStandardFromGithub(client github.Client, owner, repo, path, filename st
 		return files, nil
 	}
 
-	err = SetCache(ctx, cacheKey, data, 30)
+	err = SetCacheWithTTL(ctx, cacheKey, data, CacheTTL(CacheKindGithub))
 	if err != nil {
 		log.Printf("[WARNING] Failed setting cache for getfiles on github '%s': %s", cacheKey, err)
 	}
@@ -808,133 +807,102 @@ func LoadStandardFromGithub(client github.Client, owner, repo, path, filename st
 	return files, nil
 }
 
-func LoadAndSaveStandard(inputStandard string) error {
-	client := github.NewClient(nil)
-	owner := "shuffle"
-	repo := "standards"
-	path := "translation_standards"
-	if os.Getenv("GIT_DOWNLOAD_USER") != "" {
-		owner = os.Getenv("GIT_DOWNLOAD_USER")
-	}
+// Deprecated: Use LoadStandardFromGithubContext, which takes a *github.Client
+func LoadStandardFromGithub(client github.Client, owner, repo, path, filename string) ([]*github.RepositoryContent, error) {
+	return LoadStandardFromGithubContext(context.Background(), &client, owner, repo, path, filename)
+}
 
-	if os.Getenv("GIT_DOWNLOAD_REPO") != "" {
-		repo = os.Getenv("GIT_DOWNLOAD_REPO")
-	}
+// Loads a standard from the standard sources, saving it in the store if it came from a remote source
+func LoadAndSaveStandardContext(ctx context.Context, inputStandard string) error {
+	_, _, err := loadStandard(ctx, inputStandard, GetStore(ShuffleConfig{}))
+	return err
+}
 
-	foundFiles, err := LoadStandardFromGithub(*client, owner, repo, path, inputStandard)
+// Deprecated: Use LoadAndSaveStandardContext
+func LoadAndSaveStandard(inputStandard string) error {
+	return LoadAndSaveStandardContext(context.Background(), inputStandard)
+}
 
-	if debug {
-		log.Printf("[DEBUG] Found %d files in Github for standard '%s'", len(foundFiles), inputStandard)
+// Gets a standard, with the standards it extends merged into it. JSON Schema standards are
+// returned as regular standards, with the property descriptions as values.
+func GetStandardContext(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
+	byteValue, filepath, err := getRawStandard(ctx, inputStandard, shuffleConfig)
+	if err != nil {
+		return byteValue, filepath, err
 	}
 
+	byteValue, err = ConvertStandardFormat(byteValue)
 	if err != nil {
-		log.Printf("[ERROR] Failed getting standard list from Github: %s", err)
-		return err
+		log.Printf("[ERROR] Schemaless: Failed converting JSON Schema standard %s: %s", inputStandard, err)
+		return []byte{}, filepath, err
 	}
 
-	ctx := context.Background()
-	for _, item := range foundFiles {
-		if debug {
-			log.Printf("[DEBUG] Found file from Github '%s'", *item.Name)
-		}
-
-		fileContent, _, _, err := client.Repositories.GetContents(ctx, owner, repo, *item.Path, nil)
-		if err != nil {
-			log.Printf("[ERROR] Failed getting file %s: %s", *item.Path, err)
-			continue
-		}
-
-		// Get the bytes of the file
-		decoded, err := base64.StdEncoding.DecodeString(*fileContent.Content)
-		if err != nil {
-			log.Printf("[ERROR] Failed decoding standard file %s: %s", *item.Path, err)
-			continue
-		}
-
-		// Save the file to the local filesystem
-		filename := fmt.Sprintf("%sstandards/%s", getRootFolder(), *item.Name)
-		err = ioutil.WriteFile(filename, decoded, 0644)
-		if err != nil {
-			log.Printf("[ERROR] Failed writing standard file %s: %s", filename, err)
-			continue
-		}
-
-		log.Printf("[INFO] Schemaless: Saved standard file %s to %s", *item.Name, filename)
+	composed, err := composeStandard(ctx, standardKey(inputStandard), byteValue, []string{}, shuffleConfig)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless: Failed composing standard %s: %s", inputStandard, err)
+		return []byte{}, filepath, err
 	}
 
-	return nil
+	return composed, filepath, nil
 }
 
+// Deprecated: Use GetStandardContext
 func GetStandard(inputStandard string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
-	if len(shuffleConfig.URL) > 0 {
-		// Get the standard from shuffle instead, as we are storing standards there in prod
-		return FindShuffleFile(inputStandard, "translation_standards", shuffleConfig)
-	}
+	return GetStandardContext(context.Background(), inputStandard, shuffleConfig)
+}
 
-	if strings.HasSuffix(inputStandard, ".json") {
-		inputStandard = strings.TrimSuffix(inputStandard, ".json")
-	}
+// Gets a standard as it is stored, loading it from the standard sources if it isn't
+func getRawStandard(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
+	store := GetStore(shuffleConfig)
 
-	// Open the relevant file
-	filepath := fmt.Sprintf("%sstandards/%s.json", getRootFolder(), inputStandard)
-	jsonFile, err := os.Open(filepath)
+	inputStandard = standardKey(inputStandard)
+	byteValue, filepath, err := storeGet(ctx, store, NamespaceStandards, inputStandard)
 	if err != nil {
 		if debug { 
-			log.Printf("[DEBUG] Schemaless: Problem finding file %s (4): %v. Loading the standard from Github and saving.", filepath, err)
-		}
-
-		err := LoadAndSaveStandard(inputStandard)
-		if err != nil {
-			log.Printf("[ERROR] Failed to load standard from Github: %s", err)
-			return []byte{}, filepath, err
+			log.Printf("[DEBUG] Schemaless: Problem finding standard %s (4): %v. Loading the standard from the standard sources.", inputStandard, err)
 		}
 
-		// Re-instantiate referece to the file
-		jsonFile, err = os.Open(filepath)
+		byteValue, filepath, err = loadStandard(ctx, inputStandard, store)
 		if err != nil {
-			log.Printf("[ERROR] Schemaless: No standard for file %s (5): %v", filepath, err)
+			log.Printf("[ERROR] Schemaless: No standard for %s (5): %v", inputStandard, err)
 			return []byte{}, filepath, err
 		}
-
-		log.Printf("[INFO] Done loading standard '%s' from Shuffle's Github standards. Path: %s", inputStandard, filepath)
-	}
-
-	// Read the file into a byte array
-	byteValue, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		log.Printf("[ERROR] Schemaless: Error reading file %s: %v", filepath, err)
-		return []byte{}, filepath, err
 	}
 
 	return byteValue, filepath, nil
 }
 
+func GetExistingStructureContext(ctx context.Context, inputStandard string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
+	return storeGet(ctx, GetStore(shuffleConfig), NamespaceMappings, inputStandard)
+}
+
+// Deprecated: Use GetExistingStructureContext
 func GetExistingStructure(inputStandard string, shuffleConfig ShuffleConfig) ([]byte, string, error) {
-	if len(shuffleConfig.URL) > 0 {
-		// Get the standard from shuffle instead, as we are storing standards there in prod
-		return FindShuffleFile(inputStandard, "translation_output", shuffleConfig)
-	}
+	return GetExistingStructureContext(context.Background(), inputStandard, shuffleConfig)
+}
 
-	// FIXME: Should we skip this?
-	// Is there any reason to load the standard from the file system?
-	//return []byte{}, nil
+type generatedMapping struct {
+	Mapping string
+	Version MappingVersion
+}
 
-	// Open the relevant file
-	filename := fmt.Sprintf("%stranslation_output/%s.json", getRootFolder(), inputStandard)
-	jsonFile, err := os.Open(filename)
+// Finds a mapping saved by another translation of the same input structure
+func findGeneratedMapping(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) (interface{}, bool) {
+	existing, _, err := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
 	if err != nil {
-		//log.Printf("[ERROR] Schemaless: Error opening file %s (5): %v", filename, err)
-		return []byte{}, filename, err
+		return nil, false
 	}
 
-	// Read the file into a byte array
-	byteValue, err := ioutil.ReadAll(jsonFile)
+	fixedOutput := FixTranslationStructure(string(existing))
+	_, meta, err := ParseStoredMapping([]byte(fixedOutput))
 	if err != nil {
-		log.Printf("[ERROR] Schemaless: Error reading file %s: %v", filename, err)
-		return []byte{}, filename, err
+		return nil, false
 	}
 
-	return byteValue, filename, nil
+	return generatedMapping{
+		Mapping: string(stripMappingMetadata([]byte(fixedOutput))),
+		Version: meta.Version,
+	}, true
 }
 
 // Recurses to find keys deeper based on the standard
@@ -1273,7 +1241,7 @@ func handleMultiListItems(translatedInput []interface{}, parentKey string, parse
 					unmarshalledList := []string{}
 					err := json.Unmarshal([]byte(matchingList), &unmarshalledList)
 					if err != nil {
-						log.Printf("[ERROR] Schemaless problem in string unmarshal of %s: err", matchingList, err)
+						log.Printf("[ERROR] Schemaless problem in string unmarshal of %s: %s", matchingList, err)
 					}
 
 					oldParentKey := parentKey
@@ -1459,6 +1427,12 @@ func getParsedMatch(match string) string {
 func runJsonTranslation(ctx context.Context, inputValue []byte, translation map[string]interface{}, keepOriginal ...bool) ([]byte, []byte, error) {
 	//log.Printf("Should translate %s based on %s", string(inputValue), translation)
 
+	// The metadata of stored mappings is never an output field, even when it wasn't stripped first
+	if _, ok := translation[mappingMetadataKey]; ok {
+		translation = copyMap(translation)
+		delete(translation, mappingMetadataKey)
+	}
+
 	// Unmarshal the byte back into a map[string]interface{}
 	var parsedInput map[string]interface{}
 	err := json.Unmarshal(inputValue, &parsedInput)
@@ -1801,27 +1775,10 @@ func runJsonTranslation(ctx context.Context, inputValue []byte, translation map[
 	return translatedOutput, modifiedOutput, nil
 }
 
-// Ensures relevant folders exist
-func fixPaths() {
-	folders := []string{"translation_output", "standards", "input", "queries"}
-	for _, folder := range folders {
-		folderpath := fmt.Sprintf("%s%s", getRootFolder(), folder)
-		if _, err := os.Stat(folderpath); os.IsNotExist(err) {
-			if debug {
-				log.Printf("[DEBUG] Schemaless: Folder '%s' does not exist, creating it", folderpath)
-			}
-
-			err = os.MkdirAll(folderpath, 0755)
-			if err != nil {
-				log.Printf("[ERROR] Schemaless: Error creating folder '%s': %v", folder, err)
-			}
-		}
-	}
-}
-
 // Returns the full list, and the filepath of the last one 
 // This is a bit finicky right now.
-func handleSubStandard(ctx context.Context, subStandard string, returnJson string, authConfig string) ([]byte, string, error) {
+// Translates each item of the list in returnJson to the substandard. Output keeps the order of the input, and items that fail are left out.
+func handleSubStandard(ctx context.Context, info *TranslationInfo, subStandard string, returnJson string, authConfig string, extraConfig ...string) ([]byte, string, error) {
 	log.Printf("[DEBUG] Schemaless: Finding substandard for standard '%s'", subStandard)
 
 	// 1. Check if the original returnJson is a list
@@ -1865,77 +1822,105 @@ func handleSubStandard(ctx context.Context, subStandard string, returnJson strin
 		log.Printf("[DEBUG] Schemaless: Found a list of length %d in the returnJson. Should translate each item to the substandard", len(listJson))
 	}
 
-	// For each item in the list, translate it to the substandard
-	// Doing it with recursive Translate() calls
-	skipAfterCount := 100 
-	var wg sync.WaitGroup
-	var mu sync.Mutex // Mutex to safely access parsedOutput slice
+	itemCount := len(listJson)
+	if itemCount > maxSubStandardItems {
+		warning := fmt.Sprintf("Only translated the first %d of %d list items to substandard '%s'. Change MAX_SUBSTANDARD_ITEMS to translate more.", maxSubStandardItems, itemCount, subStandard)
+		log.Printf("[WARNING] Schemaless: %s", warning)
+		info.Warnings = append(info.Warnings, warning)
+		itemCount = maxSubStandardItems
+	}
 
-	parsedOutput := [][]byte{}
-	filepaths := []string{}
-	for cnt, listItem := range listJson {
+	// For each item in the list, translate it to the substandard
+	// Doing it with recursive Translate() calls in a pool of workers. Each writes to its own index, so the order is kept.
+	parsedOutput := make([][]byte, itemCount)
+	results := make([]ListItemResult, itemCount)
+	for index := range results {
+		results[index].Index = index
+	}
 
-		// Skip: No goroutine on the first ones as we want to make sure caching is done properly before goroutining the rest. Prevents duplicates (mostly)
-		if cnt == 0 {
-			marshalledBody, err := json.Marshal(listItem)
-			if err != nil {
-				log.Printf("[ERROR] Schemaless: Error in marshalling of list item: %v", err)
-				continue
-			}
+	workers := subStandardWorkers
+	if workers > itemCount {
+		workers = itemCount
+	}
 
-			schemalessOutput, foundFile, err := Translate(ctx, subStandard, marshalledBody, authConfig, "skip_substandard")
-			if err != nil {
-				log.Printf("[ERROR] Schemaless: Error in schemaless.Translate for sub list item: %v", err)
-				continue
-			}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-			filepaths = append(filepaths, foundFile)
-			parsedOutput = append(parsedOutput, schemalessOutput)
-			time.Sleep(2 * time.Second) // Sleep for a bit to allow caching to be done properly before goroutining the rest
-			continue
-		}
+			for index := range jobs {
+				marshalledBody, err := json.Marshal(listJson[index])
+				if err != nil {
+					log.Printf("[WARNING] Schemaless: Error in marshalling of list item %d: %v", index, err)
+					results[index].Error = err.Error()
+					continue
+				}
 
-		wg.Add(1) 
-		go func(cnt int, listItem interface{}) {
-			defer wg.Done() // Decrement the wait group counter when the goroutine completes
+				schemalessOutput, translationFile, err := Translate(ctx, subStandard, marshalledBody, append([]string{authConfig, "skip_substandard"}, extraConfig...)...)
+				results[index].MappingFile = translationFile
+				if err != nil {
+					log.Printf("[WARNING] Schemaless: Error in schemaless.Translate for sub list item %d: %v", index, err)
+					results[index].Error = err.Error()
+					continue
+				}
 
-			marshalledBody, err := json.Marshal(listItem)
-			if err != nil {
-				log.Printf("[ERROR] Schemaless: Error in marshalling of list item: %v", err)
-				return
+				parsedOutput[index] = schemalessOutput
 			}
+		}()
+	}
 
-			// FIXME: Override the reference file after it has been successful for one?
-			schemalessOutput, translationFile, err := Translate(ctx, subStandard, marshalledBody, authConfig, "skip_substandard")
-			if err != nil {
-				log.Printf("[ERROR] Schemaless: Error in schemaless.Translate for sub list item: %v", err)
-				return
-			}
+	sent := 0
+feed:
+	for ; sent < itemCount; sent++ {
+		select {
+		case jobs <- sent:
+		case <-ctx.Done():
+			break feed
+		}
+	}
 
-			mu.Lock()
-			defer mu.Unlock()
-			filepaths = append(filepaths, translationFile)
-			parsedOutput = append(parsedOutput, schemalessOutput)
-		}(cnt, listItem)
+	close(jobs)
+	wg.Wait()
 
-		if cnt > skipAfterCount {
-			log.Printf("[WARNING] Schemaless: Breaking after %d items in the list", skipAfterCount)
-			break
+	if ctx.Err() != nil {
+		for index := sent; index < itemCount; index++ {
+			results[index].Error = ctx.Err().Error()
 		}
 
-		time.Sleep(100 * time.Millisecond) // Sleep for a bit to prevent overwhelming the system with too many goroutines at once (also fixes caching)
+		info.Items = results
+		log.Printf("[WARNING] Schemaless: Stopped translating list items to substandard '%s' after %d of %d: %s", subStandard, sent, itemCount, ctx.Err())
+		return []byte{}, "", ctx.Err()
 	}
 
-	wg.Wait() // Wait for all goroutines to finish
+	info.Items = results
 
-	// Make the [][]byte into a []byte
+	// Make the [][]byte into a []byte. Failed items are null, so the output lines up with the input and info.Items.
 	finalOutput := []byte("[")
-	for cnt, output := range parsedOutput {
-		if cnt > 0 {
+	filepaths := []string{}
+	outputCount := 0
+	failedCount := 0
+	for index, output := range parsedOutput {
+		if index > 0 {
 			finalOutput = append(finalOutput, []byte(",")...)
 		}
 
+		if len(results[index].Error) > 0 {
+			finalOutput = append(finalOutput, []byte("null")...)
+			failedCount += 1
+			continue
+		}
+
 		finalOutput = append(finalOutput, output...)
+		filepaths = append(filepaths, results[index].MappingFile)
+		outputCount += 1
+	}
+
+	if failedCount > 0 {
+		warning := fmt.Sprintf("Failed translating %d of %d list items to substandard '%s'. They are null in the output, with their errors in the items.", failedCount, itemCount, subStandard)
+		log.Printf("[WARNING] Schemaless: %s", warning)
+		info.Warnings = append(info.Warnings, warning)
 	}
 
 	// This isn't strictly correct due to slights diffs, but should be fine
@@ -1960,15 +1945,111 @@ func handleSubStandard(ctx context.Context, subStandard string, returnJson strin
 	}
 
 	if len(diffedPaths) > 0 {
-		log.Printf("[WARNING] Schemaless: Found %d translation paths for %d outputs", len(diffedPaths), len(finalOutput))
+		log.Printf("[WARNING] Schemaless: Found %d translation paths for %d outputs", len(diffedPaths), outputCount)
 	}
 
 	finalOutput = append(finalOutput, []byte("]")...)
 	return finalOutput, foundFilepath, nil
 }
 
+// Information about how a translation was done
+type TranslationInfo struct {
+	// The mapping file (or Shuffle file ID) used
+	MappingFile string `json:"mapping_file"`
+
+	// The version of the mapping used
+	MappingVersion MappingVersion `json:"mapping_version"`
+
+	// Set when the standard changed after the mapping was made
+	Stale *MappingStaleness `json:"stale,omitempty"`
+
+	// One per list item when translating a list to a substandard
+	Items []ListItemResult `json:"items,omitempty"`
+
+	// One per field referencing another standard, including nested ones
+	References []ReferenceResult `json:"references,omitempty"`
+
+	// Where the output doesn't match the schema, for standards written as JSON Schema
+	ValidationErrors []SchemaValidationError `json:"validation_errors,omitempty"`
+
+	// Problems that didn't stop the translation, such as list items being skipped
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// The result of translating a single list item to a substandard
+type ListItemResult struct {
+	Index       int    `json:"index"`
+	MappingFile string `json:"mapping_file,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Returned when a translation runs past the deadline of its context
+var ErrTranslationTimeout = errors.New("Translation timed out")
+
+// Returned when the context of a translation is cancelled, e.g. by the client disconnecting
+var ErrTranslationCanceled = errors.New("Translation canceled")
+
+// Tells timeouts and cancellations apart from other failures
+func contextError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrTranslationTimeout) || errors.Is(err, ErrTranslationCanceled) {
+		return err
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrTranslationTimeout, err)
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("%w: %s", ErrTranslationCanceled, err)
+	}
+
+	return err
+}
+
 // Add optional argument for whether to use shuffle files or not
+// Timeouts and cancellations of ctx return ErrTranslationTimeout and ErrTranslationCanceled
 func Translate(ctx context.Context, inputStandard string, inputValue []byte, inputConfig ...string) ([]byte, string, error) {
+	info := TranslationInfo{}
+	output, mappingFile, err := translate(ctx, &info, inputStandard, inputValue, inputConfig...)
+	return output, mappingFile, contextError(ctx, err)
+}
+
+// Same as Translate, but also returns information such as the mapping version used
+func TranslateWithInfo(ctx context.Context, inputStandard string, inputValue []byte, inputConfig ...string) ([]byte, TranslationInfo, error) {
+	info := TranslationInfo{}
+	output, mappingFile, err := translate(ctx, &info, inputStandard, inputValue, inputConfig...)
+	info.MappingFile = mappingFile
+	return output, info, contextError(ctx, err)
+}
+
+// Parses the auth config passed as the first inputConfig of Translate:
+// fmt.Sprintf("%t,%s,%s,%s,%s", keepOriginal, baseUrl, authorization, orgId, optionalExecutionId)
+func parseAuthConfig(authConfig string) (ShuffleConfig, bool) {
+	shuffleConfig := ShuffleConfig{}
+	keepOriginal := false
+
+	parsedInput := strings.Split(authConfig, ",")
+	for cnt, config := range parsedInput {
+		if cnt == 0 {
+			keepOriginal = (config == "true" || config == "1" || config == "yes")
+		} else if cnt == 1 {
+			shuffleConfig.URL = config
+		} else if cnt == 2 {
+			shuffleConfig.Authorization = config
+		} else if cnt == 3 {
+			shuffleConfig.OrgId = config
+		} else if cnt == 4 {
+			shuffleConfig.ExecutionId = config
+		} else {
+			log.Printf("[ERROR] Schemaless: Too many arguments for shuffleConfig (%d)", len(parsedInput))
+			break
+		}
+	}
+
+	return shuffleConfig, keepOriginal
+}
+
+func translate(ctx context.Context, info *TranslationInfo, inputStandard string, inputValue []byte, inputConfig ...string) ([]byte, string, error) {
 
 	// shuffleConfig is an overwrite we can use. Contains in first item with comma separation in order:
 	// keepOriginal (keep unstructured in blob)
@@ -1981,25 +2062,7 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 
 	keepOriginal := false
 	if len(inputConfig) > 0 {
-		// authConfig := fmt.Sprintf("true,%s,%s,%s,%s", baseUrl, authorization, orgId, optionalExecutionId)
-
-		parsedInput := strings.Split(inputConfig[0], ",")
-		for cnt, config := range parsedInput {
-			if cnt == 0 {
-				keepOriginal = (config == "true" || config == "1" || config == "yes")
-			} else if cnt == 1 {
-				shuffleConfig.URL = config
-			} else if cnt == 2 {
-				shuffleConfig.Authorization = config
-			} else if cnt == 3 {
-				shuffleConfig.OrgId = config
-			} else if cnt == 4 {
-				shuffleConfig.ExecutionId = config
-			} else {
-				log.Printf("[ERROR] Schemaless: Too many arguments for shuffleConfig (%d)", len(parsedInput))
-				break
-			}
-		}
+		shuffleConfig, keepOriginal = parseAuthConfig(inputConfig[0])
 	}
 
 	// FIXME: May not be important anymore
@@ -2013,7 +2076,7 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 		// Avoids recursion
 		if input == "skip_substandard" {
 			skipSubstandard = true
-			break
+			continue
 		}
 
 		if strings.HasPrefix(strings.ToLower(input), "filename_prefix:") {
@@ -2024,43 +2087,82 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 		}
 	}
 
-	if shuffleConfig.URL == "" {
-		// Check for paths
-		fixPaths()
-	}
-
 	// Doesn't handle list inputs in json
-	startValue := strings.TrimSpace(string(inputValue))
-	if !strings.HasPrefix(startValue, "{") || !strings.HasSuffix(startValue, "}") {
-		output, err := YamlConvert(startValue)
+	startBytes := bytes.TrimSpace(inputValue)
+	if !bytes.HasPrefix(startBytes, []byte("{")) || !bytes.HasSuffix(startBytes, []byte("}")) {
+		output, err := YamlConvert(string(startBytes))
 		if err != nil {
 			log.Printf("[ERROR] Schemaless bad prefix (1): %v", err)
 		}
 
-		startValue = output
+		startBytes = []byte(output)
 	}
 
 	translationFilePath := ""
-	returnJson, keyToken, err := RemoveJsonValues([]byte(startValue), 1)
-	if err != nil {
-		log.Printf("[ERROR] Schemaless json removal (2): %v", err)
-		return []byte{}, translationFilePath, err
-	}
 
 	// Used to handle recursion and weird names
 	if strings.HasSuffix(inputStandard, ".json") {
 		inputStandard = strings.TrimSuffix(inputStandard, ".json")
 	}
 
-	keyTokenFile := fmt.Sprintf("%s%s-%x", filenamePrefix, inputStandard, md5.Sum([]byte(keyToken)))
+	// The standards this is nested in, when translating a field referencing another standard
+	refChain := parseRefChain(inputConfig)
+	foundAuthConfig := ""
+	if len(inputConfig) > 0 && !strings.HasPrefix(inputConfig[0], refChainConfigPrefix) {
+		foundAuthConfig = inputConfig[0]
+	}
 
+	// Input structures translated before run the compiled plan of their mapping, without going to the store. Their key token
+	// is read without decoding the input, and only the fields the plan reads are decoded.
+	if usingMappingPlans(ctx) {
+		if keyToken, members, ok := scanKeyToken(startBytes); ok {
+			keyTokenFile := fmt.Sprintf("%s%s-%x", filenamePrefix, standardFileKey(inputStandard), md5.Sum([]byte(keyToken)))
+			if plan, ok := getMappingPlan(ctx, shuffleConfig, keyTokenFile); ok {
+				info.MappingVersion = plan.version
+				info.Stale = plan.stale
+				if plan.stale != nil {
+					info.Warnings = append(info.Warnings, fmt.Sprintf("Mapping %s is stale: %s", keyTokenFile, plan.stale.Reason))
+				}
+
+				parsedInput, err := plan.decodeInput(startBytes, members, keepOriginal)
+				if err != nil {
+					log.Printf("[ERROR] Schemaless: Failed decoding the input for mapping %s: %v", keyTokenFile, err)
+					return []byte{}, keyTokenFile, err
+				}
+
+				recordUsage(ctx, GetStore(shuffleConfig), NamespaceMappings, keyTokenFile)
+				translation, err := plan.translate(ctx, info, inputStandard, refChain, parsedInput, startBytes, keepOriginal, foundAuthConfig)
+				return translation, plan.mappingFile, err
+			}
+		}
+	}
+
+	// Decoded once for the fingerprint and the translation
+	startValue := string(startBytes)
+	parsedInput, strippedInput, keyToken, err := fingerprintInput(startBytes)
+	if err != nil {
+		log.Printf("[ERROR] Schemaless json removal (2): %v", err)
+		return []byte{}, translationFilePath, err
+	}
+
+	keyTokenFile := fmt.Sprintf("%s%s-%x", filenamePrefix, standardFileKey(inputStandard), md5.Sum([]byte(keyToken)))
 	if len(translationFilePath) == 0 {
 		translationFilePath = keyTokenFile
 	}
 
-	err = SaveParsedInput(keyTokenFile, returnJson, shuffleConfig)
+	returnJson, err := json.MarshalIndent(strippedInput, "", "\t")
+	if err != nil {
+		log.Printf("[ERROR] Schemaless json removal (3): %v", err)
+		return []byte{}, translationFilePath, err
+	}
+
+	err = SaveParsedInputContext(ctx, keyTokenFile, returnJson, shuffleConfig)
 	if err != nil {
 		log.Printf("[WARNING] Schemaless: Error in SaveParsedInput for file %s: '%v'", keyTokenFile, err)
+		if ctx.Err() != nil {
+			return []byte{}, translationFilePath, err
+		}
+
 		return inputValue, translationFilePath, nil
 	}
 
@@ -2069,7 +2171,13 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 		log.Printf("[DEBUG] Schemaless: Getting existing structure for keyToken: '%s'", keyTokenFile)
 	}
 
-	inputStructure, outputTranslationFilepath, inputStructErr := GetExistingStructure(keyTokenFile, shuffleConfig)
+	inputStructure, outputTranslationFilepath, inputStructErr := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
+	mappingSource := "stored"
+	if candidate, ok := previewCandidate(ctx, refChain); ok {
+		inputStructure, outputTranslationFilepath, inputStructErr = candidate, "", nil
+		mappingSource = "candidate"
+	}
+
 	if len(outputTranslationFilepath) > 0 && inputStructErr == nil {
 		translationFilePath = outputTranslationFilepath
 	}
@@ -2078,17 +2186,52 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 	// Or maybe it has to do with Recursion problems where they have to get all the way back up from source?
 
 
+	// Metadata such as locked fields is not part of the translation
 	fixedOutput := FixTranslationStructure(string(inputStructure))
-	inputStructure = []byte(fixedOutput)
+
+	// A broken mapping, e.g. from an interrupted write, is regenerated instead of being used as an empty one
+	if inputStructErr == nil && !json.Valid([]byte(fixedOutput)) {
+		log.Printf("[ERROR] Schemaless: Mapping %s is not valid JSON. Generating it again.", keyTokenFile)
+		inputStructErr = errors.New(fmt.Sprintf("Invalid JSON in mapping %s", keyTokenFile))
+	}
+
+	mappingMeta := MappingMetadata{}
+	if inputStructErr == nil {
+		if _, meta, err := ParseStoredMapping([]byte(fixedOutput)); err == nil {
+			mappingMeta = meta
+			info.MappingVersion = meta.Version
+			info.Stale = meta.Stale
+			if meta.Stale != nil {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("Mapping %s is stale: %s", keyTokenFile, meta.Stale.Reason))
+			}
+		}
+	}
+
+	inputStructure = stripMappingMetadata([]byte(fixedOutput))
+	standardRefs := []standardRef{}
 	if inputStructErr == nil {
 		if debug {
 			log.Printf("[DEBUG] Schemaless: Found existing structure for keyToken: '%s': %s", keyTokenFile, string(inputStructure))
 		}
+
+		recordUsage(ctx, GetStore(shuffleConfig), NamespaceMappings, keyTokenFile)
+
+		// Fields referencing other standards are only known from the standard
+		standardFormat, _, err := GetStandardContext(ctx, inputStandard, shuffleConfig)
+		if err == nil {
+			standardRefs = parseStandardRefs(standardFormat)
+		} else if debug {
+			log.Printf("[DEBUG] Schemaless: Not translating standard references for %s, as the standard wasn't found: %s", keyTokenFile, err)
+		}
 	} else {
 		// Check if the standard exists at all
-		standardFormat, _, err := GetStandard(inputStandard, shuffleConfig)
+		standardFormat, _, err := GetStandardContext(ctx, inputStandard, shuffleConfig)
 		if err != nil {
 			log.Printf("[WARNING] Schemaless: Problem in GetStandard for standard %#v: %v", inputStandard, err)
+			if ctx.Err() != nil {
+				return []byte{}, translationFilePath, err
+			}
+
 			return inputValue, translationFilePath, nil
 		}
 
@@ -2101,19 +2244,14 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 
 			standardName := strings.TrimSuffix(strings.TrimPrefix(trimmedStandard, "["), "]")
 			log.Printf("[DEBUG] Schemaless: Found a JSON array in the standard. Should convert it to a map[string]interface{}. Name: %s", standardName)
-			_, _, err := GetStandard(standardName, shuffleConfig)
+			_, _, err := GetStandardContext(ctx, standardName, shuffleConfig)
 			if err != nil {
 				log.Printf("[ERROR] Schemaless: Error in GetSubStandard for standard %#v used for lists/standard references references: %v", standardName, err)
 				return []byte{}, translationFilePath, err
 			}
 
 			// FIXME: Find the list in the inputdata. Map each item to the substandard, and then return the list
-			foundAuthConfig := ""
-			if len(inputConfig) > 0 {
-				foundAuthConfig = inputConfig[0]
-			}
-
-			resp, filepath, err := handleSubStandard(ctx, standardName, startValue, foundAuthConfig)
+			resp, filepath, err := handleSubStandard(ctx, info, standardName, startValue, foundAuthConfig, fmt.Sprintf("%s%s", refChainConfigPrefix, strings.Join(append(refChain, inputStandard), ",")))
 			if err != nil {
 				log.Printf("[ERROR] Schemaless: Error in handleSubStandard: %v", err)
 			} else {
@@ -2124,11 +2262,11 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 				return resp, translationFilePath, nil
 			}
 
-			return []byte{}, translationFilePath, errors.New("Finding substandard and list parsing")
+			return []byte{}, translationFilePath, fmt.Errorf("Finding substandard and list parsing: %w", err)
 		} else if !skipSubstandard && strings.HasSuffix(trimmedStandard, ".json") {
 			log.Printf("[INFO] Side-loading substandard %s", trimmedStandard)
 
-			_, _, err := GetStandard(trimmedStandard, shuffleConfig)
+			_, _, err := GetStandardContext(ctx, trimmedStandard, shuffleConfig)
 			if err != nil {
 				log.Printf("[ERROR] Schemaless: Error in GetSubStandard for standard %#v used for lists/standard references references: %v", trimmedStandard, err)
 				return []byte{}, translationFilePath, err
@@ -2139,25 +2277,53 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 			}
 		}
 
-		gptTranslated, err := LLMTranslate(keyTokenFile, string(standardFormat), string(returnJson), shuffleConfig)
-		if err != nil {
-			log.Printf("[ERROR] Schemaless: Error in LLMTranslate: %v", err)
+		// Referenced standards are loaded up front, so a loop between them fails before asking the LLM
+		standardRefs = parseStandardRefs(standardFormat)
+		if len(standardRefs) > 0 {
+			err = resolveStandardRefs(ctx, inputStandard, refChain, shuffleConfig)
+			if err != nil {
+				log.Printf("[ERROR] Schemaless: Failed resolving standards referenced by %s: %s", inputStandard, err)
+				return []byte{}, translationFilePath, err
+			}
+		}
+
+		if !previewAllowsLLM(ctx) {
+			return []byte{}, translationFilePath, fmt.Errorf("%w %s, and the preview doesn't allow asking the LLM", ErrNoMapping, keyTokenFile)
+		}
+
+		// Translations of the same input structure running at the same time wait for this one instead of asking the LLM again
+		flightKey := fmt.Sprintf("mapping-%s-%s", shuffleConfig.OrgId, keyTokenFile)
+		if isPreview(ctx) {
+			flightKey = fmt.Sprintf("preview-%s", flightKey)
+		}
 
-			if strings.Contains(fmt.Sprintf("%s", err), "OPENAI") {
-				//log.Printf("[DEBUG] Schemaless: Saving standard even though no OPENAI key is supplied")
-				//SaveTranslation(keyTokenFile, gptTranslated, shuffleConfig)
+		generated, err := singleFlight(ctx, flightKey, func() (interface{}, bool) {
+			return findGeneratedMapping(ctx, keyTokenFile, shuffleConfig)
+		}, func() (interface{}, error) {
+			gptTranslated, err := llmTranslateWithBases(ctx, keyTokenFile, inputStandard, string(standardFormat), returnJson, func(base string) string {
+				return fmt.Sprintf("%s%s-%x", filenamePrefix, standardFileKey(base), md5.Sum([]byte(keyToken)))
+			}, shuffleConfig)
+			if err != nil {
+				return nil, err
 			}
 
+			version, err := saveMapping(ctx, keyTokenFile, inputStandard, gptTranslated, fmt.Sprintf("llm:%s", llmModel(ctx)), shuffleConfig)
+			return generatedMapping{Mapping: gptTranslated, Version: version}, err
+		})
+
+		if generated == nil {
+			log.Printf("[ERROR] Schemaless: Error in LLMTranslate: %v", err)
 			return []byte(err.Error()), translationFilePath, err
 		}
 
-		err = SaveTranslation(keyTokenFile, gptTranslated, shuffleConfig)
 		if err != nil {
 			log.Printf("[ERROR] Schemaless: Problem in SaveTranslation (3): %v", err)
 			return []byte{}, translationFilePath, err
 		}
 
-		inputStructure = []byte(gptTranslated)
+		info.MappingVersion = generated.(generatedMapping).Version
+		inputStructure = []byte(generated.(generatedMapping).Mapping)
+		mappingSource = "llm"
 	}
 
 	if debug {
@@ -2165,20 +2331,29 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 	}
 
 	// FIXME: Why was this cache stuff implemented? This is confusing 
-	err = SetStructureCache(ctx, keyToken, inputStructure)
-	if err != nil {
-		log.Printf("[WARNING] Schemaless: problem in SetStructureCache for keyToken %#v with inputStructure %#v: %v", keyToken, inputStructure, err)
-	}
+	// Previews skip it, as the cache is only keyed by the input structure and would give back the stored mapping instead of the candidate
+	returnStructure := map[string]interface{}{}
+	cacheErr := ErrCacheMiss
+	if !isPreview(ctx) {
+		err = SetStructureCache(ctx, keyToken, inputStructure)
+		if err != nil {
+			log.Printf("[WARNING] Schemaless: problem in SetStructureCache for keyToken %#v with inputStructure %#v: %v", keyToken, inputStructure, err)
+		}
 
+		returnStructure, cacheErr = GetStructureFromCache(ctx, keyToken)
+		if cacheErr != nil {
+			log.Printf("[WARNING] Schemaless: problem in return structure for keyToken %#v. Should run ai and set cache!", keyToken)
+		}
+	}
 
-	returnStructure, cacheErr := GetStructureFromCache(ctx, keyToken)
+	// Broken mappings aren't compiled, so they are read again on the next translation
+	compilePlan := true
 	if cacheErr != nil {
-		log.Printf("[WARNING] Schemaless: problem in return structure for keyToken %#v. Should run ai and set cache!", keyToken)
-
 		returnStructure = map[string]interface{}{}
 		fixedCache := FixTranslationStructure(string(inputStructure))
 		err = json.Unmarshal([]byte(fixedCache), &returnStructure)
 		if err != nil {
+			compilePlan = false
 			log.Printf("[ERROR] Schemaless: Error in unmarshal of returnStructure from cache for keyToken (2) %#v: %v", keyToken, err)
 			//return []byte{}, translationFilePath, err
 		}
@@ -2188,13 +2363,23 @@ func Translate(ctx context.Context, inputStandard string, inputValue []byte, inp
 		log.Printf("[DEBUG] Starting JSON translation with structure: %#v", returnStructure)
 	}
 
-	translation, modifiedInput, err := runJsonTranslation(ctx, []byte(startValue), returnStructure, keepOriginal)
+	recordPreviewMapping(ctx, refChain, returnStructure, mappingSource, mappingMeta)
+
+	plan := compileMappingPlan(returnStructure, standardRefs)
+	plan.schema, plan.hasSchema = getStandardSchema(ctx, inputStandard, shuffleConfig)
+	plan.mappingFile = translationFilePath
+	plan.version = info.MappingVersion
+	plan.stale = info.Stale
+
+	translation, err := plan.translate(ctx, info, inputStandard, refChain, parsedInput, []byte(startValue), keepOriginal, foundAuthConfig)
 	if err != nil {
-		log.Printf("[ERROR] Error in runJsonTranslation: %v", err)
-		return translation, translationFilePath, err
+		return []byte{}, translationFilePath, err
 	}
 
-	_ = modifiedInput
+	// Candidate mappings of previews aren't saved, so they aren't kept either
+	if compilePlan && mappingSource != "candidate" {
+		setMappingPlan(ctx, shuffleConfig, keyTokenFile, plan)
+	}
 
 	return translation, translationFilePath, nil
 }
@@ -0,0 +1,87 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSubStandardKeepsFailedItemPositions(t *testing.T) {
+	store := useTestStore(t)
+
+	ctx := context.Background()
+	standards := map[string]string{
+		"ticket":  `{"title": "The title of the ticket"}`,
+		"tickets": `[ticket]`,
+	}
+
+	for name, standard := range standards {
+		err := store.Put(ctx, NamespaceStandards, name, []byte(standard))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	useFakeLLM(t, func(system, user string) string {
+		return `{"title": "$subject"}`
+	})
+
+	// The string can't be translated as an object
+	input := []byte(`{"items": [{"subject": "first"}, "broken", {"subject": "third"}]}`)
+	output, info, err := TranslateWithInfo(ctx, "tickets", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := []interface{}{}
+	err = json.Unmarshal(output, &parsed)
+	if err != nil {
+		t.Fatalf("invalid output %s: %s", output, err)
+	}
+
+	if len(parsed) != 3 || parsed[1] != nil {
+		t.Fatalf("expected the failed item to be null at index 1, got %s", output)
+	}
+
+	if title := parsed[2].(map[string]interface{})["title"]; title != "third" {
+		t.Errorf("expected the third item at index 2, got %v", parsed[2])
+	}
+
+	if len(info.Items) != 3 || len(info.Items[1].Error) == 0 || len(info.Items[0].Error) > 0 {
+		t.Errorf("expected the error of item 1 in the info, got %+v", info.Items)
+	}
+
+	if len(info.Warnings) != 1 || !strings.Contains(info.Warnings[0], "1 of 3") {
+		t.Errorf("expected a warning about the failed item, got %v", info.Warnings)
+	}
+}
+
+func TestFunctionsWithoutContext(t *testing.T) {
+	store := useTestStore(t)
+
+	err := store.Put(context.Background(), NamespaceStandards, "ticket", []byte(`{"title": "The title of the ticket"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	standard, _, err := GetStandard("ticket", ShuffleConfig{})
+	if err != nil || !strings.Contains(string(standard), "title") {
+		t.Errorf("expected the standard, got %s (%v)", standard, err)
+	}
+
+	mappingFile, err := MappingFile("ticket", []byte(`{"subject": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SaveTranslation(mappingFile, `{"title": "$subject"}`, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _, err := GetExistingStructure(mappingFile, ShuffleConfig{})
+	if err != nil || !strings.Contains(string(stored), "$subject") {
+		t.Errorf("expected the saved mapping, got %s (%v)", stored, err)
+	}
+}
@@ -0,0 +1,336 @@
+package schemaless
+
+/*
+Keeps a history of every saved mapping, so that bad regenerations or edits can be compared and rolled back.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MappingVersion struct {
+	ID        string `json:"id"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+
+	// Where the mapping came from, e.g. llm:gpt-5-mini, human:username or reverse
+	Source string `json:"source"`
+	Parent string `json:"parent,omitempty"`
+}
+
+type MappingFieldDiff struct {
+	Field    string      `json:"field"`
+	OldValue interface{} `json:"old_value,omitempty"`
+	NewValue interface{} `json:"new_value,omitempty"`
+}
+
+// Hash of the mapping itself, without metadata. Keys are sorted when marshalling, so the hash is stable.
+func hashMapping(mapping map[string]interface{}) string {
+	marshalled, err := json.Marshal(mapping)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(marshalled))
+}
+
+// The max amount of version IDs tried when reserving one, in case other writers are saving versions too
+var maxVersionProbes = 100
+
+// Adds a new version to a stored mapping, saves a copy of it in the history and writes it as the current mapping.
+// Saving the same mapping content again does not create a new version.
+// build gets the current stored mapping (empty if there is none) and returns the one to save. It may run more than once
+// if another writer changes the mapping at the same time.
+func commitMapping(ctx context.Context, keyTokenFile, inputStandard, source string, shuffleConfig ShuffleConfig, build func(existing []byte) ([]byte, error)) (MappingVersion, error) {
+	store := GetStore(shuffleConfig)
+
+	// Kept when the mapping is deleted, so version IDs are never reused
+	logged, err := getMappingLog(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return MappingVersion{}, err
+	}
+
+	version := MappingVersion{}
+	reserved := ""
+	versions := []MappingVersion{}
+	audit := []MappingAuditEntry{}
+
+	err = updateStore(ctx, store, NamespaceMappings, keyTokenFile, func(existing []byte) ([]byte, error) {
+		// The version reserved by an attempt that conflicted with another writer is given back
+		releaseMappingVersion(ctx, store, keyTokenFile, reserved)
+		reserved = ""
+		version = MappingVersion{}
+		versions = []MappingVersion{}
+		audit = []MappingAuditEntry{}
+
+		stored, err := build(existing)
+		if err != nil {
+			return stored, err
+		}
+
+		mapping, meta, err := ParseStoredMapping(stored)
+		if err != nil {
+			// Not a JSON object. Keep the old behavior of writing it as-is.
+			return stored, nil
+		}
+
+		if len(inputStandard) > 0 {
+			meta.Standard = standardKey(inputStandard)
+			meta.Prefix = mappingKeyPrefix(keyTokenFile, inputStandard)
+		}
+
+		// The versions and audit entries, including ones from before the mapping log, go to the mapping log instead
+		versions, meta.Versions = meta.Versions, nil
+		audit, meta.Audit = meta.Audit, nil
+		if len(meta.Created.ID) == 0 && len(versions) > 0 {
+			meta.Created = versions[0]
+		} else if len(meta.Created.ID) == 0 && len(logged.Versions) > 0 {
+			meta.Created = logged.Versions[0]
+		}
+
+		hash := hashMapping(mapping)
+		if meta.Version.Hash == hash && len(meta.Version.ID) > 0 {
+			version = meta.Version
+			return buildStoredMapping(mapping, meta)
+		}
+
+		next := 1
+		for _, known := range append(append(versions, logged.Versions...), meta.Version) {
+			if number := mappingVersionNumber(known.ID); number >= next {
+				next = number + 1
+			}
+		}
+
+		version, err = reserveMappingVersion(ctx, store, keyTokenFile, next, mapping, MappingVersion{
+			Hash:      hash,
+			Timestamp: time.Now().Unix(),
+			Source:    source,
+			Parent:    meta.Version.ID,
+		})
+		if err != nil {
+			return stored, err
+		}
+
+		reserved = version.ID
+		versions = append(versions, version)
+		meta.Version = version
+		if len(meta.Created.ID) == 0 {
+			meta.Created = version
+		}
+		meta.Stale = nil
+
+		return buildStoredMapping(mapping, meta)
+	})
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			releaseMappingVersion(ctx, store, keyTokenFile, reserved)
+		}
+
+		return version, err
+	}
+
+	deleteMappingPlan(shuffleConfig, keyTokenFile)
+
+	err = appendMappingLog(ctx, keyTokenFile, versions, audit, shuffleConfig)
+	if err != nil {
+		return version, errors.New(fmt.Sprintf("Saved version %s of mapping %s, but failed adding it to the mapping log: %s", version.ID, keyTokenFile, err))
+	}
+
+	return version, nil
+}
+
+// Saves a copy of a mapping in the history under the first free version ID from next and up.
+// The copy is written before the mapping itself, so a version ID is never used twice.
+func reserveMappingVersion(ctx context.Context, store Store, keyTokenFile string, next int, mapping map[string]interface{}, version MappingVersion) (MappingVersion, error) {
+	for number := next; number < next+maxVersionProbes; number++ {
+		version.ID = fmt.Sprintf("v%d", number)
+		history, err := buildStoredMapping(mapping, MappingMetadata{Version: version})
+		if err != nil {
+			return version, err
+		}
+
+		err = storeCreate(ctx, store, NamespaceHistory, mappingHistoryKey(keyTokenFile, version.ID), history)
+		if err == nil {
+			return version, nil
+		}
+
+		if !errors.Is(err, ErrConflict) {
+			return version, errors.New(fmt.Sprintf("Failed saving version %s of mapping %s to history: %s", version.ID, keyTokenFile, err))
+		}
+	}
+
+	return version, fmt.Errorf("%w: no free version ID for mapping %s between v%d and v%d", ErrConflict, keyTokenFile, next, next+maxVersionProbes-1)
+}
+
+func releaseMappingVersion(ctx context.Context, store Store, keyTokenFile, versionID string) {
+	if len(versionID) == 0 {
+		return
+	}
+
+	err := store.Delete(ctx, NamespaceHistory, mappingHistoryKey(keyTokenFile, versionID))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("[WARNING] Schemaless: Failed removing unused version %s of mapping %s from history: %s", versionID, keyTokenFile, err)
+	}
+}
+
+// The number of a version ID such as v12, or 0 if it has none
+func mappingVersionNumber(versionID string) int {
+	number, err := strconv.Atoi(strings.TrimPrefix(versionID, "v"))
+	if err != nil || !strings.HasPrefix(versionID, "v") {
+		return 0
+	}
+
+	return number
+}
+
+// Adds the versions that aren't in the list yet, keeping the order
+func mergeMappingVersions(versions, added []MappingVersion) []MappingVersion {
+	known := map[string]bool{}
+	for _, version := range versions {
+		known[version.ID] = true
+	}
+
+	for _, version := range added {
+		if !known[version.ID] {
+			known[version.ID] = true
+			versions = append(versions, version)
+		}
+	}
+
+	return versions
+}
+
+func mappingHistoryKey(keyTokenFile, versionID string) string {
+	return fmt.Sprintf("%s-%s", keyTokenFile, versionID)
+}
+
+func readMappingHistory(ctx context.Context, keyTokenFile, versionID string, shuffleConfig ShuffleConfig) ([]byte, error) {
+	return GetStore(shuffleConfig).Get(ctx, NamespaceHistory, mappingHistoryKey(keyTokenFile, versionID))
+}
+
+// Lists the versions of a mapping, oldest first. Versions are kept after the mapping is deleted.
+func ListMappingVersions(ctx context.Context, keyTokenFile string, shuffleConfig ShuffleConfig) ([]MappingVersion, error) {
+	existing, _, loadErr := GetExistingStructureContext(ctx, keyTokenFile, shuffleConfig)
+	if loadErr != nil && !errors.Is(loadErr, ErrNotFound) {
+		return []MappingVersion{}, fmt.Errorf("Failed loading mapping %s: %w", keyTokenFile, loadErr)
+	}
+
+	logged, err := getMappingLog(ctx, keyTokenFile, shuffleConfig)
+	if err != nil {
+		return []MappingVersion{}, err
+	}
+
+	// Mappings saved before the mapping log existed list their versions in the metadata until the next save
+	_, meta, _ := ParseStoredMapping(existing)
+	versions := mergeMappingVersions(meta.Versions, logged.Versions)
+	if len(versions) == 0 && loadErr != nil {
+		return versions, fmt.Errorf("Failed loading mapping %s: %w", keyTokenFile, loadErr)
+	}
+
+	return versions, nil
+}
+
+// Gets the mapping as it was in a specific version, without metadata
+func GetMappingVersion(ctx context.Context, keyTokenFile, versionID string, shuffleConfig ShuffleConfig) (map[string]interface{}, error) {
+	data, err := readMappingHistory(ctx, keyTokenFile, versionID, shuffleConfig)
+	if err != nil {
+		return map[string]interface{}{}, fmt.Errorf("Failed loading version %s of mapping %s: %w", versionID, keyTokenFile, err)
+	}
+
+	mapping, _, err := ParseStoredMapping(data)
+	return mapping, err
+}
+
+// Lists the fields that differ between two versions of a mapping
+func DiffMappingVersions(ctx context.Context, keyTokenFile, fromVersion, toVersion string, shuffleConfig ShuffleConfig) ([]MappingFieldDiff, error) {
+	fromMapping, err := GetMappingVersion(ctx, keyTokenFile, fromVersion, shuffleConfig)
+	if err != nil {
+		return []MappingFieldDiff{}, err
+	}
+
+	toMapping, err := GetMappingVersion(ctx, keyTokenFile, toVersion, shuffleConfig)
+	if err != nil {
+		return []MappingFieldDiff{}, err
+	}
+
+	return diffMappings(fromMapping, toMapping), nil
+}
+
+func diffMappings(fromMapping, toMapping map[string]interface{}) []MappingFieldDiff {
+	fromFlat := flattenMapping(fromMapping)
+	toFlat := flattenMapping(toMapping)
+
+	fields := []string{}
+	for field := range fromFlat {
+		fields = append(fields, field)
+	}
+
+	for field := range toFlat {
+		if _, ok := fromFlat[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+
+	sort.Strings(fields)
+
+	diffs := []MappingFieldDiff{}
+	for _, field := range fields {
+		oldValue, oldFound := fromFlat[field]
+		newValue, newFound := toFlat[field]
+		if oldFound && newFound && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		diffs = append(diffs, MappingFieldDiff{
+			Field:    field,
+			OldValue: oldValue,
+			NewValue: newValue,
+		})
+	}
+
+	return diffs
+}
+
+// Restores an earlier version of a mapping as a new version. Locked fields are restored too,
+// as a rollback is an explicit human action.
+func RollbackMapping(ctx context.Context, keyTokenFile, versionID, user string, shuffleConfig ShuffleConfig) (MappingVersion, error) {
+	restored, err := GetMappingVersion(ctx, keyTokenFile, versionID, shuffleConfig)
+	if err != nil {
+		return MappingVersion{}, err
+	}
+
+	return commitMapping(ctx, keyTokenFile, "", fmt.Sprintf("human:%s", user), shuffleConfig, func(existing []byte) ([]byte, error) {
+		if len(existing) == 0 {
+			return existing, fmt.Errorf("Failed loading mapping %s: %w", keyTokenFile, ErrNotFound)
+		}
+
+		current, meta, err := ParseStoredMapping(existing)
+		if err != nil {
+			return existing, err
+		}
+
+		timestamp := time.Now().Unix()
+		for _, diff := range diffMappings(current, restored) {
+			meta.Audit = append(meta.Audit, MappingAuditEntry{
+				Field:     diff.Field,
+				Action:    fmt.Sprintf("rollback:%s", versionID),
+				User:      user,
+				OldValue:  diff.OldValue,
+				NewValue:  diff.NewValue,
+				Timestamp: timestamp,
+			})
+		}
+
+		return buildStoredMapping(restored, meta)
+	})
+}
@@ -0,0 +1,191 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func versionIDs(versions []MappingVersion) string {
+	ids := []string{}
+	for _, version := range versions {
+		ids = append(ids, version.ID)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func TestMappingVersionsAfterDelete(t *testing.T) {
+	useTestStore(t)
+
+	ctx := context.Background()
+	input := []byte(`{"subject": "", "state": ""}`)
+	keyTokenFile := saveTestMapping(t, "ticket", input, `{"title": "$subject"}`)
+
+	err := EditMappingField(ctx, keyTokenFile, "status", "$state", "bob", false, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _, err := GetExistingStructureContext(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(stored), `"versions"`) {
+		t.Errorf("the version list should not be in the stored mapping: %s", stored)
+	}
+
+	err = DeleteMapping(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Numbering continues after a deletion instead of overwriting v1
+	saveTestMapping(t, "ticket", input, `{"title": "$state"}`)
+
+	versions, err := ListMappingVersions(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := versionIDs(versions); ids != "v1,v2,v3" {
+		t.Errorf("expected v1,v2,v3, got %s", ids)
+	}
+
+	first, err := GetMappingVersion(ctx, keyTokenFile, "v1", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first["title"] != "$subject" {
+		t.Errorf("v1 was overwritten: %v", first)
+	}
+
+	diffs, err := DiffMappingVersions(ctx, keyTokenFile, "v2", "v3", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{}
+	for _, diff := range diffs {
+		fields = append(fields, diff.Field)
+	}
+
+	if strings.Join(fields, ",") != "status,title" {
+		t.Errorf("unexpected diff between v2 and v3: %+v", diffs)
+	}
+
+	version, err := RollbackMapping(ctx, keyTokenFile, "v1", "bob", ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version.ID != "v4" || version.Parent != "v3" {
+		t.Errorf("expected v4 with parent v3, got %+v", version)
+	}
+
+	_, err = RollbackMapping(ctx, keyTokenFile, "v9", "bob", ShuffleConfig{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing version, got %v", err)
+	}
+}
+
+func TestMappingVersionSkipsTakenIDs(t *testing.T) {
+	store := useTestStore(t)
+
+	ctx := context.Background()
+	input := []byte(`{"subject": ""}`)
+	mappingFile, err := MappingFile("ticket", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. left by a writer that failed after saving to the history
+	err = store.Put(ctx, NamespaceHistory, mappingHistoryKey(mappingFile, "v1"), []byte(`{"title": "$other"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveTestMapping(t, "ticket", input, `{"title": "$subject"}`)
+
+	stored, _, err := GetExistingStructureContext(ctx, mappingFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, meta, err := ParseStoredMapping(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Version.ID != "v2" {
+		t.Errorf("expected the taken v1 to be skipped, got %s", meta.Version.ID)
+	}
+
+	history, err := store.Get(ctx, NamespaceHistory, mappingHistoryKey(mappingFile, "v1"))
+	if err != nil || !strings.Contains(string(history), "$other") {
+		t.Errorf("v1 in the history was overwritten: %s", history)
+	}
+}
+
+func TestMappingVersionsFromMetadata(t *testing.T) {
+	store := useTestStore(t)
+
+	ctx := context.Background()
+	keyTokenFile := "ticket-legacy"
+	legacy := []byte(`{"title": "$subject", "_schemaless": {"version": {"id": "v2", "hash": "old"}, "versions": [{"id": "v1"}, {"id": "v2", "hash": "old"}]}}`)
+	err := store.Put(ctx, NamespaceMappings, keyTokenFile, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = EditMappingField(ctx, keyTokenFile, "title", "$summary", "bob", false, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := ListMappingVersions(ctx, keyTokenFile, ShuffleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := versionIDs(versions); ids != "v1,v2,v3" {
+		t.Errorf("expected the versions in the metadata to be moved to the log, got %s", ids)
+	}
+
+	_, err = ListMappingVersions(ctx, "ticket-missing", ShuffleConfig{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a mapping without versions, got %v", err)
+	}
+}
+
+// Fails writes to one namespace
+type failingStore struct {
+	Store
+	namespace string
+}
+
+func (store failingStore) Put(ctx context.Context, namespace, key string, data []byte) error {
+	if namespace == store.namespace {
+		return errors.New("write failed")
+	}
+
+	return store.Store.Put(ctx, namespace, key, data)
+}
+
+func TestMappingLogFailureIsReturned(t *testing.T) {
+	store := useTestStore(t)
+	SetStore(failingStore{Store: store, namespace: NamespaceMappingLogs})
+
+	mappingFile, err := MappingFile("ticket", []byte(`{"subject": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SaveTranslationContext(context.Background(), mappingFile, `{"title": "$subject"}`, ShuffleConfig{})
+	if err == nil {
+		t.Error("expected the failed write of the mapping log to be returned")
+	}
+}